@@ -0,0 +1,58 @@
+// Package audit writes one JSON record per line for each service
+// mesos-consul registers or deregisters, with the reason of the change.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/logfile"
+)
+
+// Operations
+const (
+	OpRegister   = "register"
+	OpDeregister = "deregister"
+)
+
+// Record is a registry mutation
+type Record struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	ServiceID string    `json:"service_id"`
+	Service   string    `json:"service"`
+	TaskID    string    `json:"task_id,omitempty"`
+	Agent     string    `json:"agent"`
+	Reason    string    `json:"reason"`
+}
+
+// Log is an audit log, safe for concurrent writes
+type Log struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// New returns an audit log writing to w
+func New(w io.Writer) *Log {
+	return &Log{enc: json.NewEncoder(w)}
+}
+
+// Open opens the audit log at path for appending, rotated like the log
+// files of package logfile.
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	f, err := logfile.Open(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return New(f), nil
+}
+
+// Write appends r to the log
+func (l *Log) Write(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.enc.Encode(r)
+}
@@ -0,0 +1,29 @@
+package audit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+
+	now := time.Date(2026, 10, 15, 10, 41, 1, 0, time.UTC)
+	for _, r := range []Record{
+		{now, OpRegister, "mesos-consul:10.0.0.1:web:31000", "web", "web.1", "10.0.0.1", "new-task"},
+		{now, OpDeregister, "mesos-consul:10.0.0.1-master", "master", "", "10.0.0.1", "host-gone"},
+	} {
+		if err := l.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"time":"2026-10-15T10:41:01Z","op":"register","service_id":"mesos-consul:10.0.0.1:web:31000","service":"web","task_id":"web.1","agent":"10.0.0.1","reason":"new-task"}
+{"time":"2026-10-15T10:41:01Z","op":"deregister","service_id":"mesos-consul:10.0.0.1-master","service":"master","agent":"10.0.0.1","reason":"host-gone"}
+`
+	if buf.String() != want {
+		t.Errorf("audit log => %s, want %s", buf.String(), want)
+	}
+}
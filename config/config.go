@@ -5,36 +5,277 @@ import (
 )
 
 type Config struct {
-	Refresh         time.Duration
-	Zk              string
-	LogLevel        string
-	MesosIpOrder    string
-	Healthcheck     bool
-	HealthcheckIp   string
-	HealthcheckPort string
-	WhiteList       []string
-	BlackList       []string
-	TaskTag         []string
-	Separator       string
+	Refresh          time.Duration
+	RefreshAdaptive  bool
+	RefreshMin       time.Duration
+	RefreshMax       time.Duration
+	RefreshChurn     int
+	RefreshJitter    int
+	RefreshSplay     time.Duration
+	Zk               string
+	Registries       []string
+	RegistryPlugins  []string
+	LogLevel         string
+	LogFormat        string
+	LogFile          string
+	LogMaxSize       int
+	LogMaxBackups    int
+	AuditLog         string
+	MesosIpOrder     string
+	PreferNetworks   string
+	PreferHostname   bool
+	AgentAddressMap  string
+	MetaSchema       string
+	PruneNodesAfter  time.Duration
+	AgentNodes       bool
+	Healthcheck      bool
+	HealthcheckIp    string
+	HealthcheckPort  string
+	ReadyIntervals   int
+	WhiteList        []string
+	BlackList        []string
+	FilterPrecedence string
+	FilterKV         string
+
+	// Agents, by hostname or ID, and task labels to leave out
+	AgentBlacklist []string
+	LabelBlacklist []string
+
+	// Refreshes a service may be missing from before it is deregistered
+	HeartbeatsBeforeRemove int
+
+	// Task label, under the label prefix, holding extra tags
+	TaskTagLabel string
+
+	// Webhooks notified of the services registered and deregistered, the
+	// template of their body, and the retries and timeout of each post
+	Webhooks        []string
+	WebhookTemplate string
+	WebhookRetries  int
+	WebhookTimeout  time.Duration
+
+	TaskTag          []string
+	Separator        string
+	LabelPrefix      string
+	ServicePerPort   bool
+	RegisterPortless bool
+	EnvPorts         bool
+	LabeledPortsOnly bool
+	PortPolicy       string
+	PortMode         string
+	MaxTaskPorts     int
+	PortLimitPolicy  string
+	IDScheme         string
+
+	// Template of the IDs of task services, replacing the ID scheme
+	IDTemplate string
+
+	// Let external tools change the tags of task services
+	EnableTagOverride bool
+
+	// Agent attribute holding the WAN address of tasks
+	WANAddressAttribute string
+
+	// TCP check of task services without a check
+	AutoTCPCheck         bool
+	AutoTCPCheckInterval time.Duration
+
+	// Defaults of the checks of task services
+	CheckInterval        time.Duration
+	CheckTimeout         time.Duration
+	CheckDeregisterAfter time.Duration
+
+	// Emergency DNS responder listen address and domain
+	EmergencyDNS       string
+	EmergencyDNSDomain string
+
+	// Maximum number of label sets per metric
+	MetricsMaxLabelSets int
+
+	// Listen address of the Prometheus metrics endpoint
+	MetricsAddress string
+
+	// Listen address of the pprof endpoints, and the bearer token
+	// required to reach them
+	DebugAddress string
+	DebugToken   string
+
+	// Statsd server the metrics are pushed to, the prefix of their
+	// names, the tags sent with DogStatsD and the push interval
+	Statsd          string
+	StatsdPrefix    string
+	StatsdTags      []string
+	StatsdDogStatsD bool
+	StatsdInterval  time.Duration
+
+	// DiscoveryInfo port visibilities to register
+	DiscoveryVisibility string
 
 	// Mesos service name and tags
 	ServiceName string
 	ServiceTags string
+
+	// Template of the service names of tasks, and whether they are
+	// prefixed by the framework name
+	ServiceNameTemplate string
+	FwPrefix            bool
+
+	// Templates of tags added to the services of tasks
+	TagTemplate []string
+
+	// Sanitization rules of service names
+	NameStrip       string
+	NameReplacement string
+	NameLowercase   bool
+	NameMaxLength   int
+
+	// Tags of the Mesos hosts per role, and service name of the leader
+	LeaderTags    string
+	MasterTags    string
+	FollowerTags  string
+	LeaderService string
+
+	// Service name of the Zookeeper ensemble members
+	ZkService string
+
+	// Job result services for completed tasks
+	JobResultFramework []string
+	JobResultTTL       time.Duration
+
+	// Data frameworks, whose driver tasks only are registered
+	DataFramework []string
+	DriverPattern string
+
+	// Extra redaction patterns and task labels whose values are
+	// redacted from the output
+	RedactPatterns []string
+	RedactLabels   []string
+
+	// Configuration file the options not given on the command line are
+	// read from
+	ConfigFile string
+
+	// Print the registry calls instead of making them
+	DryRun bool
+
+	// Run a single refresh and exit
+	Once bool
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		Refresh:         time.Minute,
-		Zk:              "zk://127.0.0.1:2181/mesos",
-		MesosIpOrder:    "netinfo,mesos,host",
-		Healthcheck:     false,
-		HealthcheckIp:   "127.0.0.1",
-		HealthcheckPort: "24476",
-		WhiteList:       []string{},
-		BlackList:       []string{},
-		TaskTag:         []string{},
-		Separator:       "",
-		ServiceName:     "mesos",
-		ServiceTags:     "",
+		Refresh:          time.Minute,
+		RefreshAdaptive:  false,
+		RefreshMin:       10 * time.Second,
+		RefreshMax:       5 * time.Minute,
+		RefreshChurn:     10,
+		RefreshJitter:    0,
+		RefreshSplay:     0,
+		Zk:               "zk://127.0.0.1:2181/mesos",
+		Registries:       []string{},
+		RegistryPlugins:  []string{},
+		LogFormat:        "text",
+		LogFile:          "",
+		LogMaxSize:       100,
+		LogMaxBackups:    5,
+		AuditLog:         "",
+		MesosIpOrder:     "netinfo,mesos,host",
+		PreferNetworks:   "",
+		PreferHostname:   false,
+		AgentAddressMap:  "",
+		MetaSchema:       "",
+		PruneNodesAfter:  0,
+		AgentNodes:       false,
+		Healthcheck:      false,
+		HealthcheckIp:    "127.0.0.1",
+		HealthcheckPort:  "24476",
+		ReadyIntervals:   3,
+		WhiteList:        []string{},
+		BlackList:        []string{},
+		FilterPrecedence: "blacklist",
+		AgentBlacklist:   []string{},
+		LabelBlacklist:   []string{},
+		FilterKV:         "",
+		TaskTag:          []string{},
+		TaskTagLabel:     "tags.extra",
+		Webhooks:         []string{},
+		WebhookTemplate:  "",
+		WebhookRetries:   3,
+		WebhookTimeout:   10 * time.Second,
+		Separator:        "",
+		LabelPrefix:      "consul.",
+		ServicePerPort:   false,
+		RegisterPortless: true,
+		EnvPorts:         false,
+		LabeledPortsOnly: false,
+		PortPolicy:       "all",
+		PortMode:         "ip-order",
+		MaxTaskPorts:     0,
+		PortLimitPolicy:  "first",
+		IDScheme:         "v1",
+		IDTemplate:       "",
+
+		HeartbeatsBeforeRemove: 1,
+
+		EnableTagOverride: false,
+
+		WANAddressAttribute: "",
+
+		AutoTCPCheck:         false,
+		AutoTCPCheckInterval: 30 * time.Second,
+
+		CheckInterval:        10 * time.Second,
+		CheckTimeout:         0,
+		CheckDeregisterAfter: 0,
+
+		EmergencyDNS:       "",
+		EmergencyDNSDomain: "consul.",
+
+		MetricsMaxLabelSets: 1000,
+		MetricsAddress:      "",
+
+		DebugAddress: "",
+		DebugToken:   "",
+
+		Statsd:          "",
+		StatsdPrefix:    "",
+		StatsdTags:      []string{},
+		StatsdDogStatsD: false,
+		StatsdInterval:  10 * time.Second,
+
+		DiscoveryVisibility: "FRAMEWORK,CLUSTER,EXTERNAL",
+
+		ServiceName: "mesos",
+		ServiceTags: "",
+
+		ServiceNameTemplate: "",
+		TagTemplate:         []string{},
+		FwPrefix:            false,
+
+		NameStrip:       "",
+		NameReplacement: "-",
+		NameLowercase:   true,
+		NameMaxLength:   0,
+
+		LeaderTags:    "leader,master",
+		MasterTags:    "master",
+		FollowerTags:  "agent,follower",
+		LeaderService: "",
+
+		ZkService: "",
+
+		JobResultFramework: []string{},
+		JobResultTTL:       time.Hour,
+
+		DataFramework: []string{},
+		DriverPattern: "(?i)driver|jobmanager",
+
+		RedactPatterns: []string{},
+		RedactLabels:   []string{},
+
+		ConfigFile: "",
+
+		DryRun: false,
+		Once:   false,
 	}
 }
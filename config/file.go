@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v2"
+)
+
+// structured converts the entries of the options written as maps in
+// configuration files to their command line form
+var structured = map[string]func(map[string]interface{}) (string, error){
+	"task-tag":          taskTagEntry,
+	"consul-datacenter": keyValueEntry,
+}
+
+// LoadFile reads the configuration file at path, in HCL or in YAML, and
+// returns the values it sets, by option name. Keys are option names, with
+// '_' accepted for '-'. Nested sections prefix the names of their keys, so
+// that 'consul { port = 8501 }' sets --consul-port.
+func LoadFile(path string) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hcl":
+		err = hcl.Unmarshal(b, &raw)
+	case ".yaml", ".yml", ".json":
+		err = yaml.Unmarshal(b, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unknown configuration file format, expected .hcl, .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	values, err := fileOptions(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return values, nil
+}
+
+// fileOptions flattens the decoded contents of a configuration file into
+// option values
+func fileOptions(raw map[string]interface{}) (map[string][]string, error) {
+	values := make(map[string][]string)
+	if err := addSection(values, "", raw); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func addSection(values map[string][]string, prefix string, section map[string]interface{}) error {
+	for k, v := range section {
+		name := strings.Replace(strings.ToLower(k), "_", "-", -1)
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		if err := addValue(values, name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addValue(values map[string][]string, name string, v interface{}) error {
+	if m, ok := stringMap(v); ok {
+		if entry, ok := structured[name]; ok {
+			s, err := entry(m)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			values[name] = append(values[name], s)
+			return nil
+		}
+		return addSection(values, name, m)
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if err := addValue(values, name, e); err != nil {
+				return err
+			}
+		}
+	case []map[string]interface{}:
+		for _, e := range v {
+			if err := addValue(values, name, e); err != nil {
+				return err
+			}
+		}
+	default:
+		s, err := scalar(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		values[name] = append(values[name], s)
+	}
+
+	return nil
+}
+
+// stringMap returns v as a map with string keys, as decoded by HCL, or
+// YAML for nested maps
+func stringMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = e
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func scalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int, int64, uint64:
+		return fmt.Sprint(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// taskTagEntry converts a { pattern, tags } entry to a 'pattern:tag,...'
+// task-tag rule
+func taskTagEntry(m map[string]interface{}) (string, error) {
+	pattern, err := scalar(m["pattern"])
+	if err != nil || pattern == "" {
+		return "", fmt.Errorf("entry %v requires a pattern", m)
+	}
+
+	tags := []string{}
+	for _, key := range []string{"tag", "tags"} {
+		v, ok := m[key].([]interface{})
+		if !ok {
+			v = []interface{}{m[key]}
+		}
+		for _, e := range v {
+			t, err := scalar(e)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", key, err)
+			}
+			if t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return "", fmt.Errorf("entry %v requires tags", m)
+	}
+
+	return pattern + ":" + strings.Join(tags, ","), nil
+}
+
+// keyValueEntry converts a map to a '<key>=<value>,...' option value
+func keyValueEntry(m map[string]interface{}) (string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		s, err := scalar(m[k])
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", k, err)
+		}
+		parts = append(parts, strings.Replace(k, "_", "-", -1)+"="+s)
+	}
+
+	return strings.Join(parts, ","), nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileOptions(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		raw    map[string]interface{}
+		values map[string][]string
+	}{
+		{
+			"scalars",
+			map[string]interface{}{
+				"zk":               "zk://10.0.0.1:2181/mesos",
+				"refresh":          "30s",
+				"service_per_port": true,
+				"max-task-ports":   4,
+			},
+			map[string][]string{
+				"zk":               {"zk://10.0.0.1:2181/mesos"},
+				"refresh":          {"30s"},
+				"service-per-port": {"true"},
+				"max-task-ports":   {"4"},
+			},
+		},
+		{
+			"lists",
+			map[string]interface{}{
+				"mesos-ip-order": []interface{}{"netinfo", "host"},
+				"whitelist":      []interface{}{"^web", "^api{1,2}"},
+			},
+			map[string][]string{
+				"mesos-ip-order": {"netinfo", "host"},
+				"whitelist":      {"^web", "^api{1,2}"},
+			},
+		},
+		{
+			"hcl sections",
+			map[string]interface{}{
+				"consul": []map[string]interface{}{
+					{"port": 8501, "ssl": true},
+				},
+				"task_tag": []map[string]interface{}{
+					{"pattern": "web", "tags": []interface{}{"http", "public"}},
+					{"pattern": "db", "tag": "sql"},
+				},
+			},
+			map[string][]string{
+				"consul-port": {"8501"},
+				"consul-ssl":  {"true"},
+				"task-tag":    {"web:http,public", "db:sql"},
+			},
+		},
+		{
+			"yaml sections",
+			map[string]interface{}{
+				"etcd": map[interface{}]interface{}{
+					"prefix": "/services",
+				},
+				"consul": map[interface{}]interface{}{
+					"datacenter": []interface{}{
+						map[interface{}]interface{}{"name": "dc2", "address": "10.0.1.1"},
+					},
+				},
+			},
+			map[string][]string{
+				"etcd-prefix":       {"/services"},
+				"consul-datacenter": {"address=10.0.1.1,name=dc2"},
+			},
+		},
+	} {
+		values, err := fileOptions(tt.raw)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("%s: fileOptions() => %v, want %v", tt.name, values, tt.values)
+		}
+	}
+}
+
+func TestFileOptionsInvalidTaskTag(t *testing.T) {
+	for _, entry := range []map[string]interface{}{
+		{"tags": []interface{}{"http"}},
+		{"pattern": "web"},
+	} {
+		raw := map[string]interface{}{"task-tag": []interface{}{entry}}
+		if _, err := fileOptions(raw); err == nil {
+			t.Errorf("fileOptions(%v) => no error", raw)
+		}
+	}
+}
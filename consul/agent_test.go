@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testAgent is a Consul agent recording the services registered and
+// deregistered on it, with a KV store. Further endpoints are served by
+// handlers, which take precedence.
+type testAgent struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	registered   []*consulapi.AgentServiceRegistration
+	deregistered []string
+	kv           map[string][]byte
+	handlers     map[string]http.HandlerFunc
+}
+
+// newTestConsul returns a Consul registry talking to a test agent on
+// 127.0.0.1
+func newTestConsul(t *testing.T, cfg consulConfig) (*Consul, *testAgent) {
+	a := &testAgent{kv: make(map[string][]byte), handlers: make(map[string]http.HandlerFunc)}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	t.Cleanup(a.Close)
+
+	_, cfg.port, _ = net.SplitHostPort(a.Listener.Addr().String())
+	if cfg.heartbeatsBeforeRemove == 0 {
+		cfg.heartbeatsBeforeRemove = 1
+	}
+	c := newConsul(cfg)
+	c.CacheCreate()
+	return c, a
+}
+
+func (a *testAgent) serve(w http.ResponseWriter, r *http.Request) {
+	if h, ok := a.handlers[r.URL.Path]; ok {
+		h(w, r)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/agent/self":
+		w.Write([]byte("{}"))
+	case r.URL.Path == "/v1/agent/service/register":
+		s := &consulapi.AgentServiceRegistration{}
+		json.NewDecoder(r.Body).Decode(s)
+		a.registered = append(a.registered, s)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		a.deregistered = append(a.deregistered, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		a.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *testAgent) serveKV(w http.ResponseWriter, r *http.Request, key string) {
+	switch r.Method {
+	case "PUT":
+		a.kv[key], _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("true"))
+	case "DELETE":
+		delete(a.kv, key)
+		w.Write([]byte("true"))
+	default:
+		pairs := consulapi.KVPairs{}
+		for k, v := range a.kv {
+			if k == key || (r.URL.Query().Has("recurse") && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, &consulapi.KVPair{Key: k, Value: v})
+			}
+		}
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		json.NewEncoder(w).Encode(pairs)
+	}
+}
+
+func (a *testAgent) registrations() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.registered)
+}
@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"sort"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetRunningServices()
+//   Record the names of the services the tasks running in Mesos may
+//   register during the refresh
+//
+func (c *Consul) SetRunningServices(names []string) {
+	c.runningServices = make(map[string]bool, len(names))
+	for _, n := range names {
+		c.runningServices[n] = true
+	}
+}
+
+// checkBlastRadius()
+//   Report the services the deregistration of batch leaves with fewer
+//   than --deregister-min-instances healthy instances. With
+//   --deregister-block-zero, return batch without the last healthy
+//   instances of services a task running in Mesos may register
+//
+func (c *Consul) checkBlastRadius(batch []string) []string {
+	if len(batch) == 0 || (c.config.minInstances <= 0 && !c.config.blockZeroInstances) {
+		metrics.ServicesBelowMinInstances.Set(0)
+		return batch
+	}
+
+	deregistered := make(map[string]bool, len(batch))
+	for _, id := range batch {
+		deregistered[id] = true
+	}
+	remaining := make(map[string]int)
+	for _, id := range batch {
+		s := c.cache[id].service
+		if _, ok := remaining[s.Name]; !ok {
+			remaining[s.Name] = c.healthyInstances(s, deregistered)
+		}
+	}
+
+	below := []string{}
+	for name, n := range remaining {
+		if n < c.config.minInstances {
+			below = append(below, name)
+		}
+	}
+	sort.Strings(below)
+	metrics.ServicesBelowMinInstances.Set(float64(len(below)))
+	for _, name := range below {
+		log.WithField("service", name).Warnf("Deregistrations leave %d healthy instances, below the minimum of %d", remaining[name], c.config.minInstances)
+	}
+
+	if !c.config.blockZeroInstances {
+		return batch
+	}
+
+	kept := []string{}
+	for _, id := range batch {
+		s := c.cache[id].service
+		if remaining[s.Name] == 0 && c.runningServices[s.Name] {
+			log.WithField("service", s.Name).Errorf("Not deregistering %s, the last healthy instance of a service a task running in Mesos registers", id)
+			metrics.DeregistrationsBlocked.Inc(registry.FrameworkLabel(s.Meta))
+			continue
+		}
+		kept = append(kept, id)
+	}
+
+	return kept
+}
+
+// healthyInstances()
+//   Return the number of passing instances of the service of s left
+//   in Consul once the services of deregistered are gone. When Consul
+//   can't tell, the instances in the cache are counted instead
+//
+func (c *Consul) healthyInstances(s *consulapi.AgentServiceRegistration, deregistered map[string]bool) int {
+	n := 0
+
+	client := c.client(c.clusterAddress(c.host))
+	if client != nil {
+		entries, _, err := client.Health().Service(s.Name, "", true, serviceQuery(s))
+		if err == nil {
+			for _, e := range entries {
+				if !deregistered[e.Service.ID] {
+					n++
+				}
+			}
+			return n
+		}
+		log.WithField("service", s.Name).Warnf("Unable to read the healthy instances, counting the cached ones: %s", err)
+	}
+
+	for id, e := range c.cache {
+		if e.service.Name == s.Name && !deregistered[id] {
+			n++
+		}
+	}
+	return n
+}
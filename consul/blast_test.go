@@ -0,0 +1,53 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestCheckBlastRadius(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{minInstances: 2, blockZeroInstances: true})
+	c.host = "127.0.0.1"
+
+	// Three cached instances of web, one of them healthy in Consul
+	// besides an instance registered by another tool
+	for _, id := range []string{"web-1", "web-2", "web-3"} {
+		c.cache[id] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: id, Name: "web"}, "127.0.0.1")
+	}
+	healthy := []string{"web-1", "other"}
+	a.handlers["/v1/health/service/web"] = func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("passing") == "" {
+			t.Error("health query of all instances, want the passing ones")
+		}
+		entries := []*consulapi.ServiceEntry{}
+		for _, id := range healthy {
+			entries = append(entries, &consulapi.ServiceEntry{Service: &consulapi.AgentService{ID: id, Service: "web"}})
+		}
+		json.NewEncoder(w).Encode(entries)
+	}
+
+	// Unhealthy instances don't count
+	if batch := c.checkBlastRadius([]string{"web-2", "web-3"}); len(batch) != 2 {
+		t.Errorf("checkBlastRadius() => %v, want both deregistrations", batch)
+	}
+
+	// Deregistering the healthy instance leaves the foreign one
+	if batch := c.checkBlastRadius([]string{"web-1"}); len(batch) != 1 {
+		t.Errorf("checkBlastRadius() => %v, want web-1", batch)
+	}
+
+	// The last healthy instance is kept while a running task registers
+	// the service, whatever the task is named
+	healthy = []string{"web-1"}
+	c.SetRunningServices([]string{"api"})
+	if batch := c.checkBlastRadius([]string{"web-1"}); len(batch) != 1 {
+		t.Errorf("checkBlastRadius() without a task => %v, want web-1", batch)
+	}
+	c.SetRunningServices([]string{"web"})
+	if batch := c.checkBlastRadius([]string{"web-1", "web-2"}); len(batch) != 0 {
+		t.Errorf("checkBlastRadius() => %v, want the deregistrations blocked", batch)
+	}
+}
@@ -1,7 +1,8 @@
 package consul
 
 import (
-	"strings"
+	"sort"
+	"time"
 
 	"github.com/CiscoCloud/mesos-consul/registry"
 
@@ -13,6 +14,21 @@ type cacheEntry struct {
 	service         *consulapi.AgentServiceRegistration
 	agent           string
 	validityCounter int
+
+	// consul.token label of the task, unknown for services loaded from
+	// Consul until their task is seen
+	token string
+
+	// Token of the consul.token label the service was registered with.
+	// Never logged
+	resolved string
+
+	// Service as registered by this instance, nil for services loaded
+	// from Consul whose check and sidecar are unknown
+	registered *registry.Service
+
+	// When the service was registered, or loaded from Consul
+	since time.Time
 }
 
 func newCacheEntry(service *consulapi.AgentServiceRegistration, agent string) *cacheEntry {
@@ -20,80 +36,185 @@ func newCacheEntry(service *consulapi.AgentServiceRegistration, agent string) *c
 		agent:           agent,
 		service:         service,
 		validityCounter: 0,
+		since:           time.Now(),
 	}
 }
 
-// Service cache
-var serviceCache map[string]*cacheEntry
-var cacheEntryValidityThreshold int = 1
-
 // CacheCreate()
+//   Create the cache, and tell whether it needs to be loaded: on
+//   startup, and every --reconcile-interval
 //
 func (c *Consul) CacheCreate() bool {
-	if serviceCache == nil {
-		serviceCache = make(map[string]*cacheEntry)
+	if c.cache == nil {
+		c.cache = make(map[string]*cacheEntry)
+		c.syncing = true
 		return true
 	}
 
-	return false
+	return c.reconcileDue()
 }
 
 // Initialize the service cache
 //
 func (c *Consul) CacheLoad(host string) error {
-	client := c.client(host).Catalog()
+	c.host = host
+	client := c.client(c.clusterAddress(host)).Catalog()
+
+	found := make(map[string]*cacheEntry)
+	for _, q := range c.namespaceQueries() {
+		if err := c.loadServices(client, q, found); err != nil {
+			return err
+		}
+	}
+
+	c.reconcile(found)
+	c.applyReplayed()
+
+	return nil
+}
+
+// namespaceQueries()
+//   Return the query options of each namespace services are registered
+//   in. Services are only looked up in the namespaces mesos-consul is
+//   configured with, those of the other namespaces are left alone
+//
+func (c *Consul) namespaceQueries() []*consulapi.QueryOptions {
+	namespaces := c.config.namespaces()
+	if len(namespaces) == 0 {
+		return []*consulapi.QueryOptions{nil}
+	}
+
+	queries := []*consulapi.QueryOptions{}
+	for _, ns := range namespaces {
+		queries = append(queries, &consulapi.QueryOptions{Namespace: ns})
+	}
+	return queries
+}
 
-	serviceList, _, err := client.Services(nil)
+// loadServices()
+//   Add the services of mesos-consul found in the catalog, in the
+//   namespace of q, to found
+//
+func (c *Consul) loadServices(client *consulapi.Catalog, q *consulapi.QueryOptions, found map[string]*cacheEntry) error {
+	serviceList, _, err := client.Services(q)
 	if err != nil {
 		return err
 	}
 
 	for service, _ := range serviceList {
-		catalogServices, _, err := client.Service(service, "", nil)
+		catalogServices, _, err := client.Service(service, "", q)
 		if err != nil {
 			return err
 		}
 
 		for _, s := range catalogServices {
-			if strings.HasPrefix(s.ServiceID, "mesos-consul:") {
+			if registry.Owned(s.ServiceID, s.ServiceMeta) {
 				log.Debugf("Found '%s' with ID '%s'", s.ServiceName, s.ServiceID)
-				serviceCache[s.ServiceID] = newCacheEntry(&consulapi.AgentServiceRegistration{
+				e := newCacheEntry(&consulapi.AgentServiceRegistration{
 					ID:      s.ServiceID,
 					Name:    s.ServiceName,
 					Port:    s.ServicePort,
 					Address: s.ServiceAddress,
 					Tags:    s.ServiceTags,
+					Meta:    s.ServiceMeta,
+
+					EnableTagOverride: s.ServiceEnableTagOverride,
+
+					Namespace: s.Namespace,
+					Partition: s.Partition,
 				}, s.Address)
+				e.token = s.ServiceMeta[tokenMetaKey]
+				found[s.ServiceID] = e
 			}
 		}
 	}
-
 	return nil
 }
 
 // CacheLookup()
+//   Return the service as registered, or as found in Consul when it
+//   was loaded
 //
 func (c *Consul) CacheLookup(id string) *registry.Service {
-	if _, ok := serviceCache[id]; ok {
-		s := serviceCache[id].service
-
-		return &registry.Service{
-			ID:      s.ID,
-			Name:    s.Name,
-			Port:    s.Port,
-			Address: s.Address,
-			Tags:    s.Tags,
-		}
+	if e, ok := c.cache[id]; ok {
+		return e.lookup()
 	}
 
 	return nil
 }
 
+// lookup()
+//   Return the service of a cache entry
+//
+func (e *cacheEntry) lookup() *registry.Service {
+	if e.registered != nil {
+		return e.registered
+	}
+
+	s := loadedService(e.service)
+	s.Agent = e.agent
+	return s
+}
+
+// Cached()
+//   Return the services of the cache, ordered by ID
+//
+func (c *Consul) Cached() []*registry.Service {
+	ids := make([]string, 0, len(c.cache))
+	for id := range c.cache {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	services := make([]*registry.Service, 0, len(ids))
+	for _, id := range ids {
+		services = append(services, c.CacheLookup(id))
+	}
+	return services
+}
+
+// loadedService()
+//   Return a service as loaded from Consul: without the check, sidecar,
+//   weights and tagged addresses the catalog listing leaves out
+//
+func loadedService(s *consulapi.AgentServiceRegistration) *registry.Service {
+	return &registry.Service{
+		ID:      s.ID,
+		Name:    s.Name,
+		Port:    s.Port,
+		Address: s.Address,
+		Tags:    s.Tags,
+		Meta:    taskMeta(s.Meta),
+
+		EnableTagOverride: s.EnableTagOverride,
+
+		Namespace: s.Namespace,
+	}
+}
+
+// taskMeta()
+//   Return the meta of a loaded service without the meta mesos-consul
+//   adds to the meta of its task
+//
+func taskMeta(meta map[string]string) map[string]string {
+	if _, ok := meta[tokenMetaKey]; !ok {
+		return meta
+	}
+
+	result := make(map[string]string, len(meta))
+	for k, v := range meta {
+		if k != tokenMetaKey {
+			result[k] = v
+		}
+	}
+	return result
+}
+
 // CacheDelete()
 //
 func (c *Consul) CacheDelete(id string) {
-	if _, ok := serviceCache[id]; ok {
-		delete(serviceCache, id)
+	if _, ok := c.cache[id]; ok {
+		delete(c.cache, id)
 	}
 }
 
@@ -101,8 +222,8 @@ func (c *Consul) CacheDelete(id string) {
 //   Mark the service ID as valid
 //
 func (c *Consul) CacheMark(id string) {
-	if _, ok := serviceCache[id]; ok {
-		serviceCache[id].validityCounter = 0
+	if _, ok := c.cache[id]; ok {
+		c.cache[id].validityCounter = 0
 	}
 }
 
@@ -110,14 +231,14 @@ func (c *Consul) CacheMark(id string) {
 //   Calculate the validity of the entry
 //
 func (c *Consul) CacheProcessDeregister(id string) {
-	if _, ok := serviceCache[id]; ok {
-		serviceCache[id].validityCounter++
+	if _, ok := c.cache[id]; ok {
+		c.cache[id].validityCounter++
 	}
 }
 
 func (c *Consul) CacheIsValid(id string) bool {
-	if _, ok := serviceCache[id]; ok {
-		return serviceCache[id].validityCounter < cacheEntryValidityThreshold
+	if _, ok := c.cache[id]; ok {
+		return c.cache[id].validityCounter < c.config.heartbeatsBeforeRemove
 	}
 	return false
 }
@@ -0,0 +1,206 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// catalogNodeMeta marks the nodes registered with --consul-catalog as
+// external, for external monitors such as consul-esm to run their checks
+var catalogNodeMeta = map[string]string{
+	"external-node":  "true",
+	"external-probe": "true",
+}
+
+// catalogNode()
+//   Return the name of the catalog node of a Mesos agent
+//
+func catalogNode(agent string) string {
+	return "mesos-agent-" + strings.Replace(agent, ":", "-", -1)
+}
+
+// catalogRegister()
+//   Register a service and its checks in the catalog, under the node of
+//   its Mesos agent, which carries meta
+//
+func catalogRegister(client *consulapi.Client, agent string, meta map[string]string, s *consulapi.AgentServiceRegistration, w *consulapi.WriteOptions) error {
+	reg := &consulapi.CatalogRegistration{
+		Node:      catalogNode(agent),
+		Address:   agent,
+		NodeMeta:  meta,
+		Service:   catalogService(s),
+		Checks:    catalogChecks(agent, s),
+		Partition: s.Partition,
+	}
+
+	_, err := client.Catalog().Register(reg, w)
+	return err
+}
+
+// catalogService()
+//   Return a service registration as a catalog service
+//
+func catalogService(s *consulapi.AgentServiceRegistration) *consulapi.AgentService {
+	service := &consulapi.AgentService{
+		ID:                s.ID,
+		Service:           s.Name,
+		Tags:              s.Tags,
+		Meta:              s.Meta,
+		Port:              s.Port,
+		Address:           s.Address,
+		TaggedAddresses:   s.TaggedAddresses,
+		EnableTagOverride: s.EnableTagOverride,
+		Namespace:         s.Namespace,
+		Partition:         s.Partition,
+	}
+	if s.Weights != nil {
+		service.Weights = *s.Weights
+	}
+
+	return service
+}
+
+// catalogDeregister()
+//   Remove a service and its checks from the catalog
+//
+func catalogDeregister(client *consulapi.Client, agent string, s *consulapi.AgentServiceRegistration, w *consulapi.WriteOptions) error {
+	_, err := client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:      catalogNode(agent),
+		ServiceID: s.ID,
+		Namespace: s.Namespace,
+		Partition: s.Partition,
+	}, w)
+	return err
+}
+
+// catalogChecks()
+//   Return the HTTP and TCP checks of a service as catalog checks. They
+//   start passing and are run by an external monitor, no Consul agent
+//   running them
+//
+func catalogChecks(agent string, s *consulapi.AgentServiceRegistration) consulapi.HealthChecks {
+	checks := s.Checks
+	if s.Check != nil {
+		checks = append(consulapi.AgentServiceChecks{s.Check}, checks...)
+	}
+
+	result := consulapi.HealthChecks{}
+	for _, chk := range checks {
+		if chk.HTTP == "" && chk.TCP == "" {
+			continue
+		}
+
+		result = append(result, &consulapi.HealthCheck{
+			Node:      catalogNode(agent),
+			CheckID:   fmt.Sprintf("service:%s:%d", s.ID, len(result)+1),
+			Name:      fmt.Sprintf("Service '%s' check", s.Name),
+			Status:    consulapi.HealthPassing,
+			ServiceID: s.ID,
+			Definition: consulapi.HealthCheckDefinition{
+				HTTP:          chk.HTTP,
+				TCP:           chk.TCP,
+				TLSSkipVerify: chk.TLSSkipVerify,
+
+				IntervalDuration:                       duration(chk.Interval),
+				TimeoutDuration:                        duration(chk.Timeout),
+				DeregisterCriticalServiceAfterDuration: duration(chk.DeregisterCriticalServiceAfter),
+			},
+			Namespace: s.Namespace,
+			Partition: s.Partition,
+		})
+	}
+
+	return result
+}
+
+// catalogUnsupported()
+//   Return the parts of a service the catalog can't register: checks
+//   other than HTTP and TCP, which no external monitor runs, and Connect
+//   sidecars, which need a Consul agent
+//
+func catalogUnsupported(s *registry.Service) []string {
+	unsupported := []string{}
+	if s.Check != nil {
+		if s.Check.GRPC != "" {
+			unsupported = append(unsupported, "gRPC check")
+		}
+		if s.Check.Script != "" {
+			unsupported = append(unsupported, "script check")
+		}
+		if s.Check.TTL != "" {
+			unsupported = append(unsupported, "TTL check")
+		}
+	}
+	if s.Connect != nil {
+		unsupported = append(unsupported, "Connect sidecar")
+	}
+	return unsupported
+}
+
+// pruneCatalogNodes()
+//   Deregister the catalog nodes of the given Mesos agents left without
+//   services. Nodes synced by SyncNodes, or carrying services not created
+//   by mesos-consul, are left alone
+//
+func (c *Consul) pruneCatalogNodes(agents map[string]bool) {
+	if c.config.catalog == "" || len(agents) == 0 {
+		return
+	}
+
+	client := c.client(c.clusterAddress(c.host))
+	if client == nil {
+		return
+	}
+
+	for agent := range agents {
+		if _, synced := c.agentNodes[agent]; synced || c.hasServices(agent) {
+			continue
+		}
+
+		node, _, err := client.Catalog().Node(catalogNode(agent), nil)
+		if err != nil {
+			log.Warnf("Unable to read the catalog node of Mesos agent %s: %s", agent, err)
+			continue
+		}
+		if node == nil {
+			continue
+		}
+		foreign := false
+		for id, s := range node.Services {
+			if !registry.Owned(id, s.Meta) {
+				foreign = true
+				break
+			}
+		}
+		if foreign {
+			log.WithField("node", catalogNode(agent)).Debug("Node has foreign services. Not pruning node")
+			continue
+		}
+
+		if c.lostLead() {
+			return
+		}
+		log.Infof("Deregistering the catalog node of Mesos agent %s, left without services", agent)
+		_, err = client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:      catalogNode(agent),
+			Partition: c.config.partition,
+		}, nil)
+		if err != nil {
+			log.Warnf("Unable to deregister the catalog node of Mesos agent %s: %s", agent, err)
+		}
+	}
+}
+
+// duration()
+//   Parse a check duration, 0 when unset or invalid
+//
+func duration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
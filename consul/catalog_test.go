@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestCatalogUnsupported(t *testing.T) {
+	for i, tt := range []struct {
+		service *registry.Service
+		want    int
+	}{
+		{&registry.Service{Check: &registry.Check{HTTP: "http://10.0.0.1/"}}, 0},
+		{&registry.Service{Check: &registry.Check{GRPC: "10.0.0.1:9090"}}, 1},
+		{&registry.Service{Check: &registry.Check{Script: "true", TTL: "30s"}}, 2},
+		{&registry.Service{Connect: &registry.Connect{SidecarPort: 21000}}, 1},
+	} {
+		if got := catalogUnsupported(tt.service); len(got) != tt.want {
+			t.Errorf("test #%d: catalogUnsupported() => %v, want %d parts", i, got, tt.want)
+		}
+	}
+}
+
+func TestPruneCatalogNodes(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{catalog: "127.0.0.1"})
+	c.host = "127.0.0.1"
+	c.cache["mesos-consul:db"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:db"}, "10.0.0.2")
+
+	nodes := map[string]*consulapi.CatalogNode{
+		"mesos-agent-10.0.0.1": {Node: &consulapi.Node{}, Services: map[string]*consulapi.AgentService{}},
+		"mesos-agent-10.0.0.3": {Node: &consulapi.Node{}, Services: map[string]*consulapi.AgentService{"web": {ID: "web"}}},
+	}
+	deregistered := []string{}
+	a.handlers["/v1/catalog/deregister"] = func(w http.ResponseWriter, r *http.Request) {
+		d := &consulapi.CatalogDeregistration{}
+		json.NewDecoder(r.Body).Decode(d)
+		deregistered = append(deregistered, d.Node)
+		w.Write([]byte("true"))
+	}
+	for name, n := range nodes {
+		n := n
+		a.handlers["/v1/catalog/node/"+name] = func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(n)
+		}
+	}
+
+	c.pruneCatalogNodes(map[string]bool{"10.0.0.1": true, "10.0.0.2": true, "10.0.0.3": true})
+	if len(deregistered) != 1 || deregistered[0] != "mesos-agent-10.0.0.1" {
+		t.Errorf("pruneCatalogNodes() deregistered %v, want the empty node of 10.0.0.1", deregistered)
+	}
+}
+
+func TestSyncNodesAgentMode(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{})
+	touched := false
+	a.handlers["/v1/catalog/nodes"] = func(w http.ResponseWriter, r *http.Request) { touched = true }
+	a.handlers["/v1/catalog/register"] = a.handlers["/v1/catalog/nodes"]
+
+	if c.RegistersNodes() {
+		t.Error("RegistersNodes() without --consul-catalog")
+	}
+	c.SyncNodes("127.0.0.1", []*registry.Node{{Address: "10.0.0.1"}})
+	if touched {
+		t.Error("SyncNodes() wrote the catalog without --consul-catalog")
+	}
+}
+
+func TestAgentNodeMetaTruncation(t *testing.T) {
+	attributes := make(map[string]string, 2*nodeMetaMaxPairs)
+	for i := 0; i < 2*nodeMetaMaxPairs; i++ {
+		attributes[fmt.Sprintf("attr-%03d", i)] = "x"
+	}
+
+	want := nodeMetaMaxPairs - len(catalogNodeMeta)
+	for n := 0; n < 10; n++ {
+		meta, dropped := agentNodeMeta(attributes)
+		if len(meta) != nodeMetaMaxPairs {
+			t.Fatalf("agentNodeMeta() returned %d pairs, want %d", len(meta), nodeMetaMaxPairs)
+		}
+		if dropped != len(attributes)-want {
+			t.Errorf("agentNodeMeta() dropped %d attributes, want %d", dropped, len(attributes)-want)
+		}
+		for i := 0; i < want; i++ {
+			if _, ok := meta[fmt.Sprintf("attr-%03d", i)]; !ok {
+				t.Fatalf("agentNodeMeta() dropped attr-%03d, want the first %d attributes by name", i, want)
+			}
+		}
+	}
+
+	if _, dropped := agentNodeMeta(map[string]string{"rack": "r1"}); dropped != 0 {
+		t.Errorf("agentNodeMeta() dropped %d attributes under the limit", dropped)
+	}
+}
@@ -2,9 +2,13 @@ package consul
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
 	flag "github.com/ogier/pflag"
+	log "github.com/sirupsen/logrus"
 )
 
 type consulConfig struct {
@@ -15,8 +19,42 @@ type consulConfig struct {
 	sslVerify              bool
 	sslCert                string
 	sslCaCert              string
+	sslKey                 string
+	sslServerName          string
 	token                  string
+	tokenFile              string
 	heartbeatsBeforeRemove int
+	deregisterBatch        int
+	ttlCheck               time.Duration
+	minInstances           int
+	blockZeroInstances     bool
+	journal                string
+	namespace              string
+	taskNamespaces         []string
+	partition              string
+	catalog                string
+	agentMap               string
+	fallbackAgents         []string
+	kvTasks                bool
+	kvTasksPrefix          string
+	kvTasksRedact          bool
+	lockKey                string
+	lockTTL                time.Duration
+	criticalAfter          time.Duration
+	taskTokens             bool
+	vaultPrefix            string
+	addresses              []string
+	txnOps                 int
+	reconcileInterval      time.Duration
+	preparedQueries        bool
+	queryNearestN          int
+	queryDatacenters       []string
+	queryTemplate          string
+
+	// Further datacenters to register services in, and the datacenter
+	// of a registry registering in one of them
+	datacenters []datacenter
+	datacenter  string
 }
 
 var config consulConfig
@@ -29,8 +67,37 @@ func AddCmdFlags(f *flag.FlagSet) {
 	f.BoolVar(&config.sslVerify, "consul-ssl-verify", true, "")
 	f.StringVar(&config.sslCert, "consul-ssl-cert", "", "")
 	f.StringVar(&config.sslCaCert, "consul-ssl-cacert", "", "")
+	f.StringVar(&config.sslKey, "consul-ssl-key", "", "")
+	f.StringVar(&config.sslServerName, "consul-ssl-server-name", "", "")
 	f.StringVar(&config.token, "consul-token", "", "")
-	f.IntVar(&config.heartbeatsBeforeRemove, "heartbeats-before-remove", 1, "")
+	f.StringVar(&config.namespace, "consul-namespace", "", "")
+	f.Var((*listVar)(&config.taskNamespaces), "consul-task-namespaces", "")
+	f.StringVar(&config.partition, "consul-partition", "", "")
+	f.StringVar(&config.catalog, "consul-catalog", "", "")
+	f.Var((*listVar)(&config.addresses), "consul-addresses", "")
+	f.IntVar(&config.txnOps, "consul-txn-ops", 64, "")
+	f.Var((*datacentersVar)(&config.datacenters), "consul-datacenter", "")
+	f.StringVar(&config.agentMap, "consul-agent-map", "", "")
+	f.Var((*listVar)(&config.fallbackAgents), "consul-fallback-agents", "")
+	f.StringVar(&config.tokenFile, "consul-token-file", "", "")
+	f.BoolVar(&config.taskTokens, "consul-task-tokens", false, "")
+	f.StringVar(&config.vaultPrefix, "consul-vault-prefix", "", "")
+	f.IntVar(&config.deregisterBatch, "deregister-batch", 0, "")
+	f.DurationVar(&config.reconcileInterval, "reconcile-interval", 0, "")
+	f.DurationVar(&config.ttlCheck, "consul-ttl-check", 0, "")
+	f.IntVar(&config.minInstances, "deregister-min-instances", 0, "")
+	f.DurationVar(&config.criticalAfter, "deregister-critical-after", 0, "")
+	f.BoolVar(&config.blockZeroInstances, "deregister-block-zero", false, "")
+	f.StringVar(&config.journal, "journal", "", "")
+	f.BoolVar(&config.preparedQueries, "consul-prepared-queries", false, "")
+	f.IntVar(&config.queryNearestN, "consul-query-nearest-n", 3, "")
+	f.Var((*listVar)(&config.queryDatacenters), "consul-query-datacenters", "")
+	f.StringVar(&config.queryTemplate, "consul-query-template", "", "")
+	f.StringVar(&config.lockKey, "consul-lock", "", "")
+	f.DurationVar(&config.lockTTL, "consul-lock-ttl", 15*time.Second, "")
+	f.BoolVar(&config.kvTasks, "consul-kv-tasks", false, "")
+	f.StringVar(&config.kvTasksPrefix, "consul-kv-tasks-prefix", "mesos-consul/tasks", "")
+	f.BoolVar(&config.kvTasksRedact, "consul-kv-tasks-redact", false, "")
 }
 
 func Help() string {
@@ -54,17 +121,219 @@ Consul Options:
 				certificates to use to validate the certificate sent
 				by the Consul server to us
 				(default: not set)
-  --consul-token		The Consul ACL token
+  --consul-ssl-key		Path to the private key of the SSL client certificate.
+				Required with --consul-ssl-cert
+				(default: not set)
+  --consul-ssl-server-name	Server name to verify the Consul server certificate
+				against, instead of the agent address
+				(default: not set)
+  --consul-token		The Consul ACL token. Defaults to the CONSUL_HTTP_TOKEN
+				environment variable
+				(default: not set)
+  --consul-token-file		Path to a file containing the Consul ACL token. Defaults
+				to the CONSUL_HTTP_TOKEN_FILE environment variable
+				(default: not set)
+  --consul-task-tokens		Register the services of tasks with a consul.token label
+				with that token, or with the token read from Vault for
+				vault:<path> values
+				(default: false)
+  --consul-vault-prefix		Vault path the vault:<path> values of consul.token
+				labels must be under. Those labels are rejected
+				when not set
+				(default: not set)
+  --consul-namespace		Consul Enterprise namespace to register services in.
+				Also enables the consul.namespace task label
+				(default: not set)
+  --consul-task-namespaces=<ns>,...
+				Comma separated namespaces the consul.namespace task label
+				may select, besides --consul-namespace
+				(default: not set)
+  --consul-partition		Consul Enterprise admin partition to register services
+				in. Defaults to the CONSUL_PARTITION environment variable
+				(default: not set)
+  --consul-catalog=<address>	Register services in the catalog of the Consul servers at
+				the given address, under a node per Mesos agent, instead
+				of on Consul agents running on every Mesos agent. Can be
+				a comma separated list to fail over between
+				(default: not set)
+  --consul-txn-ops=<n>		With --consul-catalog, maximum number of operations per
+				transaction registrations and deregistrations are
+				batched in. Otherwise, maximum number of operations
+				of the initial sync sent concurrently to the Consul
+				agents. 0 disables batching
+				(default: 64)
+  --consul-addresses=<addresses>
+				Comma separated Consul agents to load the cache from and
+				use for KV, locks and queries, failing over between them,
+				instead of the agent of the leading Mesos master
+				(default: not set)
+  --consul-datacenter=<dc>	Also register services in the catalog of another datacenter,
+				given as name=<dc>,address=<server>[,port=<port>]
+				[,token=<token>|,token-file=<file>]. Can be specified
+				multiple times
+				(default: not set)
+  --consul-agent-map=<file>	File mapping Mesos agent addresses to the address of the
+				Consul agent serving them, one '<mesos agent> <consul
+				agent>' pair per line. Defaults to the agent on the
+				same host
+				(default: not set)
+  --consul-fallback-agents=<addresses>
+				Comma separated Consul agents to register services on
+				while the Consul agent serving their Mesos agent is down.
+				Services move back when it recovers
+				(default: not set)
+  --deregister-batch		Maximum number of services deregistered per refresh.
+				Further deregistrations are spread over the next
+				refreshes. 0 disables the limit
+				(default: 0)
+  --reconcile-interval=<time>	Reload the services of mesos-consul from Consul at this
+				interval, registering again those missing or changed
+				in Consul and deregistering those not from a running
+				task. 0 only loads them on startup
+				(default: 0)
+  --deregister-min-instances	Report the services left with fewer healthy instances
+				than this by the deregistrations of a refresh, before
+				executing them. 0 disables the report
+				(default: 0)
+  --deregister-block-zero	Do not deregister the last healthy instance of a service
+				while a task running in Mesos registers it, which points
+				to an address or service ID mismatch
+				(default: false)
+  --deregister-critical-after=<time>
+				Deregister the services found critical on every refresh
+				for longer than this, and do not register them again
+				while their task runs. Services registered less than
+				three check intervals ago are left alone. 0 disables
+				the check
+				(default: 0)
+  --consul-ttl-check=<time>	Add a TTL check of the given TTL to every service, passed
+				by mesos-consul on each successful refresh while the
+				task is running. 0 disables the check
+				(default: 0)
+  --consul-kv-tasks		Mirror the metadata of every Mesos task to the Consul KV
+				store on each refresh
+				(default: false)
+  --consul-kv-tasks-prefix=<path>
+				KV path of the task tree
+				(default: mesos-consul/tasks)
+  --consul-kv-tasks-redact	Redact the label values of the task tree as in the
+				output
+				(default: false)
+  --consul-prepared-queries	Create or update a prepared query per registered service,
+				returning its nearest passing instances and failing
+				over to other datacenters
+				(default: false)
+  --consul-query-nearest-n=<n>	Number of nearest datacenters the prepared queries fail
+				over to
+				(default: 3)
+  --consul-query-datacenters=<dcs>
+				Comma separated datacenters the prepared queries fail
+				over to after the nearest ones
+				(default: not set)
+  --consul-query-template=<file>
+				Go template of the JSON prepared query definition,
+				rendered per service
+				(default: not set)
+  --consul-lock=<key>		Run as one of several replicas, registering only while
+				holding the Consul lock on the given KV key
+				(default: not set)
+  --consul-lock-ttl=<time>	TTL of the lock session, after which a standby takes over
+				from a replica that stopped
+				(default: 15s)
+  --journal=<file>		Write registry operations to a journal file before
+				executing them, and replay those interrupted by a
+				crash on startup
 				(default: not set)
-  --heartbeats-before-remove	Number of times that registration needs to fail
-				before removing task from Consul
-				(default: 1)
 
 `
 
 	return helpText
 }
 
+// Validate()
+//   Return every problem of the Consul options, which New relies on
+//
+func Validate() []error {
+	errs := []error{}
+
+	if (config.sslCert == "") != (config.sslKey == "") {
+		errs = append(errs, fmt.Errorf("--consul-ssl-cert and --consul-ssl-key must be set together"))
+	}
+
+	if config.catalog != "" && config.ttlCheck > 0 {
+		errs = append(errs, fmt.Errorf("--consul-ttl-check requires Consul agents and can not be used with --consul-catalog"))
+	}
+
+	if config.queryTemplate != "" {
+		if _, err := loadQueryTemplate(config.queryTemplate); err != nil {
+			errs = append(errs, fmt.Errorf("--consul-query-template: %s", err))
+		}
+	}
+
+	return errs
+}
+
+// aclToken returns the ACL token presented to Consul. The command line
+// takes precedence over the environment, and a token over a token file.
+// A token file which can't be read is fatal.
+func (c consulConfig) aclToken() string {
+	if c.token != "" {
+		return c.token
+	}
+	if c.tokenFile != "" {
+		return readTokenFile(c.tokenFile)
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		return token
+	}
+	if file := os.Getenv("CONSUL_HTTP_TOKEN_FILE"); file != "" {
+		return readTokenFile(file)
+	}
+	return ""
+}
+
+func readTokenFile(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Unable to read Consul ACL token file: %s", err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// namespaces returns the namespaces services are registered in: the
+// --consul-namespace and the --consul-task-namespaces
+func (c consulConfig) namespaces() []string {
+	if c.namespace == "" {
+		return nil
+	}
+	return append([]string{c.namespace}, c.taskNamespaces...)
+}
+
+// routing tells whether services are registered on the Consul agent
+// serving their Mesos agent, checking that it is alive first.
+func (c consulConfig) routing() bool {
+	return c.agentMap != "" || len(c.fallbackAgents) > 0
+}
+
+// listVar implements the Flag.Value interface and allows the user to
+// specify a comma separated list.
+type listVar []string
+
+func (l *listVar) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+
+	return nil
+}
+
+func (l *listVar) String() string {
+	return strings.Join(*l, ",")
+}
+
 type auth struct {
 	Enabled  bool
 	Username string
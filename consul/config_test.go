@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestACLToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		token, tokenFile string
+		env              string
+		want             string
+	}{
+		{"flag", file, "env", "flag"},
+		{"", file, "env", "from-file"},
+		{"", "", "env", "env"},
+		{"", "", "", ""},
+	} {
+		os.Setenv("CONSUL_HTTP_TOKEN", tt.env)
+		c := consulConfig{token: tt.token, tokenFile: tt.tokenFile}
+		if got := c.aclToken(); got != tt.want {
+			t.Errorf("aclToken(%q, %q, %q) => %q, want %q", tt.token, tt.tokenFile, tt.env, got, tt.want)
+		}
+	}
+	os.Unsetenv("CONSUL_HTTP_TOKEN")
+}
+
+func TestNamespace(t *testing.T) {
+	c := &Consul{config: consulConfig{namespace: "mesos", taskNamespaces: []string{"team-a"}}}
+
+	for _, tt := range []struct {
+		label, want string
+	}{
+		{"", ""},
+		{"mesos", "mesos"},
+		{"team-a", "team-a"},
+		{"team-b", ""},
+	} {
+		if got := c.namespace(&registry.Service{ID: "mesos-consul:web", Namespace: tt.label}); got != tt.want {
+			t.Errorf("namespace(%q) => %q, want %q", tt.label, got, tt.want)
+		}
+	}
+
+	queries := c.namespaceQueries()
+	if len(queries) != 2 || queries[0].Namespace != "mesos" || queries[1].Namespace != "team-a" {
+		t.Errorf("namespaceQueries() => %+v, want mesos and team-a", queries)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	defer func(c consulConfig) { config = c }(config)
+
+	config = consulConfig{}
+	if errs := Validate(); len(errs) != 0 {
+		t.Errorf("Validate() of the defaults => %v, want none", errs)
+	}
+
+	config = consulConfig{
+		sslCert:       "cert.pem",
+		catalog:       "127.0.0.1",
+		ttlCheck:      time.Minute,
+		queryTemplate: "/nonexistent/query.tmpl",
+	}
+	if errs := Validate(); len(errs) != 3 {
+		t.Errorf("Validate() => %v, want the key, TTL check and query template errors", errs)
+	}
+}
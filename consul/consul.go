@@ -1,10 +1,15 @@
 package consul
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/CiscoCloud/mesos-consul/journal"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/redact"
 	"github.com/CiscoCloud/mesos-consul/registry"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -14,24 +19,151 @@ import (
 type Consul struct {
 	agents map[string]*consulapi.Client
 	config consulConfig
+
+	// Service cache
+	cache map[string]*cacheEntry
+
+	journal  *journal.Journal
+	replayed map[string]*cacheEntry
+
+	// Whether operations of the journal failed to replay
+	replayFailed bool
+
+	// Names of the services the tasks running in Mesos may register
+	// during the current refresh
+	runningServices map[string]bool
+
+	// Consul agent serving each Mesos agent, and the liveness of the
+	// Consul agents checked during the current refresh
+	routes *agentRoutes
+	alive  map[string]bool
+
+	// Services found on each Consul agent and namespace during the
+	// current refresh, to tell those Consul deregistered on its own
+	agentServices map[string]map[string]*consulapi.AgentService
+
+	// Leader election between replicas, and whether this instance led
+	// during the last refresh
+	election   *election
+	wasLeading bool
+
+	queries preparedQueries
+
+	// Blocking queries on the KV store, by prefix
+	watches map[string]*kvWatch
+
+	// Vault client reading consul.token labels, created on first use
+	vault *vault
+
+	// Time of the last load of the cache from Consul
+	reconciled time.Time
+
+	// Meta of the catalog nodes of the Mesos agents, by address
+	agentNodes map[string]map[string]string
+
+	// Operations queued for a transaction, or an agent batch during the
+	// initial sync, the first refresh after startup
+	txnQueued []*txnOp
+	syncing   bool
+
+	// Consul servers of --consul-catalog and agents of --consul-addresses
+	// and --consul-fallback-agents
+	catalogs  addressPool
+	addresses addressPool
+	fallbacks addressPool
+
+	// Agent the service cache was loaded from, when each service was
+	// first seen critical, and the services deregistered for staying
+	// critical, by whether their task was seen in the current refresh
+	host          string
+	criticalSince map[string]time.Time
+	quarantined   map[string]bool
 }
 
+// New()
+//   Return the Consul registry, deregistering services once missing from
+//   heartbeats refreshes. With --consul-datacenter, services are also
+//   registered in the catalog of the given datacenters
 //
-func New() *Consul {
-	return &Consul{
-		agents: make(map[string]*consulapi.Client),
-		config: config,
+func New(heartbeats int) registry.Registry {
+	config.heartbeatsBeforeRemove = heartbeats
+	c := newConsul(config)
+	if len(config.datacenters) == 0 {
+		return c
+	}
+
+	m := &multiDC{primary: c}
+	for _, dc := range config.datacenters {
+		m.datacenters = append(m.datacenters, newConsul(config.datacenterConfig(dc)))
 	}
+	return m
+}
+
+// NewReadOnly()
+//   Return the Consul registry of the primary datacenter for --dry-run,
+//   only used to load the services of mesos-consul from the catalog. The
+//   journal is not opened, so no pending operation is replayed to Consul
+//
+func NewReadOnly(heartbeats int) *Consul {
+	cfg := config
+	cfg.heartbeatsBeforeRemove = heartbeats
+	cfg.journal = ""
+	return newConsul(cfg)
+}
+
+func newConsul(cfg consulConfig) *Consul {
+	c := &Consul{
+		agents:      make(map[string]*consulapi.Client),
+		config:      cfg,
+		replayed:    make(map[string]*cacheEntry),
+		quarantined: make(map[string]bool),
+	}
+
+	source := "consul"
+	if c.config.datacenter != "" {
+		source += ":" + c.config.datacenter
+	}
+	redact.Default.SetValues(source, []string{c.config.aclToken(), c.config.auth.Password})
+
+	if c.config.journal != "" {
+		c.openJournal(c.config.journal)
+	}
+
+	c.catalogs = newAddressPool(strings.Split(c.config.catalog, ","))
+	c.addresses = newAddressPool(c.config.addresses)
+	c.fallbacks = newAddressPool(c.config.fallbackAgents)
+
+	if c.config.agentMap != "" {
+		c.routes = newAgentRoutes(c.config.agentMap)
+	}
+
+	if c.config.queryTemplate != "" {
+		// Checked by Validate
+		c.queries.template, _ = loadQueryTemplate(c.config.queryTemplate)
+	}
+
+	return c
 }
 
 // client()
-//   Return a consul client at the specified address
+//   Return a consul client at the specified address. With
+//   --consul-catalog, every address is served by the Consul servers
 func (c *Consul) client(address string) *consulapi.Client {
 	if address == "" {
 		log.Warn("No address to Consul.Agent")
 		return nil
 	}
+	if c.config.catalog != "" {
+		address = c.pick(&c.catalogs)
+	}
+
+	return c.agentClient(address)
+}
 
+// agentClient()
+//   Return a consul client of the agent at address
+//
+func (c *Consul) agentClient(address string) *consulapi.Client {
 	if _, ok := c.agents[address]; !ok {
 		// Agent connection not saved. Connect.
 		c.agents[address] = c.newAgent(address)
@@ -54,23 +186,41 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 	config.Address = fmt.Sprintf("%s:%s", address, c.config.port)
 	log.Debugf("consul address: %s", config.Address)
 
-	if c.config.token != "" {
-		log.Debugf("setting token to %s", c.config.token)
-		config.Token = c.config.token
+	if c.config.namespace != "" {
+		config.Namespace = c.config.namespace
+	}
+	if c.config.partition != "" {
+		config.Partition = c.config.partition
+	}
+	if c.config.datacenter != "" {
+		config.Datacenter = c.config.datacenter
+	}
+
+	if token := c.config.aclToken(); token != "" {
+		log.Debugf("setting ACL token")
+		config.Token = token
 	}
 
 	if c.config.sslEnabled {
 		log.Debugf("enabling SSL")
 		config.Scheme = "https"
+
+		if c.config.sslServerName != "" {
+			config.TLSConfig.Address = c.config.sslServerName
+		}
+		if c.config.sslCaCert != "" {
+			config.TLSConfig.CAFile = c.config.sslCaCert
+		}
+		if c.config.sslCert != "" {
+			log.Debugf("using SSL client certificate %s", c.config.sslCert)
+			config.TLSConfig.CertFile = c.config.sslCert
+			config.TLSConfig.KeyFile = c.config.sslKey
+		}
 	}
 
 	if !c.config.sslVerify {
 		log.Debugf("disabled SSL verification")
-		config.HttpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+		config.TLSConfig.InsecureSkipVerify = true
 	}
 
 	if c.config.auth.Enabled {
@@ -89,18 +239,39 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 }
 
 func (c *Consul) Register(service *registry.Service) {
-	if _, ok := serviceCache[service.ID]; ok {
-		log.Debugf("Service found. Not registering: %s", service.ID)
-		c.CacheMark(service.ID)
+	agent := c.route(service.Agent)
+
+	if _, ok := c.quarantined[service.ID]; ok {
+		log.Debugf("Service deregistered for staying critical. Not registering: %s", service.ID)
+		c.quarantined[service.ID] = true
 		return
 	}
+	c.ensureQuery(agent, service)
 
-	if _, ok := c.agents[service.Agent]; !ok {
-		// Agent connection not saved. Connect.
-		c.agents[service.Agent] = c.newAgent(service.Agent)
+	previous, ok := c.cache[service.ID]
+	if ok && c.reaped(previous) {
+		log.Infof("Service deregistered by Consul for staying critical. Registering again: %s", service.ID)
+		delete(c.cache, service.ID)
+		ok = false
+	}
+	if ok && !c.rehome(previous, agent) {
+		if !c.unchanged(previous, service) {
+			log.Infof("Service changed. Re-registering %s", service.ID)
+		} else if c.tokenChanged(previous, service.Token) {
+			log.Infof("Service token changed. Re-registering %s", service.ID)
+		} else {
+			log.Debugf("Service found. Not registering: %s", service.ID)
+			c.CacheMark(service.ID)
+			return
+		}
 	}
 
 	log.Info("Registering ", service.ID)
+	if c.config.catalog != "" {
+		for _, u := range catalogUnsupported(service) {
+			log.Warnf("%s is not supported with --consul-catalog. Registering %s without it", u, service.ID)
+		}
+	}
 
 	s := &consulapi.AgentServiceRegistration{
 		ID:      service.ID,
@@ -109,50 +280,364 @@ func (c *Consul) Register(service *registry.Service) {
 		Address: service.Address,
 		Check: &consulapi.AgentServiceCheck{
 			TTL:      service.Check.TTL,
-			Script:   service.Check.Script,
+			Args:     scriptArgs(service.Check.Script),
 			HTTP:     service.Check.HTTP,
+			TCP:      service.Check.TCP,
 			Interval: service.Check.Interval,
+			Timeout:  service.Check.Timeout,
+
+			GRPC:          service.Check.GRPC,
+			GRPCUseTLS:    service.Check.GRPCUseTLS,
+			TLSSkipVerify: service.Check.TLSSkipVerify,
+
+			DeregisterCriticalServiceAfter: service.Check.DeregisterCriticalServiceAfter,
 		},
 	}
 
+	if c.config.ttlCheck > 0 {
+		s.Checks = ttlChecks(s.ID, s.Check, c.config.ttlCheck)
+		s.Check = nil
+	}
+
 	if len(service.Tags) > 0 {
 		s.Tags = service.Tags
 	}
 
-	err := c.agents[service.Agent].Agent().ServiceRegister(s)
+	if meta := c.tokenMeta(service.Meta, service.Token); len(meta) > 0 {
+		s.Meta = meta
+	}
+
+	s.EnableTagOverride = service.EnableTagOverride
+
+	if service.Connect != nil {
+		s.Connect = sidecar(service.Connect)
+	}
+
+	if service.Weights != nil {
+		s.Weights = &consulapi.AgentWeights{
+			Passing: service.Weights.Passing,
+			Warning: service.Weights.Warning,
+		}
+	}
+
+	if len(service.TaggedAddresses) > 0 {
+		s.TaggedAddresses = make(map[string]consulapi.ServiceAddress, len(service.TaggedAddresses))
+		for k, a := range service.TaggedAddresses {
+			s.TaggedAddresses[k] = consulapi.ServiceAddress{Address: a.Address, Port: a.Port}
+		}
+	}
+	s.Namespace = c.namespace(service)
+	s.Partition = c.config.partition
+
+	if c.txnEnabled(service.Token) && !(ok && previous.agent != agent) {
+		e := newCacheEntry(s, agent)
+		e.token = service.Token
+		e.registered = service
+		c.txnQueue(journal.OpRegister, e)
+		return
+	}
+
+	seq := c.journalBegin(journal.OpRegister, agent, s, service.Token)
+	err := c.registerService(agent, s, service.Token)
+	c.journalDone(seq)
 	if err != nil {
 		log.Warnf("Unable to register %s: %s", s.ID, err.Error())
+		metrics.RegistryErrors.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(service.Agent), "register")
+		registry.Failed("register", s.ID, err)
 		return
 	}
+	metrics.Registrations.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(service.Agent))
+	registry.Applied("register", service, "")
+	if c.isFallback(agent) {
+		metrics.FallbackRegistrations.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(service.Agent))
+	}
 
-	serviceCache[s.ID] = newCacheEntry(s, service.Agent)
+	// Remove the service from the agent it was moved away from. An agent
+	// which is down is left alone, the service moving back to it once
+	// it recovers
+	if ok && previous.agent != agent {
+		log.Infof("Moved %s from agent %s to %s", s.ID, previous.agent, agent)
+		if !c.config.routing() || c.agentAlive(previous.agent) {
+			if err := c.deregister(previous); err != nil {
+				log.Warnf("Unable to deregister %s from agent %s: %s", s.ID, previous.agent, err)
+			}
+		}
+	}
+
+	c.cache[s.ID] = newCacheEntry(s, agent)
+	c.cache[s.ID].token = service.Token
+	c.cache[s.ID].resolved, _ = c.serviceToken(service.Token)
+	c.cache[s.ID].registered = service
 	c.CacheMark(s.ID)
 }
 
+// unchanged()
+//   Tell whether a cached service is registered as given. The check,
+//   sidecar, weights and tagged addresses of services loaded from
+//   Consul are unknown and left out
+//
+func (c *Consul) unchanged(e *cacheEntry, service *registry.Service) bool {
+	if e.registered != nil {
+		return registry.SameService(e.registered, service)
+	}
+
+	s := *service
+	s.Check, s.Connect, s.Weights, s.TaggedAddresses = nil, nil, nil, nil
+	s.Namespace = c.namespace(service)
+	if s.Namespace == "" {
+		s.Namespace = c.config.namespace
+	}
+	return registry.SameService(c.CacheLookup(service.ID), &s)
+}
+
 // Deregister()
-//   Deregister services that no longer exist
+//   Deregister services that no longer exist. With --deregister-batch,
+//   at most that many services are deregistered per cycle, in the order
+//   of the hash of their ID, and the rest are left for later cycles.
 //
 func (c *Consul) Deregister() {
-	for s, b := range serviceCache {
+	c.txnFlush()
+	c.passTTLChecks()
+	c.deregisterCritical()
+
+	expired := []string{}
+	for s := range c.cache {
 		if c.CacheIsValid(s) {
 			c.CacheProcessDeregister(s)
 		} else {
-			log.Infof("Deregistering %s", s)
-			err := c.deregister(b.agent, b.service)
-			if err != nil {
-				log.Info("Deregistration error ", err)
-			} else {
-				delete(serviceCache, s)
-			}
+			expired = append(expired, s)
 		}
 	}
+
+	batch := hashOrder(expired)
+	if c.config.deregisterBatch > 0 && len(batch) > c.config.deregisterBatch {
+		log.Infof("%d services to deregister, deregistering %d this cycle", len(batch), c.config.deregisterBatch)
+		batch = batch[:c.config.deregisterBatch]
+	}
+
+	batch = c.checkBlastRadius(batch)
+
+	pending := len(expired)
+	agents := make(map[string]bool)
+	for _, s := range batch {
+		b := c.cache[s]
+		agents[b.agent] = true
+
+		log.Infof("Deregistering %s", s)
+		if c.txnEnabled(b.token) {
+			c.txnQueued = append(c.txnQueued, &txnOp{op: journal.OpDeregister, entry: b})
+			continue
+		}
+
+		err := c.deregister(b)
+		if err != nil {
+			log.Info("Deregistration error ", err)
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(b.service.Meta), metrics.HashLabel(b.agent), "deregister")
+			registry.Failed("deregister", b.service.ID, err)
+		} else {
+			metrics.Deregistrations.Inc(registry.FrameworkLabel(b.service.Meta), metrics.HashLabel(b.agent))
+			registry.Applied("deregister", b.lookup(), "")
+			delete(c.cache, s)
+			pending--
+		}
+	}
+	pending -= c.txnFlush()
+	c.pruneCatalogNodes(agents)
+	c.pruneQueries()
+	metrics.DeregistrationsPending.Set(float64(pending))
+	metrics.CacheServices.Set(float64(len(c.cache)))
+
+	c.syncing = false
+	c.journalCheckpoint()
+	c.endRouting()
 }
 
-func (c *Consul) deregister(agent string, service *consulapi.AgentServiceRegistration) error {
-	if _, ok := c.agents[agent]; !ok {
-		// Agent connection not saved. Connect.
-		c.agents[agent] = c.newAgent(agent)
+// hashOrder()
+//   Sort service IDs by their hash, spreading the services of an agent
+//   or framework over deregistration batches
+//
+func hashOrder(ids []string) []string {
+	hashes := make(map[string]uint32, len(ids))
+	for _, id := range ids {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		hashes[id] = h.Sum32()
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if hashes[ids[i]] != hashes[ids[j]] {
+			return hashes[ids[i]] < hashes[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (c *Consul) deregister(e *cacheEntry) error {
+	seq := c.journalBegin(journal.OpDeregister, e.agent, e.service, e.token)
+	defer c.journalDone(seq)
+
+	return c.deregisterService(e.agent, e.service, e.token)
+}
+
+// registerService()
+//   Register a service on the agent at address, or in the catalog of
+//   the Consul servers with --consul-catalog, with the token of its
+//   consul.token label
+//
+func (c *Consul) registerService(agent string, s *consulapi.AgentServiceRegistration, label string) error {
+	if c.lostLead() {
+		return errLostLock
+	}
+
+	client := c.client(agent)
+	if client == nil {
+		return fmt.Errorf("no Consul agent for %s", s.ID)
+	}
+
+	token, err := c.serviceToken(label)
+	if err != nil {
+		return fmt.Errorf("no token for %s: %s", s.ID, err)
+	}
+
+	if c.config.catalog != "" {
+		return catalogRegister(client, agent, c.nodeMeta(agent), s, writeOptions(token))
+	}
+	return client.Agent().ServiceRegisterOpts(s, consulapi.ServiceRegisterOpts{Token: token})
+}
+
+// deregisterService()
+//   Deregister a service from the agent at address, or from the catalog
+//   of the Consul servers with --consul-catalog
+//
+func (c *Consul) deregisterService(agent string, s *consulapi.AgentServiceRegistration, label string) error {
+	if c.lostLead() {
+		return errLostLock
+	}
+
+	client := c.client(agent)
+	if client == nil {
+		return fmt.Errorf("no Consul agent for %s", s.ID)
+	}
+
+	token, err := c.serviceToken(label)
+	if err != nil {
+		return fmt.Errorf("no token for %s: %s", s.ID, err)
+	}
+
+	if c.config.catalog != "" {
+		return catalogDeregister(client, agent, s, writeOptions(token))
+	}
+	q := serviceQuery(s)
+	q.Token = token
+	return client.Agent().ServiceDeregisterOpts(s.ID, q)
+}
+
+// scriptArgs()
+//   Return the arguments of a script check, run by a shell since
+//   Consul no longer accepts a script command line
+//
+func scriptArgs(script string) []string {
+	if script == "" {
+		return nil
 	}
+	return []string{"/bin/sh", "-c", script}
+}
+
+// sidecar()
+//   Return the Connect registration of a sidecar proxy
+//
+func sidecar(c *registry.Connect) *consulapi.AgentServiceConnect {
+	proxy := &consulapi.AgentServiceConnectProxyConfig{}
+	for _, u := range c.Upstreams {
+		proxy.Upstreams = append(proxy.Upstreams, consulapi.Upstream{
+			DestinationType: consulapi.UpstreamDestTypeService,
+			DestinationName: u.Name,
+			LocalBindPort:   u.LocalBindPort,
+		})
+	}
+
+	return &consulapi.AgentServiceConnect{
+		SidecarService: &consulapi.AgentServiceRegistration{
+			Port:  c.SidecarPort,
+			Proxy: proxy,
+		},
+	}
+}
+
+// namespace()
+//   Return the namespace set for a service. It is only honored when
+//   namespaces are enabled, otherwise the client namespace is used.
+//
+func (c *Consul) namespace(service *registry.Service) string {
+	if c.config.namespace == "" || service.Namespace == "" {
+		return ""
+	}
+
+	for _, ns := range c.config.namespaces() {
+		if ns == service.Namespace {
+			return ns
+		}
+	}
+	log.Warnf("Namespace %s of %s is not in --consul-task-namespaces, using %s", service.Namespace, service.ID, c.config.namespace)
+	return ""
+}
 
-	return c.agents[agent].Agent().ServiceDeregister(service.ID)
+// serviceQuery()
+//   Return the query options addressing a registered service in its
+//   namespace and partition. Services without one use those of the
+//   client.
+//
+func serviceQuery(service *consulapi.AgentServiceRegistration) *consulapi.QueryOptions {
+	return &consulapi.QueryOptions{
+		Namespace: service.Namespace,
+		Partition: service.Partition,
+	}
+}
+
+// EnableMaintenance()
+//   Put a service in maintenance mode on its agent, and record it in
+//   the KV store
+//
+func (c *Consul) EnableMaintenance(s *registry.Service, reason string) error {
+	if c.config.catalog != "" {
+		return fmt.Errorf("maintenance mode of %s requires Consul agents", s.ID)
+	}
+	if c.lostLead() {
+		return errLostLock
+	}
+
+	client := c.client(s.Agent)
+	if client == nil {
+		return fmt.Errorf("no Consul agent for %s", s.ID)
+	}
+
+	err := client.Agent().EnableServiceMaintenanceOpts(s.ID, reason, &consulapi.QueryOptions{Namespace: c.namespace(s)})
+	if err == nil {
+		rememberMaintenance(client, s)
+	}
+	return err
+}
+
+// DisableMaintenance()
+//   Take a service out of maintenance mode
+//
+func (c *Consul) DisableMaintenance(s *registry.Service) error {
+	if c.config.catalog != "" {
+		return fmt.Errorf("maintenance mode of %s requires Consul agents", s.ID)
+	}
+	if c.lostLead() {
+		return errLostLock
+	}
+
+	client := c.client(s.Agent)
+	if client == nil {
+		return fmt.Errorf("no Consul agent for %s", s.ID)
+	}
+
+	err := client.Agent().DisableServiceMaintenanceOpts(s.ID, &consulapi.QueryOptions{Namespace: c.namespace(s)})
+	if err == nil {
+		forgetMaintenance(client, s)
+	}
+	return err
 }
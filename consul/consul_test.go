@@ -0,0 +1,109 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestRegisterChanged(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{})
+
+	service := func() *registry.Service {
+		return &registry.Service{
+			ID:      "mesos-consul:web",
+			Name:    "web",
+			Port:    31000,
+			Address: "10.0.0.1",
+			Tags:    []string{"v1"},
+			Check:   &registry.Check{HTTP: "http://10.0.0.1:31000/", Interval: "10s"},
+			Agent:   "127.0.0.1",
+		}
+	}
+
+	c.Register(service())
+	c.Register(service())
+	if n := a.registrations(); n != 1 {
+		t.Fatalf("registered %d times an unchanged service, want once", n)
+	}
+
+	for i, change := range []func(s *registry.Service){
+		func(s *registry.Service) { s.Tags = []string{"v2"} },
+		func(s *registry.Service) { s.Check.Interval = "5s" },
+		func(s *registry.Service) { s.Meta = map[string]string{"version": "2"} },
+	} {
+		n := a.registrations()
+		s := service()
+		change(s)
+		c.Register(s)
+		if a.registrations() != n+1 {
+			t.Errorf("change #%d: the changed service was not registered again", i)
+		}
+		c.Register(service())
+	}
+
+	// The check of a service loaded from Consul is unknown
+	c.cache = map[string]*cacheEntry{"mesos-consul:web": newCacheEntry(&consulapi.AgentServiceRegistration{
+		ID:      "mesos-consul:web",
+		Name:    "web",
+		Port:    31000,
+		Address: "10.0.0.1",
+		Tags:    []string{"v1"},
+	}, "127.0.0.1")}
+	n := a.registrations()
+	c.Register(service())
+	if a.registrations() != n {
+		t.Error("registered again an unchanged service loaded from Consul")
+	}
+}
+
+func TestRegisterReaped(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{})
+
+	running := map[string]*consulapi.AgentService{}
+	a.handlers["/v1/agent/services"] = func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(running)
+	}
+
+	service := &registry.Service{
+		ID:    "mesos-consul:web",
+		Name:  "web",
+		Check: &registry.Check{HTTP: "http://10.0.0.1:31000/", Interval: "10s", DeregisterCriticalServiceAfter: "1m"},
+		Agent: "127.0.0.1",
+	}
+	c.Register(service)
+	running[service.ID] = &consulapi.AgentService{ID: service.ID}
+
+	c.endRouting()
+	c.Register(service)
+	if n := a.registrations(); n != 1 {
+		t.Fatalf("registered %d times a service still on its agent, want once", n)
+	}
+
+	// Consul deregistered the critical service
+	delete(running, service.ID)
+	c.endRouting()
+	c.Register(service)
+	if n := a.registrations(); n != 2 {
+		t.Errorf("registered %d times a service Consul deregistered, want twice", n)
+	}
+}
+
+func TestRedactTask(t *testing.T) {
+	redact.Default.SetValues("test", []string{"s3cr3t"})
+	defer redact.Default.SetValues("test", nil)
+
+	task := &registry.Task{ID: "web.1", Labels: map[string]string{"team": "core", "DB_PASSWORD": "s3cr3t"}}
+	got := redactTask(task)
+	if got.Labels["team"] != "core" || got.Labels["DB_PASSWORD"] == "s3cr3t" {
+		t.Errorf("redactTask() => %v, want DB_PASSWORD redacted", got.Labels)
+	}
+	if task.Labels["DB_PASSWORD"] != "s3cr3t" {
+		t.Error("redactTask() changed the labels of the task")
+	}
+}
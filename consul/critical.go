@@ -0,0 +1,155 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Checks a service gets to run after its registration before it can be
+// deregistered for being critical, and the check interval assumed when
+// the check of a service is unknown
+const (
+	criticalGraceChecks   = 3
+	criticalGraceInterval = 10 * time.Second
+)
+
+// deregisterCritical()
+//   With --deregister-critical-after, deregister the services critical
+//   on every refresh for longer than that, and keep them from being
+//   registered again while their task stays in Mesos. Services
+//   registered less than criticalGraceChecks check intervals ago are
+//   left alone, their check not having run yet
+//
+func (c *Consul) deregisterCritical() {
+	if c.config.criticalAfter <= 0 {
+		return
+	}
+
+	// Forget the quarantined services of tasks gone from Mesos
+	for id, seen := range c.quarantined {
+		if seen {
+			c.quarantined[id] = false
+		} else {
+			delete(c.quarantined, id)
+		}
+	}
+
+	client := c.client(c.clusterAddress(c.host))
+	if client == nil {
+		return
+	}
+
+	checks := consulapi.HealthChecks{}
+	for _, q := range c.namespaceQueries() {
+		found, _, err := client.Health().State(consulapi.HealthCritical, q)
+		if err != nil {
+			log.Warnf("Unable to read the critical checks: %s", err)
+			return
+		}
+		checks = append(checks, found...)
+	}
+
+	now := time.Now()
+	critical := make(map[string]time.Time)
+	for _, check := range checks {
+		if _, ok := c.cache[check.ServiceID]; !ok {
+			continue
+		}
+		since, ok := c.criticalSince[check.ServiceID]
+		if !ok {
+			since = now
+		}
+		critical[check.ServiceID] = since
+	}
+	c.criticalSince = critical
+
+	for id, since := range critical {
+		if now.Sub(since) < c.config.criticalAfter {
+			continue
+		}
+
+		e := c.cache[id]
+		if grace := criticalGrace(e); now.Sub(e.since) < grace {
+			log.Debugf("%s is critical, but was registered less than %s ago", id, grace)
+			continue
+		}
+		log.Warnf("Deregistering %s, critical since %s", id, since.Format(time.RFC3339))
+		if err := c.deregister(e); err != nil {
+			log.Info("Deregistration error ", err)
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(e.service.Meta), metrics.HashLabel(e.agent), "deregister")
+			registry.Failed("deregister", e.service.ID, err)
+			continue
+		}
+		metrics.CriticalDeregistrations.Inc(registry.FrameworkLabel(e.service.Meta))
+		registry.Applied("deregister", e.lookup(), registry.ReasonCritical)
+
+		delete(c.cache, id)
+		delete(c.criticalSince, id)
+		c.quarantined[id] = false
+	}
+}
+
+// criticalGrace()
+//   Return the time a service gets after its registration for its
+//   checks to pass, from their longest interval or TTL
+//
+func criticalGrace(e *cacheEntry) time.Duration {
+	checks := e.service.Checks
+	if e.service.Check != nil {
+		checks = append(consulapi.AgentServiceChecks{e.service.Check}, checks...)
+	}
+
+	interval := time.Duration(0)
+	for _, chk := range checks {
+		for _, d := range []time.Duration{duration(chk.Interval), duration(chk.TTL)} {
+			if d > interval {
+				interval = d
+			}
+		}
+	}
+	if interval <= 0 {
+		interval = criticalGraceInterval
+	}
+	return criticalGraceChecks * interval
+}
+
+// reaped()
+//   Tell whether Consul deregistered a cached service on its own, its
+//   check having stayed critical longer than its
+//   DeregisterCriticalServiceAfter. The services of each agent are
+//   listed once per refresh. Services of the catalog are never reaped
+//
+func (c *Consul) reaped(e *cacheEntry) bool {
+	if c.config.catalog != "" || e.registered == nil || e.registered.Check == nil || e.registered.Check.DeregisterCriticalServiceAfter == "" {
+		return false
+	}
+
+	key := e.agent + "/" + e.service.Namespace
+	services, ok := c.agentServices[key]
+	if !ok {
+		client := c.agentClient(e.agent)
+		if client == nil {
+			return false
+		}
+		var err error
+		services, err = client.Agent().ServicesWithFilterOpts("", serviceQuery(e.service))
+		if err != nil {
+			log.Warnf("Unable to list the services of Consul agent %s: %s", e.agent, err)
+		}
+		if c.agentServices == nil {
+			c.agentServices = make(map[string]map[string]*consulapi.AgentService)
+		}
+		c.agentServices[key] = services
+	}
+	if services == nil {
+		return false
+	}
+
+	_, found := services[e.service.ID]
+	return !found
+}
@@ -0,0 +1,51 @@
+package consul
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestCriticalGrace(t *testing.T) {
+	tests := []struct {
+		service *consulapi.AgentServiceRegistration
+		want    time.Duration
+	}{
+		{&consulapi.AgentServiceRegistration{}, 30 * time.Second},
+		{&consulapi.AgentServiceRegistration{Check: &consulapi.AgentServiceCheck{Interval: "1m"}}, 3 * time.Minute},
+		{&consulapi.AgentServiceRegistration{Checks: consulapi.AgentServiceChecks{{TTL: "20s"}, {Interval: "5s"}}}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := criticalGrace(newCacheEntry(tt.service, "127.0.0.1")); got != tt.want {
+			t.Errorf("criticalGrace(%+v) = %s, want %s", tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestDeregisterCriticalGrace(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{criticalAfter: time.Nanosecond})
+	c.host = "127.0.0.1"
+	a.handlers["/v1/health/state/critical"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"ServiceID":"mesos-consul:new"},{"ServiceID":"mesos-consul:old"}]`))
+	}
+
+	check := &consulapi.AgentServiceCheck{Interval: "10s"}
+	c.cache["mesos-consul:new"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:new", Check: check}, "127.0.0.1")
+	c.cache["mesos-consul:old"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:old", Check: check}, "127.0.0.1")
+	c.cache["mesos-consul:old"].since = time.Now().Add(-time.Minute)
+
+	// The first refresh finds them critical, the second deregisters them
+	c.deregisterCritical()
+	time.Sleep(time.Millisecond)
+	c.deregisterCritical()
+
+	if _, ok := c.cache["mesos-consul:new"]; !ok {
+		t.Error("a service registered within its grace period was deregistered")
+	}
+	if _, ok := c.cache["mesos-consul:old"]; ok {
+		t.Error("a service critical past its grace period was not deregistered")
+	}
+}
@@ -0,0 +1,229 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// datacenter holds a further datacenter services are registered in
+type datacenter struct {
+	name      string
+	address   string
+	port      string
+	token     string
+	tokenFile string
+}
+
+// datacentersVar implements the Flag.Value interface and allows the user
+// to specify datacenters in the name=<dc>,address=<server>[,port=<port>]
+// [,token=<token>|,token-file=<file>] form.
+type datacentersVar []datacenter
+
+func (d *datacentersVar) Set(value string) error {
+	var dc datacenter
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid datacenter option '%s', expected <key>=<value>", kv)
+		}
+
+		switch strings.TrimSpace(parts[0]) {
+		case "name":
+			dc.name = parts[1]
+		case "address":
+			dc.address = parts[1]
+		case "port":
+			dc.port = parts[1]
+		case "token":
+			dc.token = parts[1]
+		case "token-file":
+			dc.tokenFile = parts[1]
+		default:
+			return fmt.Errorf("unknown datacenter option '%s'", parts[0])
+		}
+	}
+
+	if dc.name == "" || dc.address == "" {
+		return fmt.Errorf("datacenter '%s' requires a name and an address", value)
+	}
+
+	*d = append(*d, dc)
+	return nil
+}
+
+func (d *datacentersVar) String() string {
+	names := []string{}
+	for _, dc := range *d {
+		names = append(names, dc.name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (d *datacentersVar) IsRepeatable() bool {
+	return true
+}
+
+// datacenterConfig returns the configuration of the registry of a further
+// datacenter: the catalog of its servers, with its own token. Operations
+// needing a Consul agent are left to the primary registry.
+func (c consulConfig) datacenterConfig(dc datacenter) consulConfig {
+	cfg := c
+	cfg.datacenters = nil
+	cfg.datacenter = dc.name
+	cfg.catalog = dc.address
+	cfg.token = dc.token
+	cfg.tokenFile = dc.tokenFile
+	if dc.port != "" {
+		cfg.port = dc.port
+	}
+	cfg.journal = ""
+	cfg.ttlCheck = 0
+	cfg.agentMap = ""
+	cfg.fallbackAgents = nil
+	cfg.lockKey = ""
+	cfg.taskTokens = false
+	cfg.addresses = nil
+
+	return cfg
+}
+
+// multiDC registers services in a primary registry and in further
+// datacenters, each with its own cache and deregistration sweep
+type multiDC struct {
+	primary     *Consul
+	datacenters []*Consul
+
+	// Registries whose cache is still to be loaded, retried on every
+	// refresh until it loads
+	load map[*Consul]bool
+}
+
+func (m *multiDC) all() []*Consul {
+	return append([]*Consul{m.primary}, m.datacenters...)
+}
+
+func (m *multiDC) CacheCreate() bool {
+	if m.load == nil {
+		m.load = make(map[*Consul]bool)
+	}
+	for _, c := range m.all() {
+		if c.CacheCreate() {
+			m.load[c] = true
+		}
+	}
+	return len(m.load) > 0
+}
+
+// CacheLoad loads the cache of every datacenter still to be loaded. A
+// datacenter failing to load does not keep the others from loading, and
+// is retried on the next refresh.
+func (m *multiDC) CacheLoad(host string) error {
+	errs := []string{}
+	for _, c := range m.all() {
+		if !m.load[c] {
+			continue
+		}
+
+		name := c.config.datacenter
+		if name == "" {
+			name = "primary"
+		}
+		if err := c.CacheLoad(host); err != nil {
+			log.Warnf("Unable to load the cache of datacenter %s: %s", name, err)
+			errs = append(errs, fmt.Sprintf("datacenter %s: %s", name, err))
+			continue
+		}
+		delete(m.load, c)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (m *multiDC) CacheLookup(id string) *registry.Service {
+	return m.primary.CacheLookup(id)
+}
+
+func (m *multiDC) CacheDelete(id string) {
+	for _, c := range m.all() {
+		c.CacheDelete(id)
+	}
+}
+
+func (m *multiDC) CacheMark(id string) {
+	for _, c := range m.all() {
+		c.CacheMark(id)
+	}
+}
+
+func (m *multiDC) Register(s *registry.Service) {
+	for _, c := range m.all() {
+		c.Register(s)
+	}
+}
+
+func (m *multiDC) Deregister() {
+	for _, c := range m.all() {
+		c.Deregister()
+	}
+}
+
+func (m *multiDC) SetRunningServices(names []string) {
+	for _, c := range m.all() {
+		c.SetRunningServices(names)
+	}
+}
+
+func (m *multiDC) MirrorTasks(host string, tasks []*registry.Task) {
+	for _, c := range m.all() {
+		c.MirrorTasks(host, tasks)
+	}
+}
+
+func (m *multiDC) Leading(host string) bool {
+	leading := m.primary.Leading(host)
+	for _, c := range m.datacenters {
+		c.follow(leading)
+	}
+	return leading
+}
+
+func (m *multiDC) SyncNodes(host string, nodes []*registry.Node) {
+	for _, c := range m.all() {
+		c.SyncNodes(host, nodes)
+	}
+}
+
+func (m *multiDC) RegistersNodes() bool {
+	return m.primary.RegistersNodes()
+}
+
+func (m *multiDC) KVGet(host string, key string) (string, bool, error) {
+	return m.primary.KVGet(host, key)
+}
+
+func (m *multiDC) KVWatched(host string, prefix string) (map[string]string, error) {
+	return m.primary.KVWatched(host, prefix)
+}
+
+func (m *multiDC) PruneNode(host string, address string) error {
+	return m.primary.PruneNode(host, address)
+}
+
+func (m *multiDC) EnableMaintenance(s *registry.Service, reason string) error {
+	return m.primary.EnableMaintenance(s, reason)
+}
+
+func (m *multiDC) DisableMaintenance(s *registry.Service) error {
+	return m.primary.DisableMaintenance(s)
+}
+
+func (m *multiDC) Maintained() ([]*registry.Service, error) {
+	return m.primary.Maintained()
+}
@@ -0,0 +1,41 @@
+package consul
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMultiDCCacheLoad(t *testing.T) {
+	primary, a := newTestConsul(t, consulConfig{})
+	east, _ := newTestConsul(t, consulConfig{datacenter: "east"})
+	west, w := newTestConsul(t, consulConfig{datacenter: "west"})
+	primary.cache, east.cache, west.cache = nil, nil, nil
+
+	catalog := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) }
+	a.handlers["/v1/catalog/services"] = catalog
+	east.config.catalog = "127.0.0.1"
+	west.config.catalog = "127.0.0.1"
+	west.catalogs = newAddressPool([]string{"127.0.0.1"})
+	east.catalogs = newAddressPool([]string{"127.0.0.1"})
+	w.handlers["/v1/catalog/services"] = catalog
+
+	m := &multiDC{primary: primary, datacenters: []*Consul{east, west}}
+	if !m.CacheCreate() {
+		t.Fatal("CacheCreate() => false on startup")
+	}
+
+	// The failure of east does not keep west from loading
+	err := m.CacheLoad("127.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), "east") {
+		t.Errorf("CacheLoad() => %v, want an error of east", err)
+	}
+	if primary.reconciled.IsZero() || west.reconciled.IsZero() {
+		t.Error("CacheLoad() did not load the datacenters after east")
+	}
+
+	// Only east is loaded again
+	if !m.CacheCreate() || len(m.load) != 1 || !m.load[east] {
+		t.Errorf("CacheCreate() left %v to load, want east", m.load)
+	}
+}
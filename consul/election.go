@@ -0,0 +1,154 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Delay before campaigning again after a failed lock attempt
+const campaignRetry = 5 * time.Second
+
+// errLostLock is returned by the operations attempted after the
+// --consul-lock was lost
+var errLostLock = errors.New("lost the Consul lock")
+
+// election holds the state of the --consul-lock campaign, run in the
+// background once started
+type election struct {
+	sync.Mutex
+	host    string
+	leading bool
+}
+
+// Leading()
+//   Report whether this instance holds the --consul-lock, starting the
+//   campaign for it through the agent at host on the first call. Without
+//   --consul-lock, the instance always leads
+//
+func (c *Consul) Leading(host string) bool {
+	if c.config.lockKey == "" {
+		return true
+	}
+
+	address := c.clusterAddress(host)
+	if c.election == nil {
+		c.election = &election{host: address}
+		metrics.Leader.Set(0)
+		go c.campaign()
+	}
+
+	c.election.Lock()
+	if address != "" {
+		c.election.host = address
+	}
+	leading := c.election.leading
+	c.election.Unlock()
+
+	c.follow(leading)
+	return leading
+}
+
+// follow()
+//   Record whether this instance leads. On taking over, the cache is
+//   dropped to be reloaded from Consul, which holds the registrations of
+//   the previous leader
+//
+func (c *Consul) follow(leading bool) {
+	if leading && !c.wasLeading {
+		c.cache = nil
+	}
+	c.wasLeading = leading
+}
+
+// campaign()
+//   Acquire the lock, hold it until the session is lost, and start
+//   over
+//
+func (c *Consul) campaign() {
+	for {
+		c.election.Lock()
+		host := c.election.host
+		c.election.Unlock()
+
+		lost, lock, err := c.acquire(host)
+		if err != nil {
+			log.Warnf("Unable to acquire the lock %s: %s", c.config.lockKey, err)
+			time.Sleep(campaignRetry)
+			continue
+		}
+
+		log.Infof("Acquired the lock %s, registering services", c.config.lockKey)
+		c.setLeading(true)
+
+		<-lost
+
+		log.Warnf("Lost the lock %s, standing by", c.config.lockKey)
+		c.setLeading(false)
+		lock.Unlock()
+	}
+}
+
+// acquire()
+//   Block until the lock is acquired through the agent at address, and
+//   return the channel closed when it is lost
+//
+func (c *Consul) acquire(address string) (<-chan struct{}, *consulapi.Lock, error) {
+	// The campaign runs along the refreshes and uses its own client
+	client := c.newAgent(address)
+	if client == nil {
+		return nil, nil, fmt.Errorf("no Consul agent")
+	}
+
+	lock, err := client.LockOpts(&consulapi.LockOptions{
+		Key: c.config.lockKey,
+		SessionOpts: &consulapi.SessionEntry{
+			Name:      "mesos-consul",
+			TTL:       c.config.lockTTL.String(),
+			LockDelay: time.Second,
+		},
+		MonitorRetries: 3,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lost, err := lock.Lock(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lost, lock, nil
+}
+
+// lostLead()
+//   Tell whether this instance lost the --consul-lock it held at the
+//   start of the refresh. It must not change Consul anymore, another
+//   replica taking over
+//
+func (c *Consul) lostLead() bool {
+	if c.election == nil {
+		return false
+	}
+
+	c.election.Lock()
+	defer c.election.Unlock()
+	return !c.election.leading
+}
+
+func (c *Consul) setLeading(leading bool) {
+	c.election.Lock()
+	c.election.leading = leading
+	c.election.Unlock()
+
+	if leading {
+		metrics.Leader.Set(1)
+	} else {
+		metrics.Leader.Set(0)
+	}
+}
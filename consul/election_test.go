@@ -0,0 +1,69 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestLeadingWithoutLock(t *testing.T) {
+	c := &Consul{}
+	if !c.Leading("10.0.0.1") || c.lostLead() {
+		t.Error("Leading() => false without --consul-lock, want true")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	c := &Consul{cache: map[string]*cacheEntry{}}
+
+	c.follow(false)
+	if c.cache == nil {
+		t.Error("follow(false) dropped the cache of a standby")
+	}
+
+	// Taking over reloads the registrations of the previous leader
+	c.follow(true)
+	if c.cache != nil {
+		t.Error("follow(true) kept the cache on taking over")
+	}
+
+	c.cache = map[string]*cacheEntry{}
+	c.follow(true)
+	if c.cache == nil {
+		t.Error("follow(true) dropped the cache of the leader")
+	}
+}
+
+func TestLostLead(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{lockKey: "mesos-consul/leader"})
+	c.election = &election{host: "127.0.0.1", leading: true}
+
+	service := &registry.Service{ID: "mesos-consul:web", Name: "web", Check: registry.DefaultCheck(), Agent: "127.0.0.1"}
+	c.Register(service)
+	if n := a.registrations(); n != 1 {
+		t.Fatalf("registered %d times while leading, want once", n)
+	}
+
+	// The lock is lost in the middle of the refresh
+	c.setLeading(false)
+	if !c.lostLead() {
+		t.Fatal("lostLead() => false after losing the lock")
+	}
+
+	c.Register(&registry.Service{ID: "mesos-consul:api", Name: "api", Check: registry.DefaultCheck(), Agent: "127.0.0.1"})
+	if n := a.registrations(); n != 1 {
+		t.Errorf("registered %d times after losing the lock, want once", n)
+	}
+
+	c.cache["mesos-consul:db"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:db", Name: "db"}, "127.0.0.1")
+	c.CacheProcessDeregister("mesos-consul:db")
+	c.Deregister()
+	if len(a.deregistered) != 0 {
+		t.Errorf("deregistered %v after losing the lock, want nothing", a.deregistered)
+	}
+	if _, ok := c.cache["mesos-consul:db"]; !ok {
+		t.Error("Deregister() dropped the cache entry of a service it could not deregister")
+	}
+}
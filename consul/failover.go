@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// addressPool holds Consul addresses to fail over between. The address in
+// use is kept until it stops answering.
+type addressPool struct {
+	addresses []string
+	current   int
+}
+
+func newAddressPool(addresses []string) addressPool {
+	p := addressPool{}
+	for _, a := range addresses {
+		if a = strings.TrimSpace(a); a != "" {
+			p.addresses = append(p.addresses, a)
+		}
+	}
+	return p
+}
+
+// pick()
+//   Return the address in use in the pool, or the next live one when it
+//   is down. A pool of one address is not checked
+//
+func (c *Consul) pick(p *addressPool) string {
+	if len(p.addresses) == 0 {
+		return ""
+	}
+	if len(p.addresses) == 1 {
+		return p.addresses[0]
+	}
+
+	for i := range p.addresses {
+		n := (p.current + i) % len(p.addresses)
+		if !c.agentAlive(p.addresses[n]) {
+			continue
+		}
+
+		if n != p.current {
+			log.Warnf("Consul at %s is unreachable, failing over to %s", p.addresses[p.current], p.addresses[n])
+			p.current = n
+		}
+		return p.addresses[n]
+	}
+
+	return p.addresses[p.current]
+}
+
+// clusterAddress()
+//   Return the address of the Consul agent to use for operations on the
+//   whole cluster, such as loading the cache: the Consul servers with
+//   --consul-catalog, the --consul-addresses agents, or the agent at host
+//
+func (c *Consul) clusterAddress(host string) string {
+	if c.config.catalog != "" {
+		return c.pick(&c.catalogs)
+	}
+	if len(c.addresses.addresses) > 0 {
+		return c.pick(&c.addresses)
+	}
+	return host
+}
@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/CiscoCloud/mesos-consul/journal"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// journalService is the payload of a journal operation: the service and
+// its consul.token label, so that it is replayed with the same token. The
+// journal file is only readable by mesos-consul
+type journalService struct {
+	*consulapi.AgentServiceRegistration
+	TokenLabel string `json:",omitempty"`
+}
+
+// openJournal()
+//   Open the operation journal and replay the operations a previous
+//   process did not complete
+//
+func (c *Consul) openJournal(path string) {
+	j, err := journal.Open(path)
+	if err != nil {
+		log.Fatalf("Unable to open journal: %s", err)
+	}
+	c.journal = j
+	c.replayPending()
+}
+
+// replayPending()
+//   Replay the pending operations of the journal. Operations which fail
+//   stay pending, and are replayed again on the next checkpoint
+//
+func (c *Consul) replayPending() {
+	c.replayFailed = false
+	for _, op := range c.journal.Pending() {
+		if err := c.replay(op); err != nil {
+			log.Warnf("Unable to replay %s: %s", op.Op, err)
+			c.replayFailed = true
+			continue
+		}
+		c.journal.Done(op.Seq)
+	}
+	c.journal.Checkpoint()
+}
+
+// replay()
+//   Execute an operation from the journal again. The outcome is kept
+//   to correct the cache, which is loaded from the catalog and may not
+//   reflect the replayed operations yet. An operation which can't be
+//   decoded is dropped.
+//
+func (c *Consul) replay(op journal.Operation) error {
+	var s consulapi.AgentServiceRegistration
+	payload := journalService{AgentServiceRegistration: &s}
+	if err := json.Unmarshal(op.Service, &payload); err != nil {
+		log.Warnf("Skipping journal operation %d: %s", op.Seq, err)
+		return nil
+	}
+
+	log.Infof("Replaying %s of %s", op.Op, s.ID)
+	switch op.Op {
+	case journal.OpRegister:
+		if err := c.registerService(op.Agent, &s, payload.TokenLabel); err != nil {
+			return fmt.Errorf("%s: %s", s.ID, err)
+		}
+		c.replayed[s.ID] = newCacheEntry(&s, op.Agent)
+		c.replayed[s.ID].token = payload.TokenLabel
+	case journal.OpDeregister:
+		if err := c.deregisterService(op.Agent, &s, payload.TokenLabel); err != nil {
+			return fmt.Errorf("%s: %s", s.ID, err)
+		}
+		c.replayed[s.ID] = nil
+	}
+	return nil
+}
+
+// applyReplayed()
+//   Apply the outcome of the replayed operations to the cache
+//
+func (c *Consul) applyReplayed() {
+	for id, e := range c.replayed {
+		if e == nil {
+			delete(c.cache, id)
+		} else if _, ok := c.cache[id]; !ok {
+			c.cache[id] = e
+		}
+	}
+	c.replayed = make(map[string]*cacheEntry)
+}
+
+// journalBegin()
+//   Write an operation to the journal before it is executed, with the
+//   consul.token label of the service
+//
+func (c *Consul) journalBegin(op string, agent string, s *consulapi.AgentServiceRegistration, label string) uint64 {
+	if c.journal == nil {
+		return 0
+	}
+
+	seq, err := c.journal.Begin(op, agent, journalService{s, label})
+	if err != nil {
+		log.Warnf("Unable to journal %s of %s: %s", op, s.ID, err)
+	}
+	return seq
+}
+
+// journalDone()
+//   Mark a journal operation as completed
+//
+func (c *Consul) journalDone(seq uint64) {
+	if c.journal == nil || seq == 0 {
+		return
+	}
+
+	if err := c.journal.Done(seq); err != nil {
+		log.Warnf("Unable to journal operation %d: %s", seq, err)
+	}
+}
+
+// journalCheckpoint()
+//   Truncate the journal once all operations are completed, replaying
+//   those still pending from a previous process first
+//
+func (c *Consul) journalCheckpoint() {
+	if c.journal == nil {
+		return
+	}
+
+	if c.replayFailed {
+		c.replayPending()
+		c.applyReplayed()
+	}
+	if err := c.journal.Checkpoint(); err != nil {
+		log.Warnf("Unable to checkpoint journal: %s", err)
+	}
+}
@@ -0,0 +1,134 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// MirrorTasks()
+//   Write the metadata of the tasks to the KV store with --consul-kv-tasks,
+//   under <prefix>/<framework>/<task id>/, and delete the keys of the
+//   tasks gone since the last refresh. Unchanged keys are not written
+//
+func (c *Consul) MirrorTasks(host string, tasks []*registry.Task) {
+	if !c.config.kvTasks {
+		return
+	}
+
+	client := c.client(c.clusterAddress(host))
+	if client == nil {
+		return
+	}
+	kv := client.KV()
+
+	prefix := strings.Trim(c.config.kvTasksPrefix, "/") + "/"
+	want := make(map[string][]byte)
+	for _, t := range tasks {
+		if c.config.kvTasksRedact {
+			t = redactTask(t)
+		}
+		for k, v := range taskKeys(t) {
+			want[prefix+k] = []byte(v)
+		}
+	}
+
+	pairs, _, err := kv.List(prefix, nil)
+	if err != nil {
+		log.Warnf("Unable to list the task KV tree %s: %s", prefix, err)
+		return
+	}
+
+	have := make(map[string][]byte, len(pairs))
+	for _, p := range pairs {
+		have[p.Key] = p.Value
+		if _, ok := want[p.Key]; ok {
+			continue
+		}
+		if c.lostLead() {
+			return
+		}
+		if _, err := kv.Delete(p.Key, nil); err != nil {
+			log.Warnf("Unable to delete %s: %s", p.Key, err)
+		}
+	}
+
+	written := 0
+	for k, v := range want {
+		if old, ok := have[k]; ok && bytes.Equal(old, v) {
+			continue
+		}
+		if c.lostLead() {
+			return
+		}
+		if _, err := kv.Put(&consulapi.KVPair{Key: k, Value: v}, nil); err != nil {
+			log.Warnf("Unable to write %s: %s", k, err)
+			continue
+		}
+		written++
+	}
+	log.Debugf("Mirrored %d tasks to %s, %d keys written", len(tasks), prefix, written)
+}
+
+// redactTask()
+//   Return a copy of a task with its label values redacted
+//
+func redactTask(t *registry.Task) *registry.Task {
+	r := *t
+	r.Labels = make(map[string]string, len(t.Labels))
+	for k, v := range t.Labels {
+		r.Labels[k] = redact.Default.String(v)
+	}
+	return &r
+}
+
+// KVGet()
+//   Return the value of a key of the KV store, and whether it exists
+//
+func (c *Consul) KVGet(host string, key string) (string, bool, error) {
+	client := c.client(c.clusterAddress(host))
+	if client == nil {
+		return "", false, fmt.Errorf("no Consul agent to read %s", key)
+	}
+
+	pair, _, err := client.KV().Get(key, nil)
+	if err != nil || pair == nil {
+		return "", false, err
+	}
+	return string(pair.Value), true, nil
+}
+
+// Reader()
+//   Return a reader of the Consul KV store for the subcommands, which
+//   read the --filter-kv keys without running refresh cycles
+//
+func Reader() registry.KVReader {
+	return standalone()
+}
+
+// taskKeys()
+//   Return the keys of a task, relative to the task tree
+//
+func taskKeys(t *registry.Task) map[string]string {
+	dir := url.PathEscape(t.Framework) + "/" + url.PathEscape(t.ID) + "/"
+
+	keys := map[string]string{
+		dir + "name":     t.Name,
+		dir + "slave_id": t.SlaveID,
+		dir + "agent_ip": t.AgentIP,
+		dir + "state":    t.State,
+		dir + "ports":    strings.Join(t.Ports, ","),
+	}
+	for k, v := range t.Labels {
+		keys[dir+"labels/"+url.PathEscape(k)] = v
+	}
+
+	return keys
+}
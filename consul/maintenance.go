@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// KV prefix of the services put in maintenance mode, so that a restarted
+// mesos-consul takes them out of it
+const maintenanceKVPrefix = "mesos-consul/maintenance/"
+
+func maintenanceKey(id string) string {
+	return maintenanceKVPrefix + url.PathEscape(id)
+}
+
+// rememberMaintenance()
+//   Record a service put in maintenance mode in the KV store. Its token
+//   is left out, maintenance mode using the registry token
+//
+func rememberMaintenance(client *consulapi.Client, s *registry.Service) {
+	r := *s
+	r.Token = ""
+	b, err := json.Marshal(&r)
+	if err == nil {
+		_, err = client.KV().Put(&consulapi.KVPair{Key: maintenanceKey(s.ID), Value: b}, nil)
+	}
+	if err != nil {
+		log.Warnf("Unable to record the maintenance mode of %s: %s", s.ID, err)
+	}
+}
+
+// forgetMaintenance()
+//   Remove a service taken out of maintenance mode from the KV store
+//
+func forgetMaintenance(client *consulapi.Client, s *registry.Service) {
+	if _, err := client.KV().Delete(maintenanceKey(s.ID), nil); err != nil {
+		log.Warnf("Unable to remove the maintenance mode of %s: %s", s.ID, err)
+	}
+}
+
+// Maintained()
+//   Return the services put in maintenance mode, by this process or an
+//   earlier one, as recorded in the KV store. The records of services
+//   no longer registered are removed
+//
+func (c *Consul) Maintained() ([]*registry.Service, error) {
+	if c.config.catalog != "" {
+		return nil, nil
+	}
+
+	client := c.client(c.clusterAddress(c.host))
+	if client == nil {
+		return nil, fmt.Errorf("no Consul agent to read %s", maintenanceKVPrefix)
+	}
+
+	pairs, _, err := client.KV().List(maintenanceKVPrefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []*registry.Service{}
+	for _, p := range pairs {
+		s := &registry.Service{}
+		if err := json.Unmarshal(p.Value, s); err != nil {
+			log.Warnf("Ignoring %s: %s", p.Key, err)
+			continue
+		}
+		if _, ok := c.cache[s.ID]; !ok {
+			if !c.lostLead() {
+				forgetMaintenance(client, s)
+			}
+			continue
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
@@ -0,0 +1,183 @@
+package consul
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits of Consul on node meta
+const (
+	nodeMetaMaxPairs   = 64
+	nodeMetaMaxKey     = 128
+	nodeMetaMaxValue   = 512
+	agentNodeIDMetaKey = "mesos-agent-id"
+)
+
+var invalidNodeMetaKey = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// SyncNodes()
+//   Register a catalog node with meta for each Mesos agent of the refresh,
+//   through the agent at host, and deregister the nodes of the agents
+//   which are gone and have no service left. Unchanged nodes are not
+//   written. Nodes are only registered with --consul-catalog, the nodes
+//   of Consul agents being their own
+//
+func (c *Consul) SyncNodes(host string, nodes []*registry.Node) {
+	if !c.RegistersNodes() {
+		return
+	}
+
+	client := c.client(c.clusterAddress(host))
+	if client == nil {
+		return
+	}
+
+	if c.agentNodes == nil {
+		if err := c.loadAgentNodes(client); err != nil {
+			log.Warnf("Unable to load the Mesos agent nodes: %s", err)
+			return
+		}
+	}
+
+	seen := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		seen[n.Address] = true
+
+		meta, dropped := agentNodeMeta(n.Meta)
+		if reflect.DeepEqual(c.agentNodes[n.Address], meta) {
+			continue
+		}
+		if c.lostLead() {
+			return
+		}
+
+		_, err := client.Catalog().Register(&consulapi.CatalogRegistration{
+			Node:      catalogNode(n.Address),
+			Address:   n.Address,
+			NodeMeta:  meta,
+			Partition: c.config.partition,
+		}, nil)
+		if err != nil {
+			log.Warnf("Unable to register the node of Mesos agent %s: %s", n.Address, err)
+			continue
+		}
+		log.Debugf("Registered the node of Mesos agent %s", n.Address)
+		if dropped > 0 {
+			log.Warnf("Dropped %d attributes of Mesos agent %s from the meta of its node, over the %d pairs of Consul", dropped, n.Address, nodeMetaMaxPairs)
+		}
+		c.agentNodes[n.Address] = meta
+	}
+
+	for address := range c.agentNodes {
+		if seen[address] || c.hasServices(address) {
+			continue
+		}
+		if c.lostLead() {
+			return
+		}
+
+		log.Infof("Deregistering the node of Mesos agent %s", address)
+		_, err := client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:      catalogNode(address),
+			Partition: c.config.partition,
+		}, nil)
+		if err != nil {
+			log.Warnf("Unable to deregister the node of Mesos agent %s: %s", address, err)
+			continue
+		}
+		delete(c.agentNodes, address)
+	}
+}
+
+// RegistersNodes()
+//   Tell whether Mesos agents are registered as catalog nodes: only with
+//   --consul-catalog
+//
+func (c *Consul) RegistersNodes() bool {
+	return c.config.catalog != ""
+}
+
+// loadAgentNodes()
+//   Load the Mesos agent nodes registered before a restart
+//
+func (c *Consul) loadAgentNodes(client *consulapi.Client) error {
+	nodes, _, err := client.Catalog().Nodes(&consulapi.QueryOptions{
+		Filter: `"` + agentNodeIDMetaKey + `" in Meta`,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.agentNodes = make(map[string]map[string]string, len(nodes))
+	for _, n := range nodes {
+		if n.Node == catalogNode(n.Address) {
+			c.agentNodes[n.Address] = n.Meta
+		}
+	}
+	return nil
+}
+
+// nodeMeta()
+//   Return the meta of the catalog node of a Mesos agent
+//
+func (c *Consul) nodeMeta(agent string) map[string]string {
+	if meta, ok := c.agentNodes[agent]; ok {
+		return meta
+	}
+	return catalogNodeMeta
+}
+
+// hasServices()
+//   Tell whether services are registered on the node of a Mesos agent
+//
+func (c *Consul) hasServices(agent string) bool {
+	for _, e := range c.cache {
+		if e.agent == agent {
+			return true
+		}
+	}
+	return false
+}
+
+// agentNodeMeta()
+//   Return the catalog node meta of a Mesos agent, fitting the limits of
+//   Consul: keys of letters, digits, - and _, and at most 64 pairs. The
+//   attributes are kept in the order of their names, and the number of
+//   those dropped is returned
+//
+func agentNodeMeta(meta map[string]string) (map[string]string, int) {
+	result := make(map[string]string, len(catalogNodeMeta)+len(meta))
+	for k, v := range catalogNodeMeta {
+		result[k] = v
+	}
+
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if len(result) >= nodeMetaMaxPairs {
+			return result, len(keys) - i
+		}
+
+		v := meta[k]
+		k = invalidNodeMetaKey.ReplaceAllString(k, "-")
+		if len(k) > nodeMetaMaxKey {
+			k = k[:nodeMetaMaxKey]
+		}
+		if len(v) > nodeMetaMaxValue {
+			v = v[:nodeMetaMaxValue]
+		}
+		result[k] = v
+	}
+
+	return result, 0
+}
@@ -0,0 +1,34 @@
+package consul
+
+import (
+	"errors"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// standalone()
+//   Return a Consul registry for the subcommands, which talk to Consul
+//   without running refresh cycles
+//
+func standalone() *Consul {
+	return &Consul{
+		agents:   make(map[string]*consulapi.Client),
+		config:   config,
+		catalogs: newAddressPool(strings.Split(config.catalog, ",")),
+	}
+}
+
+// Ping()
+//   Check the connection to the Consul agent at host, or to the Consul
+//   servers with --consul-catalog, without registering anything
+//
+func Ping(host string) error {
+	client := standalone().client(host)
+	if client == nil {
+		return errors.New("no Consul address")
+	}
+
+	_, err := client.Status().Leader()
+	return err
+}
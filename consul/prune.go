@@ -0,0 +1,79 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// PruneNode()
+//   Deregister the catalog node at the given address, through the agent
+//   at host. Nodes whose agent is still alive or which carry services not
+//   created by mesos-consul are left alone.
+//
+func (c *Consul) PruneNode(host string, address string) error {
+	client := c.client(c.clusterAddress(host))
+	if client == nil {
+		return fmt.Errorf("no Consul agent to prune node %s", address)
+	}
+
+	nodes, _, err := client.Catalog().Nodes(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		if n.Address != address {
+			continue
+		}
+
+		checks, _, err := client.Health().Node(n.Node, nil)
+		if err != nil {
+			return err
+		}
+		for _, check := range checks {
+			if check.CheckID == "serfHealth" && check.Status == consulapi.HealthPassing {
+				log.WithField("node", n.Node).Debug("Consul agent still alive. Not pruning node")
+				return nil
+			}
+		}
+
+		node, _, err := client.Catalog().Node(n.Node, nil)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			for id, s := range node.Services {
+				if !registry.Owned(id, s.Meta) {
+					log.WithField("node", n.Node).Debugf("Node has foreign service %s. Not pruning node", id)
+					return nil
+				}
+			}
+		}
+
+		if c.lostLead() {
+			return errLostLock
+		}
+		log.Infof("Pruning node %s (%s)", n.Node, address)
+		_, err = client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:       n.Node,
+			Datacenter: n.Datacenter,
+			Partition:  n.Partition,
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		// The node's services are gone with it
+		for id, e := range c.cache {
+			if e.agent == address {
+				delete(c.cache, id)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package consul
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Orphan is a registration of the Consul catalog left behind by
+// mesos-consul
+type Orphan struct {
+	ID     string
+	Name   string
+	Node   string
+	TaskID string
+
+	agent   string
+	service *consulapi.AgentServiceRegistration
+	token   string
+
+	// Address the catalog was listed through, and index of the
+	// registration when it was
+	host  string
+	index uint64
+}
+
+// Registrations()
+//   Return the services of the catalog, as seen from the agent at host,
+//   whose ID starts with prefix, or registered by mesos-consul when it is
+//   empty, sorted by ID. The catalog is to be listed before the Mesos
+//   state is loaded, so that the services registered meanwhile are not
+//   taken for orphans
+//
+func Registrations(host string, prefix string) ([]Orphan, error) {
+	c := standalone()
+	address := c.clusterAddress(host)
+	client := c.client(address)
+	if client == nil {
+		return nil, errors.New("no Consul address")
+	}
+	catalog := client.Catalog()
+
+	registrations := []Orphan{}
+	for _, q := range c.namespaceQueries() {
+		serviceList, _, err := catalog.Services(q)
+		if err != nil {
+			return nil, err
+		}
+
+		for service := range serviceList {
+			catalogServices, _, err := catalog.Service(service, "", q)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, s := range catalogServices {
+				if prefix == "" && !registry.Owned(s.ServiceID, s.ServiceMeta) || prefix != "" && !strings.HasPrefix(s.ServiceID, prefix) {
+					continue
+				}
+				registrations = append(registrations, Orphan{
+					ID:     s.ServiceID,
+					Name:   s.ServiceName,
+					Node:   s.Node,
+					TaskID: s.ServiceMeta[registry.TaskIDMetaKey],
+					agent:  s.Address,
+					token:  s.ServiceMeta[tokenMetaKey],
+					service: &consulapi.AgentServiceRegistration{
+						ID:        s.ServiceID,
+						Name:      s.ServiceName,
+						Namespace: s.Namespace,
+						Partition: s.Partition,
+					},
+					host:  address,
+					index: s.ModifyIndex,
+				})
+			}
+		}
+	}
+
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].ID < registrations[j].ID
+	})
+	return registrations, nil
+}
+
+// Orphans()
+//   Return the registrations to which no running service or task
+//   corresponds, as told by running
+//
+func Orphans(registrations []Orphan, running func(id string, taskID string) bool) []Orphan {
+	orphans := []Orphan{}
+	for _, o := range registrations {
+		if !running(o.ID, o.TaskID) {
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans
+}
+
+// Purge()
+//   Deregister the orphans, and return the number of them deregistered
+//   and of those which could not be. Right before its deregistration, each orphan
+//   is checked again: it is kept when it was registered again since it
+//   was listed, or when running, reloading the Mesos state, tells that
+//   it runs by now
+//
+func Purge(orphans []Orphan, running func(id string, taskID string) (bool, error)) (int, int) {
+	c := standalone()
+
+	deregistered, failed := 0, 0
+	for _, o := range orphans {
+		keep, err := c.keep(o, running)
+		if err != nil {
+			log.Warnf("Unable to check %s again, keeping it: %s", o.ID, err)
+			failed++
+			continue
+		}
+		if keep {
+			continue
+		}
+
+		if err := c.deregisterService(o.agent, o.service, o.token); err != nil {
+			log.Warnf("Unable to deregister %s: %s", o.ID, err)
+			failed++
+			continue
+		}
+		log.Infof("Deregistered %s from %s", o.ID, o.Node)
+		deregistered++
+	}
+	return deregistered, failed
+}
+
+// keep()
+//   Tell whether an orphan is to be kept after all: registered again
+//   since it was listed, or running by now
+//
+func (c *Consul) keep(o Orphan, running func(id string, taskID string) (bool, error)) (bool, error) {
+	listed, err := c.stillListed(o)
+	if err != nil {
+		return true, err
+	}
+	if !listed {
+		log.Infof("%s changed since it was listed, keeping it", o.ID)
+		return true, nil
+	}
+
+	ok, err := running(o.ID, o.TaskID)
+	if err != nil {
+		return true, err
+	}
+	if ok {
+		log.Infof("%s started running since it was listed, keeping it", o.ID)
+	}
+	return ok, nil
+}
+
+// stillListed()
+//   Tell whether the registration of an orphan is still in the catalog,
+//   as it was listed
+//
+func (c *Consul) stillListed(o Orphan) (bool, error) {
+	client := c.client(o.host)
+	if client == nil {
+		return false, errors.New("no Consul address")
+	}
+
+	q := &consulapi.QueryOptions{Namespace: o.service.Namespace, Partition: o.service.Partition}
+	catalogServices, _, err := client.Catalog().Service(o.Name, "", q)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range catalogServices {
+		if s.ServiceID == o.ID && s.Node == o.Node {
+			return s.ModifyIndex == o.index, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,108 @@
+package consul
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// serveCatalog serves the given catalog services from the test agent,
+// by service name
+func serveCatalog(a *testAgent, catalog map[string][]*consulapi.CatalogService) {
+	a.handlers["/v1/catalog/services"] = func(w http.ResponseWriter, r *http.Request) {
+		names := make(map[string][]string)
+		for name := range catalog {
+			names[name] = []string{}
+		}
+		json.NewEncoder(w).Encode(names)
+	}
+	for name := range catalog {
+		name := name
+		a.handlers["/v1/catalog/service/"+name] = func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(catalog[name])
+		}
+	}
+}
+
+func listedService(id string, name string, taskID string, index uint64) *consulapi.CatalogService {
+	return &consulapi.CatalogService{
+		Node:        "agent-1",
+		Address:     "127.0.0.1",
+		ServiceID:   id,
+		ServiceName: name,
+		ServiceMeta: map[string]string{registry.TaskIDMetaKey: taskID},
+		ModifyIndex: index,
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	_, a := newTestConsul(t, consulConfig{})
+	defer func(c consulConfig) { config = c }(config)
+	_, port, _ := net.SplitHostPort(a.Listener.Addr().String())
+	config = consulConfig{port: port}
+
+	serveCatalog(a, map[string][]*consulapi.CatalogService{
+		"web": {
+			listedService("mesos-consul:10.0.0.1:web:31000", "web", "web.1", 5),
+			// Registered by an earlier --id-scheme for the same task
+			listedService("mesos-consul:web.1:31000", "web", "web.1", 6),
+		},
+		"db":    {listedService("mesos-consul:10.0.0.1:db:31001", "db", "db.1", 7)},
+		"redis": {listedService("redis-1", "redis", "", 8)},
+	})
+
+	registrations, err := Registrations("127.0.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 3 {
+		t.Fatalf("Registrations() => %+v, want the 3 services of mesos-consul", registrations)
+	}
+
+	running := func(id string, taskID string) bool {
+		return id == "mesos-consul:10.0.0.1:web:31000" || taskID == "web.1"
+	}
+	orphans := Orphans(registrations, running)
+	if len(orphans) != 1 || orphans[0].ID != "mesos-consul:10.0.0.1:db:31001" || orphans[0].TaskID != "db.1" {
+		t.Errorf("Orphans() => %+v, want db, whose task is gone", orphans)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	_, a := newTestConsul(t, consulConfig{})
+	defer func(c consulConfig) { config = c }(config)
+	_, port, _ := net.SplitHostPort(a.Listener.Addr().String())
+	config = consulConfig{port: port}
+
+	catalog := map[string][]*consulapi.CatalogService{
+		"db":    {listedService("mesos-consul:10.0.0.1:db:31001", "db", "db.1", 7)},
+		"api":   {listedService("mesos-consul:10.0.0.1:api:31002", "api", "api.1", 8)},
+		"cache": {listedService("mesos-consul:10.0.0.1:cache:31003", "cache", "cache.1", 9)},
+	}
+	serveCatalog(a, catalog)
+
+	orphans, err := Registrations("127.0.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// api is registered again, and the task of cache starts, after the
+	// orphans were listed
+	catalog["api"][0].ModifyIndex = 10
+	running := func(id string, taskID string) (bool, error) {
+		return taskID == "cache.1", nil
+	}
+
+	deregistered, failed := Purge(orphans, running)
+	if deregistered != 1 || failed != 0 {
+		t.Errorf("Purge() => %d deregistered, %d failed, want 1 and 0", deregistered, failed)
+	}
+	if len(a.deregistered) != 1 || a.deregistered[0] != "mesos-consul:10.0.0.1:db:31001" {
+		t.Errorf("deregistered %v, want only db", a.deregistered)
+	}
+}
@@ -0,0 +1,248 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"text/template"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// queryVars are the fields available to --consul-query-template
+type queryVars struct {
+	Service     string
+	Namespace   string
+	NearestN    int
+	Datacenters []string
+}
+
+// preparedQueries tracks the prepared queries of the services, by query
+// name
+type preparedQueries struct {
+	template *template.Template
+
+	// IDs of the existing queries and the records of those created by
+	// mesos-consul, loaded on first use, and the queries created or
+	// updated by this instance
+	ids     map[string]string
+	owned   map[string]*queryRecord
+	current map[string]bool
+}
+
+// loadQueryTemplate()
+//   Parse the --consul-query-template file
+//
+func loadQueryTemplate(path string) (*template.Template, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New("query").Parse(string(b))
+}
+
+// queryDefinition()
+//   Return the prepared query of a service: the nearest passing
+//   instance, failing over to the nearest datacenters, or the rendered
+//   --consul-query-template
+//
+func (c *Consul) queryDefinition(service *registry.Service) (*consulapi.PreparedQueryDefinition, error) {
+	vars := queryVars{
+		Service:     service.Name,
+		Namespace:   c.namespace(service),
+		NearestN:    c.config.queryNearestN,
+		Datacenters: c.config.queryDatacenters,
+	}
+
+	if c.queries.template == nil {
+		return &consulapi.PreparedQueryDefinition{
+			Name: vars.Service,
+			Service: consulapi.ServiceQuery{
+				Service:     vars.Service,
+				Namespace:   vars.Namespace,
+				Near:        "_agent",
+				OnlyPassing: true,
+				Failover: consulapi.QueryFailoverOptions{
+					NearestN:    vars.NearestN,
+					Datacenters: vars.Datacenters,
+				},
+			},
+		}, nil
+	}
+
+	var b bytes.Buffer
+	if err := c.queries.template.Execute(&b, vars); err != nil {
+		return nil, err
+	}
+
+	def := &consulapi.PreparedQueryDefinition{}
+	if err := json.Unmarshal(b.Bytes(), def); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// queryRecord is the KV record of a prepared query created by
+// mesos-consul, under queryKVPrefix and the query name
+type queryRecord struct {
+	ID      string
+	Service string
+}
+
+// KV prefix of the prepared queries created by mesos-consul. Only those
+// are updated and deleted
+const queryKVPrefix = "mesos-consul/queries/"
+
+func queryKey(name string) string {
+	return queryKVPrefix + url.PathEscape(name)
+}
+
+// ensureQuery()
+//   Create the prepared query of a service through the agent at
+//   address, or update the one created by mesos-consul once per run.
+//   Queries of the same name created by others are left alone
+//
+func (c *Consul) ensureQuery(address string, service *registry.Service) {
+	if !c.config.preparedQueries {
+		return
+	}
+
+	def, err := c.queryDefinition(service)
+	if err != nil {
+		log.Warnf("Unable to render the prepared query of %s: %s", service.Name, err)
+		return
+	}
+	if c.queries.current[def.Name] || c.lostLead() {
+		return
+	}
+
+	client := c.client(c.clusterAddress(address))
+	if client == nil {
+		return
+	}
+	if c.queries.ids == nil {
+		if err := c.loadQueries(client); err != nil {
+			log.Warnf("Unable to list the prepared queries: %s", err)
+			return
+		}
+	}
+	pq := client.PreparedQuery()
+
+	id, exists := c.queries.ids[def.Name]
+	if exists && c.queries.owned[def.Name] == nil {
+		log.Warnf("Prepared query %s was not created by mesos-consul. Leaving it alone", def.Name)
+		c.queries.current[def.Name] = true
+		return
+	}
+
+	if exists {
+		def.ID = id
+		if _, err := pq.Update(def, nil); err != nil {
+			log.Warnf("Unable to update the prepared query %s: %s", def.Name, err)
+			return
+		}
+		log.Debugf("Updated the prepared query %s", def.Name)
+	} else {
+		id, _, err := pq.Create(def, nil)
+		if err != nil {
+			log.Warnf("Unable to create the prepared query %s: %s", def.Name, err)
+			return
+		}
+		c.queries.ids[def.Name] = id
+		log.Infof("Created the prepared query %s", def.Name)
+	}
+
+	r := &queryRecord{ID: c.queries.ids[def.Name], Service: service.Name}
+	if o := c.queries.owned[def.Name]; o == nil || *o != *r {
+		b, _ := json.Marshal(r)
+		if _, err := client.KV().Put(&consulapi.KVPair{Key: queryKey(def.Name), Value: b}, nil); err != nil {
+			log.Warnf("Unable to record the prepared query %s: %s", def.Name, err)
+			return
+		}
+		c.queries.owned[def.Name] = r
+	}
+	c.queries.current[def.Name] = true
+}
+
+// loadQueries()
+//   Load the existing prepared queries, and those created by
+//   mesos-consul as recorded in the KV store. The records of queries
+//   deleted by others are removed
+//
+func (c *Consul) loadQueries(client *consulapi.Client) error {
+	queries, _, err := client.PreparedQuery().List(nil)
+	if err != nil {
+		return err
+	}
+	pairs, _, err := client.KV().List(queryKVPrefix, nil)
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]string, len(queries))
+	for _, q := range queries {
+		ids[q.Name] = q.ID
+	}
+
+	owned := make(map[string]*queryRecord, len(pairs))
+	for _, p := range pairs {
+		name, _ := url.PathUnescape(p.Key[len(queryKVPrefix):])
+		r := &queryRecord{}
+		if err := json.Unmarshal(p.Value, r); err != nil || ids[name] != r.ID {
+			if _, err := client.KV().Delete(p.Key, nil); err != nil {
+				log.Warnf("Unable to remove the record of prepared query %s: %s", name, err)
+			}
+			continue
+		}
+		owned[name] = r
+	}
+
+	c.queries.ids = ids
+	c.queries.owned = owned
+	c.queries.current = make(map[string]bool)
+	return nil
+}
+
+// pruneQueries()
+//   Delete the prepared queries created by mesos-consul whose service
+//   is no longer registered
+//
+func (c *Consul) pruneQueries() {
+	if !c.config.preparedQueries || len(c.queries.owned) == 0 {
+		return
+	}
+
+	registered := make(map[string]bool)
+	for _, e := range c.cache {
+		registered[e.service.Name] = true
+	}
+
+	var client *consulapi.Client
+	for name, r := range c.queries.owned {
+		if registered[r.Service] || c.lostLead() {
+			continue
+		}
+		if client == nil {
+			if client = c.client(c.clusterAddress(c.host)); client == nil {
+				return
+			}
+		}
+
+		if _, err := client.PreparedQuery().Delete(r.ID, nil); err != nil {
+			log.Warnf("Unable to delete the prepared query %s: %s", name, err)
+			continue
+		}
+		if _, err := client.KV().Delete(queryKey(name), nil); err != nil {
+			log.Warnf("Unable to remove the record of prepared query %s: %s", name, err)
+		}
+		log.Infof("Deleted the prepared query %s of deregistered service %s", name, r.Service)
+		delete(c.queries.owned, name)
+		delete(c.queries.ids, name)
+		delete(c.queries.current, name)
+	}
+}
@@ -0,0 +1,95 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testQueries serves the prepared query API of a test agent
+type testQueries struct {
+	queries map[string]*consulapi.PreparedQueryDefinition
+	updated []string
+}
+
+func (q *testQueries) serve(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/query"), "/")
+	switch {
+	case r.Method == "POST":
+		def := &consulapi.PreparedQueryDefinition{}
+		json.NewDecoder(r.Body).Decode(def)
+		def.ID = "q-" + def.Name
+		q.queries[def.ID] = def
+		json.NewEncoder(w).Encode(map[string]string{"ID": def.ID})
+	case r.Method == "PUT":
+		q.updated = append(q.updated, id)
+	case r.Method == "DELETE":
+		delete(q.queries, id)
+	default:
+		list := []*consulapi.PreparedQueryDefinition{}
+		for _, def := range q.queries {
+			list = append(list, def)
+		}
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+func TestEnsureQuery(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{preparedQueries: true})
+	c.host = "127.0.0.1"
+
+	q := &testQueries{queries: map[string]*consulapi.PreparedQueryDefinition{
+		"foreign": {ID: "foreign", Name: "api"},
+		"q-web":   {ID: "q-web", Name: "web"},
+	}}
+	a.handlers["/v1/query"] = q.serve
+	for _, id := range []string{"foreign", "q-web", "q-db"} {
+		a.handlers["/v1/query/"+id] = q.serve
+	}
+	a.kv[queryKey("web")] = []byte(`{"ID":"q-web","Service":"web"}`)
+
+	for _, name := range []string{"web", "api", "db"} {
+		c.Register(&registry.Service{ID: "mesos-consul:" + name, Name: name, Check: registry.DefaultCheck(), Agent: "127.0.0.1"})
+	}
+
+	if len(q.updated) != 1 || q.updated[0] != "q-web" {
+		t.Errorf("updated %v, want only the query of mesos-consul", q.updated)
+	}
+	if _, ok := q.queries["q-db"]; !ok {
+		t.Error("the query of db was not created")
+	}
+	if _, ok := a.kv[queryKey("db")]; !ok {
+		t.Error("the query of db was not recorded")
+	}
+
+	// The queries of mesos-consul go away with their service
+	delete(c.cache, "mesos-consul:db")
+	delete(c.cache, "mesos-consul:api")
+	c.pruneQueries()
+	if _, ok := q.queries["q-db"]; ok {
+		t.Error("the query of deregistered db was not deleted")
+	}
+	if _, ok := q.queries["foreign"]; !ok {
+		t.Error("the foreign query of api was deleted")
+	}
+	if _, ok := a.kv[queryKey("db")]; ok {
+		t.Error("the record of the query of db was not removed")
+	}
+}
+
+func TestRegisterQuarantinedQuery(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{preparedQueries: true})
+	c.quarantined["mesos-consul:web"] = false
+
+	created := false
+	a.handlers["/v1/query"] = func(w http.ResponseWriter, r *http.Request) { created = true }
+	c.Register(&registry.Service{ID: "mesos-consul:web", Name: "web", Check: registry.DefaultCheck(), Agent: "127.0.0.1"})
+	if created || a.registrations() != 0 {
+		t.Error("Register() touched Consul for a quarantined service")
+	}
+}
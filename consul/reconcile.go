@@ -0,0 +1,75 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileDue()
+//   Tell whether --reconcile-interval has passed since the cache was
+//   last loaded
+//
+func (c *Consul) reconcileDue() bool {
+	return c.config.reconcileInterval > 0 && time.Since(c.reconciled) >= c.config.reconcileInterval
+}
+
+// reconcile()
+//   Merge the services of mesos-consul found in Consul into the cache.
+//   Cached services missing or changed in Consul are dropped, to be
+//   registered again by the refresh. Services found in Consul only are
+//   cached, to be deregistered unless their task is seen
+//
+func (c *Consul) reconcile(found map[string]*cacheEntry) {
+	initial := c.reconciled.IsZero()
+	c.reconciled = time.Now()
+
+	dropped := make(map[string]bool)
+	for id, e := range c.cache {
+		f, ok := found[id]
+		switch {
+		case !ok:
+			log.Warnf("%s is missing from Consul, registering it again", id)
+			metrics.ReconcileRepairs.Inc("missing")
+		case !sameRegistration(e.service, f.service):
+			log.Warnf("%s was changed in Consul, registering it again", id)
+			metrics.ReconcileRepairs.Inc("changed")
+		default:
+			continue
+		}
+
+		delete(c.cache, id)
+		dropped[id] = true
+	}
+
+	for id, f := range found {
+		if _, ok := c.cache[id]; ok || dropped[id] {
+			continue
+		}
+
+		if !initial {
+			log.Warnf("%s is not tracked, deregistering it unless its task runs", id)
+			metrics.ReconcileRepairs.Inc("untracked")
+		}
+		c.cache[id] = f
+	}
+}
+
+// sameRegistration()
+//   Tell whether a service registered by mesos-consul is still the same
+//   in Consul, as far as the catalog listing tells. Tags are ignored when
+//   external tools may change them
+//
+func sameRegistration(a, b *consulapi.AgentServiceRegistration) bool {
+	as, bs := loadedService(a), loadedService(b)
+	for _, s := range []*registry.Service{as, bs} {
+		if s.Namespace == "" {
+			s.Namespace = "default"
+		}
+	}
+	return registry.SameService(as, bs)
+}
@@ -0,0 +1,33 @@
+package consul
+
+import (
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestSameRegistration(t *testing.T) {
+	registered := &consulapi.AgentServiceRegistration{
+		ID:      "mesos-consul:web",
+		Name:    "web",
+		Port:    8080,
+		Address: "10.0.0.1",
+		Tags:    []string{"a", "b"},
+		Meta:    map[string]string{"framework": "marathon", tokenMetaKey: "vault:consul/creds/web"},
+		Check:   &consulapi.AgentServiceCheck{HTTP: "http://10.0.0.1:8080/health", Interval: "10s"},
+	}
+
+	for i, tt := range []struct {
+		found *consulapi.AgentServiceRegistration
+		want  bool
+	}{
+		{&consulapi.AgentServiceRegistration{Name: "web", Port: 8080, Address: "10.0.0.1", Tags: []string{"b", "a"}, Meta: registered.Meta, Namespace: "default"}, true},
+		{&consulapi.AgentServiceRegistration{Name: "web", Port: 8080, Address: "10.0.0.1", Tags: []string{"a"}, Meta: registered.Meta}, false},
+		{&consulapi.AgentServiceRegistration{Name: "web", Port: 8080, Address: "10.0.0.1", Tags: []string{"a", "b"}}, false},
+		{&consulapi.AgentServiceRegistration{Name: "web", Port: 8080, Address: "10.0.0.1", Tags: []string{"a", "b"}, Meta: registered.Meta, Namespace: "team"}, false},
+	} {
+		if got := sameRegistration(registered, tt.found); got != tt.want {
+			t.Errorf("test #%d: sameRegistration() => %v, want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package consul
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// agentRoutes holds the Consul agent serving each Mesos agent, read from
+// --consul-agent-map. The file is re-read whenever it changes.
+type agentRoutes struct {
+	path    string
+	modTime time.Time
+	entries map[string]string
+}
+
+func newAgentRoutes(path string) *agentRoutes {
+	r := &agentRoutes{
+		path:    path,
+		entries: make(map[string]string),
+	}
+	r.reload()
+
+	return r
+}
+
+// reload re-reads the file if it was modified since the last read. On
+// error the previous mapping is kept.
+func (r *agentRoutes) reload() {
+	if r == nil || r.path == "" {
+		return
+	}
+
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		log.WithField("consul-agent-map", r.path).Warn("Unable to stat Consul agent map: ", err)
+		return
+	}
+	if fi.ModTime().Equal(r.modTime) {
+		return
+	}
+
+	f, err := os.Open(r.path)
+	if err != nil {
+		log.WithField("consul-agent-map", r.path).Warn("Unable to open Consul agent map: ", err)
+		return
+	}
+	defer f.Close()
+
+	entries, err := parseAgentRoutes(f)
+	if err != nil {
+		log.WithField("consul-agent-map", r.path).Warn("Keeping previous Consul agent map: ", err)
+		return
+	}
+
+	log.WithField("consul-agent-map", r.path).Infof("Loaded %d Consul agent routes", len(entries))
+	r.entries = entries
+	r.modTime = fi.ModTime()
+}
+
+// lookup returns the Consul agent serving the Mesos agent at address,
+// which is the agent on the same host unless mapped otherwise.
+func (r *agentRoutes) lookup(address string) string {
+	if r != nil {
+		if agent, ok := r.entries[address]; ok {
+			return agent
+		}
+	}
+	return address
+}
+
+// parseAgentRoutes reads one `<mesos agent address> <consul agent address>`
+// pair per line. Blank lines and lines starting with # are ignored.
+func parseAgentRoutes(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected '<mesos agent address> <consul agent address>', got %q", n, line)
+		}
+		entries[fields[0]] = fields[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// route()
+//   Return the address of the Consul agent to register the services of
+//   the Mesos agent at address on: the agent serving it, or while that
+//   one is down a live --consul-fallback-agents agent, picked as the
+//   cluster addresses are so that services stay on it until it fails
+//
+func (c *Consul) route(address string) string {
+	if !c.config.routing() || c.config.catalog != "" {
+		return address
+	}
+
+	home := c.routes.lookup(address)
+	if c.agentAlive(home) {
+		return home
+	}
+
+	if fallback := c.pick(&c.fallbacks); fallback != "" && c.agentAlive(fallback) {
+		log.Debugf("Consul agent %s is down, using fallback agent %s", home, fallback)
+		return fallback
+	}
+
+	return home
+}
+
+// agentAlive()
+//   Check whether the Consul agent at address answers. The result is
+//   kept until the end of the refresh
+//
+func (c *Consul) agentAlive(address string) bool {
+	if alive, ok := c.alive[address]; ok {
+		return alive
+	}
+
+	alive := false
+	if client := c.agentClient(address); client != nil {
+		_, err := client.Agent().Self()
+		if err != nil {
+			log.Warnf("Consul agent %s is unreachable: %s", address, err)
+		}
+		alive = err == nil
+	}
+
+	if c.alive == nil {
+		c.alive = make(map[string]bool)
+	}
+	c.alive[address] = alive
+	return alive
+}
+
+// rehome()
+//   Tell whether a cached service is to move to target: it sits on a
+//   fallback agent while the agent it belongs to is available again, or
+//   on an agent which is down
+//
+func (c *Consul) rehome(e *cacheEntry, target string) bool {
+	if e.agent == target {
+		return false
+	}
+	return c.isFallback(e.agent) || (c.config.routing() && c.config.catalog == "" && !c.agentAlive(e.agent))
+}
+
+// isFallback()
+//   Tell whether address is one of the --consul-fallback-agents
+//
+func (c *Consul) isFallback(address string) bool {
+	for _, fallback := range c.fallbacks.addresses {
+		if address == fallback {
+			return true
+		}
+	}
+	return false
+}
+
+// endRouting()
+//   Forget the agent liveness of the refresh and pick up changes to the
+//   Consul agent map
+//
+func (c *Consul) endRouting() {
+	c.alive = nil
+	c.agentServices = nil
+	c.routes.reload()
+}
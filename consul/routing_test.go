@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestRehome(t *testing.T) {
+	c := &Consul{
+		config:    consulConfig{fallbackAgents: []string{"10.0.0.9"}},
+		fallbacks: newAddressPool([]string{"10.0.0.9"}),
+		alive:     map[string]bool{"10.0.0.1": false, "10.0.0.2": true, "10.0.0.9": true},
+	}
+
+	for _, tt := range []struct {
+		agent, target string
+		want          bool
+	}{
+		{"10.0.0.2", "10.0.0.2", false},
+		{"10.0.0.9", "10.0.0.2", true},
+		{"10.0.0.1", "10.0.0.9", true},
+		{"10.0.0.2", "10.0.0.9", false},
+	} {
+		e := newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:web"}, tt.agent)
+		if got := c.rehome(e, tt.target); got != tt.want {
+			t.Errorf("rehome(%s, %s) => %v, want %v", tt.agent, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestRouteFallback(t *testing.T) {
+	fallbacks := []string{"10.0.0.8", "10.0.0.9"}
+	c := &Consul{
+		config:    consulConfig{fallbackAgents: fallbacks},
+		fallbacks: newAddressPool(fallbacks),
+		alive:     map[string]bool{"10.0.0.1": false, "10.0.0.8": false, "10.0.0.9": true},
+	}
+
+	if got := c.route("10.0.0.1"); got != "10.0.0.9" {
+		t.Fatalf("route() => %s, want the live fallback agent", got)
+	}
+
+	// The first fallback agent recovering does not move services off the
+	// one in use
+	c.alive["10.0.0.8"] = true
+	if got := c.route("10.0.0.1"); got != "10.0.0.9" {
+		t.Errorf("route() => %s after another fallback recovered, want 10.0.0.9", got)
+	}
+
+	c.alive["10.0.0.1"] = true
+	if got := c.route("10.0.0.1"); got != "10.0.0.1" {
+		t.Errorf("route() => %s, want the recovered agent", got)
+	}
+}
+
+func TestRegisterDeadAgent(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{fallbackAgents: []string{"127.0.0.1"}})
+	c.alive = map[string]bool{"10.0.0.1": false}
+
+	// Registered on its agent before it went down
+	c.cache["mesos-consul:web"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:web", Name: "web"}, "10.0.0.1")
+
+	c.Register(&registry.Service{ID: "mesos-consul:web", Name: "web", Check: registry.DefaultCheck(), Agent: "10.0.0.1"})
+	if n := a.registrations(); n != 1 {
+		t.Fatalf("registered %d times on the fallback agent, want once", n)
+	}
+	if e := c.cache["mesos-consul:web"]; e.agent != "127.0.0.1" {
+		t.Errorf("cached on %s, want the fallback agent", e.agent)
+	}
+}
@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Prefix of the consul.token label values read from Vault
+const vaultTokenPrefix = "vault:"
+
+// Meta key recording the vault:<path> consul.token label of a service, so
+// that it is deregistered with its token after a restart
+const tokenMetaKey = "mesos-consul-token"
+
+// serviceToken()
+//   Return the ACL token a service is registered with, from the value of
+//   its consul.token label: a token, or vault:<path> for a token read from
+//   Vault under --consul-vault-prefix. Empty for the mesos-consul token
+//
+func (c *Consul) serviceToken(label string) (string, error) {
+	if !c.config.taskTokens || label == "" {
+		return "", nil
+	}
+
+	if strings.HasPrefix(label, vaultTokenPrefix) {
+		p, err := c.vaultPath(strings.TrimPrefix(label, vaultTokenPrefix))
+		if err != nil {
+			return "", err
+		}
+		if c.vault == nil {
+			c.vault = newVault()
+		}
+		return c.vault.consulToken(p)
+	}
+	return label, nil
+}
+
+// vaultPath()
+//   Return the cleaned Vault path of a vault:<path> label, failing for
+//   paths outside --consul-vault-prefix, so that a task can't have
+//   mesos-consul read the secrets of others
+//
+func (c *Consul) vaultPath(p string) (string, error) {
+	if c.config.vaultPrefix == "" {
+		return "", fmt.Errorf("vault: tokens need --consul-vault-prefix")
+	}
+	if strings.ContainsAny(p, "?#%") {
+		return "", fmt.Errorf("invalid Vault path %s", p)
+	}
+
+	p = path.Clean("/" + p)
+	prefix := path.Clean("/" + c.config.vaultPrefix)
+	if prefix != "/" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+		return "", fmt.Errorf("Vault path %s is not under %s", p, prefix)
+	}
+	return p, nil
+}
+
+// tokenChanged()
+//   Tell whether a cached service is to be registered again for its
+//   token to change: its consul.token label changed, or its Vault token
+//   was rotated. Services loaded from Consul, registered with an
+//   unknown token, take the token of their task
+//
+func (c *Consul) tokenChanged(e *cacheEntry, label string) bool {
+	token, err := c.serviceToken(label)
+	if err != nil {
+		return false
+	}
+
+	if e.registered == nil {
+		e.token, e.resolved = label, token
+		return false
+	}
+	return e.token != label || e.resolved != token
+}
+
+// tokenMeta()
+//   Return the meta of a service, recording its consul.token label when
+//   it is read from Vault. Tokens themselves are never recorded
+//
+func (c *Consul) tokenMeta(meta map[string]string, label string) map[string]string {
+	if !c.config.taskTokens || !strings.HasPrefix(label, vaultTokenPrefix) {
+		return meta
+	}
+
+	result := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		result[k] = v
+	}
+	result[tokenMetaKey] = label
+	return result
+}
+
+// writeOptions()
+//   Return the write options presenting token, nil for the client token
+//
+func writeOptions(token string) *consulapi.WriteOptions {
+	if token == "" {
+		return nil
+	}
+	return &consulapi.WriteOptions{Token: token}
+}
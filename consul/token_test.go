@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestVaultPath(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   string
+	}{
+		{"", "consul/creds/web", ""},
+		{"consul/creds", "consul/creds/web", "/consul/creds/web"},
+		{"/consul/creds/", "/consul/creds/web", "/consul/creds/web"},
+		{"consul/creds", "consul/creds/../../secret/db", ""},
+		{"consul/creds", "consul/credsx/web", ""},
+		{"consul/creds", "consul/creds/web?version=1", ""},
+	}
+
+	for _, tt := range tests {
+		c := &Consul{config: consulConfig{vaultPrefix: tt.prefix}}
+		got, err := c.vaultPath(tt.path)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("vaultPath(%q) under %q = %q, want an error", tt.path, tt.prefix, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("vaultPath(%q) under %q = %q, %v, want %q", tt.path, tt.prefix, got, err, tt.want)
+		}
+	}
+}
+
+func TestRegisterTokenChanged(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{taskTokens: true})
+
+	service := func(token string) *registry.Service {
+		return &registry.Service{ID: "mesos-consul:web", Name: "web", Check: registry.DefaultCheck(), Agent: "127.0.0.1", Token: token}
+	}
+
+	c.Register(service("one"))
+	c.Register(service("one"))
+	if n := a.registrations(); n != 1 {
+		t.Fatalf("%d registrations with the same token, want 1", n)
+	}
+	c.Register(service("two"))
+	if n := a.registrations(); n != 2 {
+		t.Errorf("%d registrations after the token changed, want 2", n)
+	}
+	if e := c.cache["mesos-consul:web"]; e.token != "two" || e.resolved != "two" {
+		t.Errorf("cached token %q, %q, want two", e.token, e.resolved)
+	}
+}
+
+func TestTokenMeta(t *testing.T) {
+	c := &Consul{config: consulConfig{taskTokens: true}}
+
+	meta := map[string]string{"framework": "marathon"}
+	if got := c.tokenMeta(meta, "secret"); got[tokenMetaKey] != "" {
+		t.Errorf("tokenMeta() recorded a token: %v", got)
+	}
+	got := c.tokenMeta(meta, "vault:consul/creds/web")
+	if got[tokenMetaKey] != "vault:consul/creds/web" || meta[tokenMetaKey] != "" {
+		t.Errorf("tokenMeta() = %v, task meta %v", got, meta)
+	}
+	if stripped := taskMeta(got); !registry.SameService(&registry.Service{Meta: stripped}, &registry.Service{Meta: meta}) {
+		t.Errorf("taskMeta() = %v, want %v", stripped, meta)
+	}
+}
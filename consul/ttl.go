@@ -0,0 +1,66 @@
+package consul
+
+import (
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// ttlCheckID()
+//   Return the ID of the TTL check of a service
+//
+func ttlCheckID(serviceID string) string {
+	return "service:" + serviceID + ":ttl"
+}
+
+// ttlChecks()
+//   Return the checks of a service registered with a TTL check: its
+//   check, when it has one, and the TTL check
+//
+func ttlChecks(serviceID string, check *consulapi.AgentServiceCheck, ttl time.Duration) consulapi.AgentServiceChecks {
+	checks := consulapi.AgentServiceChecks{}
+	deregisterAfter := ""
+	if check != nil && (check.TTL != "" || len(check.Args) > 0 || check.HTTP != "" || check.TCP != "" || check.GRPC != "") {
+		checks = append(checks, check)
+		deregisterAfter = check.DeregisterCriticalServiceAfter
+	}
+
+	return append(checks, &consulapi.AgentServiceCheck{
+		CheckID: ttlCheckID(serviceID),
+		Name:    "Mesos task running",
+		Notes:   "Passed by mesos-consul while the task is TASK_RUNNING",
+		TTL:     ttl.String(),
+
+		DeregisterCriticalServiceAfter: deregisterAfter,
+	})
+}
+
+// passTTLChecks()
+//   Pass the TTL check of every service seen during the current refresh.
+//   Services of tasks which are gone, or of a mesos-consul which stopped,
+//   see their check expire
+//
+func (c *Consul) passTTLChecks() {
+	if c.config.ttlCheck <= 0 {
+		return
+	}
+
+	for id, e := range c.cache {
+		if e.validityCounter != 0 {
+			continue
+		}
+		if c.lostLead() {
+			return
+		}
+
+		client := c.client(e.agent)
+		if client == nil {
+			continue
+		}
+		err := client.Agent().UpdateTTLOpts(ttlCheckID(id), "TASK_RUNNING", consulapi.HealthPassing, serviceQuery(e.service))
+		if err != nil {
+			log.Debugf("Unable to pass the TTL check of %s: %s", id, err)
+		}
+	}
+}
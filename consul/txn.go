@@ -0,0 +1,292 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/CiscoCloud/mesos-consul/journal"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// txnOp is a registration or deregistration queued for a transaction
+type txnOp struct {
+	op    string
+	entry *cacheEntry
+}
+
+// txnEnabled()
+//   Tell whether the operations on a service with the given consul.token
+//   label are batched: in transactions with --consul-catalog, and in
+//   agent batches during the initial sync otherwise. Only operations
+//   with the mesos-consul token can be
+//
+func (c *Consul) txnEnabled(label string) bool {
+	if c.config.txnOps <= 0 || (label != "" && c.config.taskTokens) {
+		return false
+	}
+	return c.config.catalog != "" || c.syncing
+}
+
+// txnQueue()
+//   Queue an operation, executing the queue once it holds enough
+//   operations to fill a transaction
+//
+func (c *Consul) txnQueue(op string, e *cacheEntry) {
+	c.txnQueued = append(c.txnQueued, &txnOp{op: op, entry: e})
+	if len(c.txnQueued) >= c.config.txnOps {
+		c.txnFlush()
+	}
+}
+
+// txnFlush()
+//   Execute the queued operations in transactions of at most
+//   --consul-txn-ops operations. Return the number of services
+//   deregistered
+//
+func (c *Consul) txnFlush() int {
+	queued := c.txnQueued
+	c.txnQueued = nil
+
+	deregistered := 0
+	if c.config.catalog == "" {
+		for len(queued) > 0 {
+			n := len(queued)
+			if n > c.config.txnOps {
+				n = c.config.txnOps
+			}
+			deregistered += c.agentBatch(queued[:n])
+			queued = queued[n:]
+		}
+		return deregistered
+	}
+
+	for len(queued) > 0 {
+		ops := consulapi.TxnOps{}
+		nodes := make(map[string]bool)
+
+		n := 0
+		for ; n < len(queued); n++ {
+			agent := queued[n].entry.agent
+			var meta map[string]string
+			if !nodes[agent] {
+				meta = c.nodeMeta(agent)
+			}
+
+			next := txnOps(queued[n], meta)
+			if len(ops) > 0 && len(ops)+len(next) > c.config.txnOps {
+				break
+			}
+			ops = append(ops, next...)
+			nodes[agent] = true
+		}
+
+		deregistered += c.txnExecute(queued[:n], ops)
+		queued = queued[n:]
+	}
+
+	return deregistered
+}
+
+// txnExecute()
+//   Execute a transaction. When it fails, its operations are executed one
+//   by one, so that a single bad one does not fail the others. Return the
+//   number of services deregistered. The operations which failed stay
+//   pending in the journal
+//
+func (c *Consul) txnExecute(queued []*txnOp, ops consulapi.TxnOps) int {
+	seqs := make([]uint64, len(queued))
+	for i, q := range queued {
+		seqs[i] = c.journalBegin(q.op, q.entry.agent, q.entry.service, q.entry.token)
+	}
+
+	var err error
+	if c.lostLead() {
+		err = errLostLock
+	} else if client := c.client(c.clusterAddress(c.host)); client == nil {
+		err = fmt.Errorf("no Consul server")
+	} else {
+		var ok bool
+		var resp *consulapi.TxnResponse
+		ok, resp, _, err = client.Txn().Txn(ops, nil)
+		if err == nil && !ok {
+			err = txnError(resp)
+		}
+	}
+
+	if err == nil {
+		log.Debugf("Executed %d operations in a transaction", len(ops))
+		metrics.Transactions.Inc()
+	} else {
+		log.Warnf("Transaction of %d services failed, executing them one by one: %s", len(queued), err)
+	}
+
+	errs := make([]error, len(queued))
+	for i, q := range queued {
+		errs[i] = err
+		if err != nil {
+			errs[i] = c.txnApply(q)
+		}
+	}
+	return c.txnDone(queued, seqs, errs)
+}
+
+// agentBatch()
+//   Execute a batch of operations on Consul agents concurrently, one
+//   worker per agent. Return the number of services deregistered. The
+//   operations which failed stay pending in the journal
+//
+func (c *Consul) agentBatch(queued []*txnOp) int {
+	seqs := make([]uint64, len(queued))
+	byAgent := make(map[string][]int)
+	for i, q := range queued {
+		seqs[i] = c.journalBegin(q.op, q.entry.agent, q.entry.service, q.entry.token)
+		byAgent[q.entry.agent] = append(byAgent[q.entry.agent], i)
+
+		// Connect before the workers share the clients
+		c.agentClient(q.entry.agent)
+	}
+
+	errs := make([]error, len(queued))
+	var wg sync.WaitGroup
+	for _, ops := range byAgent {
+		wg.Add(1)
+		go func(ops []int) {
+			defer wg.Done()
+			for _, i := range ops {
+				errs[i] = c.txnApply(queued[i])
+			}
+		}(ops)
+	}
+	wg.Wait()
+
+	log.Debugf("Executed a batch of %d operations on %d Consul agents", len(queued), len(byAgent))
+	return c.txnDone(queued, seqs, errs)
+}
+
+// txnApply()
+//   Execute a queued operation on its own
+//
+func (c *Consul) txnApply(q *txnOp) error {
+	if q.op == journal.OpRegister {
+		return c.registerService(q.entry.agent, q.entry.service, q.entry.token)
+	}
+	return c.deregisterService(q.entry.agent, q.entry.service, q.entry.token)
+}
+
+// txnDone()
+//   Apply the outcome of executed operations, marking those which
+//   succeeded as done in the journal. Return the number of services
+//   deregistered
+//
+func (c *Consul) txnDone(queued []*txnOp, seqs []uint64, errs []error) int {
+	deregistered := 0
+	for i, q := range queued {
+		if !c.txnApplied(q, errs[i]) {
+			continue
+		}
+		c.journalDone(seqs[i])
+		if q.op == journal.OpDeregister {
+			deregistered++
+		}
+	}
+	return deregistered
+}
+
+// txnApplied()
+//   Count the outcome of a queued operation and update the cache. Return
+//   whether it succeeded
+//
+func (c *Consul) txnApplied(q *txnOp, err error) bool {
+	s := q.entry.service
+	if err != nil {
+		log.Warnf("Unable to %s %s: %s", q.op, s.ID, err)
+		metrics.RegistryErrors.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(q.entry.agent), q.op)
+		registry.Failed(q.op, s.ID, err)
+		return false
+	}
+
+	if q.op == journal.OpRegister {
+		metrics.Registrations.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(q.entry.agent))
+		registry.Applied(q.op, q.entry.lookup(), "")
+		c.cache[s.ID] = q.entry
+		c.CacheMark(s.ID)
+	} else {
+		metrics.Deregistrations.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(q.entry.agent))
+		registry.Applied(q.op, q.entry.lookup(), "")
+		delete(c.cache, s.ID)
+	}
+	return true
+}
+
+// txnOps()
+//   Return the transaction operations of a queued operation. The node of
+//   a registration is set with meta along its first service in a
+//   transaction, and meta is nil for the next ones
+//
+func txnOps(q *txnOp, meta map[string]string) consulapi.TxnOps {
+	s := q.entry.service
+	node := catalogNode(q.entry.agent)
+
+	if q.op == journal.OpDeregister {
+		return consulapi.TxnOps{{
+			Service: &consulapi.ServiceTxnOp{
+				Verb:    consulapi.ServiceDelete,
+				Node:    node,
+				Service: consulapi.AgentService{ID: s.ID, Namespace: s.Namespace, Partition: s.Partition},
+			},
+		}}
+	}
+
+	ops := consulapi.TxnOps{}
+	if meta != nil {
+		ops = append(ops, &consulapi.TxnOp{
+			Node: &consulapi.NodeTxnOp{
+				Verb: consulapi.NodeSet,
+				Node: consulapi.Node{
+					Node:      node,
+					Address:   q.entry.agent,
+					Meta:      meta,
+					Partition: s.Partition,
+				},
+			},
+		})
+	}
+
+	ops = append(ops, &consulapi.TxnOp{
+		Service: &consulapi.ServiceTxnOp{
+			Verb:    consulapi.ServiceSet,
+			Node:    node,
+			Service: *catalogService(s),
+		},
+	})
+	for _, chk := range catalogChecks(q.entry.agent, s) {
+		ops = append(ops, &consulapi.TxnOp{
+			Check: &consulapi.CheckTxnOp{
+				Verb:  consulapi.CheckSet,
+				Check: *chk,
+			},
+		})
+	}
+
+	return ops
+}
+
+// txnError()
+//   Return the errors of a rolled back transaction
+//
+func txnError(resp *consulapi.TxnResponse) error {
+	if resp == nil || len(resp.Errors) == 0 {
+		return fmt.Errorf("transaction rolled back")
+	}
+
+	errs := []string{}
+	for _, e := range resp.Errors {
+		errs = append(errs, fmt.Sprintf("operation %d: %s", e.OpIndex, e.What))
+	}
+	return fmt.Errorf("transaction rolled back: %s", strings.Join(errs, ", "))
+}
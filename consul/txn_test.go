@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestInitialSyncBatch(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{txnOps: 2})
+
+	for _, id := range []string{"mesos-consul:a", "mesos-consul:b", "mesos-consul:c"} {
+		c.Register(&registry.Service{ID: id, Name: "web", Check: registry.DefaultCheck(), Agent: "127.0.0.1"})
+	}
+	if n := a.registrations(); n != 2 {
+		t.Errorf("%d registrations before the end of the refresh, want a full batch of 2", n)
+	}
+
+	c.Deregister()
+	if n := a.registrations(); n != 3 {
+		t.Errorf("%d registrations after the initial sync, want 3", n)
+	}
+	if len(c.cache) != 3 {
+		t.Errorf("%d services cached, want 3", len(c.cache))
+	}
+
+	// Past the initial sync, services are registered right away
+	c.Register(&registry.Service{ID: "mesos-consul:d", Name: "web", Check: registry.DefaultCheck(), Agent: "127.0.0.1"})
+	if n := a.registrations(); n != 4 {
+		t.Errorf("%d registrations after the initial sync, want 4", n)
+	}
+}
+
+func TestBatchFailedStaysPending(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{txnOps: 64})
+	c.openJournal(filepath.Join(t.TempDir(), "journal"))
+	a.handlers["/v1/agent/service/register"] = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}
+
+	c.Register(&registry.Service{ID: "mesos-consul:web", Name: "web", Check: registry.DefaultCheck(), Agent: "127.0.0.1"})
+	c.txnFlush()
+
+	if pending := c.journal.Pending(); len(pending) != 1 {
+		t.Errorf("%d journal operations pending, want the failed registration", len(pending))
+	}
+	if _, ok := c.cache["mesos-consul:web"]; ok {
+		t.Error("the failed registration was cached")
+	}
+}
@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/redact"
+)
+
+// vault reads secrets from the Vault server at VAULT_ADDR, with the
+// VAULT_TOKEN token, and keeps them for their lease
+type vault struct {
+	sync.Mutex
+	addr    string
+	token   string
+	client  *http.Client
+	secrets map[string]vaultSecret
+}
+
+type vaultSecret struct {
+	value   string
+	expires time.Time
+}
+
+// vaultResponse holds the fields of a Vault secret read mesos-consul uses
+type vaultResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Errors        []string               `json:"errors"`
+}
+
+func newVault() *vault {
+	return &vault{
+		addr:    strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		token:   os.Getenv("VAULT_TOKEN"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		secrets: make(map[string]vaultSecret),
+	}
+}
+
+// consulToken returns the Consul ACL token stored at path, an absolute
+// cleaned path: the token
+// issued by the Consul secrets engine, or the token field of a KV secret.
+// It is read again once two thirds of its lease have passed.
+func (v *vault) consulToken(path string) (string, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if s, ok := v.secrets[path]; ok && (s.expires.IsZero() || time.Now().Before(s.expires)) {
+		return s.value, nil
+	}
+
+	if v.addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	req, err := http.NewRequest("GET", v.addr+"/v1"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var r vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("reading %s: %s", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reading %s: %s %s", path, resp.Status, strings.Join(r.Errors, ", "))
+	}
+
+	token, ok := r.Data["token"].(string)
+	if !ok {
+		// KV version 2 secrets nest their fields
+		if data, isMap := r.Data["data"].(map[string]interface{}); isMap {
+			token, ok = data["token"].(string)
+		}
+	}
+	if !ok || token == "" {
+		return "", fmt.Errorf("no token in %s", path)
+	}
+
+	s := vaultSecret{value: token}
+	if r.LeaseDuration > 0 {
+		s.expires = time.Now().Add(time.Duration(r.LeaseDuration) * time.Second * 2 / 3)
+	}
+	v.secrets[path] = s
+
+	values := []string{}
+	for _, s := range v.secrets {
+		values = append(values, s.value)
+	}
+	redact.Default.SetValues("vault", values)
+
+	return token, nil
+}
@@ -0,0 +1,117 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Longest wait of a blocking query on the KV store, and delay before
+// watching again after a failed one
+const (
+	kvWatchWait  = 5 * time.Minute
+	kvWatchRetry = 5 * time.Second
+)
+
+// kvWatch holds the keys under a KV prefix, kept up to date by a
+// blocking query run in the background once started
+type kvWatch struct {
+	sync.Mutex
+	host   string
+	values map[string]string
+	err    error
+}
+
+// KVWatched()
+//   Return the keys under prefix and the error of the last failed
+//   query. The keys are read through the agent at host on the first
+//   call, then watched in the background with blocking queries
+//
+func (c *Consul) KVWatched(host string, prefix string) (map[string]string, error) {
+	address := c.clusterAddress(host)
+
+	w, ok := c.watches[prefix]
+	if !ok {
+		client := c.client(address)
+		if client == nil {
+			return nil, fmt.Errorf("no Consul agent to watch %s", prefix)
+		}
+		pairs, meta, err := client.KV().List(prefix, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		w = &kvWatch{host: address, values: kvValues(pairs)}
+		if c.watches == nil {
+			c.watches = make(map[string]*kvWatch)
+		}
+		c.watches[prefix] = w
+		go c.watchKV(w, prefix, meta.LastIndex)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if address != "" {
+		w.host = address
+	}
+	return w.values, w.err
+}
+
+// watchKV()
+//   Update the keys of w on every change under prefix, with blocking
+//   queries through its current host
+//
+func (c *Consul) watchKV(w *kvWatch, prefix string, index uint64) {
+	var client *consulapi.Client
+	host := ""
+	for {
+		w.Lock()
+		if w.host != host || client == nil {
+			// The watch runs along the refreshes and uses its own client
+			host = w.host
+			client = c.newAgent(host)
+		}
+		w.Unlock()
+
+		var pairs consulapi.KVPairs
+		var meta *consulapi.QueryMeta
+		err := fmt.Errorf("no Consul agent")
+		if client != nil {
+			pairs, meta, err = client.KV().List(prefix, &consulapi.QueryOptions{WaitIndex: index, WaitTime: kvWatchWait})
+		}
+		if err != nil {
+			log.Warnf("Unable to watch %s: %s", prefix, err)
+			w.Lock()
+			w.err = err
+			w.Unlock()
+			time.Sleep(kvWatchRetry)
+			continue
+		}
+
+		// The index goes back when the Consul servers are restored
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+
+		w.Lock()
+		w.values = kvValues(pairs)
+		w.err = nil
+		w.Unlock()
+	}
+}
+
+// kvValues()
+//   Return the values of KV pairs by key
+//
+func kvValues(pairs consulapi.KVPairs) map[string]string {
+	values := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		values[p.Key] = string(p.Value)
+	}
+	return values
+}
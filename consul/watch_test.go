@@ -0,0 +1,58 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestKVWatched(t *testing.T) {
+	c, a := newTestConsul(t, consulConfig{})
+
+	var mu sync.Mutex
+	index := uint64(1)
+	value := "^batch"
+	changed := make(chan struct{})
+	a.handlers["/v1/kv/mesos-consul/filters/"] = func(w http.ResponseWriter, r *http.Request) {
+		// Block until the value changes
+		mu.Lock()
+		current := strconv.FormatUint(index, 10)
+		mu.Unlock()
+		if r.URL.Query().Get("index") == current {
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		json.NewEncoder(w).Encode(consulapi.KVPairs{{Key: "mesos-consul/filters/blacklist", Value: []byte(value)}})
+	}
+
+	values, err := c.KVWatched("127.0.0.1", "mesos-consul/filters/")
+	if err != nil || values["mesos-consul/filters/blacklist"] != "^batch" {
+		t.Fatalf("KVWatched() => %v, %v, want the blacklist", values, err)
+	}
+
+	mu.Lock()
+	index, value = 2, "^tmp"
+	mu.Unlock()
+	close(changed)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		values, _ = c.KVWatched("127.0.0.1", "mesos-consul/filters/")
+		if values["mesos-consul/filters/blacklist"] == "^tmp" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("KVWatched() => %v, want the changed blacklist", values)
+}
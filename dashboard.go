@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+
+	flag "github.com/ogier/pflag"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dashboard formats
+const DashboardGrafanaJSON = "grafana-json"
+
+// dashboard runs the dashboard subcommand and returns the exit status
+func dashboard(args []string) int {
+	var format, title string
+
+	flags := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(Help()) }
+	flags.StringVar(&format, "format", DashboardGrafanaJSON, "")
+	flags.StringVar(&title, "title", "mesos-consul", "")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	switch format {
+	case DashboardGrafanaJSON:
+		body, err := metrics.DefaultRegistry.GrafanaDashboard(title)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		fmt.Println(string(body))
+	default:
+		log.Errorf("Unknown dashboard format '%s'", format)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/redact"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StartDebugService serves the net/http/pprof profiles under /debug/pprof/,
+// but for the command line, and the log level on /v1/loglevel at
+// --debug-address, to the requests presenting the --debug-token
+func StartDebugService(c *config.Config) {
+	if c.DebugToken == "" {
+		log.Fatal("--debug-address requires a --debug-token")
+	}
+	redact.Default.SetValues("debug", []string{c.DebugToken})
+
+	// The command line is left out: it carries the tokens and passwords
+	// given as options, the --debug-token included
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/v1/loglevel", LogLevelHandler)
+
+	log.Fatal(http.ListenAndServe(c.DebugAddress, requireToken(c.DebugToken, mux)))
+}
+
+// requireToken refuses the requests to h without an 'Authorization:
+// Bearer <token>' header
+func requireToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
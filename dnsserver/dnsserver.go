@@ -0,0 +1,178 @@
+// Package dnsserver is a registry answering DNS queries for the
+// registered services from memory, for mesos-dns style resolution
+// without Consul.
+package dnsserver
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/CiscoCloud/mesos-consul/emergencydns"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	flag "github.com/ogier/pflag"
+	log "github.com/sirupsen/logrus"
+)
+
+type dnsConfig struct {
+	domain string
+	ttl    uint
+}
+
+var config dnsConfig
+
+func AddCmdFlags(f *flag.FlagSet) {
+	f.StringVar(&config.domain, "dns-domain", "mesos.", "")
+	f.UintVar(&config.ttl, "dns-ttl", 5, "")
+}
+
+func Help() string {
+	helpText := `
+DNS Options (with --registry=dns://<ip:port>):
+
+  --dns-domain=<domain>		Domain of the DNS server
+				(default: mesos.)
+  --dns-ttl=<seconds>		TTL of the DNS records
+				(default: 5)
+
+`
+
+	return helpText
+}
+
+// DNS is a registry keeping the services in memory, and serving them
+// over DNS as [<tag>.]<service>.service.<domain>, like Consul DNS.
+type DNS struct {
+	sync.RWMutex
+	cache map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	service *registry.Service
+	marked  bool
+}
+
+// New starts the DNS server of a dns://ip:port address, and returns its
+// registry
+func New(uri string) registry.Registry {
+	d := &DNS{}
+	s := d.server(config.domain, config.ttl)
+
+	addr := strings.TrimSuffix(strings.TrimPrefix(uri, "dns://"), "/")
+	go func() {
+		log.Fatal(s.ListenAndServe(addr))
+	}()
+
+	return d
+}
+
+// server returns the DNS server of the services, answering
+// authoritatively for domain
+func (d *DNS) server(domain string, ttl uint) *emergencydns.Server {
+	s := emergencydns.New(domain, d.services)
+	s.TTL = uint32(ttl)
+	s.Notice = ""
+	s.Authoritative = true
+	return s
+}
+
+// services returns the registered services, for the DNS server
+func (d *DNS) services() []*registry.Service {
+	d.RLock()
+	defer d.RUnlock()
+
+	ids := make([]string, 0, len(d.cache))
+	for id := range d.cache {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	services := make([]*registry.Service, len(ids))
+	for i, id := range ids {
+		services[i] = d.cache[id].service
+	}
+	return services
+}
+
+// CacheCreate creates the cache. There is nothing to load, since the
+// services are only registered in memory.
+func (d *DNS) CacheCreate() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.cache == nil {
+		d.cache = make(map[string]*cacheEntry)
+	}
+	return false
+}
+
+func (d *DNS) CacheLoad(host string) error {
+	return nil
+}
+
+func (d *DNS) CacheLookup(id string) *registry.Service {
+	d.RLock()
+	defer d.RUnlock()
+
+	if c, ok := d.cache[id]; ok {
+		return c.service
+	}
+	return nil
+}
+
+// Cached returns the services of the cache
+func (d *DNS) Cached() []*registry.Service {
+	return d.services()
+}
+
+func (d *DNS) CacheDelete(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.cache, id)
+}
+
+func (d *DNS) CacheMark(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if c, ok := d.cache[id]; ok {
+		c.marked = true
+	}
+}
+
+// Register adds a service, or marks it when it is known
+func (d *DNS) Register(s *registry.Service) {
+	d.Lock()
+	defer d.Unlock()
+
+	if c, ok := d.cache[s.ID]; ok {
+		c.marked = true
+		return
+	}
+
+	log.Info("Registering ", s.ID)
+	d.cache[s.ID] = &cacheEntry{service: s, marked: true}
+	metrics.Registrations.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(s.Agent))
+	registry.Applied("register", s, "")
+}
+
+// Deregister removes the services not seen during the refresh
+func (d *DNS) Deregister() {
+	d.Lock()
+	defer d.Unlock()
+
+	for id, c := range d.cache {
+		if c.marked {
+			c.marked = false
+			continue
+		}
+
+		log.Infof("Deregistering %s", id)
+		delete(d.cache, id)
+		metrics.Deregistrations.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent))
+		registry.Applied("deregister", c.service, "")
+	}
+}
@@ -0,0 +1,127 @@
+package dnsserver
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDNS() *DNS {
+	d := &DNS{}
+	d.CacheCreate()
+	return d
+}
+
+// query asks the DNS server of d over UDP
+func query(t *testing.T, d *DNS, name string, qtype uint16) *dns.Msg {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: d.server("mesos.", 7)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	<-started
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	resp, _, err := new(dns.Client).Exchange(req, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func answerIPs(m *dns.Msg) []string {
+	ips := []string{}
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A.String())
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func TestServe(t *testing.T) {
+	d := newTestDNS()
+	d.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 31000, Tags: []string{"blue"}})
+	d.Register(&registry.Service{ID: "mesos-consul:web:2", Name: "web", Address: "10.0.0.2", Port: 31001})
+
+	m := query(t, d, "web.service.mesos.", dns.TypeA)
+	if got := answerIPs(m); len(got) != 2 || got[0] != "10.0.0.1" || got[1] != "10.0.0.2" {
+		t.Errorf("A web.service.mesos. => %v, want both instances", got)
+	}
+	if !m.Authoritative {
+		t.Error("answer is not authoritative")
+	}
+	for _, rr := range append(m.Answer, m.Extra...) {
+		if rr.Header().Rrtype == dns.TypeTXT {
+			t.Errorf("answer carries the emergency notice %v", rr)
+		}
+		if rr.Header().Ttl != 7 {
+			t.Errorf("record %v has a TTL of %d, want 7", rr, rr.Header().Ttl)
+		}
+	}
+
+	if got := answerIPs(query(t, d, "blue.web.service.mesos.", dns.TypeA)); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Errorf("A blue.web.service.mesos. => %v, want 10.0.0.1", got)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	d := newTestDNS()
+	d.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1"})
+	d.Register(&registry.Service{ID: "mesos-consul:web:2", Name: "web", Address: "10.0.0.2"})
+	d.Deregister()
+
+	// web:2 is gone from the next refresh
+	d.CacheMark("mesos-consul:web:1")
+	d.Deregister()
+
+	if d.CacheLookup("mesos-consul:web:1") == nil {
+		t.Error("deregistered a service seen during the refresh")
+	}
+	if d.CacheLookup("mesos-consul:web:2") != nil {
+		t.Error("kept a service missing from the refresh")
+	}
+
+	d.Deregister()
+	if len(d.services()) != 0 {
+		t.Errorf("services() => %v, want none", d.services())
+	}
+}
+
+func TestServices(t *testing.T) {
+	d := newTestDNS()
+	for _, id := range []string{"mesos-consul:c", "mesos-consul:a", "mesos-consul:b"} {
+		d.Register(&registry.Service{ID: id, Name: "web"})
+	}
+	d.Register(&registry.Service{ID: "mesos-consul:a", Name: "changed"})
+
+	services := d.services()
+	if len(services) != 3 {
+		t.Fatalf("services() => %d services, want 3", len(services))
+	}
+	for i, id := range []string{"mesos-consul:a", "mesos-consul:b", "mesos-consul:c"} {
+		if services[i].ID != id {
+			t.Errorf("services()[%d] => %s, want %s", i, services[i].ID, id)
+		}
+	}
+	if services[0].Name != "web" {
+		t.Errorf("registering a known service replaced it with %s", services[0].Name)
+	}
+
+	if d.CacheCreate() {
+		t.Error("CacheCreate() => true, want nothing to load")
+	}
+	if len(d.services()) != 3 {
+		t.Error("CacheCreate() dropped the services")
+	}
+}
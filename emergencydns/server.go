@@ -0,0 +1,217 @@
+// Package emergencydns answers DNS queries for the services registered by
+// mesos-consul straight from memory, so service lookups keep working
+// during a Consul outage. It is read-only and only meant as an emergency
+// fallback for Consul DNS.
+package emergencydns
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Notice is returned as a TXT record along with every answer
+const Notice = "mesos-consul emergency DNS: answers are served from memory and may be stale"
+
+// Server answers A, AAAA and SRV queries for
+//
+//	[<tag>.]<service>.service.<domain>
+//	<hex address>.addr.<domain>
+//
+// like Consul DNS, from the services returned by Services.
+type Server struct {
+	Domain   string
+	TTL      uint32
+	Services func() []*registry.Service
+
+	// TXT record returned along with every answer, if set, and whether
+	// answers are authoritative
+	Notice        string
+	Authoritative bool
+}
+
+// New returns a Server for the given domain
+func New(domain string, services func() []*registry.Service) *Server {
+	return &Server{
+		Domain:   dns.Fqdn(strings.ToLower(domain)),
+		TTL:      0,
+		Services: services,
+		Notice:   Notice,
+	}
+}
+
+// ListenAndServe serves DNS on addr over UDP and TCP. It returns when
+// either listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	if s.Notice != "" {
+		log.Warnf("Emergency DNS responder listening on %s for %s", addr, s.Domain)
+	} else {
+		log.Infof("DNS server listening on %s for %s", addr, s.Domain)
+	}
+
+	errc := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: network, Handler: s}
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	return <-errc
+}
+
+// ServeDNS implements dns.Handler
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if err := w.WriteMsg(s.answer(req)); err != nil {
+		log.Warn("Emergency DNS: unable to write answer: ", err)
+	}
+}
+
+// answer builds the reply to a query
+func (s *Server) answer(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = s.Authoritative
+
+	for _, q := range req.Question {
+		name := strings.ToLower(q.Name)
+		if !dns.IsSubDomain(s.Domain, name) {
+			m.Rcode = dns.RcodeRefused
+			return m
+		}
+
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, s.Domain))
+		switch {
+		case len(labels) == 2 && labels[1] == "addr":
+			if ip := hexIP(labels[0]); ip != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) {
+				m.Answer = append(m.Answer, s.addressRR(q.Name, ip)...)
+			}
+		case len(labels) >= 2 && len(labels) <= 3 && labels[len(labels)-1] == "service":
+			tag := ""
+			if len(labels) == 3 {
+				tag = labels[0]
+			}
+			services := s.lookup(labels[len(labels)-2], tag)
+			if len(services) == 0 {
+				m.Rcode = dns.RcodeNameError
+				continue
+			}
+			s.serviceRRs(m, q, services)
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+
+	if s.Notice != "" {
+		m.Extra = append(m.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: s.Domain, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: s.TTL},
+			Txt: []string{s.Notice},
+		})
+	}
+
+	return m
+}
+
+// lookup returns the services with the given name carrying tag
+func (s *Server) lookup(name string, tag string) []*registry.Service {
+	services := []*registry.Service{}
+	for _, svc := range s.Services() {
+		if strings.ToLower(svc.Name) != name {
+			continue
+		}
+		if tag != "" && !hasTag(svc, tag) {
+			continue
+		}
+		services = append(services, svc)
+	}
+	return services
+}
+
+// serviceRRs adds the records answering q for services to m
+func (s *Server) serviceRRs(m *dns.Msg, q dns.Question, services []*registry.Service) {
+	seen := make(map[string]bool)
+
+	for _, svc := range services {
+		addr := serviceAddress(svc)
+		ip := net.ParseIP(addr)
+
+		switch q.Qtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+			if ip != nil && !seen[ip.String()] {
+				seen[ip.String()] = true
+				for _, rr := range s.addressRR(q.Name, ip) {
+					if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+						m.Answer = append(m.Answer, rr)
+					}
+				}
+			}
+		case dns.TypeSRV:
+			target := dns.Fqdn(addr)
+			if ip != nil {
+				target = ipHex(ip) + ".addr." + s.Domain
+				if !seen[target] {
+					seen[target] = true
+					m.Extra = append(m.Extra, s.addressRR(target, ip)...)
+				}
+			}
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: s.TTL},
+				Priority: 1,
+				Weight:   1,
+				Port:     uint16(svc.Port),
+				Target:   target,
+			})
+		}
+	}
+}
+
+// addressRR returns the A or AAAA record of ip
+func (s *Server) addressRR(name string, ip net.IP) []dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.TTL},
+			A:   ip4,
+		}}
+	}
+	return []dns.RR{&dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.TTL},
+		AAAA: ip,
+	}}
+}
+
+// serviceAddress returns the address of a service, which Consul
+// defaults to the address of its agent
+func serviceAddress(svc *registry.Service) string {
+	if svc.Address != "" {
+		return svc.Address
+	}
+	return svc.Agent
+}
+
+func hasTag(svc *registry.Service, tag string) bool {
+	for _, t := range svc.Tags {
+		if strings.ToLower(t) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ipHex encodes an IP address the way Consul DNS does in addr names
+func ipHex(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return hex.EncodeToString(ip4)
+	}
+	return hex.EncodeToString(ip.To16())
+}
+
+// hexIP decodes an IP address encoded by ipHex
+func hexIP(s string) net.IP {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil
+	}
+	return net.IP(b)
+}
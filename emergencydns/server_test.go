@@ -0,0 +1,121 @@
+package emergencydns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	"github.com/miekg/dns"
+)
+
+func testServer() *Server {
+	return New("consul", func() []*registry.Service {
+		return []*registry.Service{
+			{Name: "web", Address: "10.0.0.1", Port: 31000, Tags: []string{"blue"}},
+			{Name: "web", Address: "10.0.0.2", Port: 31001},
+			{Name: "web", Address: "10.0.0.2", Port: 31002},
+			{Name: "mesos", Address: "", Agent: "10.0.0.10", Port: 5050, Tags: []string{"leader", "master"}},
+			{Name: "db", Address: "2001:db8::1", Port: 5432},
+		}
+	})
+}
+
+func query(s *Server, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return s.answer(req)
+}
+
+func TestAnswerA(t *testing.T) {
+	s := testServer()
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"web.service.consul.", []string{"10.0.0.1", "10.0.0.2"}},
+		{"blue.web.service.consul.", []string{"10.0.0.1"}},
+		{"WEB.service.consul.", []string{"10.0.0.1", "10.0.0.2"}},
+		{"leader.mesos.service.consul.", []string{"10.0.0.10"}},
+		{"0a000002.addr.consul.", []string{"10.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		m := query(s, tt.name, dns.TypeA)
+		var got []string
+		for _, rr := range m.Answer {
+			got = append(got, rr.(*dns.A).A.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("A %s => %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("A %s => %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestAnswerAAAA(t *testing.T) {
+	m := query(testServer(), "db.service.consul.", dns.TypeAAAA)
+	if len(m.Answer) != 1 || !m.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("AAAA db.service.consul. => %v", m.Answer)
+	}
+	if m := query(testServer(), "db.service.consul.", dns.TypeA); len(m.Answer) != 0 {
+		t.Errorf("A db.service.consul. => %v, want no answer", m.Answer)
+	}
+}
+
+func TestAnswerSRV(t *testing.T) {
+	m := query(testServer(), "web.service.consul.", dns.TypeSRV)
+	if len(m.Answer) != 3 {
+		t.Fatalf("SRV web.service.consul. => %v, want 3 answers", m.Answer)
+	}
+
+	srv := m.Answer[1].(*dns.SRV)
+	if srv.Port != 31001 || srv.Target != "0a000002.addr.consul." {
+		t.Errorf("SRV answer => %v", srv)
+	}
+
+	// One A record per target, plus the notice
+	if len(m.Extra) != 3 {
+		t.Errorf("SRV extra => %v, want 2 A records and the notice", m.Extra)
+	}
+}
+
+func TestAnswerErrors(t *testing.T) {
+	s := testServer()
+
+	if m := query(s, "missing.service.consul.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+		t.Errorf("missing service rcode => %d, want NXDOMAIN", m.Rcode)
+	}
+	if m := query(s, "example.com.", dns.TypeA); m.Rcode != dns.RcodeRefused {
+		t.Errorf("foreign domain rcode => %d, want REFUSED", m.Rcode)
+	}
+
+	m := query(s, "web.service.consul.", dns.TypeA)
+	txt, ok := m.Extra[len(m.Extra)-1].(*dns.TXT)
+	if !ok || txt.Txt[0] != Notice {
+		t.Errorf("answer does not carry the emergency notice: %v", m.Extra)
+	}
+	if m.Authoritative {
+		t.Error("answer is authoritative")
+	}
+}
+
+func TestAnswerWithoutNotice(t *testing.T) {
+	s := testServer()
+	s.Notice = ""
+	s.Authoritative = true
+
+	m := query(s, "web.service.consul.", dns.TypeA)
+	if len(m.Extra) != 0 {
+		t.Errorf("answer carries extra records: %v", m.Extra)
+	}
+	if !m.Authoritative {
+		t.Error("answer is not authoritative")
+	}
+}
@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	flag "github.com/ogier/pflag"
+)
+
+type etcdConfig struct {
+	prefix    string
+	auth      string
+	sslCert   string
+	sslKey    string
+	sslCaCert string
+}
+
+var config etcdConfig
+
+func AddCmdFlags(f *flag.FlagSet) {
+	f.StringVar(&config.prefix, "etcd-prefix", "/mesos-consul/services", "")
+	f.StringVar(&config.auth, "etcd-auth", "", "")
+	f.StringVar(&config.sslCert, "etcd-ssl-cert", "", "")
+	f.StringVar(&config.sslKey, "etcd-ssl-key", "", "")
+	f.StringVar(&config.sslCaCert, "etcd-ssl-cacert", "", "")
+}
+
+func Help() string {
+	helpText := `
+etcd Options (with --registry=etcd://<host:port>,...):
+
+  --etcd-prefix=<path>		Key prefix of the registered services
+				(default: /mesos-consul/services)
+  --etcd-auth=<user:password>	The etcd username and password
+				(default: not set)
+  --etcd-ssl-cert		Path to an SSL client certificate to authenticate to
+				etcd with
+				(default: not set)
+  --etcd-ssl-key		Path to the private key of the SSL client certificate
+				(default: not set)
+  --etcd-ssl-cacert		Path to a CA certificate file to validate the certificate
+				of the etcd servers with
+				(default: not set)
+
+`
+
+	return helpText
+}
+
+// credentials returns the username and password of --etcd-auth
+func (c etcdConfig) credentials() (string, string) {
+	if c.auth == "" {
+		return "", ""
+	}
+
+	split := strings.SplitN(c.auth, ":", 2)
+	if len(split) == 1 {
+		return split[0], ""
+	}
+	return split[0], split[1]
+}
+
+// tlsConfig returns the TLS configuration of the client, or nil when no
+// TLS option is set
+func (c etcdConfig) tlsConfig() (*tls.Config, error) {
+	if c.sslCert == "" && c.sslCaCert == "" {
+		return nil, nil
+	}
+
+	t := &tls.Config{}
+	if c.sslCert != "" {
+		if c.sslKey == "" {
+			return nil, fmt.Errorf("--etcd-ssl-key is required with --etcd-ssl-cert")
+		}
+		cert, err := tls.LoadX509KeyPair(c.sslCert, c.sslKey)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.sslCaCert != "" {
+		b, err := ioutil.ReadFile(c.sslCaCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", c.sslCaCert)
+		}
+		t.RootCAs = pool
+	}
+
+	return t, nil
+}
+
+// endpoints returns the host:port of the servers of an
+// etcd://host:port,host:port address
+func endpoints(uri string) []string {
+	hosts := strings.TrimPrefix(uri, "etcd://")
+	if i := strings.Index(hosts, "/"); i >= 0 {
+		hosts = hosts[:i]
+	}
+
+	eps := []string{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			eps = append(eps, h)
+		}
+	}
+
+	return eps
+}
@@ -0,0 +1,381 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Timeout of the requests to etcd
+const requestTimeout = 5 * time.Second
+
+// Number of refresh periods the keys outlive mesos-consul by
+const leaseRefreshes = 3
+
+// Number of keys written per transaction when the services are
+// registered again, below the 128 operations etcd accepts by default
+const txnPuts = 64
+
+// client is the part of the etcd client used by the registry
+type client interface {
+	clientv3.KV
+	clientv3.Lease
+}
+
+// Etcd registers services as keys of an etcd v3 cluster, holding the
+// JSON encoded service. The keys are attached to a lease kept alive on
+// every refresh, so they expire once mesos-consul stops.
+type Etcd struct {
+	client client
+	prefix string
+	ttl    int64
+	lease  clientv3.LeaseID
+	cache  map[string]*cacheEntry
+
+	// Refreshes a service may be missing from before it is deregistered
+	heartbeats int
+}
+
+// record is the value of the key of a service
+type record struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Agent   string            `json:"agent,omitempty"`
+}
+
+type cacheEntry struct {
+	record *record
+
+	// Service as registered by this instance, nil for the services
+	// loaded from etcd
+	service *registry.Service
+
+	lease           clientv3.LeaseID
+	validityCounter int
+}
+
+// New returns the etcd registry of an etcd://host:port,... address,
+// whose keys expire after a few refresh periods, and whose services are
+// deregistered once missing from heartbeats refreshes.
+func New(uri string, refresh time.Duration, heartbeats int) registry.Registry {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.Fatal("Invalid etcd TLS options: ", err)
+	}
+
+	scheme := "http://"
+	if tlsConfig != nil {
+		scheme = "https://"
+	}
+	eps := endpoints(uri)
+	for i, ep := range eps {
+		eps[i] = scheme + ep
+	}
+
+	username, password := config.credentials()
+	redact.Default.SetValues("etcd", []string{password})
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   eps,
+		DialTimeout: requestTimeout,
+		TLS:         tlsConfig,
+		Username:    username,
+		Password:    password,
+	})
+	if err != nil {
+		log.Fatal("Unable to create the etcd client: ", err)
+	}
+
+	ttl := int64((leaseRefreshes * refresh).Seconds())
+	if ttl < 10 {
+		ttl = 10
+	}
+
+	return &Etcd{
+		client: client,
+		prefix: strings.TrimSuffix(config.prefix, "/"),
+		ttl:    ttl,
+
+		heartbeats: heartbeats,
+	}
+}
+
+// key returns the key of a service, grouping the instances of a
+// service under a common prefix
+func (e *Etcd) key(r *record) string {
+	return path.Join(e.prefix, r.Name, r.ID)
+}
+
+// CacheCreate creates the cache, and tells whether it needs to be
+// loaded
+func (e *Etcd) CacheCreate() bool {
+	if e.cache == nil {
+		e.cache = make(map[string]*cacheEntry)
+		return true
+	}
+
+	return false
+}
+
+// CacheLoad loads the services registered under the prefix. The host
+// of the Mesos leader is not used.
+func (e *Etcd) CacheLoad(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, e.prefix+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range resp.Kvs {
+		r := &record{}
+		if err := json.Unmarshal(kv.Value, r); err != nil {
+			log.Warnf("Ignoring key %s: %s", kv.Key, err)
+			continue
+		}
+		if !registry.Owned(r.ID, r.Meta) {
+			continue
+		}
+
+		log.Debugf("Found '%s' with ID '%s'", r.Name, r.ID)
+		e.cache[r.ID] = &cacheEntry{
+			record: r,
+			lease:  clientv3.LeaseID(kv.Lease),
+		}
+	}
+
+	return nil
+}
+
+// CacheLookup returns the cached service of the given ID, or nil
+func (e *Etcd) CacheLookup(id string) *registry.Service {
+	c, ok := e.cache[id]
+	if !ok {
+		return nil
+	}
+	if c.service != nil {
+		return c.service
+	}
+
+	return &registry.Service{
+		ID:      c.record.ID,
+		Name:    c.record.Name,
+		Port:    c.record.Port,
+		Address: c.record.Address,
+		Tags:    c.record.Tags,
+		Meta:    c.record.Meta,
+		Agent:   c.record.Agent,
+	}
+}
+
+// Cached returns the services of the cache
+func (e *Etcd) Cached() []*registry.Service {
+	services := make([]*registry.Service, 0, len(e.cache))
+	for id := range e.cache {
+		services = append(services, e.CacheLookup(id))
+	}
+	return services
+}
+
+// CacheDelete removes a service from the cache
+func (e *Etcd) CacheDelete(id string) {
+	delete(e.cache, id)
+}
+
+// CacheMark marks a service as seen during the refresh
+func (e *Etcd) CacheMark(id string) {
+	if c, ok := e.cache[id]; ok {
+		c.validityCounter = 0
+	}
+}
+
+// Register writes the key of a service, unless it is cached. Keys
+// loaded from etcd under the lease of a previous run are written again
+// under the current lease.
+func (e *Etcd) Register(service *registry.Service) {
+	if c, ok := e.cache[service.ID]; ok && c.lease == e.lease {
+		log.Debugf("Service found. Not registering: %s", service.ID)
+		e.CacheMark(service.ID)
+		return
+	}
+
+	log.Info("Registering ", service.ID)
+
+	r := &record{
+		ID:      service.ID,
+		Name:    service.Name,
+		Address: service.Address,
+		Port:    service.Port,
+		Tags:    service.Tags,
+		Meta:    service.Meta,
+		Agent:   service.Agent,
+	}
+
+	if err := e.put(r); err != nil {
+		log.Warnf("Unable to register %s: %s", r.ID, err)
+		metrics.RegistryErrors.Inc(registry.FrameworkLabel(r.Meta), metrics.HashLabel(r.Agent), "register")
+		registry.Failed("register", r.ID, err)
+		return
+	}
+	metrics.Registrations.Inc(registry.FrameworkLabel(r.Meta), metrics.HashLabel(r.Agent))
+	registry.Applied("register", service, "")
+
+	e.cache[r.ID] = &cacheEntry{record: r, service: service, lease: e.lease}
+}
+
+// Deregister keeps the lease alive, and deletes the keys of the
+// services not seen during the refresh.
+func (e *Etcd) Deregister() {
+	e.keepAlive()
+
+	for id, c := range e.cache {
+		if c.validityCounter < e.heartbeats {
+			c.validityCounter++
+			continue
+		}
+
+		log.Infof("Deregistering %s", id)
+		if err := e.delete(c.record); err != nil {
+			log.Info("Deregistration error ", err)
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(c.record.Meta), metrics.HashLabel(c.record.Agent), "deregister")
+			registry.Failed("deregister", id, err)
+			continue
+		}
+		metrics.Deregistrations.Inc(registry.FrameworkLabel(c.record.Meta), metrics.HashLabel(c.record.Agent))
+		registry.Applied("deregister", e.CacheLookup(id), "")
+		delete(e.cache, id)
+	}
+}
+
+// put writes the key of a service under the lease, granting it first
+// if needed
+func (e *Etcd) put(r *record) error {
+	if err := e.grant(); err != nil {
+		return err
+	}
+
+	op, err := e.putOp(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err = e.client.Do(ctx, op)
+	return err
+}
+
+// putOp returns the operation writing the key of a service under the
+// lease
+func (e *Etcd) putOp(r *record) (clientv3.Op, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+
+	return clientv3.OpPut(e.key(r), string(b), clientv3.WithLease(e.lease)), nil
+}
+
+func (e *Etcd) delete(r *record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := e.client.Delete(ctx, e.key(r))
+	return err
+}
+
+// grant grants the lease of the keys, when none is held
+func (e *Etcd) grant() error {
+	if e.lease != clientv3.NoLease {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := e.client.Grant(ctx, e.ttl)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Granted etcd lease %x with a TTL of %ds", resp.ID, e.ttl)
+	e.lease = resp.ID
+	return nil
+}
+
+// keepAlive renews the lease. A lease which expired, e.g. while etcd
+// was unreachable, took the keys along, so a new one is granted and the
+// cached services are written again.
+func (e *Etcd) keepAlive() {
+	if e.lease == clientv3.NoLease {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	_, err := e.client.KeepAliveOnce(ctx, e.lease)
+	cancel()
+	if err == nil {
+		return
+	}
+
+	log.Warnf("Unable to renew etcd lease %x, registering services again: %s", e.lease, err)
+	e.lease = clientv3.NoLease
+	if err := e.grant(); err != nil {
+		// Without a lease, the services are registered again as they
+		// are seen by the next refreshes
+		log.Warnf("Unable to grant an etcd lease: %s", err)
+		return
+	}
+
+	entries := []*cacheEntry{}
+	ops := []clientv3.Op{}
+	for id, c := range e.cache {
+		op, err := e.putOp(c.record)
+		if err != nil {
+			log.Warnf("Unable to register %s: %s", id, err)
+			continue
+		}
+		entries = append(entries, c)
+		ops = append(ops, op)
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > txnPuts {
+			n = txnPuts
+		}
+
+		if err := e.txn(ops[:n]); err != nil {
+			log.Warnf("Unable to register %d services again: %s", n, err)
+		} else {
+			for _, c := range entries[:n] {
+				c.lease = e.lease
+			}
+		}
+		entries, ops = entries[n:], ops[n:]
+	}
+}
+
+// txn executes operations in a single transaction
+func (e *Etcd) txn(ops []clientv3.Op) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := e.client.Txn(ctx).Then(ops...).Commit()
+	return err
+}
@@ -0,0 +1,163 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// testClient is an etcd client whose lease can be made to expire
+type testClient struct {
+	clientv3.KV
+	clientv3.Lease
+
+	expired  bool
+	grantErr error
+
+	grants  int
+	txns    []int
+	deleted []string
+}
+
+func (c *testClient) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	if c.grantErr != nil {
+		return nil, c.grantErr
+	}
+	c.grants++
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(100 + c.grants)}, nil
+}
+
+func (c *testClient) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	if c.expired {
+		return nil, errors.New("requested lease not found")
+	}
+	return &clientv3.LeaseKeepAliveResponse{ID: id}, nil
+}
+
+func (c *testClient) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	return clientv3.OpResponse{}, nil
+}
+
+func (c *testClient) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	c.deleted = append(c.deleted, key)
+	return &clientv3.DeleteResponse{}, nil
+}
+
+func (c *testClient) Txn(ctx context.Context) clientv3.Txn {
+	return &testTxn{client: c}
+}
+
+type testTxn struct {
+	clientv3.Txn
+
+	client *testClient
+	ops    []clientv3.Op
+}
+
+func (t *testTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.ops = append(t.ops, ops...)
+	return t
+}
+
+func (t *testTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.client.txns = append(t.client.txns, len(t.ops))
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func newTestEtcd(c *testClient, heartbeats int) *Etcd {
+	e := &Etcd{client: c, prefix: "/services", ttl: 10, heartbeats: heartbeats}
+	e.CacheCreate()
+	return e
+}
+
+func TestKeepAliveRegistersAgain(t *testing.T) {
+	c := &testClient{}
+	e := newTestEtcd(c, 1)
+
+	for i := 0; i < 150; i++ {
+		e.Register(&registry.Service{ID: fmt.Sprintf("mesos-consul:web:%d", i), Name: "web"})
+	}
+	if c.grants != 1 {
+		t.Fatalf("granted %d leases for the registrations, want 1", c.grants)
+	}
+
+	c.expired = true
+	e.keepAlive()
+
+	if c.grants != 2 {
+		t.Errorf("granted %d leases, want a single new one", c.grants-1)
+	}
+	if fmt.Sprint(c.txns) != "[64 64 22]" {
+		t.Errorf("registered the services again in transactions of %v keys, want [64 64 22]", c.txns)
+	}
+	for id, entry := range e.cache {
+		if entry.lease != e.lease {
+			t.Errorf("%s is under lease %x, want the new lease %x", id, entry.lease, e.lease)
+		}
+	}
+}
+
+func TestKeepAliveGrantFails(t *testing.T) {
+	c := &testClient{}
+	e := newTestEtcd(c, 1)
+	e.Register(&registry.Service{ID: "mesos-consul:web", Name: "web"})
+
+	c.expired = true
+	c.grantErr = errors.New("etcdserver: request timed out")
+	e.keepAlive()
+
+	if len(c.txns) != 0 {
+		t.Errorf("wrote %v keys without a lease", c.txns)
+	}
+	if e.lease != clientv3.NoLease {
+		t.Errorf("kept the expired lease %x", e.lease)
+	}
+
+	// The service is written again under a new lease once seen
+	c.grantErr = nil
+	e.Register(&registry.Service{ID: "mesos-consul:web", Name: "web"})
+	if e.cache["mesos-consul:web"].lease != e.lease || e.lease == clientv3.NoLease {
+		t.Error("did not register the service again under a new lease")
+	}
+}
+
+func TestDeregisterHeartbeats(t *testing.T) {
+	for _, heartbeats := range []int{1, 3} {
+		c := &testClient{}
+		e := newTestEtcd(c, heartbeats)
+		e.Register(&registry.Service{ID: "mesos-consul:web", Name: "web"})
+
+		refreshes := 0
+		for len(c.deleted) == 0 && refreshes < 10 {
+			e.Deregister()
+			refreshes++
+		}
+
+		if refreshes != heartbeats+1 {
+			t.Errorf("heartbeats %d: deregistered after %d refreshes without the service, want %d", heartbeats, refreshes, heartbeats+1)
+		}
+		if _, ok := e.cache["mesos-consul:web"]; ok {
+			t.Errorf("heartbeats %d: kept the deregistered service cached", heartbeats)
+		}
+	}
+}
+
+func TestDeregisterKeepsSeenServices(t *testing.T) {
+	c := &testClient{}
+	e := newTestEtcd(c, 1)
+	e.Register(&registry.Service{ID: "mesos-consul:web", Name: "web"})
+
+	for i := 0; i < 3; i++ {
+		e.Deregister()
+		e.CacheMark("mesos-consul:web")
+	}
+
+	if len(c.deleted) != 0 {
+		t.Errorf("deregistered %v while it was seen", c.deleted)
+	}
+}
@@ -0,0 +1,75 @@
+package eureka
+
+import (
+	"strings"
+
+	flag "github.com/ogier/pflag"
+)
+
+type eurekaConfig struct {
+	sslEnabled bool
+	auth       string
+	dataCenter string
+}
+
+var config eurekaConfig
+
+func AddCmdFlags(f *flag.FlagSet) {
+	f.BoolVar(&config.sslEnabled, "eureka-ssl", false, "")
+	f.StringVar(&config.auth, "eureka-auth", "", "")
+	f.StringVar(&config.dataCenter, "eureka-datacenter", "MyOwn", "")
+}
+
+func Help() string {
+	helpText := `
+Eureka Options (with --registry=eureka://<host:port>,.../<path>):
+
+  --eureka-ssl			Use HTTPS when talking to Eureka
+				(default: false)
+  --eureka-auth=<user:password>	The basic authentication username and password
+				(default: not set)
+  --eureka-datacenter=<name>	Data center info name of the registered instances,
+				e.g. MyOwn
+				(default: MyOwn)
+
+`
+
+	return helpText
+}
+
+// credentials returns the username and password of --eureka-auth
+func (c eurekaConfig) credentials() (string, string) {
+	split := strings.SplitN(c.auth, ":", 2)
+	if len(split) == 1 {
+		return split[0], ""
+	}
+	return split[0], split[1]
+}
+
+// serverURLs returns the base URLs of the servers of an
+// eureka://host:port,host:port/path address. The path defaults to
+// /eureka, that of Spring Cloud servers.
+func serverURLs(uri string, ssl bool) []string {
+	hosts := strings.TrimPrefix(uri, "eureka://")
+	base := "/eureka"
+	if i := strings.Index(hosts, "/"); i >= 0 {
+		if p := strings.TrimSuffix(hosts[i:], "/"); p != "" {
+			base = p
+		}
+		hosts = hosts[:i]
+	}
+
+	scheme := "http://"
+	if ssl {
+		scheme = "https://"
+	}
+
+	urls := []string{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			urls = append(urls, scheme+h+base)
+		}
+	}
+
+	return urls
+}
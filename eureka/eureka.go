@@ -0,0 +1,372 @@
+package eureka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeout of the requests to Eureka
+const requestTimeout = 5 * time.Second
+
+// Number of refresh periods the instances outlive mesos-consul by
+const leaseRefreshes = 3
+
+// Metadata keys of the instance fields Eureka has no place for
+const (
+	metaTags  = "mesos-consul.tags"
+	metaAgent = "mesos-consul.agent"
+)
+
+// Eureka registers services as instances of the Eureka application of
+// their name. Instances are renewed on every refresh, and expire once
+// mesos-consul stops.
+type Eureka struct {
+	client   *http.Client
+	urls     []string
+	duration int
+	cache    map[string]*cacheEntry
+
+	// Refreshes a service may be missing from before it is deregistered
+	heartbeats int
+}
+
+type cacheEntry struct {
+	service         *registry.Service
+	validityCounter int
+}
+
+// instance is the Eureka InstanceInfo of a service
+type instance struct {
+	InstanceID     string            `json:"instanceId"`
+	HostName       string            `json:"hostName"`
+	App            string            `json:"app"`
+	IPAddr         string            `json:"ipAddr"`
+	VipAddress     string            `json:"vipAddress"`
+	Status         string            `json:"status"`
+	Port           port              `json:"port"`
+	SecurePort     port              `json:"securePort"`
+	DataCenterInfo dataCenterInfo    `json:"dataCenterInfo"`
+	LeaseInfo      *leaseInfo        `json:"leaseInfo,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+type port struct {
+	Number  int    `json:"$"`
+	Enabled string `json:"@enabled"`
+}
+
+// UnmarshalJSON accepts the numbers Eureka returns as strings as well
+func (p *port) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Number  json.Number `json:"$"`
+		Enabled interface{} `json:"@enabled"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	n, err := v.Number.Int64()
+	if err != nil {
+		return err
+	}
+	p.Number = int(n)
+	p.Enabled = fmt.Sprint(v.Enabled)
+	return nil
+}
+
+type dataCenterInfo struct {
+	Class string `json:"@class"`
+	Name  string `json:"name"`
+}
+
+type leaseInfo struct {
+	DurationInSecs int `json:"durationInSecs"`
+}
+
+// New returns the Eureka registry of an eureka://host:port,.../path
+// address, whose instances expire after a few refresh periods, and are
+// deregistered once missing from heartbeats refreshes.
+func New(uri string, refresh time.Duration, heartbeats int) registry.Registry {
+	_, password := config.credentials()
+	redact.Default.SetValues("eureka", []string{password})
+
+	duration := int((leaseRefreshes * refresh).Seconds())
+	if duration < 30 {
+		duration = 30
+	}
+
+	return &Eureka{
+		client:   &http.Client{Timeout: requestTimeout},
+		urls:     serverURLs(uri, config.sslEnabled),
+		duration: duration,
+
+		heartbeats: heartbeats,
+	}
+}
+
+// CacheCreate creates the cache, and tells whether it needs to be
+// loaded
+func (e *Eureka) CacheCreate() bool {
+	if e.cache == nil {
+		e.cache = make(map[string]*cacheEntry)
+		return true
+	}
+
+	return false
+}
+
+// CacheLoad loads the instances registered by mesos-consul. The host of
+// the Mesos leader is not used.
+func (e *Eureka) CacheLoad(host string) error {
+	var apps struct {
+		Applications struct {
+			Application []struct {
+				Instance []instance `json:"instance"`
+			} `json:"application"`
+		} `json:"applications"`
+	}
+
+	if _, err := e.do("GET", "/apps", nil, &apps); err != nil {
+		return err
+	}
+
+	for _, app := range apps.Applications.Application {
+		for _, i := range app.Instance {
+			if !registry.Owned(i.InstanceID, i.Metadata) {
+				continue
+			}
+
+			log.Debugf("Found '%s' with ID '%s'", i.VipAddress, i.InstanceID)
+			e.cache[i.InstanceID] = &cacheEntry{service: toService(&i)}
+		}
+	}
+
+	return nil
+}
+
+// CacheLookup returns the cached service of the given ID, or nil
+func (e *Eureka) CacheLookup(id string) *registry.Service {
+	if c, ok := e.cache[id]; ok {
+		return c.service
+	}
+	return nil
+}
+
+// Cached returns the services of the cache
+func (e *Eureka) Cached() []*registry.Service {
+	services := make([]*registry.Service, 0, len(e.cache))
+	for id := range e.cache {
+		services = append(services, e.CacheLookup(id))
+	}
+	return services
+}
+
+// CacheDelete removes a service from the cache
+func (e *Eureka) CacheDelete(id string) {
+	delete(e.cache, id)
+}
+
+// CacheMark marks a service as seen during the refresh
+func (e *Eureka) CacheMark(id string) {
+	if c, ok := e.cache[id]; ok {
+		c.validityCounter = 0
+	}
+}
+
+// Register renews the instance of a cached service, and registers the
+// others, or those Eureka no longer knows.
+func (e *Eureka) Register(service *registry.Service) {
+	if _, ok := e.cache[service.ID]; ok {
+		status, err := e.do("PUT", instancePath(service), nil, nil)
+		if err == nil {
+			log.Debugf("Service found. Renewed: %s", service.ID)
+			e.CacheMark(service.ID)
+			return
+		}
+		if status != http.StatusNotFound {
+			log.Warnf("Unable to renew %s: %s", service.ID, err)
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(service.Meta), metrics.HashLabel(service.Agent), "register")
+			registry.Failed("register", service.ID, err)
+			e.CacheMark(service.ID)
+			return
+		}
+		log.Infof("Instance %s unknown to Eureka, registering again", service.ID)
+	}
+
+	log.Info("Registering ", service.ID)
+
+	body := map[string]*instance{"instance": e.toInstance(service)}
+	if _, err := e.do("POST", "/apps/"+url.PathEscape(appName(service.Name)), body, nil); err != nil {
+		log.Warnf("Unable to register %s: %s", service.ID, err)
+		metrics.RegistryErrors.Inc(registry.FrameworkLabel(service.Meta), metrics.HashLabel(service.Agent), "register")
+		registry.Failed("register", service.ID, err)
+		return
+	}
+	metrics.Registrations.Inc(registry.FrameworkLabel(service.Meta), metrics.HashLabel(service.Agent))
+	registry.Applied("register", service, "")
+
+	e.cache[service.ID] = &cacheEntry{service: service}
+}
+
+// Deregister cancels the instances of the services not seen during the
+// refresh.
+func (e *Eureka) Deregister() {
+	for id, c := range e.cache {
+		if c.validityCounter < e.heartbeats {
+			c.validityCounter++
+			continue
+		}
+
+		log.Infof("Deregistering %s", id)
+		status, err := e.do("DELETE", instancePath(c.service), nil, nil)
+		if err != nil && status != http.StatusNotFound {
+			log.Info("Deregistration error ", err)
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent), "deregister")
+			registry.Failed("deregister", id, err)
+			continue
+		}
+		metrics.Deregistrations.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent))
+		registry.Applied("deregister", c.service, "")
+		delete(e.cache, id)
+	}
+}
+
+// do sends a request to the first server answering, and decodes the
+// JSON response into out. It returns the status of the response, and an
+// error for statuses other than 2xx.
+func (e *Eureka) do(method string, path string, in interface{}, out interface{}) (int, error) {
+	var b []byte
+	if in != nil {
+		var err error
+		if b, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+
+	var lastErr error
+	for _, base := range e.urls {
+		var body io.Reader
+		if b != nil {
+			body = bytes.NewReader(b)
+		}
+
+		req, err := http.NewRequest(method, base+path, body)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if b != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if config.auth != "" {
+			req.SetBasicAuth(config.credentials())
+		}
+
+		resp, err := e.client.Do(req)
+		if err != nil {
+			log.Debugf("Eureka server %s unreachable: %s", base, err)
+			lastErr = err
+			continue
+		}
+
+		status, err := decode(resp, out)
+		return status, err
+	}
+
+	return 0, lastErr
+}
+
+func decode(resp *http.Response, out interface{}) (int, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// appName returns the Eureka application of a service, which Eureka
+// uppercases
+func appName(name string) string {
+	return strings.ToUpper(name)
+}
+
+func instancePath(s *registry.Service) string {
+	return "/apps/" + url.PathEscape(appName(s.Name)) + "/" + url.PathEscape(s.ID)
+}
+
+// toInstance returns the instance of a service. Its name is the VIP
+// address, as in Spring Cloud, and its tags and agent go to metadata.
+func (e *Eureka) toInstance(s *registry.Service) *instance {
+	meta := make(map[string]string, len(s.Meta)+2)
+	for k, v := range s.Meta {
+		meta[k] = v
+	}
+	if len(s.Tags) > 0 {
+		meta[metaTags] = strings.Join(s.Tags, ",")
+	}
+	if s.Agent != "" {
+		meta[metaAgent] = s.Agent
+	}
+
+	return &instance{
+		InstanceID:     s.ID,
+		HostName:       s.Address,
+		App:            appName(s.Name),
+		IPAddr:         s.Address,
+		VipAddress:     s.Name,
+		Status:         "UP",
+		Port:           port{Number: s.Port, Enabled: "true"},
+		SecurePort:     port{Number: 443, Enabled: "false"},
+		DataCenterInfo: dataCenterInfo{Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo", Name: config.dataCenter},
+		LeaseInfo:      &leaseInfo{DurationInSecs: e.duration},
+		Metadata:       meta,
+	}
+}
+
+// toService returns the service of an instance registered by
+// mesos-consul
+func toService(i *instance) *registry.Service {
+	s := &registry.Service{
+		ID:      i.InstanceID,
+		Name:    i.VipAddress,
+		Port:    i.Port.Number,
+		Address: i.IPAddr,
+		Agent:   i.Metadata[metaAgent],
+	}
+
+	for k, v := range i.Metadata {
+		switch k {
+		case metaTags:
+			s.Tags = strings.Split(v, ",")
+		case metaAgent:
+		default:
+			if s.Meta == nil {
+				s.Meta = make(map[string]string)
+			}
+			s.Meta[k] = v
+		}
+	}
+
+	return s
+}
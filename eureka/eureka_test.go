@@ -0,0 +1,228 @@
+package eureka
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// testServer is a Eureka server keeping the instances registered
+type testServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	instances map[string]*instance
+	requests  []string
+}
+
+func newTestEureka(t *testing.T, heartbeats int) (*Eureka, *testServer) {
+	s := &testServer{instances: make(map[string]*instance)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	e := &Eureka{
+		client:     s.Client(),
+		urls:       []string{"http://127.0.0.1:1/eureka", s.URL + "/eureka"},
+		duration:   30,
+		heartbeats: heartbeats,
+	}
+	e.CacheCreate()
+	return e, s
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/eureka/apps"), "/")
+
+	switch {
+	case r.Method == "GET" && len(parts) == 1:
+		apps := map[string][]*instance{}
+		for _, i := range s.instances {
+			apps[i.App] = append(apps[i.App], i)
+		}
+		resp := map[string]interface{}{}
+		list := []interface{}{}
+		for name, instances := range apps {
+			list = append(list, map[string]interface{}{"name": name, "instance": instances})
+		}
+		resp["applications"] = map[string]interface{}{"application": list}
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "POST" && len(parts) == 2:
+		var body struct {
+			Instance *instance `json:"instance"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.instances[body.Instance.InstanceID] = body.Instance
+		w.WriteHeader(http.StatusNoContent)
+	case (r.Method == "PUT" || r.Method == "DELETE") && len(parts) == 3:
+		if _, ok := s.instances[parts[2]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(s.instances, parts[2])
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (s *testServer) methods() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := strings.Join(s.requests, ",")
+	s.requests = nil
+	return m
+}
+
+func TestPortUnmarshalJSON(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		number  int
+		enabled string
+	}{
+		{`{"$":8080,"@enabled":"true"}`, 8080, "true"},
+		{`{"$":"8080","@enabled":true}`, 8080, "true"},
+		{`{"$":"443","@enabled":"false"}`, 443, "false"},
+	} {
+		var p port
+		if err := json.Unmarshal([]byte(tt.in), &p); err != nil {
+			t.Errorf("unmarshal %s: %s", tt.in, err)
+			continue
+		}
+		if p.Number != tt.number || p.Enabled != tt.enabled {
+			t.Errorf("unmarshal %s => %+v, want {%d %s}", tt.in, p, tt.number, tt.enabled)
+		}
+	}
+
+	var p port
+	if err := json.Unmarshal([]byte(`{"$":"http","@enabled":"true"}`), &p); err == nil {
+		t.Error("unmarshal of a port which is no number did not fail")
+	}
+}
+
+func TestInstanceRoundTrip(t *testing.T) {
+	e := &Eureka{duration: 30}
+	s := &registry.Service{
+		ID:      "mesos-consul:10.0.0.1:web:31000",
+		Name:    "web",
+		Port:    31000,
+		Address: "10.0.0.1",
+		Agent:   "10.0.0.2",
+		Tags:    []string{"http", "v2"},
+		Meta:    map[string]string{"framework": "marathon"},
+	}
+
+	b, err := json.Marshal(e.toInstance(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &instance{}
+	if err := json.Unmarshal(b, i); err != nil {
+		t.Fatal(err)
+	}
+
+	if i.App != "WEB" {
+		t.Errorf("app %s, want WEB", i.App)
+	}
+	if got := toService(i); !reflect.DeepEqual(got, s) {
+		t.Errorf("toService(toInstance()) => %+v, want %+v", got, s)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	e, srv := newTestEureka(t, 1)
+	s := &registry.Service{ID: "mesos-consul:web", Name: "web", Address: "10.0.0.1", Port: 80}
+
+	e.Register(s)
+	if m := srv.methods(); m != "POST" {
+		t.Errorf("first registration sent %s, want POST", m)
+	}
+
+	e.Register(s)
+	if m := srv.methods(); m != "PUT" {
+		t.Errorf("registration of a cached service sent %s, want a PUT renewal", m)
+	}
+
+	// An instance Eureka dropped is registered again
+	delete(srv.instances, s.ID)
+	e.Register(s)
+	if m := srv.methods(); m != "PUT,POST" {
+		t.Errorf("registration of an expired instance sent %s, want PUT,POST", m)
+	}
+	if _, ok := srv.instances[s.ID]; !ok {
+		t.Error("did not register the expired instance again")
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	e, srv := newTestEureka(t, 1)
+	srv.instances["mesos-consul:web"] = e.toInstance(&registry.Service{ID: "mesos-consul:web", Name: "web", Port: 80})
+	srv.instances["web-1"] = e.toInstance(&registry.Service{ID: "web-1", Name: "web", Port: 80})
+	srv.instances["custom-web"] = e.toInstance(&registry.Service{
+		ID:   "custom-web",
+		Name: "web",
+		Port: 80,
+		Meta: map[string]string{registry.OwnerMetaKey: registry.OwnerMetaValue},
+	})
+
+	if err := e.CacheLoad(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]bool{"mesos-consul:web": true, "web-1": false, "custom-web": true} {
+		if got := e.CacheLookup(id) != nil; got != want {
+			t.Errorf("%s cached: %v, want %v", id, got, want)
+		}
+	}
+	if s := e.CacheLookup("mesos-consul:web"); s != nil && s.Port != 80 {
+		t.Errorf("loaded port %d, want 80", s.Port)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	e, srv := newTestEureka(t, 1)
+	e.Register(&registry.Service{ID: "mesos-consul:web", Name: "web"})
+	e.Register(&registry.Service{ID: "mesos-consul:api", Name: "api"})
+	srv.methods()
+
+	e.Deregister()
+	if m := srv.methods(); m != "" {
+		t.Errorf("first refresh without the services sent %s, want nothing", m)
+	}
+
+	// An instance already gone from Eureka is deregistered all the same
+	delete(srv.instances, "mesos-consul:api")
+	e.Deregister()
+	if m := srv.methods(); m != "DELETE,DELETE" {
+		t.Errorf("second refresh without the services sent %s, want two DELETE", m)
+	}
+	if len(e.cache) != 0 {
+		t.Errorf("%d services left cached, want none", len(e.cache))
+	}
+}
+
+func TestServerURLs(t *testing.T) {
+	for _, tt := range []struct {
+		uri  string
+		ssl  bool
+		want []string
+	}{
+		{"eureka://e1:8761", false, []string{"http://e1:8761/eureka"}},
+		{"eureka://e1:8761,e2:8761/", true, []string{"https://e1:8761/eureka", "https://e2:8761/eureka"}},
+		{"eureka://e1:8761/eureka/v2/", false, []string{"http://e1:8761/eureka/v2"}},
+	} {
+		if got := serverURLs(tt.uri, tt.ssl); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("serverURLs(%s, %v) => %v, want %v", tt.uri, tt.ssl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package fileexport is a registry writing the services registered
+// during each refresh to a JSON file, for debugging and external tools.
+package fileexport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// File is a registry keeping the services in memory, and writing them
+// to a file at the end of every refresh. The file is replaced
+// atomically, so readers never see a partial export.
+type File struct {
+	path  string
+	cache map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	service *registry.Service
+	marked  bool
+}
+
+// export is the content of the file
+type export struct {
+	Generated time.Time           `json:"generated"`
+	Services  []*registry.Service `json:"services"`
+}
+
+// New returns the registry of a file:///path address
+func New(uri string) registry.Registry {
+	path := strings.TrimPrefix(uri, "file://")
+	if path == "" {
+		log.Fatalf("No path in registry '%s'", uri)
+	}
+
+	return &File{path: path}
+}
+
+// CacheCreate creates the cache. There is nothing to load, since the
+// file is written again from scratch.
+func (f *File) CacheCreate() bool {
+	if f.cache == nil {
+		f.cache = make(map[string]*cacheEntry)
+	}
+	return false
+}
+
+func (f *File) CacheLoad(host string) error {
+	return nil
+}
+
+func (f *File) CacheLookup(id string) *registry.Service {
+	if c, ok := f.cache[id]; ok {
+		return c.service
+	}
+	return nil
+}
+
+// Cached returns the services of the cache
+func (f *File) Cached() []*registry.Service {
+	services := make([]*registry.Service, 0, len(f.cache))
+	for id := range f.cache {
+		services = append(services, f.CacheLookup(id))
+	}
+	return services
+}
+
+func (f *File) CacheDelete(id string) {
+	delete(f.cache, id)
+}
+
+func (f *File) CacheMark(id string) {
+	if c, ok := f.cache[id]; ok {
+		c.marked = true
+	}
+}
+
+func (f *File) Register(s *registry.Service) {
+	if c, ok := f.cache[s.ID]; ok {
+		c.marked = true
+		return
+	}
+
+	f.cache[s.ID] = &cacheEntry{service: s, marked: true}
+}
+
+// Deregister drops the services not seen during the refresh, and
+// writes the others to the file.
+func (f *File) Deregister() {
+	services := []*registry.Service{}
+	for id, c := range f.cache {
+		if !c.marked {
+			delete(f.cache, id)
+			continue
+		}
+		c.marked = false
+
+		// Secrets and ACL tokens are not exported
+		services = append(services, redact.Default.Service(c.service))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+
+	if err := f.write(export{Generated: time.Now().UTC(), Services: services}); err != nil {
+		log.Warnf("Unable to write the registrations to %s: %s", f.path, err)
+		return
+	}
+	log.Debugf("Wrote %d registrations to %s", len(services), f.path)
+}
+
+// write replaces the file with e, through a temporary file renamed
+// over it
+func (f *File) write(e export) error {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,61 @@
+package fileexport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "services.json")
+	f := New("file://" + path)
+	f.CacheCreate()
+
+	f.Register(&registry.Service{
+		ID:    "mesos-consul:web:2",
+		Name:  "web",
+		Token: "secret",
+		Meta:  map[string]string{"db-password": "hunter2"},
+	})
+	f.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web"})
+	f.Deregister()
+
+	// The first service is only marked, the second one is gone
+	f.CacheMark("mesos-consul:web:2")
+	f.Deregister()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e export
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e.Services) != 1 || e.Services[0].ID != "mesos-consul:web:2" {
+		t.Fatalf("exported %+v, want mesos-consul:web:2 only", e.Services)
+	}
+	if e.Services[0].Token != "" {
+		t.Error("the ACL token of the service was exported")
+	}
+	if v := e.Services[0].Meta["db-password"]; v != redact.Mask {
+		t.Errorf("exported the password meta as %q, want it masked", v)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files left in the directory, want the export only", len(files))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/mesos"
+
+	flag "github.com/ogier/pflag"
+	log "github.com/sirupsen/logrus"
+)
+
+// filters runs the filters subcommand, printing the filters in the order
+// they apply, or with --test whether each running task would be
+// registered and the rule deciding it, and returns the exit status
+func filters(args []string) int {
+	var test bool
+	var timeout time.Duration
+
+	c, err := parseFlags(args, func(flags *flag.FlagSet) {
+		flags.BoolVar(&test, "test", false, "")
+		flags.DurationVar(&timeout, "timeout", 10*time.Second, "")
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if !test {
+		printFilters(c)
+		return 0
+	}
+
+	decisions, err := mesos.PreviewFilters(c, timeout)
+	if err != nil {
+		log.Errorf("Unable to load the Mesos state: %s", err)
+		return 1
+	}
+
+	registered := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tNAME\tFRAMEWORK\tAGENT\tDECISION\tRULE")
+	for _, d := range decisions {
+		decision := "skip"
+		if d.Registered {
+			decision = "register"
+			registered++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Task, d.Name, d.Framework, d.Agent, decision, d.Rule)
+	}
+	w.Flush()
+
+	fmt.Printf("%d of %d running task(s) registered\n", registered, len(decisions))
+	return 0
+}
+
+// printFilters prints the filters of c in the order they apply
+func printFilters(c *config.Config) {
+	for _, f := range []struct {
+		option string
+		values []string
+	}{
+		{"agent-blacklist", c.AgentBlacklist},
+		{"label-blacklist", c.LabelBlacklist},
+		{"whitelist", c.WhiteList},
+		{"blacklist", c.BlackList},
+	} {
+		if len(f.values) > 0 {
+			fmt.Printf("%s: %s\n", f.option, strings.Join(f.values, " | "))
+		}
+	}
+	fmt.Printf("filter-precedence: %s\n", c.FilterPrecedence)
+	if c.FilterKV != "" {
+		fmt.Printf("filter-kv: %s, replacing the whitelist and blacklist while its keys exist\n", c.FilterKV)
+	}
+}
@@ -0,0 +1,194 @@
+// Package journal implements a write-ahead journal of registry operations.
+// An operation is appended to the journal before it is executed and marked
+// done once it completed, so the operations interrupted by a crash can be
+// replayed on startup.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Operation kinds
+const (
+	OpRegister   = "register"
+	OpDeregister = "deregister"
+)
+
+// Operation is a registry operation. Service holds the operation payload,
+// as written by the registry.
+type Operation struct {
+	Seq     uint64          `json:"seq"`
+	Op      string          `json:"op,omitempty"`
+	Agent   string          `json:"agent,omitempty"`
+	Service json.RawMessage `json:"service,omitempty"`
+	Done    bool            `json:"done,omitempty"`
+}
+
+// Journal is an append-only file of operations
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	seq     uint64
+	pending map[uint64]Operation
+}
+
+// Open opens the journal at path, creating it if needed, and loads the
+// operations which were not marked done. A last line left incomplete by a
+// crash is truncated, so that the next operations are appended after the
+// last complete one.
+func Open(path string) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		pending: make(map[uint64]Operation),
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Offset of the end of the last complete line
+	var complete int64
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// A crash left the last line incomplete
+				return os.Truncate(j.path, complete)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		complete += int64(len(line))
+
+		var op Operation
+		if err := json.Unmarshal(line, &op); err != nil {
+			continue
+		}
+
+		if op.Seq > j.seq {
+			j.seq = op.Seq
+		}
+		if op.Done {
+			delete(j.pending, op.Seq)
+		} else {
+			j.pending[op.Seq] = op
+		}
+	}
+}
+
+// Pending returns the operations which were begun but not marked done,
+// in the order they were begun.
+func (j *Journal) Pending() []Operation {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ops := []Operation{}
+	for seq := uint64(1); seq <= j.seq; seq++ {
+		if op, ok := j.pending[seq]; ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// Begin writes an operation to the journal, before it is executed, and
+// returns its sequence number. The write is synced to disk.
+func (j *Journal) Begin(op string, agent string, service interface{}) (uint64, error) {
+	payload, err := json.Marshal(service)
+	if err != nil {
+		return 0, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	o := Operation{Seq: j.seq, Op: op, Agent: agent, Service: payload}
+	if err := j.write(o, true); err != nil {
+		return 0, err
+	}
+	j.pending[o.Seq] = o
+
+	return o.Seq, nil
+}
+
+// Done marks an operation as completed, successfully or not
+func (j *Journal) Done(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.pending[seq]; !ok {
+		return nil
+	}
+	delete(j.pending, seq)
+
+	return j.write(Operation{Seq: seq, Done: true}, false)
+}
+
+// Checkpoint truncates the journal when no operation is pending, keeping
+// its size bounded.
+func (j *Journal) Checkpoint() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.pending) > 0 {
+		return nil
+	}
+
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Close()
+}
+
+func (j *Journal) write(o Operation, sync bool) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("journal %s: %s", j.path, err)
+	}
+	if sync {
+		return j.f.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := j.Begin(OpRegister, "10.0.0.1", map[string]string{"ID": "a"})
+	b, _ := j.Begin(OpDeregister, "10.0.0.1", map[string]string{"ID": "b"})
+	c, _ := j.Begin(OpRegister, "10.0.0.2", map[string]string{"ID": "c"})
+	j.Done(b)
+	j.Close()
+
+	// Simulate a crash in the middle of a write
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"seq":4,"op":"regi`)
+	f.Close()
+
+	j, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	pending := j.Pending()
+	if len(pending) != 2 || pending[0].Seq != a || pending[1].Seq != c {
+		t.Fatalf("Pending() => %+v, want operations %d and %d", pending, a, c)
+	}
+	if pending[1].Op != OpRegister || pending[1].Agent != "10.0.0.2" || string(pending[1].Service) != `{"ID":"c"}` {
+		t.Errorf("Pending()[1] => %+v", pending[1])
+	}
+
+	// Sequence numbers keep increasing across restarts
+	if d, _ := j.Begin(OpRegister, "10.0.0.1", nil); d <= c {
+		t.Errorf("Begin() after reopening => %d, want more than %d", d, c)
+	}
+}
+
+func TestJournalReopenAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := j.Begin(OpRegister, "10.0.0.1", map[string]string{"ID": "a"})
+	j.Close()
+
+	// Crash in the middle of a write, then restart and journal another
+	// operation before crashing again
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"seq":2,"op":"regi`)
+	f.Close()
+
+	j, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := j.Begin(OpDeregister, "10.0.0.2", map[string]string{"ID": "b"})
+	j.Close()
+
+	j, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	pending := j.Pending()
+	if len(pending) != 2 || pending[0].Seq != a || pending[1].Seq != b {
+		t.Fatalf("Pending() => %+v, want operations %d and %d", pending, a, b)
+	}
+	if pending[1].Op != OpDeregister || string(pending[1].Service) != `{"ID":"b"}` {
+		t.Errorf("Pending()[1] => %+v", pending[1])
+	}
+}
+
+func TestJournalCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	a, _ := j.Begin(OpRegister, "10.0.0.1", nil)
+	j.Checkpoint()
+	if fi, _ := os.Stat(path); fi.Size() == 0 {
+		t.Error("Checkpoint() truncated a journal with pending operations")
+	}
+
+	j.Done(a)
+	j.Checkpoint()
+	if fi, _ := os.Stat(path); fi.Size() != 0 {
+		t.Errorf("Checkpoint() left %d bytes, want an empty journal", fi.Size())
+	}
+}
@@ -0,0 +1,92 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	flag "github.com/ogier/pflag"
+)
+
+// Credentials of the service account of pods
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type kubernetesConfig struct {
+	tokenFile string
+	caFile    string
+}
+
+var config kubernetesConfig
+
+func AddCmdFlags(f *flag.FlagSet) {
+	f.StringVar(&config.tokenFile, "k8s-token-file", serviceAccountToken, "")
+	f.StringVar(&config.caFile, "k8s-ca-file", serviceAccountCA, "")
+}
+
+func Help() string {
+	helpText := `
+Kubernetes Options (with --registry=k8s://[<host:port>]/<namespace>):
+
+  --k8s-token-file=<file>	Path to the bearer token to authenticate to the API
+				server with
+				(default: the pod service account token)
+  --k8s-ca-file=<file>		Path to the CA certificate of the API server
+				(default: the pod service account CA)
+
+`
+
+	return helpText
+}
+
+// parseURI returns the API server URL and the namespace of a
+// k8s://[host:port]/namespace address. Without host, the API server is
+// that of the cluster mesos-consul runs in.
+func parseURI(uri string) (string, string, error) {
+	rest := strings.TrimPrefix(uri, "k8s://")
+
+	host, namespace := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, namespace = rest[:i], strings.Trim(rest[i:], "/")
+	}
+	if namespace == "" {
+		return "", "", fmt.Errorf("no namespace in %s", uri)
+	}
+
+	if host == "" {
+		h, p := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if h == "" || p == "" {
+			return "", "", fmt.Errorf("no API server in %s, and not running in a cluster", uri)
+		}
+		host = net.JoinHostPort(h, p)
+	}
+
+	return "https://" + host, namespace, nil
+}
+
+func (c kubernetesConfig) token() (string, error) {
+	b, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (c kubernetesConfig) tlsConfig() (*tls.Config, error) {
+	b, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", c.caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
@@ -0,0 +1,660 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeout of the requests to the API server
+const requestTimeout = 10 * time.Second
+
+// Labels of the objects maintained by mesos-consul
+const (
+	managedByLabel        = "endpointslice.kubernetes.io/managed-by"
+	serviceManagedByLabel = "app.kubernetes.io/managed-by"
+	managedBy             = "mesos-consul"
+	serviceLabel          = "kubernetes.io/service-name"
+)
+
+// Annotation of the EndpointSlices holding the instances they group,
+// with the service fields Kubernetes has no place for
+const instancesAnnotation = "mesos-consul/instances"
+
+// Annotations of the EndpointSlices of a single instance, as written by
+// earlier versions, which are replaced on load
+const (
+	idAnnotation    = "mesos-consul/id"
+	nameAnnotation  = "mesos-consul/name"
+	tagsAnnotation  = "mesos-consul/tags"
+	agentAnnotation = "mesos-consul/agent"
+	metaAnnotation  = "mesos-consul/meta"
+)
+
+// Kubernetes registers services as headless Services of a namespace,
+// without selector. The instances of a service are grouped in an
+// EndpointSlice per port, since the instances of a Mesos service do not
+// share a port. EndpointSlices are written once per refresh, on
+// Deregister.
+type Kubernetes struct {
+	client    *http.Client
+	server    string
+	namespace string
+	token     string
+	cache     map[string]*cacheEntry
+
+	// Services known to exist
+	services map[string]bool
+
+	// EndpointSlices whose instances changed since they were written,
+	// and the services deregistered from them
+	dirty   map[string]sliceKey
+	removed map[string][]*registry.Service
+
+	// Refreshes a service may be missing from before it is deregistered
+	heartbeats int
+}
+
+type cacheEntry struct {
+	service *registry.Service
+	slice   string
+
+	// Whether the EndpointSlice of the service was written with it
+	registered bool
+
+	validityCounter int
+}
+
+// sliceKey identifies the EndpointSlice of the instances of a Service
+// on a port
+type sliceKey struct {
+	service     string
+	port        int
+	addressType string
+}
+
+type objectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type service struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Metadata   objectMeta  `json:"metadata"`
+	Spec       serviceSpec `json:"spec"`
+}
+
+type serviceSpec struct {
+	ClusterIP string `json:"clusterIP"`
+}
+
+type endpointSlice struct {
+	APIVersion  string     `json:"apiVersion"`
+	Kind        string     `json:"kind"`
+	Metadata    objectMeta `json:"metadata"`
+	AddressType string     `json:"addressType"`
+	Endpoints   []endpoint `json:"endpoints"`
+	Ports       []port     `json:"ports"`
+}
+
+type endpoint struct {
+	Addresses []string `json:"addresses"`
+}
+
+type port struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// instance is an instance of an EndpointSlice, in its instances
+// annotation
+type instance struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Tags    []string          `json:"tags,omitempty"`
+	Agent   string            `json:"agent,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// New returns the Kubernetes registry of a k8s://[host:port]/namespace
+// address, whose services are deregistered once missing from heartbeats
+// refreshes.
+func New(uri string, heartbeats int) registry.Registry {
+	server, namespace, err := parseURI(uri)
+	if err != nil {
+		log.Fatal("Invalid Kubernetes registry: ", err)
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.Fatal("Unable to load the Kubernetes CA: ", err)
+	}
+
+	k := &Kubernetes{
+		client: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		server:    server,
+		namespace: namespace,
+
+		heartbeats: heartbeats,
+	}
+	k.reloadToken()
+
+	return k
+}
+
+// reloadToken reads the bearer token again, since service account
+// tokens are rotated
+func (k *Kubernetes) reloadToken() {
+	token, err := config.token()
+	if err != nil {
+		log.Warn("Unable to read the Kubernetes token: ", err)
+		return
+	}
+
+	k.token = token
+	redact.Default.SetValues("kubernetes", []string{token})
+}
+
+// CacheCreate creates the cache, and tells whether it needs to be
+// loaded
+func (k *Kubernetes) CacheCreate() bool {
+	if k.cache == nil {
+		k.cache = make(map[string]*cacheEntry)
+		k.services = make(map[string]bool)
+		k.dirty = make(map[string]sliceKey)
+		k.removed = make(map[string][]*registry.Service)
+		return true
+	}
+
+	return false
+}
+
+// CacheLoad loads the EndpointSlices maintained by mesos-consul. The
+// EndpointSlices of a single instance written by earlier versions are
+// replaced by those grouping the instances on the next refresh. The
+// host of the Mesos leader is not used.
+func (k *Kubernetes) CacheLoad(host string) error {
+	var list struct {
+		Items []endpointSlice `json:"items"`
+	}
+
+	q := url.Values{"labelSelector": {managedByLabel + "=" + managedBy}}
+	if _, err := k.do("GET", k.slicesPath("")+"?"+q.Encode(), nil, &list); err != nil {
+		return err
+	}
+
+	for _, es := range list.Items {
+		name := es.Metadata.Labels[serviceLabel]
+		k.services[name] = true
+
+		legacy := es.Metadata.Annotations[idAnnotation] != ""
+		if legacy {
+			k.dirty[es.Metadata.Name] = sliceKey{service: name}
+		}
+
+		for _, s := range toServices(&es) {
+			log.Debugf("Found '%s' with ID '%s'", s.Name, s.ID)
+			key := serviceKey(s)
+			c := &cacheEntry{service: s, slice: key.name(), registered: true}
+			k.cache[s.ID] = c
+			if legacy {
+				k.dirty[c.slice] = key
+			}
+		}
+	}
+
+	return nil
+}
+
+// CacheLookup returns the cached service of the given ID, or nil
+func (k *Kubernetes) CacheLookup(id string) *registry.Service {
+	if c, ok := k.cache[id]; ok {
+		return c.service
+	}
+	return nil
+}
+
+// Cached returns the services of the cache
+func (k *Kubernetes) Cached() []*registry.Service {
+	services := make([]*registry.Service, 0, len(k.cache))
+	for id := range k.cache {
+		services = append(services, k.CacheLookup(id))
+	}
+	return services
+}
+
+// CacheDelete removes a service from the cache. The EndpointSlice it is
+// registered again in is written again.
+func (k *Kubernetes) CacheDelete(id string) {
+	if c, ok := k.cache[id]; ok {
+		k.dirty[c.slice] = serviceKey(c.service)
+		delete(k.cache, id)
+	}
+}
+
+// CacheMark marks a service as seen during the refresh
+func (k *Kubernetes) CacheMark(id string) {
+	if c, ok := k.cache[id]; ok {
+		c.validityCounter = 0
+	}
+}
+
+// Register adds the instance of a service to its EndpointSlice, unless
+// it is cached. The EndpointSlice is written on Deregister.
+func (k *Kubernetes) Register(s *registry.Service) {
+	if _, ok := k.cache[s.ID]; ok {
+		log.Debugf("Service found. Not registering: %s", s.ID)
+		k.CacheMark(s.ID)
+		return
+	}
+
+	log.Info("Registering ", s.ID)
+
+	key := serviceKey(s)
+	k.cache[s.ID] = &cacheEntry{service: s, slice: key.name()}
+	k.dirty[key.name()] = key
+}
+
+// Deregister removes the instances of the services not seen during the
+// refresh, writes the EndpointSlices which changed, deleting those left
+// without instances, and deletes the Services left without any.
+func (k *Kubernetes) Deregister() {
+	k.reloadToken()
+
+	for id, c := range k.cache {
+		if c.validityCounter < k.heartbeats {
+			c.validityCounter++
+			continue
+		}
+
+		log.Infof("Deregistering %s", id)
+		delete(k.cache, id)
+		k.dirty[c.slice] = serviceKey(c.service)
+		k.removed[c.slice] = append(k.removed[c.slice], c.service)
+	}
+
+	for name, key := range k.dirty {
+		if k.writeSlice(name, key) {
+			delete(k.dirty, name)
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, c := range k.cache {
+		used[serviceName(c.service.Name)] = true
+	}
+	for _, key := range k.dirty {
+		used[key.service] = true
+	}
+	for name := range k.services {
+		if used[name] {
+			continue
+		}
+
+		if err := k.deleteService(name); err != nil {
+			log.Warnf("Unable to delete Service %s: %s", name, err)
+			continue
+		}
+		delete(k.services, name)
+	}
+}
+
+// writeSlice writes an EndpointSlice with its cached instances, or
+// deletes it when none is left, and counts the registrations and
+// deregistrations of its instances. It returns whether it succeeded.
+func (k *Kubernetes) writeSlice(name string, key sliceKey) bool {
+	entries := []*cacheEntry{}
+	for _, c := range k.cache {
+		if c.slice == name {
+			entries = append(entries, c)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].service.ID < entries[j].service.ID })
+
+	var err error
+	if len(entries) == 0 {
+		var status int
+		if status, err = k.do("DELETE", k.slicesPath(name), nil, nil); status == http.StatusNotFound {
+			err = nil
+		}
+	} else if err = k.ensureService(key.service); err == nil {
+		err = k.upsert(k.slicesPath(name), k.slicesPath(""), toSlice(key, entries))
+	}
+
+	if err != nil {
+		log.Warnf("Unable to write EndpointSlice %s: %s", name, err)
+	} else {
+		log.Debugf("Wrote EndpointSlice %s with %d instances", name, len(entries))
+	}
+	for _, c := range entries {
+		if c.registered {
+			continue
+		}
+		if err != nil {
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent), "register")
+			registry.Failed("register", c.service.ID, err)
+			continue
+		}
+		metrics.Registrations.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent))
+		registry.Applied("register", c.service, "")
+		c.registered = true
+	}
+	for _, s := range k.removed[name] {
+		if err != nil {
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(s.Agent), "deregister")
+			registry.Failed("deregister", s.ID, err)
+			continue
+		}
+		metrics.Deregistrations.Inc(registry.FrameworkLabel(s.Meta), metrics.HashLabel(s.Agent))
+		registry.Applied("deregister", s, "")
+	}
+	if err == nil {
+		delete(k.removed, name)
+	}
+
+	return err == nil
+}
+
+// ensureService creates the headless Service of a service, unless it
+// is known to exist
+func (k *Kubernetes) ensureService(name string) error {
+	if k.services[name] {
+		return nil
+	}
+
+	status, err := k.do("POST", k.servicesPath(""), &service{
+		APIVersion: "v1",
+		Kind:       "Service",
+		Metadata: objectMeta{
+			Name:   name,
+			Labels: map[string]string{serviceManagedByLabel: managedBy},
+		},
+		Spec: serviceSpec{ClusterIP: "None"},
+	}, nil)
+	if status == http.StatusConflict {
+		err = nil
+	}
+	if err == nil {
+		k.services[name] = true
+	}
+	return err
+}
+
+// deleteService deletes a Service left without instances, unless it
+// was not created by mesos-consul
+func (k *Kubernetes) deleteService(name string) error {
+	var svc service
+	status, err := k.do("GET", k.servicesPath(name), nil, &svc)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if svc.Metadata.Labels[serviceManagedByLabel] != managedBy {
+		return nil
+	}
+
+	log.Infof("Deleting Service %s", name)
+	status, err = k.do("DELETE", k.servicesPath(name), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// upsert updates an object with a merge patch, creating it when it does
+// not exist
+func (k *Kubernetes) upsert(objectPath string, collectionPath string, object interface{}) error {
+	status, err := k.do("PATCH", objectPath, object, nil)
+	if status != http.StatusNotFound {
+		return err
+	}
+
+	_, err = k.do("POST", collectionPath, object, nil)
+	return err
+}
+
+func (k *Kubernetes) servicesPath(name string) string {
+	p := fmt.Sprintf("/api/v1/namespaces/%s/services", url.PathEscape(k.namespace))
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+func (k *Kubernetes) slicesPath(name string) string {
+	p := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(k.namespace))
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// do sends a request to the API server, and decodes the JSON response
+// into out. It returns the status of the response, and an error for
+// statuses other than 2xx.
+func (k *Kubernetes) do(method string, path string, in interface{}, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, k.server+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if method == "PATCH" {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+var invalidServiceChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// serviceName returns the name of the Service of a service, which must
+// be a DNS label starting with a letter
+func serviceName(name string) string {
+	n := strings.Trim(invalidServiceChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if n == "" {
+		n = "mesos"
+	} else if n[0] < 'a' || n[0] > 'z' {
+		n = "mesos-" + n
+	}
+	if len(n) > 63 {
+		n = strings.TrimRight(n[:63], "-")
+	}
+	return n
+}
+
+// name returns the name of the EndpointSlice, from the Service and a
+// hash of its port and address type
+func (key sliceKey) name() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", key.addressType, key.port)
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+
+	name := key.service
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// serviceKey returns the EndpointSlice key of the instance of a service
+func serviceKey(s *registry.Service) sliceKey {
+	return sliceKey{
+		service:     serviceName(s.Name),
+		port:        s.Port,
+		addressType: addressType(s.Address),
+	}
+}
+
+// toSlice returns the EndpointSlice of the instances of a Service on a
+// port
+func toSlice(key sliceKey, entries []*cacheEntry) *endpointSlice {
+	instances := make([]instance, 0, len(entries))
+	endpoints := make([]endpoint, 0, len(entries))
+	for _, c := range entries {
+		s := c.service
+		instances = append(instances, instance{
+			ID:      s.ID,
+			Name:    s.Name,
+			Address: s.Address,
+			Tags:    s.Tags,
+			Agent:   s.Agent,
+			Meta:    s.Meta,
+		})
+		endpoints = append(endpoints, endpoint{Addresses: []string{s.Address}})
+	}
+	b, _ := json.Marshal(instances)
+
+	es := &endpointSlice{
+		APIVersion: "discovery.k8s.io/v1",
+		Kind:       "EndpointSlice",
+		Metadata: objectMeta{
+			Name: key.name(),
+			Labels: map[string]string{
+				managedByLabel: managedBy,
+				serviceLabel:   key.service,
+			},
+			Annotations: map[string]string{instancesAnnotation: string(b)},
+		},
+		AddressType: key.addressType,
+		Endpoints:   endpoints,
+		Ports:       []port{},
+	}
+	if key.port > 0 {
+		es.Ports = append(es.Ports, port{Port: key.port, Protocol: "TCP"})
+	}
+
+	return es
+}
+
+func addressType(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return "FQDN"
+	case ip.To4() != nil:
+		return "IPv4"
+	default:
+		return "IPv6"
+	}
+}
+
+// toServices returns the services of an EndpointSlice maintained by
+// mesos-consul
+func toServices(es *endpointSlice) []*registry.Service {
+	p := 0
+	if len(es.Ports) > 0 {
+		p = es.Ports[0].Port
+	}
+
+	a := es.Metadata.Annotations
+	if a[idAnnotation] != "" {
+		if s := legacyService(es, p); s != nil {
+			return []*registry.Service{s}
+		}
+		return nil
+	}
+
+	var instances []instance
+	if err := json.Unmarshal([]byte(a[instancesAnnotation]), &instances); err != nil {
+		log.Warnf("Ignoring EndpointSlice %s: %s", es.Metadata.Name, err)
+		return nil
+	}
+
+	services := []*registry.Service{}
+	for _, i := range instances {
+		if !registry.Owned(i.ID, i.Meta) {
+			continue
+		}
+		services = append(services, &registry.Service{
+			ID:      i.ID,
+			Name:    i.Name,
+			Port:    p,
+			Address: i.Address,
+			Tags:    i.Tags,
+			Meta:    i.Meta,
+			Agent:   i.Agent,
+		})
+	}
+	return services
+}
+
+// legacyService returns the service of an EndpointSlice of a single
+// instance, or nil
+func legacyService(es *endpointSlice, p int) *registry.Service {
+	a := es.Metadata.Annotations
+	s := &registry.Service{
+		ID:    a[idAnnotation],
+		Name:  a[nameAnnotation],
+		Port:  p,
+		Agent: a[agentAnnotation],
+	}
+	if len(es.Endpoints) > 0 && len(es.Endpoints[0].Addresses) > 0 {
+		s.Address = es.Endpoints[0].Addresses[0]
+	}
+	if t := a[tagsAnnotation]; t != "" {
+		s.Tags = strings.Split(t, ",")
+	}
+	if m := a[metaAnnotation]; m != "" {
+		json.Unmarshal([]byte(m), &s.Meta)
+	}
+
+	if !registry.Owned(s.ID, s.Meta) {
+		return nil
+	}
+	return s
+}
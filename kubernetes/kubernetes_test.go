@@ -0,0 +1,317 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// testServer is an API server keeping the Services and EndpointSlices
+// of a namespace
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	services map[string]*service
+	slices   map[string]*endpointSlice
+	writes   int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	a := &testServer{services: make(map[string]*service), slices: make(map[string]*endpointSlice)}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	t.Cleanup(a.Close)
+	return a
+}
+
+func newTestKubernetes(a *testServer, heartbeats int) *Kubernetes {
+	k := &Kubernetes{client: a.Client(), server: a.URL, namespace: "mesos", heartbeats: heartbeats}
+	k.CacheCreate()
+	return k
+}
+
+func (a *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var name string
+	var objects interface{}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/mesos/services"):
+		name = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/mesos/services"), "/")
+		objects = a.services
+	case strings.HasPrefix(r.URL.Path, "/apis/discovery.k8s.io/v1/namespaces/mesos/endpointslices"):
+		name = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/apis/discovery.k8s.io/v1/namespaces/mesos/endpointslices"), "/")
+		objects = a.slices
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch objects := objects.(type) {
+	case map[string]*service:
+		switch {
+		case r.Method == "POST":
+			svc := &service{}
+			json.NewDecoder(r.Body).Decode(svc)
+			if _, ok := objects[svc.Metadata.Name]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			objects[svc.Metadata.Name] = svc
+		case objects[name] == nil:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "GET":
+			json.NewEncoder(w).Encode(objects[name])
+		case r.Method == "DELETE":
+			delete(objects, name)
+		}
+	case map[string]*endpointSlice:
+		switch {
+		case r.Method == "GET" && name == "":
+			items := []*endpointSlice{}
+			for _, es := range objects {
+				items = append(items, es)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+		case r.Method == "POST":
+			es := &endpointSlice{}
+			json.NewDecoder(r.Body).Decode(es)
+			if _, ok := objects[es.Metadata.Name]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			objects[es.Metadata.Name] = es
+			a.writes++
+		case objects[name] == nil:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "PATCH":
+			if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			es := &endpointSlice{}
+			json.NewDecoder(r.Body).Decode(es)
+			objects[name] = es
+			a.writes++
+		case r.Method == "DELETE":
+			delete(objects, name)
+			a.writes++
+		}
+	}
+}
+
+// endpoints returns the number of endpoints of the EndpointSlice of a
+// Service on a port, or -1 without one
+func (a *testServer) endpoints(service string, p int) int {
+	es := a.slices[sliceKey{service: service, port: p, addressType: "IPv4"}.name()]
+	if es == nil {
+		return -1
+	}
+	return len(es.Endpoints)
+}
+
+func TestRegisterGroupsInstances(t *testing.T) {
+	a := newTestServer(t)
+	k := newTestKubernetes(a, 1)
+
+	k.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 80})
+	k.Register(&registry.Service{ID: "mesos-consul:web:2", Name: "web", Address: "10.0.0.2", Port: 80})
+	k.Register(&registry.Service{ID: "mesos-consul:web:3", Name: "web", Address: "10.0.0.3", Port: 31000})
+	k.Register(&registry.Service{ID: "mesos-consul:api:1", Name: "api", Address: "10.0.0.1", Port: 80})
+	if a.writes != 0 {
+		t.Errorf("wrote %d EndpointSlices before the end of the refresh, want none", a.writes)
+	}
+
+	k.Deregister()
+
+	if a.writes != 3 {
+		t.Errorf("wrote %d EndpointSlices, want one per Service and port", a.writes)
+	}
+	for _, tt := range []struct {
+		service string
+		port    int
+		want    int
+	}{
+		{"web", 80, 2},
+		{"web", 31000, 1},
+		{"api", 80, 1},
+	} {
+		if got := a.endpoints(tt.service, tt.port); got != tt.want {
+			t.Errorf("EndpointSlice of %s on %d has %d endpoints, want %d", tt.service, tt.port, got, tt.want)
+		}
+	}
+	if len(a.services) != 2 {
+		t.Errorf("%d Services created, want 2", len(a.services))
+	}
+
+	// Unchanged EndpointSlices are not written again
+	for id := range k.cache {
+		k.CacheMark(id)
+	}
+	k.Deregister()
+	if a.writes != 3 {
+		t.Errorf("wrote %d EndpointSlices again without any change", a.writes-3)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	a := newTestServer(t)
+	k := newTestKubernetes(a, 1)
+
+	k.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 80})
+	k.Register(&registry.Service{ID: "mesos-consul:web:2", Name: "web", Address: "10.0.0.2", Port: 80})
+	k.Deregister()
+
+	// web:2 goes missing for two refreshes
+	for i := 0; i < 2; i++ {
+		k.CacheMark("mesos-consul:web:1")
+		k.Deregister()
+	}
+	if got := a.endpoints("web", 80); got != 1 {
+		t.Errorf("EndpointSlice has %d endpoints after deregistering an instance, want 1", got)
+	}
+	if a.services["web"] == nil {
+		t.Error("deleted the Service of an instance left")
+	}
+
+	k.Deregister()
+	k.Deregister()
+	if got := a.endpoints("web", 80); got != -1 {
+		t.Errorf("EndpointSlice left with %d endpoints after deregistering every instance", got)
+	}
+	if a.services["web"] != nil {
+		t.Error("kept the Service without instances")
+	}
+}
+
+func TestDeregisterKeepsForeignServices(t *testing.T) {
+	a := newTestServer(t)
+	k := newTestKubernetes(a, 1)
+	a.services["web"] = &service{Metadata: objectMeta{Name: "web"}}
+
+	k.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 80})
+	k.Deregister()
+	k.Deregister()
+	k.Deregister()
+
+	if a.services["web"] == nil {
+		t.Error("deleted a Service not created by mesos-consul")
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	a := newTestServer(t)
+	k := newTestKubernetes(a, 1)
+	k.Register(&registry.Service{
+		ID:      "mesos-consul:web:1",
+		Name:    "web",
+		Address: "10.0.0.1",
+		Port:    80,
+		Tags:    []string{"http"},
+		Meta:    map[string]string{"framework": "marathon"},
+		Agent:   "10.0.0.10",
+	})
+	k.Register(&registry.Service{ID: "mesos-consul:web:2", Name: "web", Address: "10.0.0.2", Port: 80})
+	k.Deregister()
+	writes := a.writes
+
+	k = newTestKubernetes(a, 1)
+	if err := k.CacheLoad(""); err != nil {
+		t.Fatal(err)
+	}
+
+	s := k.CacheLookup("mesos-consul:web:1")
+	if s == nil || s.Address != "10.0.0.1" || s.Port != 80 || s.Agent != "10.0.0.10" || s.Meta["framework"] != "marathon" || len(s.Tags) != 1 {
+		t.Errorf("loaded %+v, want the registered service", s)
+	}
+	if k.CacheLookup("mesos-consul:web:2") == nil {
+		t.Error("did not load the second instance")
+	}
+
+	k.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 80})
+	k.Register(&registry.Service{ID: "mesos-consul:web:2", Name: "web", Address: "10.0.0.2", Port: 80})
+	k.Deregister()
+	if a.writes != writes {
+		t.Errorf("wrote %d EndpointSlices for the loaded instances, want none", a.writes-writes)
+	}
+}
+
+func TestCacheLoadLegacySlices(t *testing.T) {
+	a := newTestServer(t)
+	a.services["web"] = &service{Metadata: objectMeta{Name: "web", Labels: map[string]string{serviceManagedByLabel: managedBy}}}
+	a.slices["web-0a1b2c3d"] = &endpointSlice{
+		Metadata: objectMeta{
+			Name:   "web-0a1b2c3d",
+			Labels: map[string]string{managedByLabel: managedBy, serviceLabel: "web"},
+			Annotations: map[string]string{
+				idAnnotation:   "mesos-consul:web:1",
+				nameAnnotation: "web",
+				tagsAnnotation: "http",
+			},
+		},
+		AddressType: "IPv4",
+		Endpoints:   []endpoint{{Addresses: []string{"10.0.0.1"}}},
+		Ports:       []port{{Port: 80, Protocol: "TCP"}},
+	}
+
+	k := newTestKubernetes(a, 1)
+	if err := k.CacheLoad(""); err != nil {
+		t.Fatal(err)
+	}
+	if s := k.CacheLookup("mesos-consul:web:1"); s == nil || s.Port != 80 || s.Tags[0] != "http" {
+		t.Fatalf("loaded %+v from the legacy EndpointSlice", s)
+	}
+
+	k.CacheMark("mesos-consul:web:1")
+	k.Deregister()
+
+	if a.slices["web-0a1b2c3d"] != nil {
+		t.Error("kept the legacy EndpointSlice")
+	}
+	if got := a.endpoints("web", 80); got != 1 {
+		t.Errorf("EndpointSlice replacing the legacy one has %d endpoints, want 1", got)
+	}
+	if a.services["web"] == nil {
+		t.Error("deleted the Service of the replaced EndpointSlice")
+	}
+}
+
+func TestSliceKeyName(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	for _, key := range []sliceKey{
+		{service: "web", port: 80, addressType: "IPv4"},
+		{service: long, port: 80, addressType: "IPv4"},
+	} {
+		name := key.name()
+		if len(name) > 63 || !strings.HasPrefix(name, key.service[:3]) {
+			t.Errorf("name of %+v is %s, want a DNS label starting with the Service", key, name)
+		}
+	}
+
+	a := sliceKey{service: "web", port: 80, addressType: "IPv4"}.name()
+	b := sliceKey{service: "web", port: 80, addressType: "IPv6"}.name()
+	c := sliceKey{service: "web", port: 8080, addressType: "IPv4"}.name()
+	if a == b || a == c {
+		t.Errorf("EndpointSlices of different ports or address types share names: %s, %s, %s", a, b, c)
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	for in, want := range map[string]string{
+		"web":                   "web",
+		"My_App.v2":             "my-app-v2",
+		"2048":                  "mesos-2048",
+		"--":                    "mesos",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+	} {
+		if got := serviceName(in); got != want {
+			t.Errorf("serviceName(%s) => %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Package logfile implements a log file rotated by size. Once a write would
+// make the file larger than its maximum size, it is renamed to <path>.1,
+// the previous <path>.1 to <path>.2 and so on, the oldest backups being
+// removed, and a new file is started.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is a log file rotated by size, safe for concurrent writes
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// Open opens the log file at path for appending, creating it if needed.
+// It is rotated when it would grow over maxSize bytes, keeping maxBackups
+// rotated files; a maxSize of 0 disables the rotation.
+func Open(path string, maxSize int64, maxBackups int) (*File, error) {
+	l := &File{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *File) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first when p would make it
+// larger than its maximum size. A line longer than the maximum size is
+// still written, to a file of its own.
+func (l *File) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, renames the file to the first of them and
+// opens a new file
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	if l.maxBackups > 0 {
+		os.Remove(l.backup(l.maxBackups))
+		for i := l.maxBackups - 1; i > 0; i-- {
+			os.Rename(l.backup(i), l.backup(i+1))
+		}
+		if err := os.Rename(l.path, l.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// Close closes the file
+func (l *File) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
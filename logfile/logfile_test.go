@@ -0,0 +1,56 @@
+package logfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mesos-consul.log")
+
+	l, err := Open(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "a long line\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	for file, want := range map[string]string{
+		path:        "a long line\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "three\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s => %q, want %q", filepath.Base(file), b, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want at most 2 backups", filepath.Base(path))
+	}
+
+	// Appends to the existing file
+	l, err = Open(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("six\n"))
+	l.Close()
+	if b, _ := ioutil.ReadFile(path); string(b) != "a long line\nsix\n" {
+		t.Errorf("reopened file => %q, want the new line appended", b)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/logfile"
+	"github.com/CiscoCloud/mesos-consul/redact"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// setupLogging sets the level, format and output of the log. Secrets are
+// masked in every format.
+func setupLogging(c *config.Config) error {
+	l, err := log.ParseLevel(strings.ToLower(c.LogLevel))
+	if err != nil {
+		log.SetLevel(log.WarnLevel)
+		log.Warnf("Invalid log level '%v'. Setting to WARN", c.LogLevel)
+	} else {
+		log.SetLevel(l)
+	}
+
+	var formatter log.Formatter
+	switch c.LogFormat {
+	case LogFormatText:
+		formatter = &log.TextFormatter{}
+	case LogFormatJSON:
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format '%s', expected %s or %s", c.LogFormat, LogFormatText, LogFormatJSON)
+	}
+	log.SetFormatter(&redact.Formatter{
+		Formatter: formatter,
+		Redactor:  redact.Default,
+	})
+
+	if c.LogFile != "" {
+		f, err := logfile.Open(c.LogFile, int64(c.LogMaxSize)<<20, c.LogMaxBackups)
+		if err != nil {
+			return fmt.Errorf("unable to open the log file: %s", err)
+		}
+		log.SetOutput(f)
+	}
+
+	return nil
+}
+
+// watchLogLevel raises the log level one step on SIGUSR1, up to DEBUG, and
+// lowers it one step on SIGUSR2, down to ERROR.
+func watchLogLevel() {
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range usr {
+		l := log.GetLevel()
+		switch {
+		case sig == syscall.SIGUSR1 && l < log.DebugLevel:
+			l++
+		case sig == syscall.SIGUSR2 && l > log.ErrorLevel:
+			l--
+		}
+		setLogLevel(l)
+	}
+}
+
+// setLogLevel sets the log level, logging the change while the more
+// verbose of the previous and new levels is set, at that level or INFO,
+// so that the change shows whichever the level
+func setLogLevel(l log.Level) {
+	prev := log.GetLevel()
+	verbose := prev
+	if l > verbose {
+		verbose = l
+		log.SetLevel(l)
+	}
+
+	notice := verbose
+	if notice > log.InfoLevel {
+		notice = log.InfoLevel
+	}
+	log.WithField("previous", prev.String()).Logf(notice, "Log level set to %s", l)
+	log.SetLevel(l)
+}
+
+// LogLevelHandler serves the log level on GET, and sets it to the level
+// named in the body of a PUT
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l, err := log.ParseLevel(strings.ToLower(strings.TrimSpace(string(b))))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(l)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, log.GetLevel())
+}
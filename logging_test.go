@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogLevelHandler(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+
+	for _, tt := range []struct {
+		method string
+		body   string
+		status int
+		level  log.Level
+	}{
+		{http.MethodGet, "", http.StatusOK, log.InfoLevel},
+		{http.MethodPut, " DEBUG\n", http.StatusOK, log.DebugLevel},
+		{http.MethodPut, "verbose", http.StatusBadRequest, log.DebugLevel},
+		{http.MethodPost, "error", http.StatusMethodNotAllowed, log.DebugLevel},
+		{http.MethodPut, "error", http.StatusOK, log.ErrorLevel},
+	} {
+		w := httptest.NewRecorder()
+		LogLevelHandler(w, httptest.NewRequest(tt.method, "/v1/loglevel", strings.NewReader(tt.body)))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %q => %d, want %d", tt.method, tt.body, w.Code, tt.status)
+		}
+		if l := log.GetLevel(); l != tt.level {
+			t.Errorf("%s %q set the level to %s, want %s", tt.method, tt.body, l, tt.level)
+		}
+		if tt.status == http.StatusOK && strings.TrimSpace(w.Body.String()) != tt.level.String() {
+			t.Errorf("%s %q => %q, want the level %s", tt.method, tt.body, w.Body, tt.level)
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer log.SetOutput(log.StandardLogger().Out)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+
+	for _, tt := range []struct {
+		from, to log.Level
+		notice   string
+	}{
+		{log.ErrorLevel, log.DebugLevel, "level=info"},
+		{log.DebugLevel, log.ErrorLevel, "level=info"},
+		{log.ErrorLevel, log.WarnLevel, "level=warning"},
+		{log.ErrorLevel, log.ErrorLevel, "level=error"},
+	} {
+		out.Reset()
+		log.SetLevel(tt.from)
+		setLogLevel(tt.to)
+
+		if log.GetLevel() != tt.to {
+			t.Errorf("setLogLevel(%s) from %s => %s", tt.to, tt.from, log.GetLevel())
+		}
+		if !strings.Contains(out.String(), tt.notice) || !strings.Contains(out.String(), "Log level set to "+tt.to.String()) {
+			t.Errorf("setLogLevel(%s) from %s logged %q, want the change at %s", tt.to, tt.from, out.String(), tt.notice)
+		}
+	}
+}
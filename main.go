@@ -1,15 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/CiscoCloud/mesos-consul/config"
 	"github.com/CiscoCloud/mesos-consul/consul"
+	"github.com/CiscoCloud/mesos-consul/dnsserver"
+	"github.com/CiscoCloud/mesos-consul/emergencydns"
+	"github.com/CiscoCloud/mesos-consul/etcd"
+	"github.com/CiscoCloud/mesos-consul/eureka"
+	"github.com/CiscoCloud/mesos-consul/kubernetes"
 	"github.com/CiscoCloud/mesos-consul/mesos"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/plugin"
+	"github.com/CiscoCloud/mesos-consul/redact"
 
 	flag "github.com/ogier/pflag"
 	log "github.com/sirupsen/logrus"
@@ -19,35 +31,360 @@ const Name = "mesos-consul"
 const Version = "0.3.1"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dashboard" {
+		os.Exit(dashboard(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "services" {
+		os.Exit(services(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		os.Exit(purge(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "filters" {
+		os.Exit(filters(os.Args[2:]))
+	}
+
 	c, err := parseFlags(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Checked before the services below start with the options
+	mesos.MustValidate(c)
+	go watchLogLevel()
 
 	if c.Healthcheck {
 		go StartHealthcheckService(c)
 	}
+	if c.MetricsAddress != "" {
+		go StartMetricsService(c)
+	}
+	if c.DebugAddress != "" {
+		go StartDebugService(c)
+	}
+	if c.Statsd != "" {
+		go StartStatsd(c)
+	}
 
 	log.Info("Using zookeeper: ", c.Zk)
 	leader := mesos.New(c)
+	if c.Healthcheck {
+		http.HandleFunc("/readyz", ReadyHandler(leader))
+		http.HandleFunc("/skipped", SkippedHandler(leader))
+		http.HandleFunc("/services", ServicesHandler(leader))
+		http.HandleFunc("/v1/status", StatusHandler(leader))
+	}
+
+	if d := mesos.Splay(c.RefreshSplay); d > 0 {
+		log.Infof("Waiting %v before the first refresh", d)
+		time.Sleep(d)
+	}
+
+	if c.Once {
+		shutdown(leader, refreshOnce(c, leader))
+	}
+
+	if c.EmergencyDNS != "" {
+		go StartEmergencyDNS(c, leader)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	if c.RefreshAdaptive {
+		refreshAdaptive(c, leader, hup, stop)
+		return
+	}
 
-	ticker := time.NewTicker(c.Refresh)
 	leader.Refresh()
-	for _ = range ticker.C {
+	next := time.After(mesos.Jitter(c.Refresh, c.RefreshJitter))
+	for {
+		select {
+		case <-next:
+			leader.Refresh()
+			next = time.After(mesos.Jitter(c.Refresh, c.RefreshJitter))
+		case <-hup:
+			if reload(c, leader) {
+				next = time.After(mesos.Jitter(c.Refresh, c.RefreshJitter))
+			}
+		case sig := <-stop:
+			log.Infof("Received %s, stopping", sig)
+			shutdown(leader, 0)
+		}
+	}
+}
+
+// shutdown sends the queued webhook notifications, stops the registry
+// plugins, which would otherwise outlive mesos-consul, and exits with the
+// given status
+func shutdown(leader *mesos.Mesos, status int) {
+	leader.Close()
+	plugin.Cleanup()
+	os.Exit(status)
+}
+
+// refreshOnce runs a single refresh and returns the exit status, 1 when
+// the refresh or one of its registry operations failed. While another
+// instance holds the --consul-lock, the refresh is run again every
+// --refresh until the lock is acquired.
+func refreshOnce(c *config.Config, leader *mesos.Mesos) int {
+	failed := metrics.RegistryErrors.Total()
+
+	for {
+		if err := leader.Refresh(); err != nil {
+			log.Error("Refresh failed: ", err)
+			return 1
+		}
+		if s := leader.Status(); s.LastRefresh == nil || s.LastRefresh.Outcome != mesos.RefreshStandby {
+			break
+		}
+
+		log.Infof("Another instance holds the lock, trying again in %v", c.Refresh)
+		time.Sleep(c.Refresh)
+	}
+	if n := metrics.RegistryErrors.Total() - failed; n > 0 {
+		log.Errorf("%v registry operations failed", n)
+		return 1
+	}
+
+	return 0
+}
+
+// refreshAdaptive runs the refresh loop, adjusting the interval to the
+// task churn of recent cycles.
+func refreshAdaptive(c *config.Config, leader *mesos.Mesos, hup <-chan os.Signal, stop <-chan os.Signal) {
+	refresh := func() int {
 		leader.Refresh()
+		return leader.Churn()
+	}
+	reloaded := func() bool {
+		return reload(c, leader)
+	}
+
+	runAdaptive(c, refresh, reloaded, hup, stop)
+	shutdown(leader, 0)
+}
+
+// adaptiveSchedule times the refreshes of --refresh-adaptive
+type adaptiveSchedule struct {
+	c    *config.Config
+	a    *mesos.AdaptiveRefresh
+	last time.Time
+	wait time.Duration
+}
+
+func newAdaptiveSchedule(c *config.Config) *adaptiveSchedule {
+	return &adaptiveSchedule{
+		c: c,
+		a: mesos.NewAdaptiveRefresh(c.Refresh, c.RefreshMin, c.RefreshMax, c.RefreshChurn),
 	}
 }
 
+// refreshed records a refresh ended at now with the given churn, and
+// computes the wait before the next one
+func (s *adaptiveSchedule) refreshed(now time.Time, churn int) {
+	s.last = now
+	s.wait = mesos.Jitter(s.a.Next(churn), s.c.RefreshJitter)
+}
+
+// reloaded restarts the adaptation from the reloaded --refresh, the next
+// refresh being timed from the last one
+func (s *adaptiveSchedule) reloaded() {
+	s.a = mesos.NewAdaptiveRefresh(s.c.Refresh, s.c.RefreshMin, s.c.RefreshMax, s.c.RefreshChurn)
+	s.wait = mesos.Jitter(s.a.Interval(), s.c.RefreshJitter)
+}
+
+// next returns when the next refresh is due
+func (s *adaptiveSchedule) next() time.Time {
+	return s.last.Add(s.wait)
+}
+
+// runAdaptive runs refresh, which returns the task churn of the cycle,
+// every adaptive interval, and reload on each SIGHUP, until a signal on
+// stop. A reload neither runs a refresh nor delays the next one, unless
+// it changes the refresh interval. It returns the schedule.
+func runAdaptive(c *config.Config, refresh func() int, reload func() bool, hup <-chan os.Signal, stop <-chan os.Signal) *adaptiveSchedule {
+	s := newAdaptiveSchedule(c)
+	s.refreshed(time.Now(), refresh())
+	log.Debugf("Next refresh in %v", s.wait)
+
+	for {
+		timer := time.NewTimer(time.Until(s.next()))
+		select {
+		case <-timer.C:
+			churn := refresh()
+			s.refreshed(time.Now(), churn)
+			log.WithField("churn", churn).Debugf("Next refresh in %v", s.wait)
+		case <-hup:
+			timer.Stop()
+			if reload() {
+				s.reloaded()
+			}
+		case sig := <-stop:
+			timer.Stop()
+			log.Infof("Received %s, stopping", sig)
+			return s
+		}
+	}
+}
+
+// reload re-reads the configuration file on SIGHUP and applies its
+// filters, task tags and IP order. It returns whether the refresh
+// interval changed, updating c.
+func reload(c *config.Config, leader *mesos.Mesos) bool {
+	if c.ConfigFile == "" {
+		log.Warn("Received SIGHUP without a configuration file to reload")
+		return false
+	}
+
+	log.Info("Reloading ", c.ConfigFile)
+	r, err := reloadConfig(c.ConfigFile)
+	if err != nil {
+		log.Warn("Unable to reload the configuration, keeping the current one: ", err)
+		return false
+	}
+
+	leader.Reload(r)
+
+	switch {
+	case r.Refresh == c.Refresh:
+		return false
+	case r.Refresh <= 0:
+		log.WithField("refresh", r.Refresh).Warn("Invalid refresh interval, keeping the previous one")
+		return false
+	case r.Refresh > c.Refresh && expiringRegistry(c):
+		log.WithField("refresh", r.Refresh).Warn("The refresh interval of etcd and Eureka registries can't be lengthened without a restart, keeping the previous one")
+		return false
+	}
+
+	log.Infof("Using new refresh interval %v", r.Refresh)
+	c.Refresh = r.Refresh
+	leader.SetReadyWindow(c)
+	return true
+}
+
+// expiringRegistry returns whether c registers services in a registry
+// expiring them after a multiple of the refresh interval at startup
+func expiringRegistry(c *config.Config) bool {
+	for _, uri := range c.Registries {
+		if strings.HasPrefix(uri, "etcd://") || strings.HasPrefix(uri, "eureka://") {
+			return true
+		}
+	}
+	return false
+}
+
 func StartHealthcheckService(c *config.Config) {
 	http.HandleFunc("/health", HealthHandler)
+	http.HandleFunc("/healthz", HealthHandler)
+	http.Handle("/metrics", metrics.DefaultRegistry.Handler())
 	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%s", c.HealthcheckIp, c.HealthcheckPort), nil))
 }
 
+// StartMetricsService serves the metrics to Prometheus on a listener of
+// their own
+func StartMetricsService(c *config.Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+	log.Fatal(http.ListenAndServe(c.MetricsAddress, mux))
+}
+
+// StartStatsd pushes the metrics to the --statsd server
+func StartStatsd(c *config.Config) {
+	s := metrics.NewStatsd(metrics.DefaultRegistry, c.StatsdPrefix, c.StatsdTags, c.StatsdDogStatsD)
+	log.Fatal(s.Run(c.Statsd, c.StatsdInterval))
+}
+
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-func parseFlags(args []string) (*config.Config, error) {
+// ReadyHandler serves whether leader is ready, with a 503 status and the
+// reason when it is not
+func ReadyHandler(leader *mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := leader.Ready(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// StartEmergencyDNS serves the services registered during the last refresh
+// over DNS, for use while Consul is unavailable
+func StartEmergencyDNS(c *config.Config, leader *mesos.Mesos) {
+	s := emergencydns.New(c.EmergencyDNSDomain, leader.Services)
+	log.Fatal(s.ListenAndServe(c.EmergencyDNS))
+}
+
+// SkippedHandler serves the tasks skipped during the last refresh as JSON
+func SkippedHandler(leader *mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(redactSkipped(leader.Skipped()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// redactSkipped masks the secrets in the fields of the skipped tasks
+func redactSkipped(skipped []mesos.SkippedTask) []mesos.SkippedTask {
+	for i, t := range skipped {
+		for _, f := range []*string{&t.ID, &t.Name, &t.Framework} {
+			*f = redact.Default.String(*f)
+		}
+		skipped[i] = t
+	}
+	return skipped
+}
+
+// StatusHandler serves the status of leader as JSON
+func StatusHandler(leader *mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(redactStatus(leader.Status()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// redactStatus masks the secrets in the errors and the frameworks of the
+// status
+func redactStatus(s mesos.Status) mesos.Status {
+	if s.LastRefresh != nil {
+		s.LastRefresh.Error = redact.Default.String(s.LastRefresh.Error)
+	}
+	for i := range s.RecentErrors {
+		s.RecentErrors[i].Error = redact.Default.String(s.RecentErrors[i].Error)
+	}
+
+	services := make(map[string]int, len(s.Services))
+	for framework, n := range s.Services {
+		services[redact.Default.String(framework)] += n
+	}
+	s.Services = services
+	return s
+}
+
+// parseFlags parses the mesos-consul options in args. Subcommands
+// register their own flags through extra.
+func parseFlags(args []string, extra ...func(*flag.FlagSet)) (*config.Config, error) {
 	var doHelp bool
 	var doVersion bool
 	var c = config.DefaultConfig()
@@ -59,30 +396,130 @@ func parseFlags(args []string) (*config.Config, error) {
 
 	flags.BoolVar(&doHelp, "help", false, "")
 	flags.BoolVar(&doVersion, "version", false, "")
+	flags.StringVar(&c.ConfigFile, "config", "", "")
 	flags.StringVar(&c.LogLevel, "log-level", "WARN", "")
-	flags.DurationVar(&c.Refresh, "refresh", time.Minute, "")
+	flags.StringVar(&c.LogFormat, "log-format", LogFormatText, "")
+	flags.StringVar(&c.LogFile, "log-file", "", "")
+	flags.IntVar(&c.LogMaxSize, "log-max-size", 100, "")
+	flags.IntVar(&c.LogMaxBackups, "log-max-backups", 5, "")
+	flags.StringVar(&c.AuditLog, "audit-log", "", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.Webhooks = append(c.Webhooks, s)
+		return nil
+	}), "webhook", "")
+	flags.StringVar(&c.WebhookTemplate, "webhook-template", "", "")
+	flags.IntVar(&c.WebhookRetries, "webhook-retries", 3, "")
+	flags.DurationVar(&c.WebhookTimeout, "webhook-timeout", 10*time.Second, "")
+	reloadableFlags(flags, c)
+	flags.BoolVar(&c.RefreshAdaptive, "refresh-adaptive", false, "")
+	flags.DurationVar(&c.RefreshMin, "refresh-min", 10*time.Second, "")
+	flags.DurationVar(&c.RefreshMax, "refresh-max", 5*time.Minute, "")
+	flags.IntVar(&c.RefreshChurn, "refresh-churn", 10, "")
+	flags.IntVar(&c.RefreshJitter, "refresh-jitter", 0, "")
+	flags.DurationVar(&c.RefreshSplay, "refresh-splay", 0, "")
 	flags.StringVar(&c.Zk, "zk", "zk://127.0.0.1:2181/mesos", "")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "")
+	flags.BoolVar(&c.Once, "once", false, "")
+	flags.Var((funcVar)(func(s string) error {
+		c.Registries = append(c.Registries, s)
+		return nil
+	}), "registry", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.RegistryPlugins = append(c.RegistryPlugins, s)
+		return nil
+	}), "registry-plugin", "")
+	flags.IntVar(&c.HeartbeatsBeforeRemove, "heartbeats-before-remove", 1, "")
 	flags.StringVar(&c.Separator, "group-separator", "", "")
-	flags.StringVar(&c.MesosIpOrder, "mesos-ip-order", "netinfo,mesos,host", "")
+	flags.StringVar(&c.LabelPrefix, "label-prefix", "consul.", "")
+	flags.StringVar(&c.TaskTagLabel, "task-tag-label", "tags.extra", "")
+	flags.BoolVar(&c.ServicePerPort, "service-per-port", false, "")
+	flags.BoolVar(&c.RegisterPortless, "register-portless", true, "")
+	flags.BoolVar(&c.EnvPorts, "env-ports", false, "")
+	flags.BoolVar(&c.LabeledPortsOnly, "labeled-ports-only", false, "")
+	flags.StringVar(&c.PortPolicy, "task-port-policy", "all", "")
+	flags.StringVar(&c.DiscoveryVisibility, "discovery-visibility", "FRAMEWORK,CLUSTER,EXTERNAL", "")
+	flags.StringVar(&c.PortMode, "port-mode", "ip-order", "")
+	flags.IntVar(&c.MaxTaskPorts, "max-task-ports", 0, "")
+	flags.StringVar(&c.PortLimitPolicy, "port-limit-policy", "first", "")
+	flags.StringVar(&c.IDScheme, "id-scheme", "v1", "")
+	flags.StringVar(&c.IDTemplate, "id-template", "", "")
+	flags.BoolVar(&c.EnableTagOverride, "enable-tag-override", false, "")
+	flags.BoolVar(&c.AutoTCPCheck, "auto-tcp-check", false, "")
+	flags.DurationVar(&c.AutoTCPCheckInterval, "auto-tcp-check-interval", 30*time.Second, "")
+	flags.DurationVar(&c.CheckInterval, "check-interval", 10*time.Second, "")
+	flags.DurationVar(&c.CheckTimeout, "check-timeout", 0, "")
+	flags.DurationVar(&c.CheckDeregisterAfter, "check-deregister-after", 0, "")
+	flags.StringVar(&c.PreferNetworks, "network-preference", "", "")
+	flags.BoolVar(&c.PreferHostname, "prefer-hostname", false, "")
+	flags.StringVar(&c.WANAddressAttribute, "wan-address-attribute", "", "")
+	flags.StringVar(&c.AgentAddressMap, "agent-address-map", "", "")
+	flags.StringVar(&c.MetaSchema, "meta-schema", "", "")
+	flags.DurationVar(&c.PruneNodesAfter, "prune-nodes-after", 0, "")
+	flags.BoolVar(&c.AgentNodes, "register-agent-nodes", false, "")
 	flags.BoolVar(&c.Healthcheck, "healthcheck", false, "")
 	flags.StringVar(&c.HealthcheckIp, "healthcheck-ip", "127.0.0.1", "")
 	flags.StringVar(&c.HealthcheckPort, "healthcheck-port", "24476", "")
+	flags.IntVar(&c.ReadyIntervals, "ready-intervals", 3, "")
+	flags.StringVar(&c.FilterKV, "filter-kv", "", "")
 	flags.Var((funcVar)(func(s string) error {
-		c.WhiteList = append(c.WhiteList, s)
+		c.JobResultFramework = append(c.JobResultFramework, s)
 		return nil
-	}), "whitelist", "")
+	}), "job-result-framework", "")
+	flags.DurationVar(&c.JobResultTTL, "job-result-ttl", time.Hour, "")
 	flags.Var((funcVar)(func(s string) error {
-		c.BlackList = append(c.BlackList, s)
+		c.DataFramework = append(c.DataFramework, s)
 		return nil
-	}), "blacklist", "")
+	}), "data-framework", "")
+	flags.StringVar(&c.DriverPattern, "driver-pattern", "(?i)driver|jobmanager", "")
+	flags.StringVar(&c.EmergencyDNS, "emergency-dns", "", "")
+	flags.StringVar(&c.EmergencyDNSDomain, "emergency-dns-domain", "consul.", "")
+	flags.IntVar(&c.MetricsMaxLabelSets, "metrics-max-label-sets", 1000, "")
+	flags.StringVar(&c.MetricsAddress, "metrics-address", "", "")
+	flags.StringVar(&c.DebugAddress, "debug-address", "", "")
+	flags.StringVar(&c.DebugToken, "debug-token", "", "")
+	flags.StringVar(&c.Statsd, "statsd", "", "")
+	flags.StringVar(&c.StatsdPrefix, "statsd-prefix", "", "")
 	flags.Var((funcVar)(func(s string) error {
-		c.TaskTag = append(c.TaskTag, s)
+		c.StatsdTags = append(c.StatsdTags, s)
 		return nil
-	}), "task-tag", "")
+	}), "statsd-tag", "")
+	flags.BoolVar(&c.StatsdDogStatsD, "statsd-dogstatsd", false, "")
+	flags.DurationVar(&c.StatsdInterval, "statsd-interval", 10*time.Second, "")
 	flags.StringVar(&c.ServiceName, "service-name", "mesos", "")
 	flags.StringVar(&c.ServiceTags, "service-tags", "", "")
+	flags.StringVar(&c.ServiceNameTemplate, "service-name-template", "", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.TagTemplate = append(c.TagTemplate, s)
+		return nil
+	}), "tag-template", "")
+	flags.BoolVar(&c.FwPrefix, "fw-prefix", false, "")
+	flags.StringVar(&c.NameStrip, "name-strip", "", "")
+	flags.StringVar(&c.NameReplacement, "name-replacement", "-", "")
+	flags.BoolVar(&c.NameLowercase, "name-lowercase", true, "")
+	flags.IntVar(&c.NameMaxLength, "name-max-length", 0, "")
+	flags.StringVar(&c.LeaderTags, "leader-tags", "leader,master", "")
+	flags.StringVar(&c.MasterTags, "master-tags", "master", "")
+	flags.StringVar(&c.FollowerTags, "follower-tags", "agent,follower", "")
+	flags.StringVar(&c.LeaderService, "leader-service", "", "")
+	flags.StringVar(&c.ZkService, "zk-service", "", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.RedactPatterns = append(c.RedactPatterns, s)
+		return nil
+	}), "redact-pattern", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.RedactLabels = append(c.RedactLabels, s)
+		return nil
+	}), "redact-label", "")
 
 	consul.AddCmdFlags(flags)
+	etcd.AddCmdFlags(flags)
+	eureka.AddCmdFlags(flags)
+	kubernetes.AddCmdFlags(flags)
+	dnsserver.AddCmdFlags(flags)
+
+	for _, f := range extra {
+		f(flags)
+	}
 
 	if err := flags.Parse(args); err != nil {
 		return nil, err
@@ -93,6 +530,21 @@ func parseFlags(args []string) (*config.Config, error) {
 		return nil, fmt.Errorf("extra argument(s): %q", args)
 	}
 
+	if err := applyEnv(flags); err != nil {
+		return nil, err
+	}
+
+	cmdline = cmdlineOptions{config: *c, set: make(map[string]bool)}
+	flags.Visit(func(f *flag.Flag) {
+		cmdline.set[f.Name] = true
+	})
+
+	if c.ConfigFile != "" {
+		if err := applyConfigFile(flags, c.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
 	if doVersion {
 		fmt.Printf("%s v%s\n", Name, Version)
 		os.Exit(0)
@@ -102,56 +554,466 @@ func parseFlags(args []string) (*config.Config, error) {
 		os.Exit(0)
 	}
 
-	l, err := log.ParseLevel(strings.ToLower(c.LogLevel))
-	if err != nil {
-		log.SetLevel(log.WarnLevel)
-		log.Warnf("Invalid log level '%v'. Setting to WARN", c.LogLevel)
-	} else {
-		log.SetLevel(l)
+	if err := setupLogging(c); err != nil {
+		return nil, err
+	}
+
+	metrics.DefaultRegistry.SetMaxLabelSets(c.MetricsMaxLabelSets)
+
+	for _, p := range c.RedactPatterns {
+		if err := redact.Default.AddPattern(p); err != nil {
+			return nil, err
+		}
 	}
 
 	return c, nil
 }
 
+// reloadableFlags registers the options which are applied again when the
+// configuration file is reloaded, defaulting to their values in c
+func reloadableFlags(flags *flag.FlagSet, c *config.Config) {
+	flags.DurationVar(&c.Refresh, "refresh", c.Refresh, "")
+	flags.StringVar(&c.MesosIpOrder, "mesos-ip-order", c.MesosIpOrder, "")
+	flags.Var((funcVar)(func(s string) error {
+		c.WhiteList = append(c.WhiteList, s)
+		return nil
+	}), "whitelist", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.BlackList = append(c.BlackList, s)
+		return nil
+	}), "blacklist", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.AgentBlacklist = append(c.AgentBlacklist, s)
+		return nil
+	}), "agent-blacklist", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.LabelBlacklist = append(c.LabelBlacklist, s)
+		return nil
+	}), "label-blacklist", "")
+	flags.StringVar(&c.FilterPrecedence, "filter-precedence", c.FilterPrecedence, "")
+	flags.Var((funcVar)(func(s string) error {
+		c.TaskTag = append(c.TaskTag, s)
+		return nil
+	}), "task-tag", "")
+}
+
+// cmdlineOptions holds the options given on the command line and in the
+// environment, which take precedence over the reloaded configuration file
+type cmdlineOptions struct {
+	config config.Config
+	set    map[string]bool
+}
+
+var cmdline cmdlineOptions
+
+// reloadConfig reads the reloadable options of the configuration file at
+// path, over those of the command line and the environment
+func reloadConfig(path string) (*config.Config, error) {
+	values, err := config.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := cmdline.config
+	flags := flag.NewFlagSet("mesos-consul", flag.ContinueOnError)
+	reloadableFlags(flags, &c)
+	for name := range values {
+		if flags.Lookup(name) == nil || cmdline.set[name] {
+			delete(values, name)
+		}
+	}
+
+	if err := applyOptions(flags, path, values); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// envPrefix prefixes the environment variables setting options, named
+// after the option in upper case with '_' for '-', e.g. MESOS_CONSUL_ZK
+const envPrefix = "MESOS_CONSUL_"
+
+// applyEnv sets the options of the environment variables which were not
+// given on the command line. Options which can be specified multiple times
+// take one value per line.
+func applyEnv(flags *flag.FlagSet) error {
+	values := make(map[string][]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "help" || f.Name == "version" {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if r, ok := f.Value.(repeatable); ok && r.IsRepeatable() {
+			values[f.Name] = strings.Split(strings.TrimSpace(v), "\n")
+		} else {
+			values[f.Name] = []string{v}
+		}
+	})
+
+	return applyOptions(flags, "environment", values)
+}
+
+// applyConfigFile sets the options of the configuration file at path
+// which were not given on the command line or in the environment
+func applyConfigFile(flags *flag.FlagSet, path string) error {
+	values, err := config.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := values["config"]; ok {
+		return fmt.Errorf("%s: unknown option 'config'", path)
+	}
+
+	return applyOptions(flags, path, values)
+}
+
+// applyOptions sets the options in values which were not set yet, by a
+// source of higher precedence. The values of options which can only be
+// specified once are joined with commas.
+func applyOptions(flags *flag.FlagSet, source string, values map[string][]string) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: unknown option '%s'", source, name)
+		}
+		if set[name] {
+			continue
+		}
+
+		v := values[name]
+		if r, ok := f.Value.(repeatable); !ok || !r.IsRepeatable() {
+			v = []string{strings.Join(v, ",")}
+		}
+		for _, s := range v {
+			if err := flags.Set(name, s); err != nil {
+				return fmt.Errorf("%s: %s: %s", source, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func Help() string {
 	helpText := `
 Usage: mesos-consul [options]
+       mesos-consul simulate --before=<file> --after=<file> [options]
+       mesos-consul dashboard [--format=grafana-json] [--title=<title>]
+       mesos-consul validate [--offline] [--timeout=<time>] [options]
+       mesos-consul services [--healthcheck-ip=<ip>] [--healthcheck-port=<port>]
+       mesos-consul purge [--prefix=<prefix>] [--dry-run] [--timeout=<time>] [options]
+       mesos-consul filters [--test] [--timeout=<time>] [options]
+
+Commands:
+
+  simulate			Run two Mesos state.json snapshots through the
+				registration pipeline and print the register and
+				deregister calls the transition from --before to
+				--after would cause. Nothing is sent to Consul
+  dashboard			Print a dashboard definition graphing the metrics
+				exported by mesos-consul. --format is one of
+				[ "grafana-json" ] (default grafana-json), --title
+				sets the dashboard title (default mesos-consul)
+  validate			Check the options, then that Zookeeper knows a leading
+				master and that Consul answers, and print every
+				problem found. --offline skips the connection checks,
+				--timeout bounds each of them (default 10s)
+  services			Print the services a running mesos-consul registered
+				during its last refresh, with their task, agent,
+				registration and last seen times, from its
+				--healthcheck endpoint
+  purge				Deregister the services of the Consul catalog whose ID
+				starts with --prefix (default the services registered
+				by mesos-consul, under any ID scheme or template) and
+				which no running task corresponds to. --dry-run only lists
+				them, --timeout bounds the Zookeeper lookup (default 10s)
+  filters			Print the filters in the order they apply. With --test,
+				load the state of the leading master and print whether
+				each running task would be registered and the rule
+				deciding it. --timeout bounds the Zookeeper lookup
+				(default 10s)
 
 Options:
 
   --version 			Print mesos-consul version
+  --config=<file>		HCL (.hcl) or YAML (.yaml, .yml, .json) file setting the
+				options not given on the command line or in the
+				environment. Filters, task tags, IP order and refresh
+				are re-read on SIGHUP. See README (default not set)
   --log-level=<log_level>	Set the Logging level to one of [ "DEBUG", "INFO", "WARN", "ERROR" ]
 				(default "WARN")
+  --log-format=<format>		Format of the log lines, one of [ "text", "json" ]
+				(default text)
+  --log-file=<path>		Write the log to a file rotated by size instead of
+				stderr (default not set)
+  --log-max-size=<MB>		Size in megabytes over which the --log-file is
+				rotated, 0 to disable the rotation (default 100)
+  --log-max-backups=<n>		Number of rotated log files kept (default 5)
+  --audit-log=<path>		Write a JSON record of each service registered or
+				deregistered, with the reason, to this file, rotated
+				like --log-file (default not set)
+  --webhook=<url>		POST the services registered or deregistered during
+				each refresh, with the reasons, to this URL. May be
+				given multiple times
+  --webhook-template=<template>	Go template of the webhook bodies, rendered with the
+				list of the --audit-log records of a refresh
+				(default the records as a JSON list)
+  --webhook-retries=<n>		Retries of a webhook post failing with an error, a
+				5xx status or a 429 status (default 3)
+  --webhook-timeout=<time>	Timeout of a webhook post (default 10s)
   --refresh=<time>		Set the Mesos refresh rate (default 1m)
+  --refresh-adaptive		Adjust the refresh rate to the task churn of recent cycles,
+				starting from --refresh (default not enabled)
+  --refresh-min=<time>		Shortest adaptive refresh rate (default 10s)
+  --refresh-max=<time>		Longest adaptive refresh rate (default 5m)
+  --refresh-churn=<num>		Number of started or stopped tasks per cycle above which
+				the adaptive refresh rate is shortened (default 10)
+  --refresh-jitter=<percent>	Randomly lengthen or shorten each refresh interval by
+				up to this percentage of it, from 0 to 99 (default 0)
+  --refresh-splay=<time>	Wait a random delay shorter than this before the first
+				refresh (default 0)
   --zk=<address>		Zookeeper path to Mesos (default zk://127.0.0.1:2181/mesos)
+  --dry-run			Discover tasks and print the register and deregister
+				calls of every refresh, with the service name, ID,
+				address, port, tags and check, instead of making
+				them. Nothing is written to the registries, the
+				services registered are only read from Consul
+				(default not enabled)
+  --once			Run a single refresh and exit, with status 1 if it or
+				one of its registry operations failed, e.g. from cron.
+				Waits for the --consul-lock held by another instance
+				(default not enabled)
+  --registry=<registry>		Registry backend, consul, etcd://<host:port>,... for
+				an etcd v3 cluster, or eureka://<host:port>,.../<path>
+				for Eureka servers, or serverset://<host:port>,.../<root>
+				for ZooKeeper serversets, or k8s://[<host:port>]/<namespace>
+				for a Kubernetes namespace, dns://<ip:port> to serve
+				the services over DNS, or file://<path> to write them
+				to a JSON file. Can be specified multiple
+				times to register in all of them (default consul)
+  --registry-plugin=<path>	Register in the registry of the given plugin binary, along
+				the --registry ones. Can be specified multiple times
+				(default not set)
   --group-separator=<separator> Choose the group separator. Will replace _ in task names (default is empty)
+  --label-prefix=<prefix>	Prefix of the task labels recognized by mesos-consul,
+				such as consul.address (default consul.)
+  --service-per-port		Register each port of a task as a separate service named
+				<task>-<port name|index> (default not enabled)
+  --register-portless		Register tasks without ports, such as batch workers and
+				sidecars, with port 0. --register-portless=false
+				skips them (default enabled)
+  --env-ports			Read the ports of tasks without DiscoveryInfo or port
+				resources from their PORT0..PORTn command environment
+				variables (default not enabled)
+  --labeled-ports-only		Only register ports named by a SERVICE_<port>_NAME or
+				consul.port.<index>.name task label. Same as
+				--task-port-policy=label (default not enabled)
+  --task-port-policy=<policy>	Which ports of a task to register. One of [ "all",
+				"first", "index:<n>", "label" ] (default all)
+  --discovery-visibility=<vis>,... Comma delimited list of DiscoveryInfo port visibilities
+				to register. Ports with another visibility are skipped
+				(default FRAMEWORK,CLUSTER,EXTERNAL)
+  --port-mode=<mode>		Register the --mesos-ip-order address and host ports
+				("ip-order"), the agent address and host ports ("host"),
+				the container address and container ports ("container"),
+				or "host" for bridge-mode Docker tasks only ("auto")
+				(default ip-order)
+  --max-task-ports=<num>	Maximum number of ports registered per task. 0 disables
+				the limit (default 0)
+  --port-limit-policy=<policy>	Which ports of a task over --max-task-ports to register.
+				One of [ "first", "named" ] (default first)
+  --id-scheme=<scheme>		Service ID scheme. "v1" IDs include the service name,
+				"v2" IDs only the agent address, task ID and port.
+				See README before switching (default v1)
+  --id-template=<template>	Go template of the service IDs of tasks, replacing
+				--id-scheme, e.g. 'mesos-consul:{{.Agent}}:{{.TaskID}}:{{.Port}}'.
+				Services whose ID does not start with mesos-consul:
+				are marked with registered-by=mesos-consul meta.
+				See README before switching (default not set)
+  --enable-tag-override		Let external tools change the tags of task services in
+				Consul without mesos-consul restoring them. Set per task
+				with the consul.enable-tag-override label
+				(default not enabled)
+  --auto-tcp-check		Add a TCP check of the registered address and port to task
+				services without a check label or Mesos HTTP health check
+				(default not enabled)
+  --auto-tcp-check-interval=<time> Interval of the automatic TCP checks, unless set by
+				the check_interval label (default 30s)
+  --check-interval=<time>	Interval of the checks of task services, unless set by the
+				check_interval label or the Mesos health check (default 10s)
+  --check-timeout=<time>	Timeout of the checks of task services, unless set by the
+				check_timeout label or the Mesos health check
+				(default Consul default)
+  --check-deregister-after=<time> Let Consul deregister task services whose check stayed
+				critical for the given time, unless set by the
+				check_deregister_after label (default not enabled)
   --healthcheck 		Enables a http endpoint for health checks. When this
-				flag is enabled, serves a service health status on 127.0.0.1:24476 (default not enabled)
+				flag is enabled, serves a service health status on 127.0.0.1:24476,
+				liveness on /healthz, readiness on /readyz, the tasks
+				skipped during the last refresh on /skipped, the
+				services registered on /services, the status on
+				/v1/status and the metrics on /metrics
+				(default not enabled)
   --healthcheck-ip=<ip> 	Health check interface ip (default 127.0.0.1)
   --healthcheck-port=<port>	Health check service port (default 24476)
+  --ready-intervals=<num>	Report the instance as not ready on /readyz when no
+				refresh succeeded for this many refresh intervals
+				(default 3)
   --mesos-ip-order		Comma separated list to control the order in
 				which github.com/CiscoCloud/mesos-consul searches for the task IP
-				address. Valid options are 'netinfo', 'mesos', 'docker' and 'host'
+				address. Valid options are 'netinfo', 'netinfo4', 'netinfo6',
+				'mesos', 'docker', 'host', 'hostname', 'label' and 'cloud'
 				(default netinfo,mesos,host)
-  --heartbeats-before-remove	Number of times that registration needs to fail before removing
-				task from Consul. (default: 1)
+  --prefer-hostname		Register tasks with the hostname of their agent instead of
+				an IP address. Same as putting 'hostname' first in
+				--mesos-ip-order (default not enabled)
+  --wan-address-attribute=<name> Agent attribute holding the public address of the agent.
+				Task services are registered with their address as
+				"lan" tagged address and this one as "wan", unless set by
+				the consul.wan-address label (default not set)
+  --network-preference=<name>,... Comma delimited list of container network names, in order
+				of preference. Tasks attached to one of them are registered
+				with their address on that network, ahead of --mesos-ip-order
+				(default not set)
+  --agent-address-map=<file>	File of '<hostname|slave id> <address>' lines overriding
+				the address Mesos reports for an agent. Re-read when
+				it changes (default not set)
+  --meta-schema=<file>		File of '<key> <value regex>' lines listing the Meta keys
+				consul.meta.<key> task labels may set. Replaces the
+				lb-algorithm, proxy-protocol and sticky defaults
+				(default not set)
+  --prune-nodes-after=<time>	Deregister the Consul node of an agent absent from Mesos
+				for longer than the given time, unless its Consul agent
+				is alive or it has services not created by mesos-consul
+				(default not enabled)
+  --register-agent-nodes	Register a Consul catalog node with the ID, version and
+				attributes of each Mesos agent as node meta. Requires
+				--consul-catalog
+				(default not enabled)
+  --heartbeats-before-remove	Number of refreshes a service can be missing from before
+				it is deregistered, from every registry but dns://
+				(default: 1)
   --whitelist=<regex>		Only register services matching the provided regex. 
 				Can be specified multiple times
   --blacklist=<regex>		Do not register services matching the provided regex. 
 				Can be specified multiple times
+  --filter-precedence=<list>	Which list wins when a task matches both the whitelist
+				and the blacklist. One of [ "blacklist", "whitelist" ]
+				(default blacklist)
+  --agent-blacklist=<regex>	Do not register the agents whose hostname or ID matches
+				the provided regex, nor their tasks, whatever their
+				name. Can be specified multiple times
+  --label-blacklist=<key[=value]> Do not register tasks with the given label, or with
+				any value of it without '=value', whatever their name.
+				Can be specified multiple times
+  --filter-kv=<path>		Consul KV path of 'whitelist' and 'blacklist' keys, one
+				regex per line, replacing --whitelist and --blacklist
+				while they exist. Re-read on every refresh
+				(default not set)
   --task-tag=<pattern:tag>	Tag tasks whose name contains 'pattern' substring (case-insensitive) with given tag.
 				Can be specified multiple times
+  --tag-template=<template>	Go template of a tag of the task services, e.g.
+				'env-{{.Label "ENVIRONMENT"}}'. No tag is added when it
+				fails to render. See README. Can be specified multiple times
+  --task-tag-label=<name>	Task label, under --label-prefix, holding extra tags of the
+				task services, comma separated. Empty to disable
+				(default tags.extra)
+  --job-result-framework=<regex> Register a <task>-result service for the latest completed
+				run of each task of frameworks matching the provided regex.
+				Can be specified multiple times
+  --job-result-ttl=<time>	How long job result services stay registered after the
+				task completed (default 1h)
+  --data-framework=<regex>	Only register the driver tasks of frameworks matching the
+				provided regex, such as Spark and Flink, tagged with
+				"driver" and their job name. Can be specified multiple times
+  --driver-pattern=<regex>	Names of the driver tasks of the data frameworks, unless
+				set by the consul.role label (default (?i)driver|jobmanager)
+  --emergency-dns=<ip:port>	Serve A, AAAA and SRV lookups of the registered services
+				from memory on the given address, as an emergency
+				fallback for Consul DNS (default not enabled)
+  --emergency-dns-domain=<domain> Domain of the emergency DNS responder (default consul.)
+  --metrics-max-label-sets=<num> Maximum number of distinct framework/agent label sets
+				kept per metric. Further samples are aggregated under
+				"other". 0 disables the cap (default 1000)
+  --metrics-address=<ip:port>	Serve the metrics to Prometheus on /metrics at this
+				address. They are also served on the --healthcheck
+				endpoint (default not set)
+  --debug-address=<ip:port>	Serve the CPU, memory and goroutine profiles of
+				net/http/pprof under /debug/pprof/, and the log level
+				on /v1/loglevel, at this address (default not set)
+  --debug-token=<token>		Bearer token required by the --debug-address endpoints
+  --statsd=<host:port>		Push the metrics to this statsd server over UDP
+				(default not set)
+  --statsd-prefix=<prefix>	Prefix of the statsd metric names, followed by a dot
+				(default none)
+  --statsd-tag=<key>:<value>	Tag added to every metric with --statsd-dogstatsd.
+				May be given multiple times
+  --statsd-dogstatsd		Send the metric labels as DogStatsD tags instead of
+				appending their values to the metric names
+				(default not enabled)
+  --statsd-interval=<time>	Interval of the statsd pushes (default 10s)
   --service-name=<name>		Service name of the Mesos hosts. (default: mesos)
   --service-tags=<tag>,...	Comma delimited list of tags to add to the mesos hosts
 				Hosts are registered as
 				(leader|master|follower).<tag>.mesos.service.conul
-` + consul.Help()
+  --service-name-template=<template>
+				Go template of the service names of tasks, e.g.
+				'{{.Framework}}{{.Sep}}{{.TaskName}}', replacing the
+				cleaned task name. See README (default not set)
+  --fw-prefix			Prefix the service names of tasks with the name of
+				their framework, e.g. marathon-myapp (default false)
+  --name-strip=<chars>		Characters removed from service names (default not set)
+  --name-replacement=<str>	Replacement of the characters of service names not
+				allowed in DNS names. May be empty (default -)
+  --name-lowercase		Lowercase service names (default true)
+  --name-max-length=<num>	Truncate longer service names, ending them with a hash
+				of the full name. 0 disables the limit (default 0)
+  --leader-tags=<tag>,...	Tags of the leading Mesos master. {version} is replaced
+				by its Mesos version (default: leader,master)
+  --master-tags=<tag>,...	Tags of the other Mesos masters, e.g. standby
+				(default: master)
+  --follower-tags=<tag>,...	Tags of the Mesos agents (default: agent,follower)
+  --leader-service=<name>	Also register the leading Mesos master under this
+				service name (default not enabled)
+  --zk-service=<name>		Register the members of the --zk ensemble under this
+				service name, e.g. zookeeper, with a ruok check
+				(default not enabled)
+  --redact-pattern=<regex>	Mask the matches of the provided regex, or of its first
+				capture group, in logs, /skipped and simulate output.
+				Adds to the token, password and secret patterns.
+				Can be specified multiple times
+  --redact-label=<key>		Mask the values of the given task label in logs, /skipped
+				and simulate output. Can be specified multiple times
+` + consul.Help() + etcd.Help() + eureka.Help() + kubernetes.Help() + dnsserver.Help()
 
 	return strings.TrimSpace(helpText)
 }
 
+// repeatable is implemented by the values of the options which can be
+// specified multiple times
+type repeatable interface {
+	IsRepeatable() bool
+}
+
 type funcVar func(s string) error
 
 func (f funcVar) Set(s string) error { return f(s) }
 func (f funcVar) String() string     { return "" }
 func (f funcVar) IsBoolFlag() bool   { return false }
+func (f funcVar) IsRepeatable() bool { return true }
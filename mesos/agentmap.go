@@ -0,0 +1,103 @@
+package mesos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// agentAddressMap holds agent address overrides read from a file, keyed
+// by agent hostname or slave ID. The file is re-read whenever it changes.
+type agentAddressMap struct {
+	path    string
+	modTime time.Time
+	entries map[string]string
+}
+
+func newAgentAddressMap(path string) *agentAddressMap {
+	a := &agentAddressMap{
+		path:    path,
+		entries: make(map[string]string),
+	}
+	a.reload()
+
+	return a
+}
+
+// reload re-reads the file if it was modified since the last read. On
+// error the previous mapping is kept.
+func (a *agentAddressMap) reload() {
+	if a == nil || a.path == "" {
+		return
+	}
+
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		log.WithField("agent-address-map", a.path).Warn("Unable to stat agent address map: ", err)
+		return
+	}
+	if fi.ModTime().Equal(a.modTime) {
+		return
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		log.WithField("agent-address-map", a.path).Warn("Unable to open agent address map: ", err)
+		return
+	}
+	defer f.Close()
+
+	entries, err := parseAgentAddressMap(f)
+	if err != nil {
+		log.WithField("agent-address-map", a.path).Warn("Keeping previous agent address map: ", err)
+		return
+	}
+
+	log.WithField("agent-address-map", a.path).Infof("Loaded %d agent address overrides", len(entries))
+	a.entries = entries
+	a.modTime = fi.ModTime()
+}
+
+// lookup returns the override address for an agent, matching on slave
+// ID first and hostname second.
+func (a *agentAddressMap) lookup(id string, hostname string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	if addr, ok := a.entries[id]; ok {
+		return addr, true
+	}
+	addr, ok := a.entries[hostname]
+	return addr, ok
+}
+
+// parseAgentAddressMap reads one `<hostname|slave id> <address>` pair per
+// line. Blank lines and lines starting with # are ignored.
+func parseAgentAddressMap(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected '<hostname|slave id> <address>', got %q", n, line)
+		}
+		entries[fields[0]] = fields[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
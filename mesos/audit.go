@@ -0,0 +1,211 @@
+package mesos
+
+import (
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/webhook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons of the registry mutations written to the audit log
+const (
+	AuditNewTask        = "new-task"
+	AuditTaskGone       = "task-gone"
+	AuditFilterChange   = "filter-change"
+	AuditServiceChanged = "service-changed"
+	AuditNewHost        = "new-host"
+	AuditHostGone       = "host-gone"
+	AuditCritical       = registry.ReasonCritical
+)
+
+// auditTrail writes the services the registries register and deregister
+// to the --audit-log, and notifies the --webhook endpoints. A change is
+// recorded once, however many registries or datacenters apply it.
+type auditTrail struct {
+	log      *audit.Log
+	webhooks *webhook.Notifier
+
+	// Tasks filtered out during the last cycle
+	filtered map[string]bool
+
+	// Tasks filtered out during the current cycle, once its tasks are
+	// registered
+	current map[string]bool
+
+	// Services to record once a registry registers them during the
+	// current cycle, by ID
+	pending map[string]auditIntent
+
+	// Services recorded as deregistered since the current cycle started,
+	// by ID
+	deregistered map[string]bool
+}
+
+// auditIntent is a registration of the current cycle to record
+type auditIntent struct {
+	taskID string
+	reason string
+}
+
+func (a *auditTrail) enabled() bool {
+	return a.log != nil || a.webhooks != nil
+}
+
+// Close waits for the queued webhook notifications to be sent, before
+// mesos-consul exits
+func (m *Mesos) Close() {
+	if m.audit.webhooks != nil {
+		m.audit.webhooks.Close()
+	}
+}
+
+// startAuditCycle keeps the tasks filtered out during the last cycle,
+// telling the tasks registered after a filter change from the others
+func (m *Mesos) startAuditCycle() {
+	if !m.audit.enabled() {
+		return
+	}
+	m.audit.filtered = m.filteredTasks()
+	m.audit.current = nil
+	m.audit.pending = make(map[string]auditIntent)
+	m.audit.deregistered = make(map[string]bool)
+}
+
+// endAuditCycle keeps the tasks filtered out during the current cycle,
+// once its tasks are registered, for the reasons of the deregistrations
+func (m *Mesos) endAuditCycle() {
+	if !m.audit.enabled() {
+		return
+	}
+	m.audit.current = m.filteredTasks()
+}
+
+// filteredTasks returns the IDs of the tasks filtered out during the
+// last complete cycle
+func (m *Mesos) filteredTasks() map[string]bool {
+	m.skipped.Lock()
+	defer m.skipped.Unlock()
+
+	filtered := make(map[string]bool)
+	for _, s := range m.skipped.last {
+		switch s.Reason {
+		case SkipFiltered, SkipFilteredAgent, SkipFilteredLabel:
+			filtered[s.ID] = true
+		}
+	}
+	return filtered
+}
+
+// flushAudit sends the records of the cycle to the --webhook endpoints,
+// in one batch
+func (m *Mesos) flushAudit() {
+	if m.audit.webhooks != nil {
+		m.audit.webhooks.Flush()
+	}
+}
+
+// auditRegister keeps the reason of the registration of s for task
+// taskID, empty for the Mesos hosts, until a registry registers it.
+// Services in the registry cache were registered before and are only
+// recorded when they changed.
+func (m *Mesos) auditRegister(s *registry.Service, taskID string, changed bool) {
+	if !m.audit.enabled() {
+		return
+	}
+
+	reason := AuditServiceChanged
+	switch {
+	case changed:
+	case m.Registry.CacheLookup(s.ID) != nil:
+		return
+	case taskID == "":
+		reason = AuditNewHost
+	case m.audit.filtered[taskID]:
+		reason = AuditFilterChange
+	default:
+		if _, ok := m.taskIDs[taskID]; !ok {
+			reason = AuditNewTask
+		}
+	}
+
+	m.audit.pending[s.ID] = auditIntent{taskID: taskID, reason: reason}
+}
+
+// auditApplied records an operation a registry made. Registrations are
+// recorded when auditRegister kept their reason, by the first registry
+// making them. Deregistrations are recorded whenever the first registry
+// makes them, including those of the services loaded from the registry,
+// of the services whose check is critical and of those held back for
+// --heartbeats-before-remove.
+func (m *Mesos) auditApplied(o *registry.Operation) {
+	s := o.Service
+	if o.Op == audit.OpRegister {
+		intent, ok := m.audit.pending[s.ID]
+		if !ok {
+			return
+		}
+		delete(m.audit.pending, s.ID)
+		m.auditWrite(audit.OpRegister, s, intent.taskID, intent.reason)
+		return
+	}
+
+	if m.audit.deregistered[s.ID] {
+		return
+	}
+	if m.audit.deregistered != nil {
+		m.audit.deregistered[s.ID] = true
+	}
+
+	taskID := s.Meta[registry.TaskIDMetaKey]
+	m.owned.Lock()
+	if owned, ok := m.owned.services[s.ID]; ok {
+		if taskID == "" {
+			taskID = owned.Task
+		}
+		if s.Agent == "" {
+			c := *s
+			c.Agent = owned.Agent
+			s = &c
+		}
+	}
+	m.owned.Unlock()
+
+	reason := o.Reason
+	if reason == "" {
+		reason = AuditServiceChanged
+		if taskID == "" {
+			reason = AuditHostGone
+		} else if _, ok := m.taskIDs[taskID]; !ok {
+			reason = AuditTaskGone
+		} else if m.audit.current[taskID] {
+			reason = AuditFilterChange
+		}
+	}
+
+	m.auditWrite(audit.OpDeregister, s, taskID, reason)
+}
+
+func (m *Mesos) auditWrite(op string, s *registry.Service, taskID string, reason string) {
+	r := redact.Default.Record(audit.Record{
+		Time:      time.Now(),
+		Op:        op,
+		ServiceID: s.ID,
+		Service:   s.Name,
+		TaskID:    taskID,
+		Agent:     s.Agent,
+		Reason:    reason,
+	})
+
+	if m.audit.webhooks != nil {
+		m.audit.webhooks.Notify(r)
+	}
+	if m.audit.log != nil {
+		if err := m.audit.log.Write(r); err != nil {
+			log.WithField("service", s.ID).Warn("Unable to write the audit log: ", err)
+		}
+	}
+}
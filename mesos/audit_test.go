@@ -0,0 +1,194 @@
+package mesos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// appliedRecorder is a recorder reporting its operations to the audit
+// trail, but for the registrations of the services of the failing tasks,
+// and the deregistrations of the held services
+type appliedRecorder struct {
+	*recorder
+	failing map[string]bool
+	held    map[string]bool
+}
+
+func (r *appliedRecorder) Register(s *registry.Service) {
+	if r.failing[s.Meta[registry.TaskIDMetaKey]] {
+		registry.Failed("register", s.ID, errors.New("connection refused"))
+		return
+	}
+	if _, ok := r.services[s.ID]; ok {
+		r.CacheMark(s.ID)
+		return
+	}
+
+	r.recorder.Register(s)
+	registry.Applied("register", s, "")
+}
+
+func (r *appliedRecorder) Deregister() {
+	services := make(map[string]*registry.Service, len(r.services))
+	for id, s := range r.services {
+		services[id] = s
+		if r.held[id] {
+			r.marked[id] = true
+		}
+	}
+
+	r.recorder.Deregister()
+	for id, s := range services {
+		if _, ok := r.services[id]; !ok {
+			registry.Applied("deregister", s, "")
+		}
+	}
+}
+
+// critical deregisters the service of task taskID, as if its check
+// stayed critical
+func (r *appliedRecorder) critical(taskID string) {
+	for id, s := range r.services {
+		if s.Meta[registry.TaskIDMetaKey] == taskID {
+			r.CacheDelete(id)
+			registry.Applied("deregister", s, registry.ReasonCritical)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	api := `{"id": "api.1", "name": "api", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31002-31002]"}}`
+	db := `{"id": "db.1", "name": "db", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31003-31003]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	var buf bytes.Buffer
+	m := newMesos(c)
+	r := &appliedRecorder{recorder: newRecorder(), failing: map[string]bool{}, held: map[string]bool{}}
+	m.Registry = r
+	m.audit.log = audit.New(&buf)
+	registry.NotifyApplied(m.auditApplied)
+	defer registry.NotifyApplied(nil)
+
+	// Registered by an earlier run, for a task which is gone
+	r.services["mesos-consul:old"] = &registry.Service{ID: "mesos-consul:old", Name: "old", Meta: map[string]string{registry.TaskIDMetaKey: "old.1"}}
+
+	blacklist := func(exprs ...string) {
+		r := config.DefaultConfig()
+		r.MesosIpOrder = "host"
+		r.BlackList = exprs
+		m.Reload(r)
+	}
+	hold := func(id string, held bool) {
+		for sid, s := range r.services {
+			if s.Meta[registry.TaskIDMetaKey] == id {
+				r.held[sid] = held
+			}
+		}
+	}
+
+	for i, tt := range []struct {
+		update  func()
+		tasks   string
+		records []string
+	}{
+		{nil, web, []string{"register web.1 new-task", "deregister old.1 task-gone"}},
+		{nil, web + "," + api, []string{"register api.1 new-task"}},
+		{nil, web + "," + api, nil},
+		{func() { hold("web.1", true) }, api, nil},
+		{func() { hold("web.1", false) }, api, []string{"deregister web.1 task-gone"}},
+		{func() { blacklist("^api$") }, api, []string{"deregister api.1 filter-change"}},
+		{func() { blacklist() }, api, []string{"register api.1 filter-change"}},
+		{func() { r.critical("api.1") }, api, []string{"deregister api.1 critical", "register api.1 service-changed"}},
+		{func() { r.failing["db.1"] = true }, api + "," + db, nil},
+	} {
+		buf.Reset()
+		if tt.update != nil {
+			tt.update()
+		}
+		m.parseState(simulateState(t, tt.tasks))
+
+		records := []string{}
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			var r audit.Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.TaskID != "" {
+				records = append(records, r.Op+" "+r.TaskID+" "+r.Reason)
+			}
+		}
+
+		if len(records) != len(tt.records) {
+			t.Errorf("test #%d: audit records => %v, want %v", i, records, tt.records)
+			continue
+		}
+		for j := range records {
+			if records[j] != tt.records[j] {
+				t.Errorf("test #%d: audit records => %v, want %v", i, records, tt.records)
+				break
+			}
+		}
+	}
+}
+
+func TestAuditMultiRegistry(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	var buf bytes.Buffer
+	m := newMesos(c)
+	m.Registry = registry.NewMulti([]string{"dc1", "dc2"}, []registry.Registry{
+		&appliedRecorder{recorder: newRecorder()},
+		&appliedRecorder{recorder: newRecorder()},
+	})
+	m.audit.log = audit.New(&buf)
+	registry.NotifyApplied(m.auditApplied)
+	defer registry.NotifyApplied(nil)
+
+	redact.Default.SetValues("agents", []string{"10.0.0.1"})
+	defer redact.Default.SetValues("agents", nil)
+
+	for i, tt := range []struct {
+		tasks   string
+		records []string
+	}{
+		{web, []string{"register web.1 new-task"}},
+		{"", []string{"deregister web.1 task-gone"}},
+	} {
+		buf.Reset()
+		m.parseState(simulateState(t, tt.tasks))
+
+		if bytes.Contains(buf.Bytes(), []byte("10.0.0.1")) {
+			t.Errorf("test #%d: audit log %q not redacted", i, buf.String())
+		}
+
+		records := []string{}
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			var r audit.Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.TaskID != "" {
+				records = append(records, r.Op+" "+r.TaskID+" "+r.Reason)
+			}
+		}
+		if !sliceEq(records, tt.records) {
+			t.Errorf("test #%d: audit records => %v, want %v", i, records, tt.records)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package mesos
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// taskConnect returns the Connect sidecar proxy of the services of a
+// task enabling it with the consul.connect label, or nil. The proxy
+// listens on the consul.connect.port label, or a port picked by Consul,
+// and binds the consul.connect.upstreams, a comma delimited list of
+// <service>:<local port> pairs.
+func taskConnect(t *state.Task) *registry.Connect {
+	if enabled, _ := strconv.ParseBool(t.PrefixedLabel("connect")); !enabled {
+		return nil
+	}
+
+	c := &registry.Connect{}
+
+	if l := t.PrefixedLabel("connect.port"); l != "" {
+		port, err := strconv.Atoi(l)
+		if err != nil || port <= 0 {
+			log.WithField("task", t.ID).Warnf("Ignoring invalid %s label '%s'", t.PrefixedKey("connect.port"), l)
+		} else {
+			c.SidecarPort = port
+		}
+	}
+
+	for _, u := range strings.Split(t.PrefixedLabel("connect.upstreams"), ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+
+		parts := strings.Split(u, ":")
+		port := 0
+		if len(parts) == 2 {
+			port, _ = strconv.Atoi(parts[1])
+		}
+		if parts[0] == "" || port <= 0 {
+			log.WithField("task", t.ID).Warnf("Ignoring invalid upstream '%s', expected <service>:<local port>", u)
+			continue
+		}
+		c.Upstreams = append(c.Upstreams, registry.Upstream{Name: parts[0], LocalBindPort: port})
+	}
+
+	return c
+}
@@ -0,0 +1,59 @@
+package mesos
+
+import (
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// Task roles of the data frameworks
+const (
+	RoleDriver   = "driver"
+	RoleExecutor = "executor"
+)
+
+// dataRole returns the role of a task of the data frameworks, from its
+// consul.role label or else from its name, or "" when the task is not
+// part of a data framework
+func (m *Mesos) dataRole(t *state.Task) string {
+	if m.dataFrameworkRegex == nil || !m.dataFrameworkRegex.MatchString(t.FrameworkName) {
+		return ""
+	}
+
+	switch strings.ToLower(t.PrefixedLabel("role")) {
+	case RoleDriver:
+		return RoleDriver
+	case RoleExecutor:
+		return RoleExecutor
+	}
+
+	if m.driverRegex.MatchString(t.Name) {
+		return RoleDriver
+	}
+	return RoleExecutor
+}
+
+// dataJobName returns the name of the job a data framework task belongs
+// to, from its consul.job label or else its framework
+func dataJobName(t *state.Task) string {
+	if job := t.PrefixedLabel("job"); job != "" {
+		return job
+	}
+	return t.FrameworkName
+}
+
+// driverPorts returns the ports of a driver named "ui", or all of them
+// when none is
+func driverPorts(ports []taskPort) []taskPort {
+	ui := []taskPort{}
+	for _, p := range ports {
+		if strings.ToLower(p.Name) == "ui" {
+			ui = append(ui, p)
+		}
+	}
+
+	if len(ui) == 0 {
+		return ports
+	}
+	return ui
+}
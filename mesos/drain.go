@@ -0,0 +1,63 @@
+package mesos
+
+import (
+	"fmt"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updateMaintenance puts the services of draining agents in maintenance
+// mode and takes services out of it once their agent is no longer
+// draining. Services which went away are forgotten, since their
+// maintenance mode goes with them. The services put in maintenance mode
+// by an earlier process are picked up on the first refresh.
+func (m *Mesos) updateMaintenance() {
+	maintainer, ok := m.Registry.(registry.Maintainer)
+	if !ok {
+		return
+	}
+
+	if m.maintenance == nil {
+		services, err := maintainer.Maintained()
+		if err != nil {
+			log.Warn("Unable to read the services in maintenance mode: ", err)
+			return
+		}
+
+		m.maintenance = make(map[string]*registry.Service, len(services))
+		for _, s := range services {
+			m.maintenance[s.ID] = s
+		}
+	}
+
+	for id, s := range m.drainingServices {
+		if _, ok := m.maintenance[id]; ok {
+			continue
+		}
+
+		reason := fmt.Sprintf("Mesos agent %s is draining", m.agentDraining[s.Agent])
+		log.WithField("service", id).Info(reason)
+		if err := maintainer.EnableMaintenance(s, reason); err != nil {
+			log.WithField("service", id).Warn("Unable to enable maintenance mode: ", err)
+			continue
+		}
+		m.maintenance[id] = s
+	}
+
+	for id, s := range m.maintenance {
+		if _, ok := m.drainingServices[id]; ok {
+			continue
+		}
+
+		if _, ok := m.agentDraining[s.Agent]; !ok && m.Registry.CacheLookup(id) != nil {
+			log.WithField("service", id).Info("Agent no longer draining. Disabling maintenance mode")
+			if err := maintainer.DisableMaintenance(s); err != nil {
+				log.WithField("service", id).Warn("Unable to disable maintenance mode: ", err)
+				continue
+			}
+		}
+		delete(m.maintenance, id)
+	}
+}
@@ -0,0 +1,16 @@
+package mesos
+
+import (
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// leading reports whether this instance registers services. With
+// registries electing a single active replica, the others stand by.
+func (m *Mesos) leading() bool {
+	e, ok := m.Registry.(registry.Elector)
+	if !ok {
+		return true
+	}
+
+	return e.Leading(m.getLeader().Ip)
+}
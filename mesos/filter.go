@@ -0,0 +1,190 @@
+package mesos
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Filter precedence values, deciding whether a task name matching both
+// the whitelist and the blacklist is registered.
+const (
+	PrecedenceBlacklist = "blacklist"
+	PrecedenceWhitelist = "whitelist"
+)
+
+// The number of conflicting task names listed in the startup warning
+const maxFilterConflicts = 5
+
+// labelSelector matches the tasks carrying a label, with a given value
+// unless any is set
+type labelSelector struct {
+	key   string
+	value string
+	any   bool
+}
+
+// parseLabelSelectors parses '<key>=<value>' selectors, or '<key>' ones
+// matching any value of the label
+func parseLabelSelectors(selectors []string) ([]labelSelector, error) {
+	parsed := make([]labelSelector, 0, len(selectors))
+	for _, s := range selectors {
+		parts := strings.SplitN(s, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid label selector '%s', expected <key>=<value> or <key>", s)
+		}
+
+		sel := labelSelector{key: parts[0], any: len(parts) == 1}
+		if !sel.any {
+			sel.value = parts[1]
+		}
+		parsed = append(parsed, sel)
+	}
+	return parsed, nil
+}
+
+func (sel labelSelector) matches(t *state.Task) bool {
+	for _, l := range t.Labels {
+		if l.Key == sel.key && (sel.any || l.Value == sel.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sel labelSelector) String() string {
+	if sel.any {
+		return sel.key
+	}
+	return sel.key + "=" + sel.value
+}
+
+// filterTask runs a task through the filters and returns the reason it is
+// left out, or "" when it passes them
+func (m *Mesos) filterTask(t *state.Task, tname string) string {
+	reason, rule := m.filterRule(t, tname)
+	if reason != "" {
+		log.WithFields(log.Fields{"task": tname, "rule": rule}).Debug("Task filtered out")
+	}
+	return reason
+}
+
+// filterRule returns the reason a task is left out by the filters, or ""
+// when it passes them, and the rule deciding it. The agent blacklist comes
+// first, then the label blacklist, then the name whitelist and blacklist: a
+// task on a blacklisted agent or with a blacklisted label is left out
+// whatever its name, --filter-precedence only deciding between the name
+// filters.
+func (m *Mesos) filterRule(t *state.Task, tname string) (string, string) {
+	if agent := m.agentBlacklisted(m.agentHostnames[t.SlaveID], t.SlaveID); agent != "" {
+		return SkipFilteredAgent, "agent-blacklist matches " + agent
+	}
+
+	for _, sel := range m.labelBlacklist {
+		if sel.matches(t) {
+			return SkipFilteredLabel, "label-blacklist matches " + sel.String()
+		}
+	}
+
+	allowed, rule := m.nameRule(m.filterName(t, tname))
+	if !allowed {
+		return SkipFiltered, rule
+	}
+	return "", rule
+}
+
+// agentBlacklisted returns the hostname or the ID of an agent matching
+// --agent-blacklist, or "" when neither does
+func (m *Mesos) agentBlacklisted(hostname string, id string) string {
+	if m.agentBlacklistRegex == nil {
+		return ""
+	}
+
+	for _, agent := range []string{hostname, id} {
+		if agent != "" && m.agentBlacklistRegex.MatchString(agent) {
+			return agent
+		}
+	}
+	return ""
+}
+
+// taskAllowed reports whether a task passes the whitelist and blacklist
+func (m *Mesos) taskAllowed(tname string) bool {
+	allowed, _ := m.nameRule(tname)
+	return allowed
+}
+
+// nameRule reports whether a task name passes the whitelist and blacklist,
+// and the rule deciding it
+func (m *Mesos) nameRule(tname string) (bool, string) {
+	if m.whitelistRegex != nil && !m.whitelistRegex.MatchString(tname) {
+		return false, "whitelist does not match"
+	}
+
+	if m.blacklistRegex != nil {
+		if m.blacklistRegex.MatchString(tname) {
+			if m.whitelistRegex != nil && m.FilterPrecedence == PrecedenceWhitelist {
+				return true, "blacklist matches, whitelist takes precedence"
+			}
+			return false, "blacklist matches"
+		}
+		if m.whitelistRegex == nil {
+			return true, "blacklist does not match"
+		}
+	}
+
+	if m.whitelistRegex != nil {
+		return true, "whitelist matches"
+	}
+	return true, "no filter"
+}
+
+// filterConflicts returns the distinct names of tasks in the state
+// matching both the whitelist and the blacklist, up to max.
+func (m *Mesos) filterConflicts(sj state.State, max int) []string {
+	conflicts := []string{}
+	if m.whitelistRegex == nil || m.blacklistRegex == nil {
+		return conflicts
+	}
+
+	seen := make(map[string]bool)
+	for _, fw := range sj.Frameworks {
+		for _, task := range fw.Tasks {
+			task.FrameworkName = fw.Name
+			tname := m.taskName(&task)
+			if seen[tname] {
+				continue
+			}
+			seen[tname] = true
+
+			name := m.filterName(&task, tname)
+			if m.whitelistRegex.MatchString(name) && m.blacklistRegex.MatchString(name) {
+				conflicts = append(conflicts, tname)
+				if len(conflicts) >= max {
+					return conflicts
+				}
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// warnFilterConflicts logs tasks matching both filters once, on the
+// first state fetched from the master.
+func (m *Mesos) warnFilterConflicts(sj state.State) {
+	if m.conflictsChecked {
+		return
+	}
+	m.conflictsChecked = true
+
+	if conflicts := m.filterConflicts(sj, maxFilterConflicts); len(conflicts) > 0 {
+		log.WithFields(log.Fields{
+			"filter-precedence": m.FilterPrecedence,
+			"tasks":             strings.Join(conflicts, ","),
+		}).Warn("Tasks match both the whitelist and the blacklist")
+	}
+}
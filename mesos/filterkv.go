@@ -0,0 +1,122 @@
+package mesos
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadFilters reads the whitelist and blacklist from the --filter-kv
+// keys of the registry, watched in the background when the registry
+// supports it. A key replaces the command line list while it exists; a
+// regex which fails to compile is ignored with a warning and the previous
+// one stays in use.
+func (m *Mesos) reloadFilters() {
+	if m.FilterKV == "" {
+		return
+	}
+
+	read := m.filterReader()
+	whitelist := m.reloadFilter(read, "whitelist", m.WhiteList, m.whitelistRegex)
+	blacklist := m.reloadFilter(read, "blacklist", m.BlackList, m.blacklistRegex)
+	if whitelist != m.whitelistRegex || blacklist != m.blacklistRegex {
+		// Warn about tasks matching both of the new lists
+		m.conflictsChecked = false
+	}
+	m.whitelistRegex = whitelist
+	m.blacklistRegex = blacklist
+}
+
+// filterReader returns the function reading a --filter-kv key: from the
+// keys watched by the registry, or read on every call from registries
+// which can't watch them. A registry without a key/value store is fatal.
+func (m *Mesos) filterReader() func(key string) (string, bool, error) {
+	host := m.getLeader().Ip
+
+	if w, ok := m.Registry.(registry.KVWatcher); ok {
+		values, err := w.KVWatched(host, m.FilterKV+"/")
+		return func(key string) (string, bool, error) {
+			if values == nil {
+				return "", false, err
+			}
+			v, found := values[key]
+			return v, found, nil
+		}
+	}
+
+	kv, ok := m.Registry.(registry.KVReader)
+	if !ok {
+		log.WithField("filter-kv", m.FilterKV).Fatal("--filter-kv requires a registry with a key/value store")
+	}
+	return func(key string) (string, bool, error) {
+		return kv.KVGet(host, key)
+	}
+}
+
+// hasKV returns whether one of registries has a key/value store
+func hasKV(registries []registry.Registry) bool {
+	for _, r := range registries {
+		if _, ok := r.(registry.KVReader); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadFilter returns the regex of the list stored under name, the
+// command line list def when the key does not exist, or current when
+// it is unchanged or can't be used.
+func (m *Mesos) reloadFilter(read func(key string) (string, bool, error), name string, def string, current *regexp.Regexp) *regexp.Regexp {
+	key := m.FilterKV + "/" + name
+
+	value, found, err := read(key)
+	if err != nil {
+		log.WithField("filter-kv", key).Warnf("Unable to read the %s, keeping the current one: %s", name, err)
+		return current
+	}
+
+	expr := def
+	if found {
+		expr = filterExpr(value)
+	}
+
+	if current != nil && current.String() == expr {
+		return current
+	}
+	if expr == "" {
+		if current != nil {
+			log.WithField("filter-kv", key).Infof("Clearing the %s", name)
+		}
+		return nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"filter-kv": key,
+			name:        expr,
+		}).Warnf("New %s regex failed to compile, keeping the previous one: %s", name, err)
+		return current
+	}
+
+	log.WithFields(log.Fields{
+		"filter-kv": key,
+		name:        expr,
+	}).Infof("Using new %s regex", name)
+	return re
+}
+
+// filterExpr joins the regexes of a KV value, one per line, like repeated
+// --whitelist or --blacklist options
+func filterExpr(value string) string {
+	exprs := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			exprs = append(exprs, line)
+		}
+	}
+	return strings.Join(exprs, "|")
+}
@@ -0,0 +1,203 @@
+package mesos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Service ID schemes. v1 IDs embed the service name, so any change to
+// how names are built re-registers the task under a new ID. v2 IDs are
+// built from Mesos identifiers only and stay the same across versions
+// and options of mesos-consul.
+const (
+	IDSchemeV1 = "v1"
+	IDSchemeV2 = "v2"
+)
+
+// idVars are the fields available to --id-template
+type idVars struct {
+	TaskID    string
+	Agent     string
+	Port      int
+	Name      string
+	Framework string
+}
+
+// parseIDTemplate parses an --id-template and returns it with its literal
+// prefix, which tells the services of mesos-consul from the others. The
+// template must start with such a prefix, and render distinct IDs for
+// distinct tasks and ports.
+func parseIDTemplate(text string) (*template.Template, string, error) {
+	tmpl, err := template.New("service-id").Parse(text)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix := text
+	if i := strings.Index(text, "{{"); i >= 0 {
+		prefix = text[:i]
+	}
+	if prefix == "" {
+		return nil, "", errors.New("the template must start with a literal prefix, such as 'mesos-consul:'")
+	}
+
+	sample := idVars{TaskID: "web.1", Agent: "10.0.0.1", Port: 31000, Name: "web", Framework: "marathon"}
+	id, err := renderID(tmpl, sample)
+	if err != nil {
+		return nil, "", err
+	}
+	otherTask, otherPort := sample, sample
+	otherTask.TaskID = "web.2"
+	otherPort.Port = 31001
+	for _, other := range []idVars{otherTask, otherPort} {
+		if otherID, err := renderID(tmpl, other); err != nil || otherID == id {
+			return nil, "", errors.New("the template must include {{.TaskID}} and {{.Port}}")
+		}
+	}
+
+	return tmpl, prefix, nil
+}
+
+func renderID(tmpl *template.Template, vars idVars) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templateID renders the --id-template for a port of a task, or for the
+// task itself when port is 0. A failure falls back to a v2 ID under the
+// prefix of the template.
+func (m *Mesos) templateID(t *state.Task, agent string, name string, port int) string {
+	id, err := renderID(m.idTemplate, idVars{
+		TaskID:    t.ID,
+		Agent:     agent,
+		Port:      port,
+		Name:      name,
+		Framework: t.FrameworkName,
+	})
+	if err == nil {
+		return id
+	}
+
+	log.WithField("task", t.ID).Warn("Unable to render the ID template: ", err)
+	if port == 0 {
+		return fmt.Sprintf("%sv2:%s:%s", m.servicePrefix(), agent, t.ID)
+	}
+	return fmt.Sprintf("%sv2:%s:%s:%d", m.servicePrefix(), agent, t.ID, port)
+}
+
+// servicePrefix returns the prefix of the IDs of the services of the
+// Mesos hosts: the literal prefix of the --id-template, or mesos-consul:
+func (m *Mesos) servicePrefix() string {
+	if m.idPrefix == "" {
+		return registry.DefaultIDPrefix
+	}
+	return m.idPrefix
+}
+
+// taskServiceID returns the ID of the service registered for a port of a
+// task, or for the task itself when port is 0.
+func (m *Mesos) taskServiceID(t *state.Task, agent string, name string, port int) string {
+	if m.idTemplate != nil {
+		return m.templateID(t, agent, name, port)
+	}
+	return schemeID(m.IDScheme, t, agent, name, port)
+}
+
+// schemeID returns the ID of a port of a task, or of the task itself when
+// port is 0, under an ID scheme
+func schemeID(scheme string, t *state.Task, agent string, name string, port int) string {
+	if scheme == IDSchemeV2 {
+		if port == 0 {
+			return fmt.Sprintf("mesos-consul:v2:%s:%s", agent, t.ID)
+		}
+		return fmt.Sprintf("mesos-consul:v2:%s:%s:%d", agent, t.ID, port)
+	}
+
+	if port == 0 {
+		return fmt.Sprintf("mesos-consul:%s-%s", agent, name)
+	}
+	return fmt.Sprintf("mesos-consul:%s:%s:%d", agent, name, port)
+}
+
+// previousIDs returns the IDs the same port of a task has under the ID
+// schemes not in use, which it was registered with before a migration
+func (m *Mesos) previousIDs(t *state.Task, agent string, name string, port int) []string {
+	ids := []string{}
+	for _, scheme := range []string{IDSchemeV1, IDSchemeV2} {
+		if m.idTemplate == nil && scheme == m.IDScheme {
+			continue
+		}
+		ids = append(ids, schemeID(scheme, t, agent, name, port))
+	}
+	return ids
+}
+
+// jobResultID returns the ID of the job result service of a task
+func (m *Mesos) jobResultID(t *state.Task, agent string, name string) string {
+	if m.idTemplate != nil {
+		return m.templateID(t, agent, name, 0) + ":result"
+	}
+	if m.IDScheme == IDSchemeV2 {
+		return fmt.Sprintf("mesos-consul:v2:%s:%s:result", agent, t.ID)
+	}
+	return fmt.Sprintf("mesos-consul:%s:%s-result:%s", agent, name, t.ID)
+}
+
+// registerService registers a service of task t. A cached service which
+// differs from s is re-registered in place.
+//
+// The service may still be registered under previous, its IDs under
+// another ID scheme. Those are kept until s is registered, so that a
+// migration registers the new IDs a refresh before deregistering the
+// previous ones.
+func (m *Mesos) registerService(t *state.Task, s *registry.Service, previous []string) {
+	registry.MarkOwned(s)
+	m.cycleServices = append(m.cycleServices, s)
+	m.owned.task(s.ID, t.ID)
+
+	changed := false
+	h := m.Registry.CacheLookup(s.ID)
+	if h != nil && !registry.SameService(h, s) {
+		log.WithField("service", s.ID).Info("Service changed. Re-registering")
+		m.Registry.CacheDelete(s.ID)
+		changed = true
+	}
+
+	m.auditRegister(s, t.ID, changed)
+	m.Registry.Register(s)
+
+	if h == nil {
+		for _, id := range previous {
+			if m.Registry.CacheLookup(id) != nil {
+				log.WithField("service", id).Debug("Keeping the previous ID until the migration completes")
+				m.Registry.CacheMark(id)
+			}
+		}
+	}
+
+	if _, ok := m.agentDraining[s.Agent]; ok {
+		m.drainingServices[s.ID] = s
+	}
+}
+
+// tagOverride returns whether external tools may change the tags of the
+// services of a task, from its consul.enable-tag-override label or else
+// --enable-tag-override
+func (m *Mesos) tagOverride(t *state.Task) bool {
+	if b, err := strconv.ParseBool(t.PrefixedLabel("enable-tag-override")); err == nil {
+		return b
+	}
+	return m.EnableTagOverride
+}
@@ -0,0 +1,103 @@
+package mesos
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// jobResults builds a short-lived <task>-result service for the most
+// recent completed run, per terminal state, of each task of the job result
+// frameworks. Runs which finished more than the job result TTL ago are
+// left out, so their services are removed by the deregistration sweep.
+func (m *Mesos) jobResults(sj state.State, now time.Time) []*registry.Service {
+	type key struct {
+		name  string
+		state string
+	}
+
+	latest := make(map[key]*state.Task)
+	frameworks := make(map[key]string)
+	var order []key
+
+	for _, fw := range sj.Frameworks {
+		if m.jobResultRegex == nil || !m.jobResultRegex.MatchString(fw.Name) {
+			continue
+		}
+
+		for i := range fw.CompletedTasks {
+			task := &fw.CompletedTasks[i]
+			status := task.LastStatus()
+			if status == nil {
+				continue
+			}
+
+			finished := time.Unix(0, int64(status.Timestamp*float64(time.Second)))
+			if now.Sub(finished) > m.JobResultTTL {
+				continue
+			}
+
+			task.FrameworkName = fw.Name
+			tname := m.taskName(task)
+			if m.filterTask(task, tname) != "" {
+				continue
+			}
+
+			k := key{tname, task.State}
+			if prev, ok := latest[k]; ok {
+				if prev.LastStatus().Timestamp >= status.Timestamp {
+					continue
+				}
+			} else {
+				order = append(order, k)
+			}
+			latest[k] = task
+			frameworks[k] = fw.Name
+		}
+	}
+
+	services := []*registry.Service{}
+	for _, k := range order {
+		task := latest[k]
+		agent, ok := m.Agents[task.SlaveID]
+		if !ok {
+			continue
+		}
+
+		status := task.LastStatus()
+		services = append(services, &registry.Service{
+			ID:      m.jobResultID(task, agent, k.name),
+			Name:    fmt.Sprintf("%s-result", k.name),
+			Address: agent,
+			Tags:    []string{strings.ToLower(strings.TrimPrefix(task.State, "TASK_"))},
+			Meta: map[string]string{
+				"framework":   frameworks[k],
+				"task-id":     task.ID,
+				"state":       task.State,
+				"finished-at": time.Unix(0, int64(status.Timestamp*float64(time.Second))).UTC().Format(time.RFC3339),
+			},
+			Check: registry.DefaultCheck(),
+			Agent: agent,
+		})
+	}
+
+	return services
+}
+
+// registerJobResults registers the job result services of a state
+func (m *Mesos) registerJobResults(sj state.State) {
+	if m.jobResultRegex == nil {
+		return
+	}
+
+	for _, s := range m.jobResults(sj, time.Now()) {
+		registry.MarkOwned(s)
+		m.cycleServices = append(m.cycleServices, s)
+		m.owned.task(s.ID, s.Meta["task-id"])
+		m.auditRegister(s, s.Meta["task-id"], false)
+		m.Registry.Register(s)
+	}
+}
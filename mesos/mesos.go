@@ -5,17 +5,30 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
+	"github.com/CiscoCloud/mesos-consul/audit"
 	"github.com/CiscoCloud/mesos-consul/config"
 	"github.com/CiscoCloud/mesos-consul/consul"
+	"github.com/CiscoCloud/mesos-consul/dnsserver"
+	"github.com/CiscoCloud/mesos-consul/etcd"
+	"github.com/CiscoCloud/mesos-consul/eureka"
+	"github.com/CiscoCloud/mesos-consul/fileexport"
+	"github.com/CiscoCloud/mesos-consul/kubernetes"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/plugin"
 	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/serverset"
 	"github.com/CiscoCloud/mesos-consul/state"
+	"github.com/CiscoCloud/mesos-consul/webhook"
 
 	consulapi "github.com/hashicorp/consul/api"
-	proto "github.com/mesos/mesos-go/mesosproto"
+	proto "github.com/mesos/mesos-go/api/v0/mesosproto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -25,9 +38,15 @@ type CacheEntry struct {
 }
 
 type Mesos struct {
-	Registry registry.Registry
-	Agents   map[string]string
-	Lock     sync.Mutex
+	Registry        registry.Registry
+	Agents          map[string]string
+	agentAttributes map[string]map[string]string
+	agentHostnames  map[string]string
+	agentAddresses  *agentAddressMap
+	metaSchema      metaSchema
+	agentLastSeen   map[string]time.Time
+	agentDraining   map[string]string
+	Lock            sync.Mutex
 
 	Leader    *proto.MasterInfo
 	Masters   []*proto.MasterInfo
@@ -41,31 +60,285 @@ type Mesos struct {
 	blacklistRegex *regexp.Regexp
 	taskTag        map[string][]string
 
-	Separator string
+	// Agents, by hostname or ID, and task labels whose tasks are left out
+	AgentBlacklist      string
+	agentBlacklistRegex *regexp.Regexp
+	labelBlacklist      []labelSelector
+
+	FilterPrecedence string
+
+	// Registry KV path the whitelist and blacklist are read from
+	FilterKV string
+
+	IDScheme string
+
+	// Template of the IDs of task services, replacing the ID scheme, and
+	// its literal prefix
+	idTemplate *template.Template
+	idPrefix   string
+
+	AutoTCPCheck         bool
+	AutoTCPCheckInterval time.Duration
+
+	EnableTagOverride bool
+
+	// Defaults of the checks of task services
+	CheckInterval        time.Duration
+	CheckTimeout         time.Duration
+	CheckDeregisterAfter time.Duration
+
+	NetworkPreference []string
+	PreferHostname    bool
+
+	WANAddressAttribute string
+
+	JobResultFramework string
+	jobResultRegex     *regexp.Regexp
+	JobResultTTL       time.Duration
+
+	DataFramework      string
+	dataFrameworkRegex *regexp.Regexp
+	driverRegex        *regexp.Regexp
+
+	PruneNodesAfter  time.Duration
+	AgentNodes       bool
+	conflictsChecked bool
+
+	// Services on draining agents, seen in the current cycle and
+	// put in maintenance mode
+	drainingServices map[string]*registry.Service
+	maintenance      map[string]*registry.Service
+
+	Separator           string
+	LabelPrefix         string
+	TaskTagLabel        string
+	ServicePerPort      bool
+	RegisterPortless    bool
+	EnvPorts            bool
+	PortPolicy          string
+	DiscoveryVisibility []string
+	PortMode            string
+	MaxTaskPorts        int
+	PortLimitPolicy     string
 
 	ServiceName string
 	ServiceTags []string
+
+	// Sanitization rules of service names, template of the service names
+	// of tasks, replacing cleanName, and whether they are prefixed by the
+	// framework name
+	names        *nameRules
+	nameTemplate *template.Template
+	FwPrefix     bool
+
+	// Templates of tags added to the services of tasks
+	tagTemplates []*template.Template
+
+	// Tags of the Mesos hosts per role, and service name of the leader
+	LeaderTags    []string
+	MasterTags    []string
+	FollowerTags  []string
+	LeaderService string
+
+	// Service name of the Zookeeper ensemble members, and their addresses
+	ZkService string
+	zkMembers []string
+
+	// Task labels whose values are redacted from the output
+	RedactLabels []string
+
+	// Running tasks seen in the last cycle and how many of them
+	// started or stopped since the cycle before
+	taskIDs map[string]struct{}
+	churn   int
+
+	skipped skipReport
+	owned   ownedReport
+	ready   readiness
+	zk      zkSession
+	status  statusReport
+	audit   auditTrail
+
+	// Services registered during the current and the last cycle
+	cycleServices []*registry.Service
+	services      []*registry.Service
+	servicesLock  sync.RWMutex
 }
 
 func New(c *config.Config) *Mesos {
-	m := new(Mesos)
-
 	if c.Zk == "" {
 		return nil
 	}
+
+	m := newMesos(c)
+
+	if c.DryRun {
+		log.Warn("Dry run: printing the registry calls instead of making them")
+		r := newRecorder()
+		r.out = os.Stdout
+		if usesConsul(c) {
+			r.source = consul.NewReadOnly(c.HeartbeatsBeforeRemove)
+		}
+		m.Registry = r
+		m.zkDetector(c.Zk)
+		return m
+	}
+
+	if c.AuditLog != "" {
+		l, err := audit.Open(c.AuditLog, int64(c.LogMaxSize)<<20, c.LogMaxBackups)
+		if err != nil {
+			log.Fatal("Unable to open the audit log: ", err)
+		}
+		m.audit.log = l
+	}
+	if len(c.Webhooks) > 0 {
+		n, err := webhook.New(c.Webhooks, c.WebhookTemplate, c.WebhookRetries, c.WebhookTimeout)
+		if err != nil {
+			log.Fatal("Invalid webhook: ", err)
+		}
+		m.audit.webhooks = n
+	}
+
+	registry.NotifyFailures(m.status.failed)
+	if m.audit.enabled() {
+		registry.NotifyApplied(m.auditApplied)
+	}
+
+	uris := c.Registries
+	if len(uris) == 0 && len(c.RegistryPlugins) == 0 {
+		uris = []string{"consul"}
+	}
+
+	registries := []registry.Registry{}
+	for _, uri := range uris {
+		registries = append(registries, newRegistry(c, uri))
+	}
+	names := append([]string{}, uris...)
+	for _, path := range c.RegistryPlugins {
+		log.Info("Loading registry plugin ", path)
+		registries = append(registries, plugin.New(path))
+		names = append(names, "plugin:"+path)
+	}
+	m.Registry = registry.NewMulti(names, registries)
+	if m.FilterKV != "" && !hasKV(registries) {
+		log.Fatal("--filter-kv requires a registry with a key/value store, such as consul")
+	}
+	if m.AgentNodes && !registersNodes(m.Registry) {
+		log.Fatal("--register-agent-nodes requires --consul-catalog")
+	}
+
+	m.zkDetector(c.Zk)
+
+	return m
+}
+
+// usesConsul tells whether consul is among the registries of c
+func usesConsul(c *config.Config) bool {
+	if len(c.Registries) == 0 {
+		return len(c.RegistryPlugins) == 0
+	}
+	for _, uri := range c.Registries {
+		if uri == "consul" {
+			return true
+		}
+	}
+	return false
+}
+
+// newRegistry returns the registry of a --registry address
+func newRegistry(c *config.Config, uri string) registry.Registry {
+	var r registry.Registry
+
+	switch {
+	case uri == "consul":
+		r = consul.New(c.HeartbeatsBeforeRemove)
+	case strings.HasPrefix(uri, "etcd://"):
+		r = etcd.New(uri, maxRefresh(c), c.HeartbeatsBeforeRemove)
+	case strings.HasPrefix(uri, "eureka://"):
+		r = eureka.New(uri, maxRefresh(c), c.HeartbeatsBeforeRemove)
+	case strings.HasPrefix(uri, "serverset://"):
+		r = serverset.New(uri, c.HeartbeatsBeforeRemove)
+	case strings.HasPrefix(uri, "k8s://"):
+		r = kubernetes.New(uri, c.HeartbeatsBeforeRemove)
+	case strings.HasPrefix(uri, "dns://"):
+		r = dnsserver.New(uri)
+	case strings.HasPrefix(uri, "file://"):
+		r = fileexport.New(uri)
+	default:
+		log.Fatalf("Unknown registry '%s'", uri)
+	}
+
+	if r == nil {
+		log.Fatal("No registry specified")
+	}
+	return r
+}
+
+// stateTimeout bounds the loading of the Mesos state, which takes most
+// of a refresh
+const stateTimeout = 30 * time.Second
+
+// maxRefresh returns the longest time between two refreshes, which the
+// registrations of registries expiring them must outlive: the longest
+// refresh period, jitter included, as the next refresh is scheduled once
+// a refresh is over, plus the time the refresh takes
+func maxRefresh(c *config.Config) time.Duration {
+	d := c.Refresh
+	if c.RefreshAdaptive && c.RefreshMax > c.Refresh {
+		d = c.RefreshMax
+	}
+	return d + d*time.Duration(c.RefreshJitter)/100 + stateTimeout
+}
+
+// newMesos returns a Mesos configured from c, without a registry
+// or a connection to Zookeeper.
+func newMesos(c *config.Config) *Mesos {
+	m := new(Mesos)
+
+	// The options are parsed below without checking them again
+	MustValidate(c)
+
 	m.Separator = c.Separator
+	m.LabelPrefix = c.LabelPrefix
+	m.TaskTagLabel = c.TaskTagLabel
+	m.ServicePerPort = c.ServicePerPort
+	m.RegisterPortless = c.RegisterPortless
+	m.EnvPorts = c.EnvPorts
+	m.RedactLabels = c.RedactLabels
+	m.AutoTCPCheck = c.AutoTCPCheck
+	m.EnableTagOverride = c.EnableTagOverride
+	m.WANAddressAttribute = c.WANAddressAttribute
+	m.AutoTCPCheckInterval = c.AutoTCPCheckInterval
+	m.CheckInterval = c.CheckInterval
+	m.CheckTimeout = c.CheckTimeout
+	m.CheckDeregisterAfter = c.CheckDeregisterAfter
+	m.PruneNodesAfter = c.PruneNodesAfter
+	m.AgentNodes = c.AgentNodes
+	m.SetReadyWindow(c)
+	for _, v := range strings.Split(c.DiscoveryVisibility, ",") {
+		if v = strings.ToUpper(strings.TrimSpace(v)); v != "" {
+			m.DiscoveryVisibility = append(m.DiscoveryVisibility, v)
+		}
+	}
+
+	m.PortPolicy = c.PortPolicy
+	if c.LabeledPortsOnly {
+		m.PortPolicy = PortPolicyLabel
+	}
+
+	m.IDScheme = c.IDScheme
+	if c.IDTemplate != "" {
+		m.idTemplate, m.idPrefix, _ = parseIDTemplate(c.IDTemplate)
+	}
+
+	m.MaxTaskPorts = c.MaxTaskPorts
+	m.PortLimitPolicy = c.PortLimitPolicy
+	m.PortMode = c.PortMode
 
 	if len(c.WhiteList) > 0 {
 		m.WhiteList = strings.Join(c.WhiteList, "|")
 		log.WithField("whitelist", m.WhiteList).Debug("Using whitelist regex")
-		re, err := regexp.Compile(m.WhiteList)
-		if err != nil {
-			// For now, exit if the regex fails to compile. If we read regexes from Consul
-			// maybe we emit a warning and use the old regex
-			//
-			log.WithField("whitelist", m.WhiteList).Fatal("WhiteList regex failed to compile")
-		}
-		m.whitelistRegex = re
+		m.whitelistRegex = regexp.MustCompile(m.WhiteList)
 	} else {
 		m.whitelistRegex = nil
 	}
@@ -73,48 +346,78 @@ func New(c *config.Config) *Mesos {
 	if len(c.BlackList) > 0 {
 		m.BlackList = strings.Join(c.BlackList, "|")
 		log.WithField("blacklist", m.BlackList).Debug("Using blacklist regex")
-		re, err := regexp.Compile(m.BlackList)
-		if err != nil {
-			// For now, exit if the regex fails to compile. If we read regexes from Consul
-			// maybe we emit a warning and use the old regex
-			//
-			log.WithField("blacklist", m.BlackList).Fatal("BlackList regex failed to compile")
-		}
-		m.blacklistRegex = re
+		m.blacklistRegex = regexp.MustCompile(m.BlackList)
 	} else {
 		m.blacklistRegex = nil
 	}
 
-	var err error
-	m.taskTag, err = buildTaskTag(c.TaskTag)
-	if err != nil {
-		log.WithField("task-tag", c.TaskTag).Fatal(err.Error())
+	if len(c.AgentBlacklist) > 0 {
+		m.AgentBlacklist = strings.Join(c.AgentBlacklist, "|")
+		m.agentBlacklistRegex = regexp.MustCompile(m.AgentBlacklist)
 	}
 
-	m.ServiceName = cleanName(c.ServiceName, c.Separator)
+	m.labelBlacklist, _ = parseLabelSelectors(c.LabelBlacklist)
 
-	m.Registry = consul.New()
+	if len(c.JobResultFramework) > 0 {
+		m.JobResultFramework = strings.Join(c.JobResultFramework, "|")
+		log.WithField("job-result-framework", m.JobResultFramework).Debug("Using job result framework regex")
+		m.jobResultRegex = regexp.MustCompile(m.JobResultFramework)
+		m.JobResultTTL = c.JobResultTTL
+	}
 
-	if m.Registry == nil {
-		log.Fatal("No registry specified")
+	if len(c.DataFramework) > 0 {
+		m.DataFramework = strings.Join(c.DataFramework, "|")
+		m.dataFrameworkRegex = regexp.MustCompile(m.DataFramework)
+		m.driverRegex = regexp.MustCompile(c.DriverPattern)
 	}
 
-	m.zkDetector(c.Zk)
+	m.FilterKV = strings.TrimSuffix(c.FilterKV, "/")
 
-	m.IpOrder = strings.Split(c.MesosIpOrder, ",")
-	for _, src := range m.IpOrder {
-		switch src {
-		case "netinfo", "host", "docker", "mesos":
-		default:
-			log.Fatalf("Invalid IP Search Order: '%v'", src)
-		}
+	m.FilterPrecedence = c.FilterPrecedence
+	m.taskTag, _ = buildTaskTag(c.TaskTag)
+
+	rules, _ := newNameRules(c.NameStrip, c.NameReplacement, c.NameLowercase, c.NameMaxLength)
+	m.names = &rules
+
+	m.ServiceName = m.cleanName(c.ServiceName)
+	m.FwPrefix = c.FwPrefix
+
+	if c.ServiceNameTemplate != "" {
+		m.nameTemplate, _ = parseNameTemplate(c.ServiceNameTemplate, rules, c.Separator)
+	}
+	m.tagTemplates, _ = parseTagTemplates(c.TagTemplate, rules, c.Separator)
+	m.metaSchema, _ = loadMetaSchema(c.MetaSchema)
+
+	if c.AgentAddressMap != "" {
+		m.agentAddresses = newAgentAddressMap(c.AgentAddressMap)
 	}
+
+	m.PreferHostname = c.PreferHostname
+	m.IpOrder, _ = parseIPOrder(c.MesosIpOrder, m.PreferHostname)
 	log.Debugf("m.IpOrder = '%v'", m.IpOrder)
 
+	for _, n := range strings.Split(c.PreferNetworks, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			m.NetworkPreference = append(m.NetworkPreference, n)
+		}
+	}
+
 	if c.ServiceTags != "" {
 		m.ServiceTags = strings.Split(c.ServiceTags, ",")
 	}
 
+	if c.ZkService != "" {
+		m.ZkService = m.cleanName(c.ZkService)
+		m.zkMembers = zkMembers(c.Zk)
+	}
+
+	m.LeaderTags = splitTags(c.LeaderTags)
+	m.MasterTags = splitTags(c.MasterTags)
+	m.FollowerTags = splitTags(c.FollowerTags)
+	if c.LeaderService != "" {
+		m.LeaderService = m.cleanName(c.LeaderService)
+	}
+
 	return m
 }
 
@@ -144,14 +447,33 @@ func buildTaskTag(taskTag []string) (map[string][]string, error) {
 }
 
 func (m *Mesos) Refresh() error {
+	start := time.Now()
+	failed := metrics.RegistryErrors.Total()
+
+	outcome, err := m.refresh(start)
+	m.status.refreshed(start, outcome, err, int(metrics.RegistryErrors.Total()-failed))
+	return err
+}
+
+// refresh runs a cycle started at start and returns its outcome
+func (m *Mesos) refresh(start time.Time) (string, error) {
+	if !m.leading() {
+		log.Debug("Standing by, another instance is registering")
+		m.ready.synced(time.Now())
+		return RefreshStandby, nil
+	}
+
 	sj, err := m.loadState()
 	if err != nil {
 		log.Warn("loadState failed: ", err.Error())
-		return err
+		metrics.MesosErrors.Inc()
+		metrics.Refreshes.Inc(RefreshFailure)
+		return RefreshFailure, err
 	}
 
 	if sj.Leader == "" {
-		return errors.New("Empty master")
+		metrics.Refreshes.Inc(RefreshFailure)
+		return RefreshFailure, errors.New("Empty master")
 	}
 
 	if m.Registry.CacheCreate() {
@@ -160,7 +482,10 @@ func (m *Mesos) Refresh() error {
 
 	m.parseState(sj)
 
-	return nil
+	metrics.RefreshDuration.Set(time.Since(start).Seconds())
+	metrics.Refreshes.Inc(RefreshSuccess)
+	m.ready.synced(time.Now())
+	return RefreshSuccess, nil
 }
 
 func (m *Mesos) loadState() (state.State, error) {
@@ -191,6 +516,8 @@ func (m *Mesos) loadState() (state.State, error) {
 		sj, err = m.loadFromMaster(rip, mh.PortString)
 	}
 
+	sj.SetLabelPrefix(m.LabelPrefix)
+
 	return sj, err
 }
 
@@ -200,7 +527,7 @@ func (m *Mesos) loadFromMaster(ip string, port string) (sj state.State, err erro
 	req, err := http.NewRequest("GET", url, nil)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: stateTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
 		return
@@ -223,18 +550,103 @@ func (m *Mesos) loadFromMaster(ip string, port string) (sj state.State, err erro
 func (m *Mesos) parseState(sj state.State) {
 	log.Info("Running parseState")
 
+	m.cycleServices = nil
+	m.startAuditCycle()
+
 	m.RegisterHosts(sj)
 	log.Debug("Done running RegisterHosts")
 
+	m.pruneAgents(time.Now())
+
+	m.reloadFilters()
+	m.warnFilterConflicts(sj)
+
+	m.drainingServices = make(map[string]*registry.Service)
+
+	m.redactLabels(sj)
+
+	taskIDs := make(map[string]struct{})
+	serviceNames := []string{}
+	mirrored := []*registry.Task{}
 	for _, fw := range sj.Frameworks {
 		for _, task := range fw.Tasks {
+			task.FrameworkName = fw.Name
+
 			agent, ok := m.Agents[task.SlaveID]
-			if ok && task.State == "TASK_RUNNING" {
-				task.SlaveIP = agent
-				m.registerTask(&task, agent)
+			if !ok {
+				m.skipTask(&task, SkipUnknownAgent)
+				continue
+			}
+			mirrored = append(mirrored, mirrorTask(&task, agent))
+			if task.State != "TASK_RUNNING" {
+				m.skipTask(&task, SkipState)
+				continue
 			}
+
+			taskIDs[task.ID] = struct{}{}
+			serviceNames = append(serviceNames, m.serviceNames(&task)...)
+			task.SlaveIP = agent
+			task.SlaveAttributes = m.agentAttributes[task.SlaveID]
+			task.SlaveHostname = m.agentHostnames[task.SlaveID]
+			m.registerTask(&task, agent)
 		}
 	}
+	m.updateChurn(taskIDs)
+	metrics.TasksSeen.Set(float64(len(taskIDs)))
+	m.endSkipCycle()
+
+	m.mirrorTasks(mirrored)
 
+	m.registerJobResults(sj)
+
+	m.updateMaintenance()
+
+	if tracker, ok := m.Registry.(registry.TaskTracker); ok {
+		tracker.SetRunningServices(serviceNames)
+	}
+	m.endAuditCycle()
 	m.Registry.Deregister()
+	m.flushAudit()
+
+	m.servicesLock.Lock()
+	m.services = m.cycleServices
+	m.servicesLock.Unlock()
+
+	m.owned.endCycle(m.cycleServices, m.cached(), time.Now())
+	metrics.CycleServices.Set(float64(len(m.cycleServices)))
+}
+
+// Services returns the services registered during the last refresh,
+// whether or not the registry accepted them
+func (m *Mesos) Services() []*registry.Service {
+	m.servicesLock.RLock()
+	defer m.servicesLock.RUnlock()
+
+	return m.services
+}
+
+// updateChurn counts the tasks that started or stopped since the last cycle
+func (m *Mesos) updateChurn(taskIDs map[string]struct{}) {
+	churn := 0
+	if m.taskIDs != nil {
+		for id := range taskIDs {
+			if _, ok := m.taskIDs[id]; !ok {
+				churn++
+			}
+		}
+		for id := range m.taskIDs {
+			if _, ok := taskIDs[id]; !ok {
+				churn++
+			}
+		}
+	}
+
+	m.taskIDs = taskIDs
+	m.churn = churn
+}
+
+// Churn returns the number of tasks that started or stopped
+// during the last refresh
+func (m *Mesos) Churn() int {
+	return m.churn
 }
@@ -1,6 +1,17 @@
 package mesos
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
 
 func TestBuildTaskTag(t *testing.T) {
 	for _, tt := range []struct {
@@ -73,6 +84,78 @@ func TestBuildRegisterTaskTags(t *testing.T) {
 	}
 }
 
+func TestLabelTags(t *testing.T) {
+	for _, tt := range []struct {
+		label string
+		value string
+		tags  []string
+	}{
+		{"tags.extra", "", []string{"web"}},
+		{"tags.extra", "canary, web,,team-a", []string{"web", "canary", "team-a"}},
+		{"", "canary", []string{"web"}},
+	} {
+		m := &Mesos{TaskTagLabel: tt.label}
+		task := &state.Task{Labels: []state.Label{{Key: "consul.tags.extra", Value: tt.value}}}
+		if tags := m.labelTags(task, []string{"web"}); !sliceEq(tags, tt.tags) {
+			t.Errorf("labelTags(%s=%s) => %v, want %v", tt.label, tt.value, tags, tt.tags)
+		}
+	}
+}
+
+func TestTemplateTags(t *testing.T) {
+	templates, err := parseTagTemplates([]string{
+		`env-{{.Label "ENVIRONMENT"}}`,
+		`fw-{{lower .FrameworkName}}`,
+		`{{.Attribute "rack"}}`,
+		`{{if .Hostname}}{{end}}`,
+	}, defaultNameRules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mesos{
+		tagTemplates:    templates,
+		agentAttributes: map[string]map[string]string{"S1": {"rack": "r1"}},
+	}
+
+	for _, tt := range []struct {
+		task state.Task
+		tags []string
+	}{
+		{state.Task{Name: "web", FrameworkName: "Marathon", SlaveID: "S1",
+			Labels: []state.Label{{Key: "ENVIRONMENT", Value: "prod"}}}, []string{"http", "env-prod", "fw-marathon", "r1"}},
+		{state.Task{Name: "web", FrameworkName: "Marathon", SlaveID: "S2"}, []string{"http", "fw-marathon"}},
+	} {
+		if tags := m.templateTags(&tt.task, tt.task.Name, []string{"http"}); !sliceEq(tags, tt.tags) {
+			t.Errorf("templateTags(%v) => %v, want %v", tt.task.Labels, tags, tt.tags)
+		}
+	}
+
+	if _, err := parseTagTemplates([]string{"{{.Label"}, defaultNameRules, ""); err == nil {
+		t.Error("parseTagTemplates accepted an invalid template")
+	}
+}
+
+func TestTaskAddress(t *testing.T) {
+	m := &Mesos{IpOrder: []string{"host"}}
+
+	for _, tt := range []struct {
+		labels   []state.Label
+		address  string
+		resolver string
+	}{
+		{nil, "10.0.0.1", "host"},
+		{[]state.Label{{Key: "consul.address", Value: "10.1.2.3"}}, "10.1.2.3", "label"},
+		{[]state.Label{{Key: "consul.address", Value: " lb.example.com "}}, "lb.example.com", "label"},
+		{[]state.Label{{Key: "consul.address", Value: "[2001:db8::1]"}}, "2001:db8::1", "label"},
+		{[]state.Label{{Key: "consul.ip-family", Value: "ipv6"}}, "", ""},
+	} {
+		task := &state.Task{Name: "mytask", SlaveIP: "10.0.0.1", Labels: tt.labels}
+		if address, resolver := m.taskAddress(task); address != tt.address || resolver != tt.resolver {
+			t.Errorf("taskAddress(%v) => (%s, %s), want (%s, %s)", tt.labels, address, resolver, tt.address, tt.resolver)
+		}
+	}
+}
+
 func taskMapEq(a, b map[string][]string) bool {
 	if len(a) != len(b) {
 		return false
@@ -100,3 +183,1178 @@ func taskMapEq(a, b map[string][]string) bool {
 
 	return true
 }
+
+func TestTaskPorts(t *testing.T) {
+	task := &state.Task{
+		Resources: state.Resources{PortRanges: "[31000-31002]"},
+	}
+	if ports := taskPorts(task); len(ports) != 3 || ports[2] != (taskPort{Number: 31002, ServicePort: 31002, Index: 2}) {
+		t.Errorf("taskPorts() => %v, want the resource ports", ports)
+	}
+
+	task.DiscoveryInfo.Visibilty = "framework"
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{
+		{Number: 31001, Name: "admin", Protocol: "tcp"},
+		{Number: 31000, Name: "http", Protocol: "tcp", Visibility: "EXTERNAL"},
+		{Number: 9999, Name: "Metrics_Port", Protocol: "udp", Visibility: "CLUSTER"},
+	}
+
+	want := []taskPort{
+		{Number: 31001, ServicePort: 31001, Name: "admin", Protocol: "tcp", Visibility: "FRAMEWORK", Index: 0},
+		{Number: 31000, ServicePort: 31000, Name: "http", Protocol: "tcp", Visibility: "EXTERNAL", Index: 1},
+		{Number: 9999, ServicePort: 9999, Name: "Metrics_Port", Protocol: "udp", Visibility: "CLUSTER", Index: 2},
+	}
+	ports := taskPorts(task)
+	if len(ports) != len(want) {
+		t.Fatalf("taskPorts() => %v, want %v", ports, want)
+	}
+	for i := range want {
+		if ports[i] != want[i] {
+			t.Errorf("taskPorts()[%d] => %v, want %v", i, ports[i], want[i])
+		}
+	}
+
+	for i, l := range []string{"admin", "http", "metricsport"} {
+		if got := ports[i].label(defaultNameRules, ""); got != l {
+			t.Errorf("taskPorts()[%d].label() => %s, want %s", i, got, l)
+		}
+	}
+	if l := (taskPort{Index: 4}).label(defaultNameRules, ""); l != "4" {
+		t.Errorf("label() of an unnamed port => %s, want 4", l)
+	}
+
+	m := &Mesos{DiscoveryVisibility: []string{"CLUSTER", "EXTERNAL"}}
+	visible := m.visiblePorts(ports)
+	if len(visible) != 2 || visible[0].Number != 31000 || visible[1].Number != 9999 {
+		t.Errorf("visiblePorts() => %v, want ports 31000 and 9999", visible)
+	}
+}
+
+func TestServiceNames(t *testing.T) {
+	task := &state.Task{
+		Name:      "myapp",
+		Resources: state.Resources{PortRanges: "[31000-31001]"},
+		Labels:    []state.Label{{Key: "SERVICE_31000_NAME", Value: "web"}},
+	}
+
+	m := &Mesos{Separator: "_"}
+	if got := m.serviceNames(task); len(got) != 1 || got[0] != "myapp" {
+		t.Errorf("serviceNames() => %v, want [myapp]", got)
+	}
+
+	m.ServicePerPort = true
+	if got := m.serviceNames(task); len(got) != 3 || got[1] != "myapp-web" || got[2] != "myapp-1" {
+		t.Errorf("serviceNames() with --service-per-port => %v, want [myapp myapp-web myapp-1]", got)
+	}
+}
+
+func TestTaskPortsLabeled(t *testing.T) {
+	task := &state.Task{
+		Resources: state.Resources{PortRanges: "[31000-31002]"},
+		Labels: []state.Label{
+			{Key: "SERVICE_31000_NAME", Value: "web"},
+			{Key: "consul.port.2.name", Value: "metrics"},
+		},
+	}
+	ports := labeledPorts(taskPorts(task))
+	if len(ports) != 2 {
+		t.Fatalf("labeledPorts() => %v, want 2 ports", ports)
+	}
+	if ports[0].Number != 31000 || ports[0].Name != "web" {
+		t.Errorf("labeledPorts()[0] => %v, want 31000 named web", ports[0])
+	}
+	if ports[1].Number != 31002 || ports[1].Name != "metrics" {
+		t.Errorf("labeledPorts()[1] => %v, want 31002 named metrics", ports[1])
+	}
+}
+
+func TestParseAgentAddressMap(t *testing.T) {
+	entries, err := parseAgentAddressMap(strings.NewReader(`
+# comment
+build-07.example.com  10.20.0.7
+
+S3	192.168.4.12
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &agentAddressMap{entries: entries}
+	for _, tt := range []struct {
+		id       string
+		hostname string
+		addr     string
+		ok       bool
+	}{
+		{"S1", "build-07.example.com", "10.20.0.7", true},
+		{"S3", "build-07.example.com", "192.168.4.12", true},
+		{"S4", "other.example.com", "", false},
+	} {
+		if addr, ok := a.lookup(tt.id, tt.hostname); addr != tt.addr || ok != tt.ok {
+			t.Errorf("lookup(%s, %s) => (%s, %t), want (%s, %t)", tt.id, tt.hostname, addr, ok, tt.addr, tt.ok)
+		}
+	}
+
+	if _, err := parseAgentAddressMap(strings.NewReader("host-only\n")); err == nil {
+		t.Error("parseAgentAddressMap accepted a line without an address")
+	}
+}
+
+func TestLabelMeta(t *testing.T) {
+	schema, err := loadMetaSchema("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mesos{metaSchema: schema}
+
+	meta := map[string]string{}
+	m.labelMeta(&state.Task{Labels: []state.Label{
+		{Key: "consul.meta.lb-algorithm", Value: "leastconn"},
+		{Key: "consul.meta.Proxy-Protocol", Value: "v2"},
+		{Key: "consul.meta.sticky", Value: "yes"},
+		{Key: "consul.meta.owner", Value: "network"},
+		{Key: "lb-algorithm", Value: "source"},
+	}}, meta)
+
+	if len(meta) != 2 || meta["lb-algorithm"] != "leastconn" || meta["proxy-protocol"] != "v2" {
+		t.Errorf("labelMeta() => %v, want lb-algorithm=leastconn proxy-protocol=v2", meta)
+	}
+
+	if _, err := parseMetaSchema(strings.NewReader("owner\n")); err == nil {
+		t.Error("parseMetaSchema accepted a line without a regex")
+	}
+	if _, err := parseMetaSchema(strings.NewReader("owner (\n")); err == nil {
+		t.Error("parseMetaSchema accepted an invalid regex")
+	}
+}
+
+func TestTaskAllowed(t *testing.T) {
+	sj := state.State{Frameworks: []state.Framework{{Tasks: []state.Task{
+		{Name: "web-canary"}, {Name: "web"}, {Name: "web-canary"}, {Name: "db-canary"},
+	}}}}
+
+	for _, tt := range []struct {
+		precedence string
+		allowed    map[string]bool
+	}{
+		{PrecedenceBlacklist, map[string]bool{"web": true, "web-canary": false, "db-canary": false, "db": false}},
+		{PrecedenceWhitelist, map[string]bool{"web": true, "web-canary": true, "db-canary": false, "db": false}},
+	} {
+		m := &Mesos{
+			whitelistRegex:   regexp.MustCompile("^web"),
+			blacklistRegex:   regexp.MustCompile("canary"),
+			FilterPrecedence: tt.precedence,
+		}
+		for name, allowed := range tt.allowed {
+			if got := m.taskAllowed(name); got != allowed {
+				t.Errorf("%s: taskAllowed(%s) => %t, want %t", tt.precedence, name, got, allowed)
+			}
+		}
+
+		conflicts := m.filterConflicts(sj, maxFilterConflicts)
+		if !sliceEq(conflicts, []string{"web-canary"}) {
+			t.Errorf("filterConflicts() => %v, want [web-canary]", conflicts)
+		}
+	}
+}
+
+func TestFilterTask(t *testing.T) {
+	m := &Mesos{
+		whitelistRegex:      regexp.MustCompile("^web"),
+		agentBlacklistRegex: regexp.MustCompile("^ci-"),
+		agentHostnames:      map[string]string{"S1": "ci-agent-1", "S2": "prod-agent-1"},
+		FilterPrecedence:    PrecedenceWhitelist,
+	}
+	var err error
+	m.labelBlacklist, err = parseLabelSelectors([]string{"consul.ignore=true", "canary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		task   state.Task
+		reason string
+	}{
+		{state.Task{Name: "web", SlaveID: "S2"}, ""},
+		{state.Task{Name: "db", SlaveID: "S2"}, SkipFiltered},
+		{state.Task{Name: "web", SlaveID: "S1"}, SkipFilteredAgent},
+		{state.Task{Name: "web", SlaveID: "ci-S3"}, SkipFilteredAgent},
+		{state.Task{Name: "web", SlaveID: "S2", Labels: []state.Label{{Key: "consul.ignore", Value: "true"}}}, SkipFilteredLabel},
+		{state.Task{Name: "web", SlaveID: "S2", Labels: []state.Label{{Key: "consul.ignore", Value: "false"}}}, ""},
+		{state.Task{Name: "web", SlaveID: "S2", Labels: []state.Label{{Key: "canary", Value: "1"}}}, SkipFilteredLabel},
+		{state.Task{Name: "db", SlaveID: "S1"}, SkipFilteredAgent},
+	} {
+		if reason := m.filterTask(&tt.task, tt.task.Name); reason != tt.reason {
+			t.Errorf("filterTask(%s on %s, %v) => %q, want %q", tt.task.Name, tt.task.SlaveID, tt.task.Labels, reason, tt.reason)
+		}
+	}
+
+	if _, err := parseLabelSelectors([]string{"=true"}); err == nil {
+		t.Error("parseLabelSelectors accepted a selector without a key")
+	}
+}
+
+func TestFilterDecisions(t *testing.T) {
+	m := &Mesos{
+		whitelistRegex:   regexp.MustCompile("^web"),
+		blacklistRegex:   regexp.MustCompile("canary"),
+		agentHostnames:   map[string]string{"S1": "agent-1"},
+		FilterPrecedence: PrecedenceBlacklist,
+	}
+	sj := state.State{Frameworks: []state.Framework{{Name: "marathon", Tasks: []state.Task{
+		{ID: "web.1", Name: "web", SlaveID: "S1", State: "TASK_RUNNING"},
+		{ID: "web-canary.1", Name: "web-canary", SlaveID: "S1", State: "TASK_RUNNING"},
+		{ID: "db.1", Name: "db", SlaveID: "S1", State: "TASK_RUNNING"},
+		{ID: "web.2", Name: "web", SlaveID: "S1", State: "TASK_FAILED"},
+	}}}}
+
+	want := []FilterDecision{
+		{Task: "web.1", Name: "web", Framework: "marathon", Agent: "agent-1", Registered: true, Rule: "whitelist matches"},
+		{Task: "web-canary.1", Name: "web-canary", Framework: "marathon", Agent: "agent-1", Rule: "blacklist matches"},
+		{Task: "db.1", Name: "db", Framework: "marathon", Agent: "agent-1", Rule: "whitelist does not match"},
+	}
+	if decisions := m.filterDecisions(sj); !reflect.DeepEqual(decisions, want) {
+		t.Errorf("filterDecisions() => %+v, want %+v", decisions, want)
+	}
+}
+
+func TestApplyPortMode(t *testing.T) {
+	bridge := func(labels ...state.Label) *state.Task {
+		return &state.Task{
+			SlaveIP: "10.0.0.1",
+			Labels:  labels,
+			Statuses: []state.Status{{
+				State:  "TASK_RUNNING",
+				Labels: []state.Label{{Key: state.DockerIPLabel, Value: "172.17.0.2"}},
+			}},
+			Container: state.Container{Type: "DOCKER", Docker: &state.DockerInfo{
+				Network:      "BRIDGE",
+				PortMappings: []state.PortMapping{{HostPort: 31000, ContainerPort: 8080}},
+			}},
+		}
+	}
+
+	for _, tt := range []struct {
+		mode     string
+		task     *state.Task
+		address  string
+		resolver string
+		port     int
+	}{
+		{PortModeIPOrder, bridge(), "172.17.0.2", "docker", 31000},
+		{PortModeAuto, bridge(), "10.0.0.1", "host", 31000},
+		{PortModeHost, bridge(), "10.0.0.1", "host", 31000},
+		{PortModeContainer, bridge(), "172.17.0.2", "docker", 8080},
+		{PortModeHost, bridge(state.Label{Key: "consul.port-mode", Value: "container"}), "172.17.0.2", "docker", 8080},
+		{PortModeHost, bridge(state.Label{Key: "consul.address", Value: "10.9.9.9"}), "10.9.9.9", "label", 31000},
+		{PortModeAuto, &state.Task{SlaveIP: "10.0.0.1", Statuses: []state.Status{{
+			State:  "TASK_RUNNING",
+			Labels: []state.Label{{Key: state.DockerIPLabel, Value: "172.17.0.3"}},
+		}}}, "172.17.0.3", "docker", 31000},
+	} {
+		m := &Mesos{PortMode: tt.mode, IpOrder: []string{"docker", "host"}}
+		address, resolver := m.taskAddress(tt.task)
+		ports := []taskPort{{Number: 31000, ServicePort: 31000}}
+
+		address, resolver, ports = m.applyPortMode(tt.task, address, resolver, ports)
+		if address != tt.address || resolver != tt.resolver || ports[0].ServicePort != tt.port {
+			t.Errorf("%s: applyPortMode() => (%s, %s, %d), want (%s, %s, %d)", tt.mode, address, resolver, ports[0].ServicePort, tt.address, tt.resolver, tt.port)
+		}
+		if ports[0].Number != 31000 {
+			t.Errorf("%s: applyPortMode() changed the host port to %d", tt.mode, ports[0].Number)
+		}
+	}
+}
+
+func TestFilterPorts(t *testing.T) {
+	ports := []taskPort{
+		{Number: 31000, Index: 0},
+		{Number: 31001, Index: 1, Name: "admin", Labeled: true},
+		{Number: 31002, Index: 2},
+	}
+
+	for _, tt := range []struct {
+		policy string
+		ports  []int
+		err    bool
+	}{
+		{"all", []int{31000, 31001, 31002}, false},
+		{"first", []int{31000}, false},
+		{"index:2", []int{31002}, false},
+		{"index:7", []int{}, false},
+		{"LABEL", []int{31001}, false},
+		{"index", nil, true},
+		{"index:x", nil, true},
+		{"first:1", nil, true},
+		{"random", nil, true},
+	} {
+		selected, err := filterPorts(tt.policy, ports)
+		if (err != nil) != tt.err {
+			t.Errorf("filterPorts(%s) error => %v, want error %t", tt.policy, err, tt.err)
+			continue
+		}
+		got := []int{}
+		for _, p := range selected {
+			got = append(got, p.Number)
+		}
+		if !tt.err && fmt.Sprint(got) != fmt.Sprint(tt.ports) {
+			t.Errorf("filterPorts(%s) => %v, want %v", tt.policy, got, tt.ports)
+		}
+	}
+}
+
+func TestSelectTaskPorts(t *testing.T) {
+	m := &Mesos{PortPolicy: PortPolicyLabel}
+	ports := []taskPort{{Number: 31000, Index: 0}, {Number: 31001, Index: 1}}
+
+	if _, ok := m.selectTaskPorts(&state.Task{}, ports); ok {
+		t.Error("selectTaskPorts() registered a task without labeled ports")
+	}
+	if _, ok := m.selectTaskPorts(&state.Task{}, []taskPort{}); !ok {
+		t.Error("selectTaskPorts() skipped a task without ports")
+	}
+
+	task := &state.Task{Labels: []state.Label{{Key: "consul.port-policy", Value: "index:1"}}}
+	if selected, ok := m.selectTaskPorts(task, ports); !ok || len(selected) != 1 || selected[0].Number != 31001 {
+		t.Errorf("selectTaskPorts() => (%v, %t), want port 31001", selected, ok)
+	}
+}
+
+func TestJobResults(t *testing.T) {
+	run := func(id, st string, ts float64) state.Task {
+		return state.Task{ID: id, Name: "etl", SlaveID: "S1", State: st,
+			Statuses: []state.Status{{State: st, Timestamp: ts}}}
+	}
+	sj := state.State{Frameworks: []state.Framework{
+		{Name: "chronos", CompletedTasks: []state.Task{
+			run("etl.1", "TASK_FINISHED", 1000),
+			run("etl.2", "TASK_FINISHED", 2000),
+			run("etl.3", "TASK_FAILED", 1500),
+			run("etl.0", "TASK_FINISHED", 100),
+		}},
+		{Name: "marathon", CompletedTasks: []state.Task{
+			run("other.1", "TASK_FINISHED", 2000),
+		}},
+	}}
+
+	m := &Mesos{
+		Agents:         map[string]string{"S1": "10.0.0.1"},
+		jobResultRegex: regexp.MustCompile("^chronos$"),
+		JobResultTTL:   time.Hour,
+	}
+	now := time.Unix(2000, 0).Add(30 * time.Minute)
+
+	services := m.jobResults(sj, now)
+	if len(services) != 2 {
+		t.Fatalf("jobResults() => %d services, want 2", len(services))
+	}
+	for i, tt := range []struct {
+		id    string
+		tag   string
+		state string
+	}{
+		{"mesos-consul:10.0.0.1:etl-result:etl.2", "finished", "TASK_FINISHED"},
+		{"mesos-consul:10.0.0.1:etl-result:etl.3", "failed", "TASK_FAILED"},
+	} {
+		s := services[i]
+		if s.ID != tt.id || s.Name != "etl-result" || !sliceEq(s.Tags, []string{tt.tag}) || s.Meta["state"] != tt.state {
+			t.Errorf("jobResults()[%d] => %+v, want ID %s tagged %s", i, s, tt.id, tt.tag)
+		}
+	}
+	if got := services[0].Meta["finished-at"]; got != "1970-01-01T00:33:20Z" {
+		t.Errorf("finished-at => %s, want 1970-01-01T00:33:20Z", got)
+	}
+
+	if services := m.jobResults(sj, now.Add(2*time.Hour)); len(services) != 0 {
+		t.Errorf("jobResults() after TTL => %d services, want 0", len(services))
+	}
+}
+
+func TestAbsentAgents(t *testing.T) {
+	now := time.Now()
+	m := &Mesos{
+		PruneNodesAfter: time.Hour,
+		agentLastSeen: map[string]time.Time{
+			"10.0.0.1": now,
+			"10.0.0.2": now.Add(-30 * time.Minute),
+			"10.0.0.3": now.Add(-2 * time.Hour),
+		},
+	}
+
+	if absent := m.absentAgents(now); !sliceEq(absent, []string{"10.0.0.3"}) {
+		t.Errorf("absentAgents() => %v, want [10.0.0.3]", absent)
+	}
+}
+
+func TestSeedAgents(t *testing.T) {
+	now := time.Now()
+	r := newRecorder()
+	r.source = testSource{
+		{ID: "mesos-consul:10.0.0.1:web:31000", Agent: "10.0.0.1"},
+		{ID: "mesos-consul:10.0.0.2:web:31000", Agent: "10.0.0.2"},
+	}
+	r.CacheLoad("")
+
+	m := &Mesos{
+		Registry:        r,
+		PruneNodesAfter: time.Hour,
+		agentLastSeen:   map[string]time.Time{"10.0.0.1": now.Add(-2 * time.Hour)},
+	}
+	m.seedAgents(now)
+
+	if absent := m.absentAgents(now); !sliceEq(absent, []string{"10.0.0.1"}) {
+		t.Errorf("absentAgents() after seedAgents() => %v, want [10.0.0.1]", absent)
+	}
+	if absent := m.absentAgents(now.Add(2 * time.Hour)); len(absent) != 2 {
+		t.Errorf("absentAgents() 2h after seedAgents() => %v, want both agents of the cache", absent)
+	}
+}
+
+func TestTaskAddressNetworkPreference(t *testing.T) {
+	m := &Mesos{IpOrder: []string{"host"}, NetworkPreference: []string{"calico", "weave"}}
+
+	overlay := &state.Task{SlaveIP: "10.0.0.1", Statuses: []state.Status{{
+		State: "TASK_RUNNING",
+		ContainerStatus: state.ContainerStatus{NetworkInfos: []state.NetworkInfo{
+			{Name: "weave", IPAddresses: []state.IPAddress{{IPAddress: "10.32.0.5"}}},
+			{Name: "calico", IPAddresses: []state.IPAddress{{IPAddress: "192.168.7.3"}}},
+		}},
+	}}}
+	if address, resolver := m.taskAddress(overlay); address != "192.168.7.3" || resolver != "network:calico" {
+		t.Errorf("taskAddress(overlay) => (%s, %s), want (192.168.7.3, network:calico)", address, resolver)
+	}
+
+	hostnet := &state.Task{SlaveIP: "10.0.0.1"}
+	if address, resolver := m.taskAddress(hostnet); address != "10.0.0.1" || resolver != "host" {
+		t.Errorf("taskAddress(hostnet) => (%s, %s), want (10.0.0.1, host)", address, resolver)
+	}
+}
+
+func TestTaskIPOrder(t *testing.T) {
+	m := &Mesos{IpOrder: []string{"netinfo", "mesos", "host"}}
+
+	tests := []struct {
+		label string
+		want  []string
+	}{
+		{"", []string{"netinfo", "mesos", "host"}},
+		{"docker,host", []string{"docker", "host"}},
+		{" docker , host ", []string{"docker", "host"}},
+		{"docker,bogus", []string{"netinfo", "mesos", "host"}},
+	}
+
+	for _, tt := range tests {
+		task := &state.Task{}
+		if tt.label != "" {
+			task.Labels = []state.Label{{Key: "consul.ip-order", Value: tt.label}}
+		}
+		if got := m.taskIPOrder(task); !sliceEq(got, tt.want) {
+			t.Errorf("taskIPOrder(%q) => %v, want %v", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestTaskServiceID(t *testing.T) {
+	task := &state.Task{ID: "web.1234"}
+
+	tests := []struct {
+		scheme string
+		port   int
+		want   string
+	}{
+		{IDSchemeV1, 31000, "mesos-consul:10.0.0.1:web:31000"},
+		{IDSchemeV1, 0, "mesos-consul:10.0.0.1-web"},
+		{IDSchemeV2, 31000, "mesos-consul:v2:10.0.0.1:web.1234:31000"},
+		{IDSchemeV2, 0, "mesos-consul:v2:10.0.0.1:web.1234"},
+	}
+
+	for _, tt := range tests {
+		m := &Mesos{IDScheme: tt.scheme}
+		if got := m.taskServiceID(task, "10.0.0.1", "web", tt.port); got != tt.want {
+			t.Errorf("taskServiceID(%s, %d) => %s, want %s", tt.scheme, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestIDMigration(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	m := newMesos(c)
+	r := newRecorder()
+	m.Registry = r
+
+	schemes := func() map[string]bool {
+		found := make(map[string]bool)
+		for id, s := range r.services {
+			if s.Name != "web" {
+				continue
+			}
+			if strings.HasPrefix(id, "mesos-consul:v2:") {
+				found[IDSchemeV2] = true
+			} else {
+				found[IDSchemeV1] = true
+			}
+		}
+		return found
+	}
+
+	m.parseState(simulateState(t, web))
+	m.IDScheme = IDSchemeV2
+	m.parseState(simulateState(t, web))
+	if got := schemes(); !got[IDSchemeV1] || !got[IDSchemeV2] {
+		t.Errorf("first refresh after the migration => %v, want both schemes registered", got)
+	}
+
+	m.parseState(simulateState(t, web))
+	if got := schemes(); got[IDSchemeV1] || !got[IDSchemeV2] {
+		t.Errorf("second refresh after the migration => %v, want the v2 IDs only", got)
+	}
+}
+
+func TestIDTemplate(t *testing.T) {
+	tmpl, prefix, err := parseIDTemplate("svc:{{.Framework}}:{{.Agent}}:{{.TaskID}}:{{.Port}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "svc:" {
+		t.Errorf("prefix => %s, want svc:", prefix)
+	}
+
+	m := &Mesos{IDScheme: IDSchemeV1, idTemplate: tmpl}
+	task := &state.Task{ID: "web.1234", FrameworkName: "marathon"}
+	if got := m.taskServiceID(task, "10.0.0.1", "web", 31000); got != "svc:marathon:10.0.0.1:web.1234:31000" {
+		t.Errorf("taskServiceID() => %s, want svc:marathon:10.0.0.1:web.1234:31000", got)
+	}
+	if got := m.jobResultID(task, "10.0.0.1", "web"); got != "svc:marathon:10.0.0.1:web.1234:0:result" {
+		t.Errorf("jobResultID() => %s, want svc:marathon:10.0.0.1:web.1234:0:result", got)
+	}
+
+	for _, text := range []string{
+		"{{.TaskID}}:{{.Port}}",
+		"svc:{{.Agent}}:{{.Name}}:{{.Port}}",
+		"svc:{{.TaskID}}",
+		"svc:{{.TaskID",
+	} {
+		if _, _, err := parseIDTemplate(text); err == nil {
+			t.Errorf("parseIDTemplate(%s) => no error", text)
+		}
+	}
+}
+
+func TestTaskPortsProtocol(t *testing.T) {
+	task := &state.Task{
+		Resources: state.Resources{PortRanges: "[31000-31001]"},
+		Container: state.Container{Docker: &state.DockerInfo{PortMappings: []state.PortMapping{
+			{HostPort: 31000, ContainerPort: 53, Protocol: "UDP"},
+		}}},
+	}
+
+	ports := taskPorts(task)
+	if len(ports) != 2 {
+		t.Fatalf("taskPorts() => %d ports, want 2", len(ports))
+	}
+	if ports[0].Protocol != "udp" {
+		t.Errorf("port 31000 protocol => %q, want udp", ports[0].Protocol)
+	}
+	if ports[1].Protocol != "" {
+		t.Errorf("port 31001 protocol => %q, want none", ports[1].Protocol)
+	}
+
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{{Number: 31000, Protocol: "tcp"}}
+	if ports := taskPorts(task); ports[0].Protocol != "tcp" {
+		t.Errorf("discovery port 31000 protocol => %q, want tcp", ports[0].Protocol)
+	}
+}
+
+func TestTaskPortsDockerPortMappings(t *testing.T) {
+	task := &state.Task{
+		Container: state.Container{Docker: &state.DockerInfo{Network: "BRIDGE", PortMappings: []state.PortMapping{
+			{HostPort: 31000, ContainerPort: 80, Protocol: "tcp"},
+			{HostPort: 0, ContainerPort: 9090},
+			{HostPort: 31001, ContainerPort: 443},
+		}}},
+	}
+
+	ports := taskPorts(task)
+	if len(ports) != 2 {
+		t.Fatalf("taskPorts() => %+v, want 2 ports", ports)
+	}
+	for i, want := range []int{31000, 31001} {
+		if ports[i].Number != want || ports[i].ServicePort != want || ports[i].Index != i {
+			t.Errorf("taskPorts()[%d] => %+v, want port %d", i, ports[i], want)
+		}
+	}
+	if ports[0].Protocol != "tcp" {
+		t.Errorf("taskPorts()[0] protocol => %q, want tcp", ports[0].Protocol)
+	}
+
+	task.Resources.PortRanges = "[32000-32000]"
+	if ports := taskPorts(task); len(ports) != 1 || ports[0].Number != 32000 {
+		t.Errorf("taskPorts() with port resources => %+v, want port 32000", ports)
+	}
+}
+
+func TestEnvPorts(t *testing.T) {
+	env := func(vars ...string) *state.Task {
+		task := &state.Task{Command: &state.CommandInfo{}}
+		for i := 0; i < len(vars); i += 2 {
+			task.Command.Environment.Variables = append(task.Command.Environment.Variables, state.Variable{Name: vars[i], Value: vars[i+1]})
+		}
+		return task
+	}
+
+	tests := []struct {
+		task *state.Task
+		want []int
+	}{
+		{&state.Task{}, nil},
+		{env("PORT1", "31001"), nil},
+		{env("PORT0", "31000", "PORT1", "31001"), []int{31000, 31001}},
+		{env("PORT1", "31001", "PORT0", "31000", "PORT", "80"), []int{31000, 31001}},
+		{env("PORT0", "31000", "PORT1", "http", "PORT2", "31002"), []int{31000}},
+		{env("PORT0", "31000", "PORT1", "31000", "PORT2", "31002"), []int{31000, 31002}},
+		{env("PORT0", "70000"), nil},
+	}
+
+	for _, tt := range tests {
+		var got []int
+		for i, p := range envPorts(tt.task) {
+			if p.Index != i || p.ServicePort != p.Number {
+				t.Errorf("envPorts(%+v)[%d] => %+v", tt.task.Command, i, p)
+			}
+			got = append(got, p.Number)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("envPorts(%+v) => %v, want %v", tt.task.Command, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("envPorts(%+v) => %v, want %v", tt.task.Command, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestGetCheckTarget(t *testing.T) {
+	cv := &CheckVar{Host: "192.168.7.3", Port: "8080", Agent: "10.0.0.1", HostPort: "31000"}
+
+	tests := []struct {
+		labels []state.Label
+		http   string
+	}{
+		{[]state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}}, "http://192.168.7.3:8080/health"},
+		{[]state.Label{{Key: "check_http", Value: "http://{agent}:{host_port}/health"}}, "http://10.0.0.1:31000/health"},
+		{[]state.Label{
+			{Key: "check_host", Value: "{agent}"},
+			{Key: "check_port", Value: "{host_port}"},
+			{Key: "check_http", Value: "http://{host}:{port}/health"},
+		}, "http://10.0.0.1:31000/health"},
+		{[]state.Label{
+			{Key: "check_host", Value: "2001:db8::5"},
+			{Key: "check_http", Value: "http://{host}:{port}/health"},
+		}, "http://[2001:db8::5]:8080/health"},
+	}
+
+	for i, tt := range tests {
+		c := GetCheck(&state.Task{Labels: tt.labels}, cv)
+		if c.HTTP != tt.http {
+			t.Errorf("test #%d: GetCheck().HTTP => %s, want %s", i, c.HTTP, tt.http)
+		}
+	}
+}
+
+func TestGetCheckHealthCheck(t *testing.T) {
+	cv := &CheckVar{Host: "192.168.7.3", Port: "8080", Agent: "10.0.0.1", HostPort: "31000"}
+	bridge := state.Container{Docker: &state.DockerInfo{
+		Network:      "BRIDGE",
+		PortMappings: []state.PortMapping{{HostPort: 31000, ContainerPort: 8080}},
+	}}
+
+	tests := []struct {
+		task     state.Task
+		http     string
+		interval string
+		timeout  string
+	}{
+		{state.Task{HealthCheck: &state.HealthCheck{
+			Type: "HTTP",
+			HTTP: &state.HTTPHealthCheck{Port: 8080, Path: "/health"},
+		}}, "http://192.168.7.3:8080/health", "10s", "20s"},
+		{state.Task{HealthCheck: &state.HealthCheck{
+			HTTP:            &state.HTTPHealthCheck{Scheme: "https", Port: 8443},
+			IntervalSeconds: 5,
+			TimeoutSeconds:  2.5,
+		}}, "https://192.168.7.3:8443/", "5s", "2.5s"},
+		{state.Task{Container: bridge, HealthCheck: &state.HealthCheck{
+			Type: "HTTP",
+			HTTP: &state.HTTPHealthCheck{Port: 8080, Path: "ping"},
+		}}, "http://10.0.0.1:31000/ping", "10s", "20s"},
+		{state.Task{
+			Labels:      []state.Label{{Key: "check_http", Value: "http://{host}:{port}/status"}},
+			HealthCheck: &state.HealthCheck{Type: "HTTP", HTTP: &state.HTTPHealthCheck{Port: 8080}},
+		}, "http://192.168.7.3:8080/status", "", ""},
+		{state.Task{HealthCheck: &state.HealthCheck{Type: "TCP", HTTP: &state.HTTPHealthCheck{Port: 8080}}}, "", "", ""},
+	}
+
+	for i, tt := range tests {
+		c := GetCheck(&tt.task, cv)
+		if c.HTTP != tt.http || c.Interval != tt.interval || c.Timeout != tt.timeout {
+			t.Errorf("test #%d: GetCheck() => %+v, want HTTP %q, interval %q and timeout %q", i, c, tt.http, tt.interval, tt.timeout)
+		}
+	}
+}
+
+func TestGetCheckGRPC(t *testing.T) {
+	cv := &CheckVar{Host: "2001:db8::5", Port: "9090", Agent: "10.0.0.1", HostPort: "31000"}
+
+	c := GetCheck(&state.Task{Labels: []state.Label{
+		{Key: "consul.check.grpc", Value: "{host}:{port}/health.v1"},
+		{Key: "consul.check.grpc-tls", Value: "true"},
+	}}, cv)
+	if c.GRPC != "[2001:db8::5]:9090/health.v1" || !c.GRPCUseTLS || c.TLSSkipVerify {
+		t.Errorf("GetCheck() => %+v", c)
+	}
+
+	c = GetCheck(&state.Task{Labels: []state.Label{
+		{Key: "check_http", Value: "http://{host}:{port}/health"},
+		{Key: "consul.check.grpc", Value: "{host}:{port}"},
+	}}, cv)
+	if c.GRPC != "" || c.HTTP == "" {
+		t.Errorf("GetCheck() with check_http => %+v, want the HTTP check only", c)
+	}
+}
+
+func TestTaskCheckDefaults(t *testing.T) {
+	m := &Mesos{CheckInterval: 10 * time.Second, CheckTimeout: 2 * time.Second, CheckDeregisterAfter: time.Hour}
+	cv := &CheckVar{Host: "10.0.0.1", Port: "8080"}
+
+	tests := []struct {
+		labels                   []state.Label
+		interval, timeout, dereg string
+	}{
+		{[]state.Label{{Key: "check_http", Value: "http://{host}:{port}/"}}, "10s", "2s", "1h0m0s"},
+		{[]state.Label{
+			{Key: "check_http", Value: "http://{host}:{port}/"},
+			{Key: "check_interval", Value: "5s"},
+			{Key: "check_timeout", Value: "1s"},
+			{Key: "check_deregister_after", Value: "10m"},
+		}, "5s", "1s", "10m"},
+		{[]state.Label{{Key: "check_ttl", Value: "30s"}}, "", "", "1h0m0s"},
+		{nil, "", "", ""},
+	}
+
+	for i, tt := range tests {
+		c := m.taskCheck(&state.Task{Labels: tt.labels}, cv, "")
+		if c.Interval != tt.interval || c.Timeout != tt.timeout || c.DeregisterCriticalServiceAfter != tt.dereg {
+			t.Errorf("test #%d: taskCheck() => %+v, want interval %q, timeout %q and deregister after %q", i, c, tt.interval, tt.timeout, tt.dereg)
+		}
+	}
+}
+
+func TestTaskCheckAutoTCP(t *testing.T) {
+	m := &Mesos{AutoTCPCheck: true, AutoTCPCheckInterval: 30 * time.Second}
+
+	tests := []struct {
+		labels   []state.Label
+		cv       CheckVar
+		protocol string
+		tcp      string
+		interval string
+	}{
+		{nil, CheckVar{Host: "10.0.0.1", Port: "31000"}, "", "10.0.0.1:31000", "30s"},
+		{nil, CheckVar{Host: "2001:db8::5", Port: "31000"}, "tcp", "[2001:db8::5]:31000", "30s"},
+		{[]state.Label{{Key: "check_interval", Value: "5s"}}, CheckVar{Host: "10.0.0.1", Port: "31000"}, "", "10.0.0.1:31000", "5s"},
+		{[]state.Label{{Key: "check_port", Value: "{host_port}"}}, CheckVar{Host: "10.0.0.1", Port: "8080", HostPort: "31000"}, "", "10.0.0.1:31000", "30s"},
+		{[]state.Label{{Key: "check_ttl", Value: "60s"}}, CheckVar{Host: "10.0.0.1", Port: "31000"}, "", "", ""},
+		{nil, CheckVar{Host: "10.0.0.1", Port: "31053"}, "udp", "", ""},
+	}
+
+	for i, tt := range tests {
+		cv := tt.cv
+		c := m.taskCheck(&state.Task{Labels: tt.labels}, &cv, tt.protocol)
+		if c.TCP != tt.tcp || (tt.tcp != "" && c.Interval != tt.interval) {
+			t.Errorf("test #%d: taskCheck() => %+v, want TCP %q every %q", i, c, tt.tcp, tt.interval)
+		}
+	}
+
+	m.AutoTCPCheck = false
+	if c := m.taskCheck(&state.Task{}, &CheckVar{Host: "10.0.0.1", Port: "31000"}, ""); c.TCP != "" {
+		t.Errorf("taskCheck() without --auto-tcp-check => %+v", c)
+	}
+}
+
+func TestTaggedAddresses(t *testing.T) {
+	m := &Mesos{WANAddressAttribute: "public_ip"}
+
+	tests := []struct {
+		task state.Task
+		wan  string
+	}{
+		{state.Task{SlaveAttributes: map[string]string{"public_ip": "203.0.113.7"}}, "203.0.113.7"},
+		{state.Task{
+			SlaveAttributes: map[string]string{"public_ip": "203.0.113.7"},
+			Labels:          []state.Label{{Key: "consul.wan-address", Value: "198.51.100.9"}},
+		}, "198.51.100.9"},
+		{state.Task{}, ""},
+	}
+
+	for i, tt := range tests {
+		ta := m.taggedAddresses(&tt.task, "172.17.0.2", 8080, 31000)
+		if tt.wan == "" {
+			if ta != nil {
+				t.Errorf("test #%d: taggedAddresses() => %v, want none", i, ta)
+			}
+			continue
+		}
+		lan, wan := ta[TaggedAddressLAN], ta[TaggedAddressWAN]
+		if lan.Address != "172.17.0.2" || lan.Port != 8080 || wan.Address != tt.wan || wan.Port != 31000 {
+			t.Errorf("test #%d: taggedAddresses() => %v, want lan 172.17.0.2:8080 and wan %s:31000", i, ta, tt.wan)
+		}
+	}
+}
+
+func TestTaskWeights(t *testing.T) {
+	tests := []struct {
+		labels []state.Label
+		want   *registry.Weights
+	}{
+		{nil, nil},
+		{[]state.Label{{Key: "consul.weights.passing", Value: "10"}}, &registry.Weights{Passing: 10, Warning: 1}},
+		{[]state.Label{
+			{Key: "consul.weights.passing", Value: "10"},
+			{Key: "consul.weights.warning", Value: "0"},
+		}, &registry.Weights{Passing: 10, Warning: 0}},
+		{[]state.Label{{Key: "consul.weights.warning", Value: "3"}}, &registry.Weights{Passing: 1, Warning: 3}},
+		{[]state.Label{{Key: "consul.weights.passing", Value: "0"}}, nil},
+		{[]state.Label{{Key: "consul.weights.passing", Value: "heavy"}}, nil},
+	}
+
+	for i, tt := range tests {
+		got := taskWeights(&state.Task{Labels: tt.labels})
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("test #%d: taskWeights() => %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
+
+func TestTaskConnect(t *testing.T) {
+	if c := taskConnect(&state.Task{}); c != nil {
+		t.Errorf("taskConnect() without consul.connect => %+v, want nil", c)
+	}
+
+	c := taskConnect(&state.Task{Labels: []state.Label{
+		{Key: "consul.connect", Value: "true"},
+		{Key: "consul.connect.port", Value: "31005"},
+		{Key: "consul.connect.upstreams", Value: "db:5432, cache:6379,broken,:80"},
+	}})
+	want := []registry.Upstream{{Name: "db", LocalBindPort: 5432}, {Name: "cache", LocalBindPort: 6379}}
+	if c == nil || c.SidecarPort != 31005 || len(c.Upstreams) != len(want) {
+		t.Fatalf("taskConnect() => %+v, want port 31005 and upstreams %v", c, want)
+	}
+	for i := range want {
+		if c.Upstreams[i] != want[i] {
+			t.Errorf("upstream %d => %+v, want %+v", i, c.Upstreams[i], want[i])
+		}
+	}
+}
+
+func TestLimitPorts(t *testing.T) {
+	ports := []taskPort{{Number: 31000}, {Number: 31001, Name: "http"}, {Number: 31002}, {Number: 31003, Name: "admin"}}
+
+	tests := []struct {
+		max    int
+		policy string
+		want   []int
+	}{
+		{0, PortLimitFirst, []int{31000, 31001, 31002, 31003}},
+		{4, PortLimitFirst, []int{31000, 31001, 31002, 31003}},
+		{2, PortLimitFirst, []int{31000, 31001}},
+		{3, PortLimitNamed, []int{31001, 31003}},
+		{1, PortLimitNamed, []int{31001}},
+	}
+
+	for _, tt := range tests {
+		m := &Mesos{MaxTaskPorts: tt.max, PortLimitPolicy: tt.policy}
+		got := m.limitPorts(&state.Task{}, ports)
+		if len(got) != len(tt.want) {
+			t.Errorf("limitPorts(%d, %s) => %+v, want %v", tt.max, tt.policy, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Number != tt.want[i] {
+				t.Errorf("limitPorts(%d, %s) => %+v, want %v", tt.max, tt.policy, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestMirrorTask(t *testing.T) {
+	task := &state.Task{
+		ID:            "web.1",
+		Name:          "web",
+		FrameworkName: "marathon",
+		SlaveID:       "S1",
+		State:         "TASK_RUNNING",
+		Resources:     state.Resources{PortRanges: "[31000-31001]"},
+		Labels:        []state.Label{{Key: "team", Value: "core"}, {Key: "api_password", Value: "s3cr3t"}},
+	}
+
+	got := mirrorTask(task, "10.0.0.1")
+	if got.ID != "web.1" || got.Framework != "marathon" || got.SlaveID != "S1" || got.AgentIP != "10.0.0.1" || got.State != "TASK_RUNNING" {
+		t.Errorf("mirrorTask() => %+v", got)
+	}
+	if strings.Join(got.Ports, ",") != "31000,31001" {
+		t.Errorf("ports => %v, want [31000 31001]", got.Ports)
+	}
+	if got.Labels["team"] != "core" || got.Labels["api_password"] != "s3cr3t" {
+		t.Errorf("labels => %v, want the raw values", got.Labels)
+	}
+}
+
+// kvRecorder is a recorder with a key/value store
+type kvRecorder struct {
+	*recorder
+	values map[string]string
+}
+
+func (r *kvRecorder) KVGet(host string, key string) (string, bool, error) {
+	v, ok := r.values[key]
+	return v, ok, nil
+}
+
+func TestReloadFilters(t *testing.T) {
+	kv := &kvRecorder{recorder: newRecorder(), values: map[string]string{}}
+	m := &Mesos{Registry: kv, FilterKV: "mesos-consul/filters", BlackList: "^batch"}
+	m.blacklistRegex = regexp.MustCompile(m.BlackList)
+
+	kv.values["mesos-consul/filters/whitelist"] = "^web\n# comment\n^api\n"
+	m.reloadFilters()
+	if m.whitelistRegex == nil || m.whitelistRegex.String() != "^web|^api" {
+		t.Fatalf("whitelist => %v, want ^web|^api", m.whitelistRegex)
+	}
+	if m.blacklistRegex.String() != "^batch" {
+		t.Errorf("blacklist => %v, want the command line ^batch", m.blacklistRegex)
+	}
+
+	kv.values["mesos-consul/filters/whitelist"] = "^web("
+	m.reloadFilters()
+	if m.whitelistRegex.String() != "^web|^api" {
+		t.Errorf("whitelist => %v, want the previous ^web|^api kept", m.whitelistRegex)
+	}
+
+	kv.values["mesos-consul/filters/blacklist"] = ""
+	delete(kv.values, "mesos-consul/filters/whitelist")
+	m.reloadFilters()
+	if m.whitelistRegex != nil || m.blacklistRegex != nil {
+		t.Errorf("filters => %v, %v, want none", m.whitelistRegex, m.blacklistRegex)
+	}
+}
+
+// watchRecorder is a recorder with a watched key/value store
+type watchRecorder struct {
+	*kvRecorder
+	err error
+}
+
+func (r *watchRecorder) KVWatched(host string, prefix string) (map[string]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.values, nil
+}
+
+func TestReloadFiltersWatched(t *testing.T) {
+	kv := &watchRecorder{kvRecorder: &kvRecorder{recorder: newRecorder(), values: map[string]string{}}}
+	m := &Mesos{Registry: kv, FilterKV: "mesos-consul/filters"}
+
+	kv.values["mesos-consul/filters/blacklist"] = "^batch"
+	m.reloadFilters()
+	if m.blacklistRegex == nil || m.blacklistRegex.String() != "^batch" {
+		t.Fatalf("blacklist => %v, want ^batch", m.blacklistRegex)
+	}
+
+	// A failed watch keeps the current lists
+	kv.err = fmt.Errorf("connection refused")
+	m.reloadFilters()
+	if m.blacklistRegex == nil || m.blacklistRegex.String() != "^batch" {
+		t.Errorf("blacklist => %v, want ^batch kept", m.blacklistRegex)
+	}
+}
+
+func TestReload(t *testing.T) {
+	m := &Mesos{
+		WhiteList:        "^web",
+		FilterPrecedence: PrecedenceBlacklist,
+		IpOrder:          []string{"netinfo", "mesos", "host"},
+		taskTag:          map[string][]string{},
+	}
+	m.whitelistRegex = regexp.MustCompile(m.WhiteList)
+
+	c := config.DefaultConfig()
+	c.WhiteList = []string{"^api("}
+	c.BlackList = []string{"^batch"}
+	c.FilterPrecedence = "none"
+	c.TaskTag = []string{"web:http,public"}
+	c.MesosIpOrder = "host,nowhere"
+	m.Reload(c)
+
+	if m.whitelistRegex.String() != "^web" {
+		t.Errorf("whitelist => %v, want the previous ^web kept", m.whitelistRegex)
+	}
+	if m.blacklistRegex == nil || m.blacklistRegex.String() != "^batch" {
+		t.Errorf("blacklist => %v, want ^batch", m.blacklistRegex)
+	}
+	if m.FilterPrecedence != PrecedenceBlacklist {
+		t.Errorf("filter precedence => %s, want the previous %s kept", m.FilterPrecedence, PrecedenceBlacklist)
+	}
+	if !sliceEq(m.taskTag["web"], []string{"http", "public"}) {
+		t.Errorf("task tags => %v, want web:http,public", m.taskTag)
+	}
+	if !sliceEq(m.IpOrder, []string{"netinfo", "mesos", "host"}) {
+		t.Errorf("IP order => %v, want the previous one kept", m.IpOrder)
+	}
+
+	c.WhiteList = nil
+	c.TaskTag = []string{"invalid"}
+	c.MesosIpOrder = "host"
+	m.Reload(c)
+
+	if m.whitelistRegex != nil {
+		t.Errorf("whitelist => %v, want none", m.whitelistRegex)
+	}
+	if !sliceEq(m.taskTag["web"], []string{"http", "public"}) {
+		t.Errorf("task tags => %v, want the previous ones kept", m.taskTag)
+	}
+	if !sliceEq(m.IpOrder, []string{"host"}) {
+		t.Errorf("IP order => %v, want [host]", m.IpOrder)
+	}
+}
+
+func TestAgentNodeMeta(t *testing.T) {
+	s := state.Slave{
+		ID:         "S1",
+		Hostname:   "agent-1.example.com",
+		Version:    "1.11.0",
+		Attributes: map[string]interface{}{"rack": "r7", "cores": 16},
+		DrainInfo:  &state.DrainInfo{State: "DRAINING"},
+	}
+
+	want := map[string]string{
+		"mesos-agent-id":   "S1",
+		"mesos-hostname":   "agent-1.example.com",
+		"mesos-version":    "1.11.0",
+		"mesos-draining":   "true",
+		"mesos-attr-rack":  "r7",
+		"mesos-attr-cores": "16",
+	}
+
+	got := agentNodeMeta(s)
+	if len(got) != len(want) {
+		t.Fatalf("agentNodeMeta() => %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("agentNodeMeta()[%s] => %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestHostTags(t *testing.T) {
+	tags := splitTags("leader, mesos-{version},")
+
+	got := hostTags(tags, "1.11.0")
+	if !sliceEq(got, []string{"leader", "mesos-1.11.0"}) {
+		t.Errorf("hostTags() => %v, want [leader mesos-1.11.0]", got)
+	}
+
+	got = hostTags(tags, "")
+	if !sliceEq(got, []string{"leader"}) {
+		t.Errorf("hostTags() without version => %v, want [leader]", got)
+	}
+}
+
+func TestRegisterHostsAgentBlacklist(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	c.AgentBlacklist = []string{"^agent1$"}
+
+	m := newMesos(c)
+	r := newRecorder()
+	m.Registry = r
+	m.parseState(simulateState(t, web))
+
+	for id := range r.services {
+		if strings.Contains(id, "agent1") || strings.Contains(id, "web") {
+			t.Errorf("registered %s of a blacklisted agent", id)
+		}
+	}
+	if m.Agents["S1"] != "10.0.0.1" {
+		t.Error("the blacklisted agent is unknown, want its tasks filtered out rather than skipped")
+	}
+}
+
+func TestZkMembers(t *testing.T) {
+	got := zkMembers("zk://zk1:2181,zk2,10.0.0.3:2182/mesos")
+	want := []string{"zk1:2181", "zk2:2181", "10.0.0.3:2182"}
+	if !sliceEq(got, want) {
+		t.Errorf("zkMembers() => %v, want %v", got, want)
+	}
+}
+
+func TestTaskName(t *testing.T) {
+	tmpl, err := parseNameTemplate(`{{lower .Framework}}{{.Sep}}{{.TaskName}}{{with .Attributes.rack}}-{{.}}{{end}}`, defaultNameRules, "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Mesos{
+		Separator:       "-",
+		nameTemplate:    tmpl,
+		agentAttributes: map[string]map[string]string{"S1": {"rack": "r7"}},
+	}
+
+	task := &state.Task{Name: "my.app", FrameworkName: "Marathon", SlaveID: "S1"}
+	if got := m.taskName(task); got != "marathon-my-app-r7" {
+		t.Errorf("taskName() => %q, want %q", got, "marathon-my-app-r7")
+	}
+
+	m.nameTemplate = nil
+	if got := m.taskName(task); got != "my-app" {
+		t.Errorf("taskName() without template => %q, want %q", got, "my-app")
+	}
+}
+
+func TestTaskNameFwPrefix(t *testing.T) {
+	m := &Mesos{Separator: "", FwPrefix: true}
+
+	for fw, want := range map[string]string{"marathon": "marathon-myapp", "Chronos": "chronos-myapp", "": "myapp"} {
+		task := &state.Task{Name: "myapp", FrameworkName: fw}
+		if got := m.taskName(task); got != want {
+			t.Errorf("taskName() in %q => %q, want %q", fw, got, want)
+		}
+	}
+
+	m.Separator = "."
+	if got := m.taskName(&state.Task{Name: "myapp", FrameworkName: "marathon"}); got != "marathon.myapp" {
+		t.Errorf("taskName() with separator . => %q, want %q", got, "marathon.myapp")
+	}
+
+	// The filters match the name without the prefix
+	m.whitelistRegex = regexp.MustCompile("^myapp$")
+	task := &state.Task{Name: "myapp", FrameworkName: "marathon"}
+	if reason := m.filterTask(task, m.taskName(task)); reason != "" {
+		t.Errorf("filterTask() => %q, want the unprefixed name to be whitelisted", reason)
+	}
+
+	a := m.taskServiceID(&state.Task{}, "10.0.0.1", "marathon-myapp", 31000)
+	b := m.taskServiceID(&state.Task{}, "10.0.0.1", "chronos-myapp", 31000)
+	if a == b {
+		t.Errorf("taskServiceID() => %q for both frameworks", a)
+	}
+}
@@ -0,0 +1,98 @@
+package mesos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metaSchema holds the Meta keys task labels may set, with the regular
+// expression their values must match
+type metaSchema map[string]*regexp.Regexp
+
+// defaultMetaSchema holds the load balancer hints understood by the
+// consul-template HAProxy configurations
+const defaultMetaSchema = `
+lb-algorithm	^(roundrobin|leastconn|source|first|uri)$
+proxy-protocol	^(v1|v2)$
+sticky		^(true|false)$
+`
+
+// loadMetaSchema reads the schema file at path, or returns the default
+// schema when path is empty.
+func loadMetaSchema(path string) (metaSchema, error) {
+	if path == "" {
+		return parseMetaSchema(strings.NewReader(defaultMetaSchema))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMetaSchema(f)
+}
+
+// parseMetaSchema reads one `<key> <value regex>` pair per line. Blank
+// lines and lines starting with # are ignored.
+func parseMetaSchema(r io.Reader) (metaSchema, error) {
+	schema := make(metaSchema)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected '<key> <value regex>', got %q", n, line)
+		}
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		schema[strings.ToLower(fields[0])] = re
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// labelMeta adds the Meta set by the consul.meta.<key> labels of a task
+// to meta. Keys missing from the schema and values not matching it are
+// dropped with a warning.
+func (m *Mesos) labelMeta(t *state.Task, meta map[string]string) {
+	prefix := strings.ToLower(t.PrefixedKey("meta."))
+
+	for _, l := range t.Labels {
+		if !strings.HasPrefix(strings.ToLower(l.Key), prefix) {
+			continue
+		}
+		key := strings.ToLower(l.Key[len(prefix):])
+
+		re, ok := m.metaSchema[key]
+		if !ok {
+			log.WithField("task", t.ID).Warnf("Ignoring label %s: Meta key '%s' is not in the schema", l.Key, key)
+			continue
+		}
+		if !re.MatchString(l.Value) {
+			log.WithField("task", t.ID).Warnf("Ignoring label %s: '%s' does not match %s", l.Key, l.Value, re)
+			continue
+		}
+
+		meta[key] = l.Value
+	}
+}
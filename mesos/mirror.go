@@ -0,0 +1,37 @@
+package mesos
+
+import (
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// mirrorTask returns the metadata of a task on the agent at address,
+// with its raw label values.
+func mirrorTask(t *state.Task, address string) *registry.Task {
+	labels := make(map[string]string, len(t.Labels))
+	for _, l := range t.Labels {
+		labels[l.Key] = l.Value
+	}
+
+	return &registry.Task{
+		ID:        t.ID,
+		Name:      t.Name,
+		Framework: t.FrameworkName,
+		SlaveID:   t.SlaveID,
+		AgentIP:   address,
+		State:     t.State,
+		Ports:     t.Resources.Ports(),
+		Labels:    labels,
+	}
+}
+
+// mirrorTasks passes the tasks of the refresh to registries mirroring
+// them, through the registry agent of the leading master
+func (m *Mesos) mirrorTasks(tasks []*registry.Task) {
+	mirror, ok := m.Registry.(registry.TaskMirror)
+	if !ok {
+		return
+	}
+
+	mirror.MirrorTasks(m.getLeader().Ip, tasks)
+}
@@ -0,0 +1,95 @@
+package mesos
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nameVars are the fields available to --service-name-template
+type nameVars struct {
+	Framework  string
+	TaskName   string
+	Sep        string
+	Labels     map[string]string
+	Attributes map[string]string
+}
+
+// parseNameTemplate parses the --service-name-template. Besides the
+// template builtins, it can use lower, upper, replace and clean, the
+// latter applying the service name rules.
+func parseNameTemplate(text string, names nameRules, separator string) (*template.Template, error) {
+	return template.New("service-name").Funcs(template.FuncMap{
+		"lower":   strings.ToLower,
+		"upper":   strings.ToUpper,
+		"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"clean":   func(s string) string { return names.clean(s, separator) },
+	}).Parse(text)
+}
+
+// taskName returns the service name of a task, prefixed by the name of
+// its framework with --fw-prefix. v1 service IDs embed the name, so tasks
+// of the same name in different frameworks get distinct IDs as well.
+func (m *Mesos) taskName(t *state.Task) string {
+	return m.nameRules().truncate(m.fwPrefix(t) + m.baseTaskName(t))
+}
+
+// fwPrefix returns the prefix of the service names of a task with
+// --fw-prefix: the cleaned name of its framework and the group separator,
+// or - when the separator is empty so that the names don't run together.
+func (m *Mesos) fwPrefix(t *state.Task) string {
+	if !m.FwPrefix || t.FrameworkName == "" {
+		return ""
+	}
+
+	sep := m.Separator
+	if sep == "" {
+		sep = "-"
+	}
+	return m.cleanName(t.FrameworkName) + sep
+}
+
+// filterName returns the name of a task the --whitelist and --blacklist
+// match: its service name without the --fw-prefix prefix.
+func (m *Mesos) filterName(t *state.Task, tname string) string {
+	return strings.TrimPrefix(tname, m.fwPrefix(t))
+}
+
+// baseTaskName returns the service name of a task, from the
+// --service-name-template when set. Templates failing to render, or
+// rendering an empty name, fall back to the cleaned task name.
+func (m *Mesos) baseTaskName(t *state.Task) string {
+	if m.nameTemplate == nil {
+		return m.cleanName(t.Name)
+	}
+
+	vars := nameVars{
+		Framework:  t.FrameworkName,
+		TaskName:   t.Name,
+		Sep:        m.Separator,
+		Labels:     make(map[string]string, len(t.Labels)),
+		Attributes: m.agentAttributes[t.SlaveID],
+	}
+	for _, l := range t.Labels {
+		vars.Labels[l.Key] = l.Value
+	}
+
+	var b bytes.Buffer
+	if err := m.nameTemplate.Execute(&b, vars); err != nil {
+		log.WithField("task", t.Name).Warn("Unable to render the service name template: ", err)
+		return m.cleanName(t.Name)
+	}
+
+	names := m.nameRules()
+	name := names.truncate(names.replaceInvalid(strings.TrimSpace(b.String()), "_"))
+	if name == "" {
+		log.WithField("task", t.Name).Warn("Service name template rendered an empty name")
+		return m.cleanName(t.Name)
+	}
+
+	return name
+}
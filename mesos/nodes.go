@@ -0,0 +1,47 @@
+package mesos
+
+import (
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// agentNodeMeta returns the node meta of a Mesos agent: its ID, hostname,
+// version, draining state and attributes
+func agentNodeMeta(s state.Slave) map[string]string {
+	meta := map[string]string{
+		"mesos-agent-id": s.ID,
+		"mesos-hostname": s.Hostname,
+	}
+	if s.Version != "" {
+		meta["mesos-version"] = s.Version
+	}
+	if s.Draining() {
+		meta["mesos-draining"] = "true"
+	}
+	for k, v := range s.AttributeMap() {
+		meta["mesos-attr-"+k] = v
+	}
+
+	return meta
+}
+
+// registersNodes returns whether r registers the Mesos agents as nodes
+func registersNodes(r registry.Registry) bool {
+	n, ok := r.(registry.NodeRegistrar)
+	return ok && n.RegistersNodes()
+}
+
+// syncNodes passes the Mesos agents of the refresh to registries which
+// register them as nodes, with --register-agent-nodes
+func (m *Mesos) syncNodes(nodes []*registry.Node) {
+	if !m.AgentNodes {
+		return
+	}
+
+	r, ok := m.Registry.(registry.NodeRegistrar)
+	if !ok {
+		return
+	}
+
+	r.SyncNodes(m.getLeader().Ip, nodes)
+}
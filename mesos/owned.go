@@ -0,0 +1,134 @@
+package mesos
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// States of an owned service
+const (
+	// Registered during the last cycle
+	OwnedRegistered = "registered"
+
+	// Registered during an earlier cycle, missing from the last one and
+	// still in the registry cache until it is deregistered
+	OwnedDeregistering = "deregistering"
+
+	// Loaded from the registry, by this or an earlier instance, and not
+	// registered by this one since
+	OwnedLoaded = "loaded"
+)
+
+// OwnedService is a service registered by mesos-consul, during the last
+// cycle or kept in the registry cache
+type OwnedService struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Task      string `json:"task,omitempty"`
+	Framework string `json:"framework,omitempty"`
+	Agent     string `json:"agent"`
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	State     string `json:"state"`
+
+	// First cycle of this process the service was registered in, zero
+	// for the loaded ones, and last cycle it was seen in
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// ownedReport keeps the services of the last complete cycle and of the
+// registry cache for Owned, with the task of each service of the current
+// cycle.
+type ownedReport struct {
+	sync.Mutex
+	tasks    map[string]string
+	services map[string]OwnedService
+}
+
+// task records the ID of the task of a service of the current cycle
+func (r *ownedReport) task(serviceID string, taskID string) {
+	if r.tasks == nil {
+		r.tasks = make(map[string]string)
+	}
+	r.tasks[serviceID] = taskID
+}
+
+// endCycle replaces the owned services by those of the cycle and the
+// others of the registry cache, keeping the registration time of the
+// services already owned
+func (r *ownedReport) endCycle(services []*registry.Service, cached []*registry.Service, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	owned := make(map[string]OwnedService, len(services)+len(cached))
+	for _, s := range services {
+		o := ownedService(s, OwnedRegistered)
+		o.Task = r.tasks[s.ID]
+		o.Registered = now
+		o.LastSeen = now
+		if prev, ok := r.services[s.ID]; ok && !prev.Registered.IsZero() {
+			o.Registered = prev.Registered
+		}
+		owned[s.ID] = o
+	}
+
+	for _, s := range cached {
+		if _, ok := owned[s.ID]; ok {
+			continue
+		}
+
+		o := ownedService(s, OwnedLoaded)
+		if prev, ok := r.services[s.ID]; ok && !prev.Registered.IsZero() {
+			o.State = OwnedDeregistering
+			o.Task = prev.Task
+			o.Registered = prev.Registered
+			o.LastSeen = prev.LastSeen
+		}
+		owned[s.ID] = o
+	}
+
+	r.services = owned
+	r.tasks = nil
+}
+
+func ownedService(s *registry.Service, state string) OwnedService {
+	return OwnedService{
+		ID:        s.ID,
+		Name:      s.Name,
+		Framework: s.Meta["framework"],
+		Agent:     s.Agent,
+		Address:   s.Address,
+		Port:      s.Port,
+		State:     state,
+	}
+}
+
+// Owned returns the services registered during the last cycle, whether
+// or not the registry accepted them, and the other services of the
+// registry cache, sorted by ID.
+func (m *Mesos) Owned() []OwnedService {
+	m.owned.Lock()
+	defer m.owned.Unlock()
+
+	owned := make([]OwnedService, 0, len(m.owned.services))
+	for _, o := range m.owned.services {
+		owned = append(owned, o)
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].ID < owned[j].ID
+	})
+	return owned
+}
+
+// cached returns the services of the registry cache, or none when the
+// registry can't list them
+func (m *Mesos) cached() []*registry.Service {
+	if l, ok := m.Registry.(registry.CacheLister); ok {
+		return l.Cached()
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package mesos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestOwned(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	api := `{"id": "api.1", "name": "api", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31002-31002]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	m := newMesos(c)
+	m.Registry = newRecorder()
+
+	m.parseState(simulateState(t, web))
+	first := taskServices(m.Owned())
+	if len(first) != 1 {
+		t.Fatalf("Owned() => %+v, want the web service", first)
+	}
+	want := OwnedService{
+		ID:        "mesos-consul:10.0.0.1:web:31000",
+		Name:      "web",
+		Task:      "web.1",
+		Framework: "marathon",
+		Agent:     "10.0.0.1",
+		Address:   "10.0.0.1",
+		Port:      31000,
+	}
+	if o := first[0]; o.ID != want.ID || o.Name != want.Name || o.Task != want.Task || o.Framework != want.Framework ||
+		o.Agent != want.Agent || o.Address != want.Address || o.Port != want.Port {
+		t.Errorf("Owned() => %+v, want %+v", o, want)
+	}
+
+	time.Sleep(time.Millisecond)
+	m.parseState(simulateState(t, web+","+api))
+	second := taskServices(m.Owned())
+	if len(second) != 2 || second[0].Task != "api.1" || second[1].Task != "web.1" {
+		t.Fatalf("Owned() => %+v, want the api and web services", second)
+	}
+	if !second[1].Registered.Equal(first[0].Registered) || !second[1].LastSeen.After(first[0].LastSeen) {
+		t.Errorf("web => registered %v, last seen %v, want registered %v and seen since", second[1].Registered, second[1].LastSeen, first[0].Registered)
+	}
+}
+
+func TestOwnedCache(t *testing.T) {
+	web := &registry.Service{ID: "mesos-consul:10.0.0.1:web:31000", Name: "web"}
+	api := &registry.Service{ID: "mesos-consul:10.0.0.1:api:31002", Name: "api"}
+	db := &registry.Service{ID: "mesos-consul:10.0.0.1:db:31001", Name: "db"}
+
+	r := &ownedReport{}
+	first := time.Now()
+	r.task(web.ID, "web.1")
+	r.endCycle([]*registry.Service{web}, []*registry.Service{web, db}, first)
+
+	// web goes missing, and is kept in the cache until it is deregistered
+	r.endCycle([]*registry.Service{api}, []*registry.Service{web, api, db}, first.Add(time.Minute))
+
+	for _, tt := range []struct {
+		service *registry.Service
+		state   string
+		task    string
+		seen    time.Time
+	}{
+		{web, OwnedDeregistering, "web.1", first},
+		{api, OwnedRegistered, "", first.Add(time.Minute)},
+		{db, OwnedLoaded, "", time.Time{}},
+	} {
+		o := r.services[tt.service.ID]
+		if o.State != tt.state || o.Task != tt.task || !o.LastSeen.Equal(tt.seen) {
+			t.Errorf("%s => state %s, task %q, last seen %v, want %s, %q, %v", o.ID, o.State, o.Task, o.LastSeen, tt.state, tt.task, tt.seen)
+		}
+	}
+	if !r.services[web.ID].Registered.Equal(first) || !r.services[db.ID].Registered.IsZero() {
+		t.Errorf("registered web %v and db %v, want %v and never", r.services[web.ID].Registered, r.services[db.ID].Registered, first)
+	}
+}
+
+// taskServices returns the owned services of tasks
+func taskServices(owned []OwnedService) []OwnedService {
+	services := []OwnedService{}
+	for _, o := range owned {
+		if o.Task != "" {
+			services = append(services, o)
+		}
+	}
+	return services
+}
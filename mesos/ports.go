@@ -0,0 +1,439 @@
+package mesos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Port policies, selecting which ports of a task are registered. The
+// index policy is written index:<n>.
+const (
+	PortPolicyAll   = "all"
+	PortPolicyFirst = "first"
+	PortPolicyIndex = "index"
+	PortPolicyLabel = "label"
+)
+
+// Port limit policies, selecting which ports of a task with more than
+// MaxTaskPorts ports are registered
+const (
+	PortLimitFirst = "first"
+	PortLimitNamed = "named"
+)
+
+// Port modes, selecting which address and port pair of a task is registered
+const (
+	PortModeIPOrder   = "ip-order"
+	PortModeHost      = "host"
+	PortModeContainer = "container"
+	PortModeAuto      = "auto"
+)
+
+// taskPort is a single port of a task, from its DiscoveryInfo or its
+// resources.
+//
+// Number is the port allocated to the task on the agent and identifies
+// the port. ServicePort is the port advertised in the registration,
+// which differs from Number when a container port is registered.
+type taskPort struct {
+	Number      int
+	ServicePort int
+	Name        string
+	Protocol    string
+	Visibility  string
+	Index       int
+	Labeled     bool
+}
+
+// label returns the port's name if it has one, otherwise its index
+func (p taskPort) label(names nameRules, separator string) string {
+	if p.Name != "" {
+		return names.clean(p.Name, separator)
+	}
+	return strconv.Itoa(p.Index)
+}
+
+// taskPorts returns the ports of a task. When the task declares
+// DiscoveryInfo ports they are used, in their declared order, along with
+// their name, protocol and visibility. Otherwise the ports of the task
+// resources are used, with the protocol of their Docker port mapping, and
+// lacking those the host ports of the Docker port mappings.
+func taskPorts(t *state.Task) []taskPort {
+	ports := []taskPort{}
+	seen := make(map[int]bool)
+
+	for _, dp := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+		if seen[dp.Number] {
+			continue
+		}
+		seen[dp.Number] = true
+
+		visibility := dp.Visibility
+		if visibility == "" {
+			visibility = t.DiscoveryInfo.Visibilty
+		}
+
+		ports = append(ports, taskPort{
+			Number:      dp.Number,
+			ServicePort: dp.Number,
+			Name:        dp.Name,
+			Protocol:    dp.Protocol,
+			Visibility:  strings.ToUpper(visibility),
+			Index:       len(ports),
+		})
+	}
+
+	if len(ports) == 0 {
+		for _, p := range t.Resources.Ports() {
+			n := toPort(p)
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+
+			ports = append(ports, taskPort{
+				Number:      n,
+				ServicePort: n,
+				Index:       len(ports),
+			})
+		}
+	}
+
+	// Older agents may report neither DiscoveryInfo nor port resources
+	// for bridge-mode Docker tasks, only their port mappings.
+	if len(ports) == 0 && t.Container.Docker != nil {
+		for _, pm := range t.Container.Docker.PortMappings {
+			if pm.HostPort == 0 || seen[pm.HostPort] {
+				continue
+			}
+			seen[pm.HostPort] = true
+
+			ports = append(ports, taskPort{
+				Number:      pm.HostPort,
+				ServicePort: pm.HostPort,
+				Index:       len(ports),
+			})
+		}
+	}
+
+	return labelPorts(t, ports)
+}
+
+// envPorts returns the ports set in the PORT0..PORTn variables of a task's
+// command environment, for executors reporting neither DiscoveryInfo nor
+// port resources. The variables are read in order up to the first one
+// missing or invalid.
+func envPorts(t *state.Task) []taskPort {
+	ports := []taskPort{}
+	seen := make(map[int]bool)
+
+	for i := 0; ; i++ {
+		v := t.Env(fmt.Sprintf("PORT%d", i))
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 65535 {
+			if v != "" {
+				log.WithField("task", t.Name).Warnf("Ignoring PORT%d and above: invalid port number '%s'", i, v)
+			}
+			break
+		}
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+
+		ports = append(ports, taskPort{
+			Number:      n,
+			ServicePort: n,
+			Index:       len(ports),
+		})
+	}
+
+	return labelPorts(t, ports)
+}
+
+// labelPorts applies the port names of the task labels and the protocols
+// of the Docker port mappings to the ports of a task.
+func labelPorts(t *state.Task, ports []taskPort) []taskPort {
+	for i := range ports {
+		if name := portLabel(t, ports[i]); name != "" {
+			ports[i].Name = name
+			ports[i].Labeled = true
+		}
+		if ports[i].Protocol == "" {
+			ports[i].Protocol = t.PortProtocol(ports[i].Number)
+		}
+		ports[i].Protocol = strings.ToLower(ports[i].Protocol)
+	}
+
+	return ports
+}
+
+// portLabel returns the name given to a port by the task labels, using
+// either the SERVICE_<port>_NAME or the consul.port.<index>.name convention.
+func portLabel(t *state.Task, p taskPort) string {
+	if name := t.Label(fmt.Sprintf("SERVICE_%d_NAME", p.Number)); name != "" {
+		return name
+	}
+	return t.PrefixedLabel(fmt.Sprintf("port.%d.name", p.Index))
+}
+
+// labeledPorts returns the ports which were named by a task label
+func labeledPorts(ports []taskPort) []taskPort {
+	labeled := []taskPort{}
+	for _, p := range ports {
+		if p.Labeled {
+			labeled = append(labeled, p)
+		}
+	}
+	return labeled
+}
+
+// visiblePorts returns the ports whose DiscoveryInfo visibility is one
+// of the registered visibilities. Ports without a visibility are kept.
+func (m *Mesos) visiblePorts(ports []taskPort) []taskPort {
+	if len(m.DiscoveryVisibility) == 0 {
+		return ports
+	}
+
+	visible := []taskPort{}
+	for _, p := range ports {
+		if p.Visibility == "" || sliceContainsString(m.DiscoveryVisibility, p.Visibility) {
+			visible = append(visible, p)
+		}
+	}
+	return visible
+}
+
+// validPortPolicy checks the syntax of a port policy
+func validPortPolicy(policy string) error {
+	_, err := filterPorts(policy, nil)
+	return err
+}
+
+// filterPorts returns the ports selected by a port policy
+func filterPorts(policy string, ports []taskPort) ([]taskPort, error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(policy)), ":", 2)
+
+	switch parts[0] {
+	case PortPolicyAll:
+		if len(parts) == 1 {
+			return ports, nil
+		}
+	case PortPolicyFirst:
+		if len(parts) == 1 {
+			if len(ports) > 0 {
+				return ports[:1], nil
+			}
+			return ports, nil
+		}
+	case PortPolicyLabel:
+		if len(parts) == 1 {
+			return labeledPorts(ports), nil
+		}
+	case PortPolicyIndex:
+		if len(parts) == 2 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid port index in port policy '%s'", policy)
+			}
+			selected := []taskPort{}
+			for _, p := range ports {
+				if p.Index == n {
+					selected = append(selected, p)
+				}
+			}
+			return selected, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid port policy '%s'", policy)
+}
+
+// selectTaskPorts applies the port policy of a task, set globally or with
+// the consul.port-policy label. It returns false when a task with ports
+// has none left to register.
+func (m *Mesos) selectTaskPorts(t *state.Task, ports []taskPort) ([]taskPort, bool) {
+	policy := m.PortPolicy
+	if l := t.PrefixedLabel("port-policy"); l != "" {
+		if err := validPortPolicy(l); err != nil {
+			log.WithField("task", t.Name).Warn(err.Error())
+		} else {
+			policy = l
+		}
+	}
+
+	selected, err := filterPorts(policy, ports)
+	if err != nil {
+		log.WithField("task", t.Name).Warn(err.Error())
+		selected = ports
+	}
+
+	selected = m.limitPorts(t, selected)
+
+	return selected, len(ports) == 0 || len(selected) > 0
+}
+
+// limitPorts caps the number of ports registered for a task at
+// MaxTaskPorts, keeping either the first ports or the named ones
+// according to PortLimitPolicy.
+func (m *Mesos) limitPorts(t *state.Task, ports []taskPort) []taskPort {
+	if m.MaxTaskPorts <= 0 || len(ports) <= m.MaxTaskPorts {
+		return ports
+	}
+
+	limited := ports
+	if m.PortLimitPolicy == PortLimitNamed {
+		limited = []taskPort{}
+		for _, p := range ports {
+			if p.Name != "" {
+				limited = append(limited, p)
+			}
+		}
+	}
+	if len(limited) > m.MaxTaskPorts {
+		limited = limited[:m.MaxTaskPorts]
+	}
+
+	log.WithField("task", t.Name).Infof("Task has %d ports, registering %d (%s)", len(ports), len(limited), m.PortLimitPolicy)
+	return limited
+}
+
+// registerTaskPorts registers every port of a task as its own service,
+// named <task>-<port name|index>.
+func (m *Mesos) registerTaskPorts(t *state.Task, tname string, agent string, address string, tags []string, meta map[string]string, ports []taskPort) {
+	for _, p := range ports {
+		m.registerTaskPort(t, m.portServiceName(tname, p), agent, address, tags, meta, p)
+	}
+}
+
+// portServiceName returns the name of the service of a port with
+// --service-per-port.
+func (m *Mesos) portServiceName(tname string, p taskPort) string {
+	return fmt.Sprintf("%s-%s", tname, p.label(m.nameRules(), m.Separator))
+}
+
+// serviceNames returns the names of the services a task may register:
+// its own, and those of its ports with --service-per-port.
+func (m *Mesos) serviceNames(t *state.Task) []string {
+	tname := m.taskName(t)
+	names := []string{tname}
+	if !m.ServicePerPort {
+		return names
+	}
+
+	ports := taskPorts(t)
+	if len(ports) == 0 && m.EnvPorts {
+		ports = envPorts(t)
+	}
+	for _, p := range ports {
+		names = append(names, m.portServiceName(tname, p))
+	}
+	return names
+}
+
+// registerTaskPort registers a single port of a task under the given name.
+// A port with a declared protocol is tagged with it and records it under
+// the protocol Meta key.
+func (m *Mesos) registerTaskPort(t *state.Task, name string, agent string, address string, tags []string, meta map[string]string, p taskPort) {
+	port := strconv.Itoa(p.ServicePort)
+
+	if p.Protocol != "" {
+		if !sliceContainsString(tags, p.Protocol) {
+			tags = append(append([]string{}, tags...), p.Protocol)
+		}
+
+		pm := make(map[string]string, len(meta)+1)
+		for k, v := range meta {
+			pm[k] = v
+		}
+		pm["protocol"] = p.Protocol
+		meta = pm
+	}
+
+	m.registerService(t, &registry.Service{
+		ID:      m.taskServiceID(t, agent, name, p.Number),
+		Name:    name,
+		Port:    p.ServicePort,
+		Address: address,
+		Tags:    tags,
+		Meta:    meta,
+		Check: m.taskCheck(t, &CheckVar{
+			Host:     toIP(address),
+			Port:     port,
+			Agent:    toIP(agent),
+			HostPort: strconv.Itoa(p.Number),
+		}, p.Protocol),
+		Agent:     toIP(agent),
+		Namespace: t.PrefixedLabel("namespace"),
+		Token:     t.PrefixedLabel("token"),
+
+		EnableTagOverride: m.tagOverride(t),
+		TaggedAddresses:   m.taggedAddresses(t, address, p.ServicePort, p.Number),
+		Weights:           taskWeights(t),
+		Connect:           taskConnect(t),
+	}, m.previousIDs(t, agent, name, p.Number))
+}
+
+// applyPortMode selects between the agent address with the host ports and
+// the container address with the container ports, according to the port
+// mode of the task. An address set with the consul.address label is kept.
+func (m *Mesos) applyPortMode(t *state.Task, address string, resolver string, ports []taskPort) (string, string, []taskPort) {
+	mode := m.PortMode
+	if l := t.PrefixedLabel("port-mode"); l != "" {
+		mode = strings.ToLower(l)
+	}
+
+	switch mode {
+	case PortModeIPOrder:
+	case PortModeAuto:
+		if !t.IsDockerBridge() {
+			return address, resolver, ports
+		}
+		fallthrough
+	case PortModeHost:
+		if resolver != "label" && t.SlaveIP != "" {
+			address, resolver = t.SlaveIP, "host"
+			if m.PreferHostname && t.SlaveHostname != "" {
+				address, resolver = t.SlaveHostname, state.HostnameSource
+			}
+		}
+	case PortModeContainer:
+		if resolver != "label" {
+			if a, r := t.ResolveIP(t.PrefixedLabel("ip-family"), containerSources(m.taskIPOrder(t))...); a != "" {
+				address, resolver = a, r
+			}
+		}
+		for i := range ports {
+			if cp := t.ContainerPort(ports[i].Number); cp != 0 {
+				ports[i].ServicePort = cp
+			}
+		}
+	default:
+		log.WithField("task", t.Name).Warnf("Invalid port mode '%s'", mode)
+	}
+
+	return address, resolver, ports
+}
+
+// containerSources returns the IP sources of the search order which can
+// yield a container address.
+func containerSources(order []string) []string {
+	srcs := []string{}
+	for _, src := range order {
+		switch src {
+		case "host", "cloud", "label", state.HostnameSource:
+		default:
+			srcs = append(srcs, src)
+		}
+	}
+	if len(srcs) == 0 {
+		return []string{"netinfo", "docker", "mesos"}
+	}
+	return srcs
+}
@@ -0,0 +1,83 @@
+package mesos
+
+import (
+	"errors"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/consul"
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// FilterDecision tells whether the filters let a running task be
+// registered, and which rule decided it
+type FilterDecision struct {
+	Task       string
+	Name       string
+	Framework  string
+	Agent      string
+	Registered bool
+	Rule       string
+}
+
+// previewRegistry records the registry calls of a preview, reading the
+// --filter-kv keys from Consul
+type previewRegistry struct {
+	*recorder
+	registry.KVReader
+}
+
+// PreviewFilters loads the state of the leading master and runs each
+// running task through the filters of c, without registering anything.
+func PreviewFilters(c *config.Config, timeout time.Duration) ([]FilterDecision, error) {
+	r := newRecorder()
+	m := newMesos(c)
+	m.Registry = r
+	if m.FilterKV != "" {
+		m.Registry = previewRegistry{r, consul.Reader()}
+	}
+
+	if err := m.detect(c.Zk, timeout); err != nil {
+		return nil, err
+	}
+
+	sj, err := m.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if sj.Leader == "" {
+		return nil, errors.New("Empty master")
+	}
+
+	// Learn the agent hostnames, and read the filters from --filter-kv
+	m.RegisterHosts(sj)
+	m.reloadFilters()
+
+	return m.filterDecisions(sj), nil
+}
+
+// filterDecisions runs the running tasks of a state through the filters
+func (m *Mesos) filterDecisions(sj state.State) []FilterDecision {
+	decisions := []FilterDecision{}
+	for _, fw := range sj.Frameworks {
+		for _, task := range fw.Tasks {
+			if task.State != "TASK_RUNNING" {
+				continue
+			}
+			task.FrameworkName = fw.Name
+
+			tname := m.taskName(&task)
+			reason, rule := m.filterRule(&task, tname)
+			decisions = append(decisions, FilterDecision{
+				Task:       task.ID,
+				Name:       tname,
+				Framework:  fw.Name,
+				Agent:      m.agentHostnames[task.SlaveID],
+				Registered: reason == "",
+				Rule:       rule,
+			})
+		}
+	}
+	return decisions
+}
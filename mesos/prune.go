@@ -0,0 +1,69 @@
+package mesos
+
+import (
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneAgents records when each agent was last seen in the Mesos state
+// and prunes the registry nodes of agents absent for longer than
+// PruneNodesAfter.
+func (m *Mesos) pruneAgents(now time.Time) {
+	if m.PruneNodesAfter <= 0 {
+		return
+	}
+
+	pruner, ok := m.Registry.(registry.NodePruner)
+	if !ok {
+		return
+	}
+
+	if m.agentLastSeen == nil {
+		m.agentLastSeen = make(map[string]time.Time)
+	}
+	for _, agent := range m.Agents {
+		m.agentLastSeen[agent] = now
+	}
+
+	mh := m.getLeader()
+	for _, agent := range m.absentAgents(now) {
+		log.WithField("agent", agent).Infof("Agent absent for more than %v", m.PruneNodesAfter)
+		if err := pruner.PruneNode(mh.Ip, agent); err != nil {
+			log.WithField("agent", agent).Warn("Unable to prune node: ", err)
+			continue
+		}
+		delete(m.agentLastSeen, agent)
+	}
+}
+
+// seedAgents tracks the agents of the services of the registry cache not
+// tracked yet, as last seen at now, so that the nodes of agents gone
+// before mesos-consul started are pruned as well
+func (m *Mesos) seedAgents(now time.Time) {
+	if m.PruneNodesAfter <= 0 {
+		return
+	}
+
+	if m.agentLastSeen == nil {
+		m.agentLastSeen = make(map[string]time.Time)
+	}
+	for _, s := range m.cached() {
+		if _, ok := m.agentLastSeen[s.Agent]; !ok && s.Agent != "" {
+			m.agentLastSeen[s.Agent] = now
+		}
+	}
+}
+
+// absentAgents returns the agents not seen for longer than PruneNodesAfter
+func (m *Mesos) absentAgents(now time.Time) []string {
+	absent := []string{}
+	for agent, seen := range m.agentLastSeen {
+		if now.Sub(seen) > m.PruneNodesAfter {
+			absent = append(absent, agent)
+		}
+	}
+	return absent
+}
@@ -0,0 +1,90 @@
+package mesos
+
+import (
+	"errors"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// Running is what runs in a Mesos cluster: the IDs of the services a
+// refresh would register, and of the running tasks.
+type Running struct {
+	Services map[string]bool
+	Tasks    map[string]bool
+}
+
+// Has tells whether the service id of task taskID, empty when unknown,
+// corresponds to what runs.
+func (r *Running) Has(id string, taskID string) bool {
+	return r.Services[id] || taskID != "" && r.Tasks[taskID]
+}
+
+// Cluster reads what runs in a Mesos cluster, without registering
+// anything.
+type Cluster struct {
+	m *Mesos
+}
+
+// Connect finds the leading master of the cluster of c through
+// Zookeeper, waiting at most timeout. The filters are ignored, so that a
+// registration of a filtered out task still corresponds to a running
+// task.
+func Connect(c *config.Config, timeout time.Duration) (*Cluster, error) {
+	cl := unfiltered(c)
+	if err := cl.m.detect(c.Zk, timeout); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// unfiltered returns the Cluster of c, without its leading master
+func unfiltered(c *config.Config) *Cluster {
+	u := *c
+	u.WhiteList = nil
+	u.BlackList = nil
+	u.AgentBlacklist = nil
+	u.LabelBlacklist = nil
+	u.FilterKV = ""
+
+	return &Cluster{m: newMesos(&u)}
+}
+
+// Leader returns the address of the leading master
+func (cl *Cluster) Leader() string {
+	return cl.m.getLeader().Ip
+}
+
+// Running loads the state of the leading master, and returns what runs
+// in the cluster.
+func (cl *Cluster) Running() (*Running, error) {
+	sj, err := cl.m.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if sj.Leader == "" {
+		return nil, errors.New("Empty master")
+	}
+
+	return cl.m.running(sj), nil
+}
+
+// running returns what runs in the cluster of state sj
+func (m *Mesos) running(sj state.State) *Running {
+	r := newRecorder()
+	m.Registry = r
+	m.parseState(sj)
+
+	running := &Running{
+		Services: make(map[string]bool, len(r.services)),
+		Tasks:    make(map[string]bool, len(m.taskIDs)),
+	}
+	for id := range r.services {
+		running.Services[id] = true
+	}
+	for id := range m.taskIDs {
+		running.Tasks[id] = true
+	}
+	return running
+}
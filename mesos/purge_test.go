@@ -0,0 +1,38 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+)
+
+func TestRunning(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	db := `{"id": "db.1", "name": "db", "slave_id": "S1", "state": "TASK_FINISHED", "resources": {"ports": "[31001-31001]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	c.WhiteList = []string{"^api"}
+
+	r := unfiltered(c).m.running(simulateState(t, web+","+db))
+
+	for _, tt := range []struct {
+		id     string
+		taskID string
+		want   bool
+	}{
+		// Filtered out, and running
+		{"mesos-consul:10.0.0.1:web:31000", "web.1", true},
+		// Registered under another ID scheme
+		{"mesos-consul:web.1:31000", "web.1", true},
+		{"mesos-consul:10.0.0.1:db:31001", "db.1", false},
+		{"mesos-consul:10.0.0.1:db:31001", "", false},
+	} {
+		if got := r.Has(tt.id, tt.taskID); got != tt.want {
+			t.Errorf("Has(%s, %q) => %v, want %v", tt.id, tt.taskID, got, tt.want)
+		}
+	}
+	if !r.Services["mesos-consul:10.0.0.1:web:31000"] {
+		t.Error("the service of the filtered out task is not running")
+	}
+}
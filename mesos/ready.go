@@ -0,0 +1,54 @@
+package mesos
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+)
+
+// readiness keeps the time of the last successful refresh for Ready
+type readiness struct {
+	sync.Mutex
+	window time.Duration
+	last   time.Time
+}
+
+func (r *readiness) synced(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.last = now
+}
+
+// SetReadyWindow sets how long after the last successful refresh Ready
+// keeps reporting the instance as ready: --ready-intervals times the
+// longest refresh interval of c.
+func (m *Mesos) SetReadyWindow(c *config.Config) {
+	m.ready.Lock()
+	defer m.ready.Unlock()
+
+	m.ready.window = time.Duration(c.ReadyIntervals) * maxRefresh(c)
+}
+
+// Ready returns why the instance is not ready at now, or nil when its
+// Zookeeper session is connected and a refresh succeeded within the
+// ready window. An instance standing by for another one counts each
+// refresh it skips as successful.
+func (m *Mesos) Ready(now time.Time) error {
+	if err := m.zk.err(now); err != nil {
+		return err
+	}
+
+	m.ready.Lock()
+	defer m.ready.Unlock()
+
+	if m.ready.last.IsZero() {
+		return fmt.Errorf("no successful refresh yet")
+	}
+	if age := now.Sub(m.ready.last); age > m.ready.window {
+		return fmt.Errorf("last successful refresh %v ago", age.Truncate(time.Second))
+	}
+	return nil
+}
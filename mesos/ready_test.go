@@ -0,0 +1,65 @@
+package mesos
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestReady(t *testing.T) {
+	c := config.DefaultConfig()
+	m := new(Mesos)
+	m.SetReadyWindow(c)
+
+	now := time.Now()
+	if err := m.Ready(now); err == nil {
+		t.Error("Ready() before connecting to Zookeeper => nil, want an error")
+	}
+
+	m.zk.changed(zk.StateHasSession, now)
+	if err := m.Ready(now); err == nil {
+		t.Error("Ready() before a refresh => nil, want an error")
+	}
+
+	m.ready.synced(now)
+	for _, tt := range []struct {
+		after time.Duration
+		ready bool
+	}{
+		{time.Minute, true},
+		{3 * (time.Minute + stateTimeout), true},
+		{3*(time.Minute+stateTimeout) + time.Second, false},
+	} {
+		if err := m.Ready(now.Add(tt.after)); (err == nil) != tt.ready {
+			t.Errorf("Ready() %v after a refresh => %v, want ready %v", tt.after, err, tt.ready)
+		}
+	}
+
+	m.zk.changed(zk.StateDisconnected, now)
+	if err := m.Ready(now.Add(time.Minute)); err == nil || err.Error() != "Zookeeper session lost 1m0s ago" {
+		t.Errorf("Ready() after losing the Zookeeper session => %v", err)
+	}
+
+	// Connecting again keeps the last successful refresh
+	m.zk.changed(zk.StateConnecting, now)
+	m.zk.changed(zk.StateHasSession, now)
+	if err := m.Ready(now.Add(time.Minute)); err != nil {
+		t.Errorf("Ready() after a new Zookeeper session => %v, want nil", err)
+	}
+}
+
+func TestZkServers(t *testing.T) {
+	for uri, want := range map[string]string{
+		"zk://127.0.0.1:2181/mesos":              "127.0.0.1:2181",
+		"zk://user:pass@zk1:2181,zk2:2181/mesos": "zk1:2181,zk2:2181",
+		"zk://zk1:2181, zk2:2181,":               "zk1:2181,zk2:2181",
+	} {
+		if got := strings.Join(zkServers(uri), ","); got != want {
+			t.Errorf("zkServers(%q) => %s, want %s", uri, got, want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package mesos
+
+import (
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// redactLabels masks the values of the --redact-label task labels, and
+// of the consul.token label, of the state in the output, until the next
+// cycle
+func (m *Mesos) redactLabels(sj state.State) {
+	values := []string{}
+	for _, fw := range sj.Frameworks {
+		for _, t := range fw.Tasks {
+			keys := append([]string{t.PrefixedKey("token")}, m.RedactLabels...)
+			for _, l := range t.Labels {
+				for _, k := range keys {
+					if strings.EqualFold(l.Key, k) {
+						values = append(values, l.Value)
+					}
+				}
+			}
+		}
+	}
+
+	redact.Default.SetValues("labels", values)
+}
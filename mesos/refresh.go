@@ -0,0 +1,94 @@
+package mesos
+
+import (
+	"math/rand"
+	"time"
+)
+
+// The number of recent cycles the adaptive refresh averages over
+const adaptiveWindow = 3
+
+// jitterRand draws the jitter and the splay of the refreshes, seeded so
+// that instances started together draw different ones
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Jitter returns d randomly lengthened or shortened by up to percent of
+// it, so that instances started together don't refresh in lockstep
+func Jitter(d time.Duration, percent int) time.Duration {
+	spread := int64(d) * int64(percent) / 100
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(jitterRand.Int63n(2*spread+1)-spread)
+}
+
+// Splay returns a random delay shorter than max, spreading the first
+// refresh of instances started together
+func Splay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// AdaptiveRefresh computes the delay before the next refresh from the
+// task churn seen in recent cycles. High churn shortens the interval,
+// quiet cycles lengthen it, always staying within [Min, Max].
+type AdaptiveRefresh struct {
+	Min       time.Duration
+	Max       time.Duration
+	ChurnHigh int
+
+	interval time.Duration
+	history  []int
+}
+
+func NewAdaptiveRefresh(interval, min, max time.Duration, churnHigh int) *AdaptiveRefresh {
+	a := &AdaptiveRefresh{
+		Min:       min,
+		Max:       max,
+		ChurnHigh: churnHigh,
+	}
+	a.interval = a.clamp(interval)
+
+	return a
+}
+
+// Next records the churn of the last cycle and returns the interval to
+// wait before the next one.
+func (a *AdaptiveRefresh) Next(churn int) time.Duration {
+	a.history = append(a.history, churn)
+	if len(a.history) > adaptiveWindow {
+		a.history = a.history[len(a.history)-adaptiveWindow:]
+	}
+
+	total := 0
+	for _, c := range a.history {
+		total += c
+	}
+	avg := float64(total) / float64(len(a.history))
+
+	switch {
+	case churn >= a.ChurnHigh || avg >= float64(a.ChurnHigh):
+		a.interval = a.clamp(a.interval / 2)
+	case total == 0:
+		a.interval = a.clamp(a.interval + a.interval/2)
+	}
+
+	return a.interval
+}
+
+// Interval returns the current refresh interval
+func (a *AdaptiveRefresh) Interval() time.Duration {
+	return a.interval
+}
+
+func (a *AdaptiveRefresh) clamp(d time.Duration) time.Duration {
+	if d < a.Min {
+		return a.Min
+	}
+	if a.Max > 0 && d > a.Max {
+		return a.Max
+	}
+	return d
+}
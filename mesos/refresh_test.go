@@ -0,0 +1,82 @@
+package mesos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+)
+
+func TestAdaptiveRefresh(t *testing.T) {
+	a := NewAdaptiveRefresh(time.Minute, 10*time.Second, 4*time.Minute, 10)
+
+	for i, tt := range []struct {
+		churn    int
+		interval time.Duration
+	}{
+		{0, 90 * time.Second},
+		{0, 135 * time.Second},
+		{3, 135 * time.Second},
+		{20, 67500 * time.Millisecond},
+		{2, 67500 * time.Millisecond},
+		{0, 67500 * time.Millisecond},
+		{0, 67500 * time.Millisecond},
+		{0, 101250 * time.Millisecond},
+		{50, 50625 * time.Millisecond},
+		{50, 25312500 * time.Microsecond},
+		{50, 12656250 * time.Microsecond},
+		{50, 10 * time.Second},
+	} {
+		if d := a.Next(tt.churn); d != tt.interval {
+			t.Errorf("test #%d: Next(%d) => %v, want %v", i, tt.churn, d, tt.interval)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		a.Next(0)
+	}
+	if a.Interval() != 4*time.Minute {
+		t.Errorf("Interval() => %v, want %v", a.Interval(), 4*time.Minute)
+	}
+}
+
+func TestAdaptiveRefreshClampsInitial(t *testing.T) {
+	a := NewAdaptiveRefresh(time.Second, 10*time.Second, time.Minute, 10)
+	if a.Interval() != 10*time.Second {
+		t.Errorf("Interval() => %v, want %v", a.Interval(), 10*time.Second)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := Jitter(time.Minute, 0); d != time.Minute {
+		t.Errorf("Jitter(1m, 0) => %v, want 1m", d)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := Jitter(time.Minute, 10); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("Jitter(1m, 10) => %v, want within 54s and 66s", d)
+		}
+		if d := Splay(time.Second); d < 0 || d >= time.Second {
+			t.Fatalf("Splay(1s) => %v, want within 0 and 1s", d)
+		}
+	}
+
+	if d := Splay(0); d != 0 {
+		t.Errorf("Splay(0) => %v, want 0", d)
+	}
+}
+
+func TestMaxRefresh(t *testing.T) {
+	c := config.DefaultConfig()
+	c.Refresh = time.Minute
+	c.RefreshJitter = 10
+	if d := maxRefresh(c); d != 66*time.Second+stateTimeout {
+		t.Errorf("maxRefresh() => %v, want the jittered period and the state timeout %v", d, 66*time.Second+stateTimeout)
+	}
+
+	c.RefreshAdaptive = true
+	c.RefreshMax = 5 * time.Minute
+	if d := maxRefresh(c); d != 330*time.Second+stateTimeout {
+		t.Errorf("maxRefresh() adaptive => %v, want %v", d, 330*time.Second+stateTimeout)
+	}
+}
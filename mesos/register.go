@@ -2,8 +2,8 @@ package mesos
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/CiscoCloud/mesos-consul/registry"
 	"github.com/CiscoCloud/mesos-consul/state"
@@ -22,28 +22,51 @@ func (m *Mesos) LoadCache() error {
 
 	mh := m.getLeader()
 
-	return m.Registry.CacheLoad(mh.Ip)
+	err := m.Registry.CacheLoad(mh.Ip)
+	m.seedAgents(time.Now())
+	return err
 }
 
 func (m *Mesos) RegisterHosts(s state.State) {
 	log.Debug("Running RegisterHosts")
 
 	m.Agents = make(map[string]string)
+	m.agentAttributes = make(map[string]map[string]string)
+	m.agentHostnames = make(map[string]string)
+	m.agentDraining = make(map[string]string)
+	m.agentAddresses.reload()
+
+	nodes := []*registry.Node{}
 
 	// Register slaves
 	for _, f := range s.Slaves {
 		agent := toIP(f.PID.Host)
 		port := toPort(f.PID.Port)
 
+		if addr, ok := m.agentAddresses.lookup(f.ID, f.Hostname); ok {
+			log.WithField("agent", f.Hostname).Debugf("Overriding agent address %s with %s", agent, addr)
+			agent = toIP(addr)
+		}
+
 		m.Agents[f.ID] = agent
+		m.agentAttributes[f.ID] = f.AttributeMap()
+		m.agentHostnames[f.ID] = f.Hostname
+		if f.Draining() {
+			m.agentDraining[agent] = f.Hostname
+		}
+		if a := m.agentBlacklisted(f.Hostname, f.ID); a != "" {
+			log.WithField("agent", a).Debug("Agent filtered out by the agent blacklist")
+			continue
+		}
+		nodes = append(nodes, &registry.Node{Address: agent, Meta: agentNodeMeta(f)})
 
 		m.registerHost(&registry.Service{
-			ID:      fmt.Sprintf("mesos-consul:%s:%s:%s", m.ServiceName, f.ID, f.Hostname),
+			ID:      fmt.Sprintf("%s%s:%s:%s", m.servicePrefix(), m.ServiceName, f.ID, f.Hostname),
 			Name:    m.ServiceName,
 			Port:    port,
 			Address: agent,
 			Agent:   agent,
-			Tags:    m.agentTags("agent", "follower"),
+			Tags:    m.agentTags(hostTags(m.FollowerTags, f.Version)...),
 			Check: &registry.Check{
 				HTTP:     fmt.Sprintf("http://%s:%d/slave(1)/health", agent, port),
 				Interval: "10s",
@@ -51,18 +74,20 @@ func (m *Mesos) RegisterHosts(s state.State) {
 		})
 	}
 
+	m.syncNodes(nodes)
+
 	// Register masters
 	mas := m.getMasters()
 	for _, ma := range mas {
 		var tags []string
 
 		if ma.IsLeader {
-			tags = m.agentTags("leader", "master")
+			tags = m.agentTags(hostTags(m.LeaderTags, ma.Version)...)
 		} else {
-			tags = m.agentTags("master")
+			tags = m.agentTags(hostTags(m.MasterTags, ma.Version)...)
 		}
 		s := &registry.Service{
-			ID:      fmt.Sprintf("mesos-consul:%s:%s:%s", m.ServiceName, ma.Ip, ma.PortString),
+			ID:      fmt.Sprintf("%s%s:%s:%s", m.servicePrefix(), m.ServiceName, ma.Ip, ma.PortString),
 			Name:    m.ServiceName,
 			Port:    ma.Port,
 			Address: ma.Ip,
@@ -75,50 +100,70 @@ func (m *Mesos) RegisterHosts(s state.State) {
 		}
 
 		m.registerHost(s)
+
+		if ma.IsLeader && m.LeaderService != "" {
+			m.registerHost(&registry.Service{
+				ID:      fmt.Sprintf("%s%s:%s:%s", m.servicePrefix(), m.LeaderService, ma.Ip, ma.PortString),
+				Name:    m.LeaderService,
+				Port:    ma.Port,
+				Address: ma.Ip,
+				Agent:   ma.Ip,
+				Tags:    m.agentTags(hostTags(m.LeaderTags, ma.Version)...),
+				Check:   s.Check,
+			})
+		}
 	}
+
+	m.registerZookeeper()
 }
 
 func (m *Mesos) registerHost(s *registry.Service) {
+	registry.MarkOwned(s)
+	m.cycleServices = append(m.cycleServices, s)
+
 	h := m.Registry.CacheLookup(s.ID)
 	if h != nil {
-		log.Infof("Host found. Comparing tags: (%v, %v)", h.Tags, s.Tags)
+		log.Debugf("Host found. Comparing: (%v, %v)", h.Tags, s.Tags)
 
-		if sliceEq(s.Tags, h.Tags) {
+		if registry.SameService(h, s) {
 			m.Registry.CacheMark(s.ID)
 
-			// Tags are the same. Return
+			// Registration is the same. Return
 			return
 		}
 
-		log.Info("Tags changed. Re-registering")
+		log.Info("Host changed. Re-registering")
 
 		// Delete cache entry. It will be re-created below
 		m.Registry.CacheDelete(s.ID)
 	}
 
+	m.auditRegister(s, "", h != nil)
 	m.Registry.Register(s)
 }
 
 func (m *Mesos) registerTask(t *state.Task, agent string) {
 	var tags []string
 
-	tname := cleanName(t.Name, m.Separator)
-	if m.whitelistRegex != nil {
-		if !m.whitelistRegex.MatchString(tname) {
-			log.WithField("task", tname).Debug("Task not on whitelist")
-			// No match
-			return
-		}
+	tname := m.taskName(t)
+	if reason := m.filterTask(t, tname); reason != "" {
+		m.skipTask(t, reason)
+		return
 	}
-	if m.blacklistRegex != nil {
-		if m.blacklistRegex.MatchString(tname) {
-			log.WithField("task", tname).Debug("Task on blacklist")
-			// Match
-			return
-		}
+
+	role := m.dataRole(t)
+	if role == RoleExecutor {
+		m.skipTask(t, SkipExecutor)
+		return
 	}
 
-	address := t.IP(m.IpOrder...)
+	address, resolver := m.taskAddress(t)
+	meta := map[string]string{}
+	m.labelMeta(t, meta)
+	if t.FrameworkName != "" {
+		meta["framework"] = t.FrameworkName
+	}
+	meta[registry.TaskIDMetaKey] = t.ID
 
 	l := t.Label("tags")
 	if l != "" {
@@ -128,58 +173,134 @@ func (m *Mesos) registerTask(t *state.Task, agent string) {
 	}
 
 	tags = buildRegisterTaskTags(tname, tags, m.taskTag)
+	tags = m.labelTags(t, tags)
+	tags = m.templateTags(t, tname, tags)
+	if role == RoleDriver {
+		tags = append(tags, RoleDriver)
+		if job := dataJobName(t); job != "" {
+			tags = append(tags, m.cleanName(job))
+		}
+	}
 
-	for key := range t.DiscoveryInfo.Ports.DiscoveryPorts {
-		discoveryPort := state.DiscoveryPort(t.DiscoveryInfo.Ports.DiscoveryPorts[key])
-		serviceName := discoveryPort.Name
-		servicePort := strconv.Itoa(discoveryPort.Number)
-		log.Debugf("%+v framework has %+v as a name for %+v port",
-			t.Name,
-			discoveryPort.Name,
-			discoveryPort.Number)
-		if discoveryPort.Name != "" {
-			m.Registry.Register(&registry.Service{
-				ID:      fmt.Sprintf("mesos-consul:%s:%s:%d", agent, tname, discoveryPort.Number),
-				Name:    tname,
-				Port:    toPort(servicePort),
-				Address: address,
-				Tags:    append(tags, serviceName),
-				Check: GetCheck(t, &CheckVar{
-					Host: toIP(address),
-					Port: servicePort,
-				}),
-				Agent: toIP(agent),
-			})
+	ports := taskPorts(t)
+	if len(ports) == 0 && m.EnvPorts {
+		ports = envPorts(t)
+	}
+	if visible := m.visiblePorts(ports); len(visible) < len(ports) {
+		if len(visible) == 0 {
+			m.skipTask(t, SkipNoPorts)
+			return
 		}
+		ports = visible
 	}
 
-	if t.Resources.PortRanges != "" {
-		for _, port := range t.Resources.Ports() {
-			m.Registry.Register(&registry.Service{
-				ID:      fmt.Sprintf("mesos-consul:%s:%s:%s", agent, tname, port),
-				Name:    tname,
-				Port:    toPort(port),
-				Address: address,
-				Tags:    tags,
-				Check: GetCheck(t, &CheckVar{
-					Host: toIP(address),
-					Port: port,
-				}),
-				Agent: toIP(agent),
-			})
+	ports, ok := m.selectTaskPorts(t, ports)
+	if !ok {
+		m.skipTask(t, SkipNoPorts)
+		return
+	}
+	if role == RoleDriver {
+		ports = driverPorts(ports)
+	}
+
+	address, resolver, ports = m.applyPortMode(t, address, resolver, ports)
+	if address == "" {
+		m.skipTask(t, SkipNoIP)
+		return
+	}
+	if resolver != "" {
+		meta["ip-resolver"] = resolver
+	}
+
+	if m.ServicePerPort && len(ports) > 0 {
+		m.registerTaskPorts(t, tname, agent, address, tags, meta, ports)
+		return
+	}
+
+	if len(ports) == 0 {
+		if !m.RegisterPortless {
+			m.skipTask(t, SkipNoPorts)
+			return
 		}
-	} else {
-		m.Registry.Register(&registry.Service{
-			ID:      fmt.Sprintf("mesos-consul:%s-%s", agent, tname),
+
+		m.registerService(t, &registry.Service{
+			ID:      m.taskServiceID(t, agent, tname, 0),
 			Name:    tname,
+			Port:    0,
 			Address: address,
 			Tags:    tags,
-			Check: GetCheck(t, &CheckVar{
-				Host: toIP(address),
-			}),
-			Agent: toIP(agent),
-		})
+			Meta:    meta,
+			Check: m.taskCheck(t, &CheckVar{
+				Host:  toIP(address),
+				Agent: toIP(agent),
+			}, ""),
+			Agent:     toIP(agent),
+			Namespace: t.PrefixedLabel("namespace"),
+			Token:     t.PrefixedLabel("token"),
+
+			EnableTagOverride: m.tagOverride(t),
+			TaggedAddresses:   m.taggedAddresses(t, address, 0, 0),
+			Weights:           taskWeights(t),
+			Connect:           taskConnect(t),
+		}, m.previousIDs(t, agent, tname, 0))
+		return
 	}
+
+	for _, p := range ports {
+		portTags := tags
+		if p.Name != "" {
+			log.Debugf("%+v framework has %+v as a name for %+v port", t.Name, p.Name, p.Number)
+			portTags = append(append([]string{}, tags...), p.Name)
+		}
+		m.registerTaskPort(t, tname, agent, address, portTags, meta, p)
+	}
+}
+
+// taskAddress returns the address a task is registered with and the
+// name of the IP resolver it came from. The consul.address label, when
+// set, overrides the IP search order. An address on one of the preferred
+// networks comes next, then the task's IP search order.
+func (m *Mesos) taskAddress(t *state.Task) (string, string) {
+	if a := strings.TrimSpace(t.PrefixedLabel(state.AddressLabel)); a != "" {
+		log.WithField("task", t.Name).Debugf("Using address override %s", a)
+		if ip := state.ParseIP(a); ip != nil {
+			return ip.String(), "label"
+		}
+		return a, "label"
+	}
+
+	family := t.PrefixedLabel("ip-family")
+	for _, network := range m.NetworkPreference {
+		for _, a := range t.NetworkIPs(network) {
+			if ip := state.ParseIP(a); ip != nil && state.MatchesFamily(ip, family) {
+				return ip.String(), "network:" + network
+			}
+		}
+	}
+
+	return t.ResolveIP(family, m.taskIPOrder(t)...)
+}
+
+// taskIPOrder returns the IP search order for a task. The consul.ip-order
+// label replaces --mesos-ip-order for that task; a label naming an unknown
+// resolver is ignored.
+func (m *Mesos) taskIPOrder(t *state.Task) []string {
+	l := strings.TrimSpace(t.PrefixedLabel("ip-order"))
+	if l == "" {
+		return m.IpOrder
+	}
+
+	var order []string
+	for _, src := range strings.Split(l, ",") {
+		src = strings.TrimSpace(src)
+		if !state.IsValidSource(src) {
+			log.WithField("task", t.Name).Warnf("Ignoring %s label: invalid IP source '%s'", t.PrefixedKey("ip-order"), src)
+			return m.IpOrder
+		}
+		order = append(order, src)
+	}
+
+	return order
 }
 
 // buildRegisterTaskTags takes a cleaned task name, a slice of starting tags, and the processed
@@ -202,6 +323,52 @@ func buildRegisterTaskTags(taskName string, startingTags []string, taskTag map[s
 	return result
 }
 
+// labelTags appends the comma separated tags of the --task-tag-label label
+// of a task to tags, so that tasks can be tagged without changing the
+// --task-tag rules
+func (m *Mesos) labelTags(t *state.Task, tags []string) []string {
+	if m.TaskTagLabel == "" {
+		return tags
+	}
+
+	for _, tag := range strings.Split(t.PrefixedLabel(m.TaskTagLabel), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !sliceContainsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// hostTags replaces {version} in the tags of a Mesos host with its
+// version, dropping the tags needing it when the host did not report it
+func hostTags(tags []string, version string) []string {
+	rval := []string{}
+
+	for _, t := range tags {
+		if strings.Contains(t, "{version}") {
+			if version == "" {
+				continue
+			}
+			t = strings.Replace(t, "{version}", version, -1)
+		}
+		rval = append(rval, t)
+	}
+
+	return rval
+}
+
+// splitTags splits a comma separated list of tags, ignoring empty ones
+func splitTags(s string) []string {
+	tags := []string{}
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
 func (m *Mesos) agentTags(ts ...string) []string {
 	if len(m.ServiceTags) == 0 {
 		return ts
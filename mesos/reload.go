@@ -0,0 +1,94 @@
+package mesos
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload applies the filters, task tags and IP order of a reloaded
+// configuration. A value which can't be used is ignored with a warning and
+// the previous one stays in use. It must not run concurrently with Refresh.
+func (m *Mesos) Reload(c *config.Config) {
+	whitelist, whitelistRegex := reloadRegex("whitelist", m.WhiteList, m.whitelistRegex, c.WhiteList)
+	blacklist, blacklistRegex := reloadRegex("blacklist", m.BlackList, m.blacklistRegex, c.BlackList)
+	if whitelist != m.WhiteList || blacklist != m.BlackList {
+		// Warn about tasks matching both of the new lists
+		m.conflictsChecked = false
+	}
+	m.WhiteList, m.whitelistRegex = whitelist, whitelistRegex
+	m.BlackList, m.blacklistRegex = blacklist, blacklistRegex
+
+	m.AgentBlacklist, m.agentBlacklistRegex = reloadRegex("agent blacklist", m.AgentBlacklist, m.agentBlacklistRegex, c.AgentBlacklist)
+
+	if labelBlacklist, err := parseLabelSelectors(c.LabelBlacklist); err != nil {
+		log.WithField("label-blacklist", c.LabelBlacklist).Warnf("%s, keeping the previous label blacklist", err)
+	} else {
+		m.labelBlacklist = labelBlacklist
+	}
+
+	switch c.FilterPrecedence {
+	case m.FilterPrecedence:
+	case PrecedenceBlacklist, PrecedenceWhitelist:
+		log.WithField("filter-precedence", c.FilterPrecedence).Info("Using new filter precedence")
+		m.FilterPrecedence = c.FilterPrecedence
+		m.conflictsChecked = false
+	default:
+		log.WithField("filter-precedence", c.FilterPrecedence).Warn("Invalid filter precedence, keeping the previous one")
+	}
+
+	if taskTag, err := buildTaskTag(c.TaskTag); err != nil {
+		log.WithField("task-tag", c.TaskTag).Warnf("Invalid task tags, keeping the previous ones: %s", err)
+	} else {
+		m.taskTag = taskTag
+	}
+
+	if ipOrder, err := parseIPOrder(c.MesosIpOrder, m.PreferHostname); err != nil {
+		log.WithField("mesos-ip-order", c.MesosIpOrder).Warnf("%s, keeping the previous IP order", err)
+	} else if strings.Join(ipOrder, ",") != strings.Join(m.IpOrder, ",") {
+		log.Infof("Using new IP order '%v'", ipOrder)
+		m.IpOrder = ipOrder
+	}
+}
+
+// reloadRegex returns the joined expression of exprs and its regex, or
+// the current ones when it is unchanged or fails to compile
+func reloadRegex(name string, current string, re *regexp.Regexp, exprs []string) (string, *regexp.Regexp) {
+	expr := strings.Join(exprs, "|")
+	if expr == current {
+		return current, re
+	}
+	if expr == "" {
+		log.Infof("Clearing the %s", name)
+		return "", nil
+	}
+
+	next, err := regexp.Compile(expr)
+	if err != nil {
+		log.WithField(name, expr).Warnf("New %s regex failed to compile, keeping the previous one: %s", name, err)
+		return current, re
+	}
+
+	log.WithField(name, expr).Infof("Using new %s regex", name)
+	return expr, next
+}
+
+// parseIPOrder parses a --mesos-ip-order value, preceded by the hostname
+// with preferHostname
+func parseIPOrder(value string, preferHostname bool) ([]string, error) {
+	order := strings.Split(value, ",")
+	for _, src := range order {
+		if !state.IsValidSource(src) {
+			return nil, fmt.Errorf("Invalid IP Search Order: '%v'", src)
+		}
+	}
+	if preferHostname && order[0] != state.HostnameSource {
+		order = append([]string{state.HostnameSource}, order...)
+	}
+	return order, nil
+}
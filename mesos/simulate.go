@@ -0,0 +1,237 @@
+package mesos
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+const (
+	ActionRegister   = "register"
+	ActionDeregister = "deregister"
+
+	ActionEnableMaintenance  = "enable-maintenance"
+	ActionDisableMaintenance = "disable-maintenance"
+)
+
+// Action is a registry call caused by a refresh cycle.
+type Action struct {
+	Op      string
+	Service *registry.Service
+}
+
+func (a Action) String() string {
+	s := a.Service
+	if a.Op != ActionRegister {
+		return fmt.Sprintf("%s %s", a.Op, s.ID)
+	}
+
+	out := fmt.Sprintf("%s %s name=%s address=%s port=%d agent=%s", a.Op, s.ID, s.Name, s.Address, s.Port, s.Agent)
+	if len(s.Tags) > 0 {
+		out += " tags=" + strings.Join(s.Tags, ",")
+	}
+	if len(s.Meta) > 0 {
+		keys := make([]string, 0, len(s.Meta))
+		for k := range s.Meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out += fmt.Sprintf(" meta.%s=%s", k, s.Meta[k])
+		}
+	}
+	if s.Check != nil && s.Check.Defined() {
+		out += checkString(s.Check)
+	}
+	return out
+}
+
+// checkString returns the probe and the timing of a check, as
+// ' check.<type>=<target> check.<option>=<value>...'
+func checkString(c *registry.Check) string {
+	out := ""
+	for _, f := range []struct {
+		key   string
+		value string
+	}{
+		{"script", c.Script},
+		{"ttl", c.TTL},
+		{"http", c.HTTP},
+		{"tcp", c.TCP},
+		{"grpc", c.GRPC},
+		{"interval", c.Interval},
+		{"timeout", c.Timeout},
+		{"deregister-after", c.DeregisterCriticalServiceAfter},
+	} {
+		if f.value != "" {
+			out += fmt.Sprintf(" check.%s=%s", f.key, f.value)
+		}
+	}
+	return out
+}
+
+// Simulate runs the before and after state snapshots through the
+// registration pipeline and returns the registry calls the transition
+// from before to after causes. Nothing is sent to Consul or Zookeeper,
+// so Mesos masters are not registered.
+func Simulate(c *config.Config, before, after state.State) []Action {
+	r := newRecorder()
+
+	m := newMesos(c)
+	m.Registry = r
+
+	before.SetLabelPrefix(m.LabelPrefix)
+	m.parseState(before)
+	r.actions = nil
+
+	after.SetLabelPrefix(m.LabelPrefix)
+	m.parseState(after)
+
+	return r.actions
+}
+
+// recorder is an in-memory registry recording the calls made to it. It
+// keeps the cache semantics of the Consul registry: services
+// not marked since the last Deregister are deregistered.
+type recorder struct {
+	services map[string]*registry.Service
+	marked   map[string]bool
+	actions  []Action
+
+	// Services in maintenance mode
+	maintained map[string]*registry.Service
+
+	// Redacted output of the calls as they are recorded, or nil
+	out io.Writer
+
+	// Registry the cache is loaded from, read only, or nil to start
+	// from an empty cache
+	source cacheSource
+	loaded bool
+}
+
+// cacheSource is a registry the cache of the recorder is loaded from
+type cacheSource interface {
+	CacheCreate() bool
+	CacheLoad(host string) error
+	registry.CacheLister
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		services:   make(map[string]*registry.Service),
+		marked:     make(map[string]bool),
+		maintained: make(map[string]*registry.Service),
+	}
+}
+
+// CacheCreate tells whether the cache is still to be loaded from the
+// source
+func (r *recorder) CacheCreate() bool {
+	return r.source != nil && !r.loaded
+}
+
+// CacheLoad adds the services of the source to the cache, so that only
+// the changes from what is registered are recorded
+func (r *recorder) CacheLoad(host string) error {
+	if r.source == nil {
+		return nil
+	}
+
+	r.source.CacheCreate()
+	if err := r.source.CacheLoad(host); err != nil {
+		return err
+	}
+	r.loaded = true
+
+	for _, s := range r.source.Cached() {
+		if _, ok := r.services[s.ID]; !ok {
+			r.services[s.ID] = s
+		}
+	}
+	return nil
+}
+
+func (r *recorder) CacheDelete(id string) {
+	delete(r.services, id)
+	delete(r.marked, id)
+}
+
+func (r *recorder) CacheLookup(id string) *registry.Service {
+	return r.services[id]
+}
+
+func (r *recorder) Cached() []*registry.Service {
+	services := make([]*registry.Service, 0, len(r.services))
+	for _, s := range r.services {
+		services = append(services, s)
+	}
+	return services
+}
+
+func (r *recorder) CacheMark(id string) {
+	if _, ok := r.services[id]; ok {
+		r.marked[id] = true
+	}
+}
+
+func (r *recorder) Register(s *registry.Service) {
+	if _, ok := r.services[s.ID]; ok {
+		r.CacheMark(s.ID)
+		return
+	}
+
+	r.services[s.ID] = s
+	r.marked[s.ID] = true
+	r.record(Action{Op: ActionRegister, Service: s})
+}
+
+func (r *recorder) Deregister() {
+	var ids []string
+	for id := range r.services {
+		if r.marked[id] {
+			r.marked[id] = false
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		r.record(Action{Op: ActionDeregister, Service: r.services[id]})
+		r.CacheDelete(id)
+	}
+}
+
+func (r *recorder) EnableMaintenance(s *registry.Service, reason string) error {
+	r.record(Action{Op: ActionEnableMaintenance, Service: s})
+	r.maintained[s.ID] = s
+	return nil
+}
+
+func (r *recorder) DisableMaintenance(s *registry.Service) error {
+	r.record(Action{Op: ActionDisableMaintenance, Service: s})
+	delete(r.maintained, s.ID)
+	return nil
+}
+
+func (r *recorder) Maintained() ([]*registry.Service, error) {
+	services := []*registry.Service{}
+	for _, s := range r.maintained {
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+func (r *recorder) record(a Action) {
+	r.actions = append(r.actions, a)
+	if r.out != nil {
+		fmt.Fprintln(r.out, redact.Default.String(a.String()))
+	}
+}
@@ -0,0 +1,355 @@
+package mesos
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+const simulateSlaves = `"slaves": [{"id": "S1", "hostname": "agent1", "pid": "slave(1)@10.0.0.1:5051"}]`
+
+func simulateState(t *testing.T, tasks string) state.State {
+	var sj state.State
+	body := `{"leader": "master@10.0.0.10:5050", ` + simulateSlaves +
+		`, "frameworks": [{"name": "marathon", "tasks": [` + tasks + `]}]}`
+	if err := json.Unmarshal([]byte(body), &sj); err != nil {
+		t.Fatal(err)
+	}
+	return sj
+}
+
+func TestSimulate(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	db := `{"id": "db.1", "name": "db", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31001-31001]"}}`
+	api := `{"id": "api.1", "name": "api", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31002-31002]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	actions := Simulate(c, simulateState(t, web+","+db), simulateState(t, web+","+api))
+
+	var got []string
+	for _, a := range actions {
+		got = append(got, a.Op+" "+a.Service.ID)
+	}
+	want := []string{
+		"register mesos-consul:10.0.0.1:api:31002",
+		"deregister mesos-consul:10.0.0.1:db:31001",
+	}
+	if !sliceEq(got, want) {
+		t.Errorf("Simulate() => %v, want %v", got, want)
+	}
+}
+
+func TestSimulateNoChange(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	if actions := Simulate(c, simulateState(t, web), simulateState(t, web)); len(actions) != 0 {
+		t.Errorf("Simulate() => %v, want no actions", actions)
+	}
+}
+
+func TestSimulateIDSchemeV2Rename(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	renamed := `{"id": "web.1", "name": "frontend", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	c.IDScheme = IDSchemeV2
+
+	actions := Simulate(c, simulateState(t, web), simulateState(t, renamed))
+	if len(actions) != 1 || actions[0].Op != ActionRegister || actions[0].Service.Name != "frontend" {
+		t.Fatalf("Simulate() => %v, want a single register of frontend", actions)
+	}
+	if id := actions[0].Service.ID; id != "mesos-consul:v2:10.0.0.1:web.1:31000" {
+		t.Errorf("Simulate() registered %s, want mesos-consul:v2:10.0.0.1:web.1:31000", id)
+	}
+}
+
+func TestSimulateLabelPrefix(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "consul.address", "value": "10.8.8.8"}, {"key": "discovery.address", "value": "10.9.9.9"}],
+		"resources": {"ports": "[31000-31000]"}}`
+
+	for _, tt := range []struct {
+		prefix  string
+		address string
+	}{
+		{"discovery.", "10.9.9.9"},
+		{"consul.", "10.8.8.8"},
+	} {
+		c := config.DefaultConfig()
+		c.MesosIpOrder = "host"
+		c.LabelPrefix = tt.prefix
+
+		actions := Simulate(c, simulateState(t, ""), simulateState(t, web))
+		if len(actions) != 1 || actions[0].Service.Address != tt.address {
+			t.Errorf("Simulate() with prefix %s => %v, want a register at %s", tt.prefix, actions, tt.address)
+		}
+	}
+}
+
+func TestSimulateEnableTagOverride(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "tags", "value": "blue"}], "resources": {"ports": "[31000-31000]"}}`
+	retagged := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "tags", "value": "green"}], "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	c.IDScheme = IDSchemeV2
+
+	if actions := Simulate(c, simulateState(t, web), simulateState(t, retagged)); len(actions) != 1 {
+		t.Errorf("Simulate() => %v, want a re-registration", actions)
+	}
+
+	c.EnableTagOverride = true
+	if actions := Simulate(c, simulateState(t, web), simulateState(t, retagged)); len(actions) != 0 {
+		t.Errorf("Simulate() with --enable-tag-override => %v, want no action", actions)
+	}
+}
+
+func TestSimulateRegisterPortless(t *testing.T) {
+	worker := `{"id": "worker.1", "name": "worker", "slave_id": "S1", "state": "TASK_RUNNING"}`
+
+	// Registered by default, with the ID it always had
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	actions := Simulate(c, simulateState(t, ""), simulateState(t, worker))
+	if len(actions) != 1 || actions[0].Service.ID != "mesos-consul:10.0.0.1-worker" || actions[0].Service.Port != 0 {
+		t.Errorf("Simulate() of a task without ports => %v, want it registered with port 0", actions)
+	}
+
+	c.RegisterPortless = false
+	if actions := Simulate(c, simulateState(t, ""), simulateState(t, worker)); len(actions) != 0 {
+		t.Errorf("Simulate(register-portless=false) => %v, want no action", actions)
+	}
+}
+
+func TestSimulateEnvPorts(t *testing.T) {
+	worker := `{"id": "worker.1", "name": "worker", "slave_id": "S1", "state": "TASK_RUNNING",
+		"command": {"environment": {"variables": [{"name": "PORT0", "value": "31000"}]}}}`
+
+	for _, envPorts := range []bool{false, true} {
+		c := config.DefaultConfig()
+		c.MesosIpOrder = "host"
+		c.EnvPorts = envPorts
+		c.RegisterPortless = false
+
+		var got []string
+		for _, a := range Simulate(c, simulateState(t, ""), simulateState(t, worker)) {
+			got = append(got, a.Service.ID)
+		}
+
+		var want []string
+		if envPorts {
+			want = []string{"mesos-consul:10.0.0.1:worker:31000"}
+		}
+		if !sliceEq(got, want) {
+			t.Errorf("Simulate(env-ports=%v) => %v, want %v", envPorts, got, want)
+		}
+	}
+}
+
+func TestSimulateDraining(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	draining := func(s string) state.State {
+		sj := simulateState(t, web)
+		if s != "" {
+			sj.Slaves[0].DrainInfo = &state.DrainInfo{State: s}
+		}
+		return sj
+	}
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	tests := []struct {
+		before, after string
+		want          []string
+	}{
+		{"", "DRAINING", []string{"enable-maintenance mesos-consul:10.0.0.1:web:31000"}},
+		{"DRAINING", "DRAINING", nil},
+		{"DRAINING", "", []string{"disable-maintenance mesos-consul:10.0.0.1:web:31000"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, a := range Simulate(c, draining(tt.before), draining(tt.after)) {
+			got = append(got, a.Op+" "+a.Service.ID)
+		}
+		if !sliceEq(got, tt.want) {
+			t.Errorf("Simulate(%q, %q) => %v, want %v", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestMaintenanceRestart(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}}`
+	id := "mesos-consul:10.0.0.1:web:31000"
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	// Put in maintenance mode by an earlier process, whose agent is no
+	// longer draining
+	r := newRecorder()
+	r.maintained[id] = &registry.Service{ID: id, Agent: "10.0.0.1"}
+
+	m := newMesos(c)
+	m.Registry = r
+	m.parseState(simulateState(t, web))
+
+	var got []string
+	for _, a := range r.actions {
+		if a.Op != ActionRegister {
+			got = append(got, a.Op+" "+a.Service.ID)
+		}
+	}
+	if want := []string{"disable-maintenance " + id}; !sliceEq(got, want) {
+		t.Errorf("parseState() => %v, want %v", got, want)
+	}
+}
+
+func TestSimulateProtocolTag(t *testing.T) {
+	dns := `{"id": "dns.1", "name": "dns", "slave_id": "S1", "state": "TASK_RUNNING",
+		"discovery": {"ports": {"ports": [{"number": 31053, "protocol": "udp"}]}}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	actions := Simulate(c, simulateState(t, ""), simulateState(t, dns))
+	if len(actions) != 1 {
+		t.Fatalf("Simulate() => %v, want a single registration", actions)
+	}
+	s := actions[0].Service
+	if !sliceEq(s.Tags, []string{"udp"}) || s.Meta["protocol"] != "udp" {
+		t.Errorf("Simulate() registered tags %v and meta %v, want udp", s.Tags, s.Meta)
+	}
+}
+
+func TestRedactLabels(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "DB_PASSWORD", "value": "hunter2"}], "resources": {"ports": "[31000-31000]"}}`
+
+	m := newMesos(config.DefaultConfig())
+	m.RedactLabels = []string{"db_password"}
+	m.redactLabels(simulateState(t, web))
+	defer redact.Default.SetValues("labels", nil)
+
+	if got := redact.Default.String("connecting with hunter2"); got != "connecting with "+redact.Mask {
+		t.Errorf("redacted => %q", got)
+	}
+}
+
+func TestSimulateTaskToken(t *testing.T) {
+	web := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "consul.token", "value": "vault:consul/creds/web"}], "resources": {"ports": "[31000-31000]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+
+	actions := Simulate(c, simulateState(t, ""), simulateState(t, web))
+	defer redact.Default.SetValues("labels", nil)
+	if len(actions) != 1 || actions[0].Service.Token != "vault:consul/creds/web" {
+		t.Fatalf("Simulate() => %v, want a registration with the label token", actions)
+	}
+	if got := redact.Default.String("vault:consul/creds/web"); got != redact.Mask {
+		t.Errorf("token label redacted => %q", got)
+	}
+}
+
+func TestSimulateDataFramework(t *testing.T) {
+	driver := `{"id": "driver.1", "name": "etl-driver", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "consul.job", "value": "nightly-etl"}],
+		"discovery": {"ports": {"ports": [{"number": 31000, "name": "rpc"}, {"number": 31001, "name": "ui"}]}}}`
+	executor := `{"id": "exec.1", "name": "etl 0", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31002-31002]"}}`
+	labeled := `{"id": "exec.2", "name": "etl-driver-helper", "slave_id": "S1", "state": "TASK_RUNNING",
+		"labels": [{"key": "consul.role", "value": "executor"}], "resources": {"ports": "[31003-31003]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	c.DataFramework = []string{"^marathon$"}
+
+	actions := Simulate(c, simulateState(t, ""), simulateState(t, driver+","+executor+","+labeled))
+	if len(actions) != 1 {
+		t.Fatalf("Simulate() => %v, want a single registration", actions)
+	}
+	s := actions[0].Service
+	if s.Port != 31001 || !sliceEq(s.Tags, []string{"driver", "nightly-etl", "ui"}) {
+		t.Errorf("Simulate() registered port %d with tags %v, want 31001 with driver, nightly-etl and ui", s.Port, s.Tags)
+	}
+}
+
+func TestRecorderOutput(t *testing.T) {
+	var out bytes.Buffer
+	r := newRecorder()
+	r.out = &out
+
+	r.Register(&registry.Service{
+		ID:      "mesos-consul:10.0.0.1:web:31000",
+		Name:    "web",
+		Address: "10.0.0.1",
+		Port:    31000,
+		Agent:   "10.0.0.1",
+		Tags:    []string{"http"},
+		Check:   &registry.Check{TCP: "10.0.0.1:31000", Interval: "30s"},
+	})
+	r.Deregister()
+	r.Deregister()
+
+	want := "register mesos-consul:10.0.0.1:web:31000 name=web address=10.0.0.1 port=31000 agent=10.0.0.1 tags=http check.tcp=10.0.0.1:31000 check.interval=30s\n" +
+		"deregister mesos-consul:10.0.0.1:web:31000\n"
+	if out.String() != want {
+		t.Errorf("recorder output => %q, want %q", out.String(), want)
+	}
+}
+
+// testSource is a registry of services to load the recorder from
+type testSource []*registry.Service
+
+func (s testSource) CacheCreate() bool           { return true }
+func (s testSource) CacheLoad(host string) error { return nil }
+func (s testSource) Cached() []*registry.Service { return s }
+
+func TestRecorderCacheLoad(t *testing.T) {
+	r := newRecorder()
+	r.source = testSource{
+		{ID: "mesos-consul:10.0.0.1:web:31000", Name: "web"},
+		{ID: "mesos-consul:10.0.0.1:db:31001", Name: "db"},
+	}
+
+	if !r.CacheCreate() {
+		t.Fatal("CacheCreate() => false, want the cache loaded from the source")
+	}
+	if err := r.CacheLoad("10.0.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if r.CacheCreate() {
+		t.Error("CacheCreate() => true after loading the cache, want it loaded once")
+	}
+
+	r.Register(&registry.Service{ID: "mesos-consul:10.0.0.1:web:31000", Name: "web"})
+	r.Register(&registry.Service{ID: "mesos-consul:10.0.0.1:api:31002", Name: "api"})
+	r.Deregister()
+
+	var got []string
+	for _, a := range r.actions {
+		got = append(got, a.Op+" "+a.Service.ID)
+	}
+	want := []string{
+		"register mesos-consul:10.0.0.1:api:31002",
+		"deregister mesos-consul:10.0.0.1:db:31001",
+	}
+	if !sliceEq(got, want) {
+		t.Errorf("recorded %v, want the changes from the loaded services %v", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package mesos
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons a task is not registered
+const (
+	SkipFiltered      = "filtered"
+	SkipFilteredAgent = "filtered-agent"
+	SkipFilteredLabel = "filtered-label"
+	SkipNoPorts       = "no-ports"
+	SkipNoIP          = "no-ip"
+	SkipState         = "unsupported-state"
+	SkipUnknownAgent  = "unknown-agent"
+	SkipExecutor      = "executor"
+)
+
+// SkippedTask is a task left out of the registry during a cycle
+type SkippedTask struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Framework string `json:"framework"`
+	State     string `json:"state"`
+	Reason    string `json:"reason"`
+}
+
+// skipReport collects the tasks skipped during a cycle and keeps those of
+// the last complete cycle for Skipped.
+type skipReport struct {
+	sync.Mutex
+	cycle []SkippedTask
+	last  []SkippedTask
+}
+
+// skipTask records that a task is not registered, and why
+func (m *Mesos) skipTask(t *state.Task, reason string) {
+	m.skipped.cycle = append(m.skipped.cycle, SkippedTask{
+		ID:        t.ID,
+		Name:      t.Name,
+		Framework: t.FrameworkName,
+		State:     t.State,
+		Reason:    reason,
+	})
+}
+
+// endSkipCycle logs a summary of the tasks skipped during the cycle and
+// makes them available through Skipped.
+func (m *Mesos) endSkipCycle() {
+	cycle := m.skipped.cycle
+	m.skipped.cycle = nil
+
+	m.skipped.Lock()
+	m.skipped.last = cycle
+	m.skipped.Unlock()
+
+	if len(cycle) == 0 {
+		return
+	}
+
+	fields := log.Fields{}
+	for reason, n := range skipCounts(cycle) {
+		fields[reason] = n
+	}
+	log.WithFields(fields).Infof("Skipped %d tasks", len(cycle))
+}
+
+// skipCounts returns the number of skipped tasks per reason
+func skipCounts(skipped []SkippedTask) map[string]int {
+	counts := make(map[string]int)
+	for _, s := range skipped {
+		counts[s.Reason]++
+	}
+	return counts
+}
+
+// Skipped returns the tasks skipped during the last cycle, sorted by
+// reason and name.
+func (m *Mesos) Skipped() []SkippedTask {
+	m.skipped.Lock()
+	defer m.skipped.Unlock()
+
+	skipped := append([]SkippedTask{}, m.skipped.last...)
+	sort.Slice(skipped, func(i, j int) bool {
+		if skipped[i].Reason != skipped[j].Reason {
+			return skipped[i].Reason < skipped[j].Reason
+		}
+		if skipped[i].Name != skipped[j].Name {
+			return skipped[i].Name < skipped[j].Name
+		}
+		return skipped[i].ID < skipped[j].ID
+	})
+	return skipped
+}
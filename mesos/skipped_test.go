@@ -0,0 +1,49 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+)
+
+func TestSkipped(t *testing.T) {
+	tasks := `{"id": "web.1", "name": "web", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31000-31000]"}},
+		{"id": "web.2", "name": "web", "slave_id": "S1", "state": "TASK_STAGING", "resources": {"ports": "[31001-31001]"}},
+		{"id": "web.3", "name": "web", "slave_id": "S2", "state": "TASK_RUNNING", "resources": {"ports": "[31002-31002]"}},
+		{"id": "admin.1", "name": "admin", "slave_id": "S1", "state": "TASK_RUNNING", "resources": {"ports": "[31003-31003]"}},
+		{"id": "worker.1", "name": "worker", "slave_id": "S1", "state": "TASK_RUNNING"},
+		{"id": "db.1", "name": "db", "slave_id": "S1", "state": "TASK_RUNNING",
+			"labels": [{"key": "consul.ip-order", "value": "docker"}], "resources": {"ports": "[31004-31004]"}}`
+
+	c := config.DefaultConfig()
+	c.MesosIpOrder = "host"
+	c.BlackList = []string{"^admin$"}
+	c.RegisterPortless = false
+
+	m := newMesos(c)
+	m.Registry = newRecorder()
+	m.parseState(simulateState(t, tasks))
+
+	want := []SkippedTask{
+		{ID: "admin.1", Name: "admin", Framework: "marathon", State: "TASK_RUNNING", Reason: SkipFiltered},
+		{ID: "db.1", Name: "db", Framework: "marathon", State: "TASK_RUNNING", Reason: SkipNoIP},
+		{ID: "worker.1", Name: "worker", Framework: "marathon", State: "TASK_RUNNING", Reason: SkipNoPorts},
+		{ID: "web.3", Name: "web", Framework: "marathon", State: "TASK_RUNNING", Reason: SkipUnknownAgent},
+		{ID: "web.2", Name: "web", Framework: "marathon", State: "TASK_STAGING", Reason: SkipState},
+	}
+
+	got := m.Skipped()
+	if len(got) != len(want) {
+		t.Fatalf("Skipped() => %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Skipped()[%d] => %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	m.parseState(simulateState(t, ""))
+	if got := m.Skipped(); len(got) != 0 {
+		t.Errorf("Skipped() after an empty cycle => %v, want none", got)
+	}
+}
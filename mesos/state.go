@@ -1,8 +1,11 @@
 package mesos
 
 import (
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/CiscoCloud/mesos-consul/registry"
 	"github.com/CiscoCloud/mesos-consul/state"
@@ -11,36 +14,215 @@ import (
 type CheckVar struct {
 	Host string
 	Port string
+
+	// Address of the agent and host port of the task, which
+	// a check may probe instead of the registered ones
+	Agent    string
+	HostPort string
 }
 
 var globalCV *CheckVar
 
 // Task Methods
 
+// Mesos defaults of the health check interval and timeout
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 20 * time.Second
+)
+
 // GetCheck()
-//   Build a Check structure from the Task labels
+//   Build a Check structure from the Task labels. Without a check_http,
+//   check_script or check_ttl label, the consul.check.grpc label or else
+//   the Mesos HTTP health check of the task is used
 //
 func GetCheck(t *state.Task, cv *CheckVar) *registry.Check {
 	c := registry.DefaultCheck()
 
+	cv = checkTarget(t, cv)
+
 	for _, l := range t.Labels {
 		k := strings.ToLower(l.Key)
 
 		switch k {
 		case "check_http":
-			c.HTTP = interpolate(cv, l.Value)
+			c.HTTP = interpolate(urlCheckVar(cv), l.Value)
 		case "check_script":
 			c.Script = interpolate(cv, l.Value)
 		case "check_ttl":
 			c.TTL = interpolate(cv, l.Value)
 		case "check_interval":
 			c.Interval = l.Value
+		case "check_timeout":
+			c.Timeout = l.Value
+		case "check_deregister_after":
+			c.DeregisterCriticalServiceAfter = l.Value
+		}
+	}
+
+	if !c.Defined() {
+		grpcCheck(t, cv, c)
+	}
+	if !c.Defined() {
+		healthCheck(t, cv, c)
+	}
+
+	return c
+}
+
+// grpcCheck()
+//   Set a gRPC check on c from the consul.check.grpc label, with TLS
+//   enabled by consul.check.grpc-tls and certificate verification
+//   disabled by consul.check.tls-skip-verify
+//
+func grpcCheck(t *state.Task, cv *CheckVar, c *registry.Check) {
+	l := t.PrefixedLabel("check.grpc")
+	if l == "" {
+		return
+	}
+
+	c.GRPC = interpolate(urlCheckVar(cv), l)
+	c.GRPCUseTLS, _ = strconv.ParseBool(t.PrefixedLabel("check.grpc-tls"))
+	c.TLSSkipVerify, _ = strconv.ParseBool(t.PrefixedLabel("check.tls-skip-verify"))
+}
+
+// healthCheck()
+//   Set an HTTP check on c from the Mesos HTTP health check of the task.
+//   The health check port is in the network namespace of the task, so a
+//   Docker bridge task is probed on the agent, through the host port the
+//   health check port is mapped to
+//
+func healthCheck(t *state.Task, cv *CheckVar, c *registry.Check) {
+	hc := t.HTTPHealthCheck()
+	if hc == nil {
+		return
+	}
+
+	host, port := cv.Host, hc.Port
+	if hp := t.HostPort(hc.Port); t.IsDockerBridge() && hp != 0 {
+		host, port = cv.Agent, hp
+	}
+
+	scheme := strings.ToLower(hc.Scheme)
+	if scheme == "" {
+		scheme = "http"
+	}
+	path := hc.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	c.HTTP = scheme + "://" + urlHost(host) + ":" + strconv.Itoa(port) + path
+	if c.Interval == "" {
+		c.Interval = seconds(t.HealthCheck.IntervalSeconds, defaultHealthCheckInterval)
+	}
+	if c.Timeout == "" {
+		c.Timeout = seconds(t.HealthCheck.TimeoutSeconds, defaultHealthCheckTimeout)
+	}
+}
+
+// Format a number of seconds as a Consul duration, or def when unset
+//
+func seconds(s float64, def time.Duration) string {
+	if s <= 0 {
+		return def.String()
+	}
+
+	return time.Duration(s * float64(time.Second)).String()
+}
+
+// taskCheck()
+//   Build the check of a task service. With --auto-tcp-check, a service
+//   left without a check gets a TCP check of its check target, unless
+//   the port is not a TCP port. Settings left unset by the task get the
+//   --check-* defaults
+//
+func (m *Mesos) taskCheck(t *state.Task, cv *CheckVar, protocol string) *registry.Check {
+	c := GetCheck(t, cv)
+	if m.AutoTCPCheck && !c.Defined() {
+		m.autoTCPCheck(t, cv, protocol, c)
+	}
+	if !c.Defined() {
+		return c
+	}
+
+	// TTL checks are passed, not run
+	if c.TTL == "" {
+		if c.Interval == "" && m.CheckInterval > 0 {
+			c.Interval = m.CheckInterval.String()
+		}
+		if c.Timeout == "" && m.CheckTimeout > 0 {
+			c.Timeout = m.CheckTimeout.String()
 		}
 	}
+	if c.DeregisterCriticalServiceAfter == "" && m.CheckDeregisterAfter > 0 {
+		c.DeregisterCriticalServiceAfter = m.CheckDeregisterAfter.String()
+	}
 
 	return c
 }
 
+// autoTCPCheck()
+//   Set a TCP check of the check target on c, unless the port is not
+//   a TCP port
+//
+func (m *Mesos) autoTCPCheck(t *state.Task, cv *CheckVar, protocol string, c *registry.Check) {
+	if protocol != "" && strings.ToLower(protocol) != "tcp" {
+		return
+	}
+
+	target := checkTarget(t, cv)
+	if target.Host == "" || target.Port == "" || target.Port == "0" {
+		return
+	}
+
+	c.TCP = net.JoinHostPort(strings.Trim(target.Host, "[]"), target.Port)
+	if c.Interval == "" {
+		c.Interval = m.AutoTCPCheckInterval.String()
+	}
+}
+
+// checkTarget()
+//   Return a copy of cv probing the address and port set by the
+//   check_host and check_port labels, when the Consul agent can't
+//   reach the registered ones
+//
+func checkTarget(t *state.Task, cv *CheckVar) *CheckVar {
+	target := *cv
+
+	for _, l := range t.Labels {
+		switch strings.ToLower(l.Key) {
+		case "check_host":
+			target.Host = interpolate(cv, l.Value)
+		case "check_port":
+			target.Port = interpolate(cv, l.Value)
+		}
+	}
+
+	return &target
+}
+
+// urlCheckVar returns a copy of cv whose hosts are safe to embed in a URL,
+// wrapping IPv6 addresses in brackets.
+//
+func urlCheckVar(cv *CheckVar) *CheckVar {
+	u := *cv
+	u.Host = urlHost(cv.Host)
+	u.Agent = urlHost(cv.Agent)
+
+	return &u
+}
+
+// Wrap IPv6 addresses in brackets
+//
+func urlHost(host string) string {
+	if ip := state.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+
+	return host
+}
+
 // Replace {variables} with values
 //
 func interpolate(cv *CheckVar, s string) string {
@@ -60,6 +242,10 @@ func varReplace(s string) string {
 		return globalCV.Port
 	case "{host}":
 		return globalCV.Host
+	case "{agent}":
+		return globalCV.Agent
+	case "{host_port}":
+		return globalCV.HostPort
 	default:
 		return s
 	}
@@ -0,0 +1,121 @@
+package mesos
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// Outcomes of a refresh
+const (
+	RefreshSuccess = "success"
+	RefreshFailure = "failure"
+	RefreshStandby = "standby"
+)
+
+// maxStatusErrors is the number of recent errors kept for Status
+const maxStatusErrors = 20
+
+// Status is the state of the instance served on /v1/status
+type Status struct {
+	// Leading Mesos master, as host:port
+	Leader string `json:"leader"`
+
+	LastRefresh *RefreshStatus `json:"last_refresh"`
+
+	// Services registered during the last refresh, by framework. The
+	// services of the Mesos hosts have no framework.
+	Services map[string]int `json:"services"`
+
+	RecentErrors []StatusError `json:"recent_errors"`
+}
+
+// RefreshStatus is the outcome of a refresh
+type RefreshStatus struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+
+	// Registry operations which failed during the refresh
+	RegistryErrors int `json:"registry_errors"`
+}
+
+// StatusError is an error of a refresh
+type StatusError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// statusReport keeps the last refresh and the most recent errors
+type statusReport struct {
+	sync.Mutex
+	last   *RefreshStatus
+	errors []StatusError
+}
+
+// refreshed records the outcome of a refresh started at start, with the
+// number of registry operations which failed during it
+func (r *statusReport) refreshed(start time.Time, outcome string, err error, registryErrors int) {
+	r.Lock()
+	defer r.Unlock()
+
+	last := &RefreshStatus{
+		Time:           start,
+		Duration:       time.Since(start).Seconds(),
+		Outcome:        outcome,
+		RegistryErrors: registryErrors,
+	}
+	if err != nil {
+		last.Error = err.Error()
+		r.addError(start, last.Error)
+	}
+	r.last = last
+}
+
+// failed records a registry operation which failed
+func (r *statusReport) failed(err *registry.OperationError) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.addError(time.Now(), err.Error())
+}
+
+func (r *statusReport) addError(t time.Time, err string) {
+	r.errors = append(r.errors, StatusError{Time: t, Error: err})
+	if n := len(r.errors) - maxStatusErrors; n > 0 {
+		r.errors = append([]StatusError{}, r.errors[n:]...)
+	}
+}
+
+// Status returns the leading Mesos master, the outcome of the last
+// refresh, the number of services registered per framework and the most
+// recent errors, oldest first.
+func (m *Mesos) Status() Status {
+	s := Status{
+		Services:     make(map[string]int),
+		RecentErrors: []StatusError{},
+	}
+
+	if leader := m.getLeader(); leader.Ip != "" {
+		s.Leader = net.JoinHostPort(leader.Ip, leader.PortString)
+	}
+
+	for _, o := range m.Owned() {
+		if o.State == OwnedRegistered {
+			s.Services[o.Framework]++
+		}
+	}
+
+	m.status.Lock()
+	defer m.status.Unlock()
+
+	if m.status.last != nil {
+		last := *m.status.last
+		s.LastRefresh = &last
+	}
+	s.RecentErrors = append(s.RecentErrors, m.status.errors...)
+	return s
+}
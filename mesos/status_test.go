@@ -0,0 +1,46 @@
+package mesos
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestStatusReport(t *testing.T) {
+	var r statusReport
+	start := time.Now()
+
+	r.refreshed(start, RefreshSuccess, nil, 2)
+	if r.last.Outcome != RefreshSuccess || r.last.RegistryErrors != 2 {
+		t.Errorf("last refresh => %+v, want a success with 2 registry errors", r.last)
+	}
+	if len(r.errors) != 0 {
+		t.Errorf("errors => %v, want none from a successful refresh", r.errors)
+	}
+
+	registry.Failed("register", "mesos-consul:web", errors.New("connection refused"))
+	if len(r.errors) != 0 {
+		t.Errorf("errors => %v, want none without notifications", r.errors)
+	}
+	registry.NotifyFailures(r.failed)
+	defer registry.NotifyFailures(nil)
+	registry.Failed("register", "mesos-consul:web", errors.New("connection refused"))
+	if len(r.errors) != 1 || r.errors[0].Error != "Unable to register mesos-consul:web: connection refused" {
+		t.Errorf("errors => %v, want the message of the failed registration", r.errors)
+	}
+
+	for i := 0; i < maxStatusErrors; i++ {
+		r.refreshed(start.Add(time.Duration(i)*time.Second), RefreshFailure, errors.New("No master in zookeeper"), 0)
+	}
+	if len(r.errors) != maxStatusErrors {
+		t.Fatalf("%d errors kept, want %d", len(r.errors), maxStatusErrors)
+	}
+	if r.errors[0].Error != "No master in zookeeper" {
+		t.Errorf("oldest error => %v, want the oldest refresh failure", r.errors[0])
+	}
+	if r.last.Outcome != RefreshFailure || r.last.Error != "No master in zookeeper" {
+		t.Errorf("last refresh => %+v, want the refresh failure", r.last)
+	}
+}
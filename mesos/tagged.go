@@ -0,0 +1,41 @@
+package mesos
+
+import (
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// Tagged address names
+const (
+	TaggedAddressLAN = "lan"
+	TaggedAddressWAN = "wan"
+)
+
+// wanAddress returns the WAN address of a task, from its consul.wan-address
+// label or else the --wan-address-attribute attribute of its agent
+func (m *Mesos) wanAddress(t *state.Task) string {
+	if a := strings.TrimSpace(t.PrefixedLabel("wan-address")); a != "" {
+		return a
+	}
+	if m.WANAddressAttribute != "" {
+		return t.SlaveAttributes[m.WANAddressAttribute]
+	}
+	return ""
+}
+
+// taggedAddresses returns the tagged addresses of a task service: its
+// registered address and port on the LAN, and the WAN address of the task
+// with the host port. Tasks without a WAN address get none.
+func (m *Mesos) taggedAddresses(t *state.Task, address string, port int, hostPort int) map[string]registry.TaggedAddress {
+	wan := m.wanAddress(t)
+	if wan == "" {
+		return nil
+	}
+
+	return map[string]registry.TaggedAddress{
+		TaggedAddressLAN: {Address: address, Port: port},
+		TaggedAddressWAN: {Address: wan, Port: hostPort},
+	}
+}
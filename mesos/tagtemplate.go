@@ -0,0 +1,91 @@
+package mesos
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tagVars are the fields and methods available to --tag-template
+type tagVars struct {
+	FrameworkName string
+	TaskName      string
+	Name          string
+	Hostname      string
+	Sep           string
+
+	task       *state.Task
+	attributes map[string]string
+}
+
+// Label returns the value of a task label, failing when the task does
+// not have it so that no tag is rendered
+func (v tagVars) Label(key string) (string, error) {
+	for _, l := range v.task.Labels {
+		if l.Key == key {
+			return l.Value, nil
+		}
+	}
+	return "", fmt.Errorf("no label %s", key)
+}
+
+// Attribute returns the value of an attribute of the agent running the
+// task, failing when the agent does not have it
+func (v tagVars) Attribute(name string) (string, error) {
+	if a, ok := v.attributes[name]; ok {
+		return a, nil
+	}
+	return "", fmt.Errorf("no agent attribute %s", name)
+}
+
+// parseTagTemplates parses the --tag-template options, with the functions
+// of the service name template
+func parseTagTemplates(texts []string, names nameRules, separator string) ([]*template.Template, error) {
+	templates := make([]*template.Template, 0, len(texts))
+	for _, text := range texts {
+		t, err := parseNameTemplate(text, names, separator)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %s", text, err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// templateTags appends the tags rendered by the --tag-template options
+// for a task to tags. Templates failing to render, such as those reading a
+// label the task does not have, or rendering an empty tag, add no tag.
+func (m *Mesos) templateTags(t *state.Task, tname string, tags []string) []string {
+	if len(m.tagTemplates) == 0 {
+		return tags
+	}
+
+	vars := tagVars{
+		FrameworkName: t.FrameworkName,
+		TaskName:      t.Name,
+		Name:          tname,
+		Hostname:      m.agentHostnames[t.SlaveID],
+		Sep:           m.Separator,
+		task:          t,
+		attributes:    m.agentAttributes[t.SlaveID],
+	}
+
+	for _, tmpl := range m.tagTemplates {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, vars); err != nil {
+			log.WithField("task", t.Name).Debug("No tag rendered by the tag template: ", err)
+			continue
+		}
+
+		tag := strings.TrimSpace(b.String())
+		if tag != "" && !sliceContainsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
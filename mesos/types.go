@@ -7,4 +7,5 @@ type MesosHost struct {
 	PortString   string
 	IsLeader     bool
 	IsRegistered bool
+	Version      string
 }
@@ -1,24 +1,112 @@
 package mesos
 
 import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
 	"net"
-	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/CiscoCloud/mesos-consul/state"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func cleanName(name string, separator string) string {
-	reg, err := regexp.Compile("[^\\w-]")
-	if err != nil {
-		log.Warn(err)
+// nameRules are the sanitization rules of service names, set from the
+// --name-* options
+type nameRules struct {
+	strip       string
+	replacement string
+	lowercase   bool
+	maxLength   int
+}
+
+// defaultNameRules are the rules of the default --name-* options
+var defaultNameRules = nameRules{replacement: "-", lowercase: true}
+
+// minNameLength leaves room for the hash suffix of truncated names
+const minNameLength = 16
+
+func newNameRules(strip, replacement string, lowercase bool, maxLength int) (nameRules, error) {
+	if strings.IndexFunc(replacement, func(r rune) bool { return !validNameRune(r) }) >= 0 {
+		return nameRules{}, fmt.Errorf("replacement %q is not made of letters, digits, '-' or '_'", replacement)
+	}
+	if maxLength != 0 && maxLength < minNameLength {
+		return nameRules{}, fmt.Errorf("maximum length %d is lower than %d", maxLength, minNameLength)
+	}
+
+	return nameRules{
+		strip:       strip,
+		replacement: replacement,
+		lowercase:   lowercase,
+		maxLength:   maxLength,
+	}, nil
+}
+
+func validNameRune(r rune) bool {
+	return r == '-' || r == '_' || r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// replaceInvalid drops the stripped characters of name, replaces '_' by
+// separator and the other characters not allowed in DNS names by the
+// replacement.
+func (r nameRules) replaceInvalid(name string, separator string) string {
+	var b bytes.Buffer
+
+	for _, c := range name {
+		switch {
+		case strings.ContainsRune(r.strip, c):
+		case c == '_':
+			b.WriteString(separator)
+		case validNameRune(c):
+			b.WriteRune(c)
+		default:
+			b.WriteString(r.replacement)
+		}
+	}
+
+	return b.String()
+}
+
+// truncate shortens names longer than the maximum length, ending them
+// with a hash of the full name to keep them distinct
+func (r nameRules) truncate(name string) string {
+	if r.maxLength == 0 || len(name) <= r.maxLength {
 		return name
 	}
 
-	s := reg.ReplaceAllString(name, "-")
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+
+	return name[:r.maxLength-len(suffix)] + suffix
+}
+
+// clean applies the rules to name, replacing '_' by separator
+func (r nameRules) clean(name string, separator string) string {
+	s := r.replaceInvalid(name, separator)
+	if r.lowercase {
+		s = strings.ToLower(s)
+	}
+
+	return r.truncate(s)
+}
 
-	return strings.ToLower(strings.Replace(s, "_", separator, -1))
+// nameRules returns the service name rules of m, the default ones until
+// they are set from the options
+func (m *Mesos) nameRules() nameRules {
+	if m.names == nil {
+		return defaultNameRules
+	}
+	return *m.names
+}
+
+// cleanName applies the service name rules to name
+func (m *Mesos) cleanName(name string) string {
+	return m.nameRules().clean(name, m.Separator)
 }
 
 // helper function to compare service tag slices
@@ -48,16 +136,21 @@ func sliceContainsString(s []string, b string) bool {
 
 func leaderIP(leader string) string {
 	host := strings.Split(leader, "@")[1]
-	host = strings.Split(host, ":")[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.Split(host, ":")[0]
+	}
 
 	return toIP(host)
 }
 
 func toIP(host string) string {
-	// Check if host string is already an IP address
-	ip := net.ParseIP(host)
+	// Check if host string is already an IP address. IPv6 literals
+	// may be wrapped in brackets, which Consul does not accept.
+	ip := state.ParseIP(host)
 	if ip != nil {
-		return host
+		return ip.String()
 	}
 
 	// Try to resolve host
@@ -10,6 +10,34 @@ func TestLeaderIP(t *testing.T) {
 	ip := leaderIP(l)
 
 	t.Log("ip: ", ip)
+
+	for _, tt := range []struct {
+		leader string
+		ip     string
+	}{
+		{"master@124.123.123.121:5050", "124.123.123.121"},
+		{"master@[2001:db8::1]:5050", "2001:db8::1"},
+	} {
+		if ip := leaderIP(tt.leader); ip != tt.ip {
+			t.Errorf("leaderIP(%s) => %s, want %s", tt.leader, ip, tt.ip)
+		}
+	}
+}
+
+func TestToIP(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		ip   string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:0db8:0000::1]", "2001:db8::1"},
+	} {
+		if ip := toIP(tt.host); ip != tt.ip {
+			t.Errorf("toIP(%s) => %s, want %s", tt.host, ip, tt.ip)
+		}
+	}
 }
 
 func TestSliceEq(t *testing.T) {
@@ -51,3 +79,28 @@ func TestSliceContainsString(t *testing.T) {
 		}
 	}
 }
+
+func TestCleanName(t *testing.T) {
+	long := "a-very-long-task-name-from-a-framework"
+	for _, tt := range []struct {
+		rules nameRules
+		name  string
+		want  string
+	}{
+		{nameRules{replacement: "-", lowercase: true}, "My_App.v2", "my-app-v2"},
+		{nameRules{replacement: "", lowercase: true}, "My_App.v2", "my-appv2"},
+		{nameRules{strip: ".", replacement: "-", lowercase: false}, "My_App.v2", "My-Appv2"},
+		{nameRules{replacement: "-", lowercase: true, maxLength: 20}, long, "a-very-long-48fc01ae"},
+	} {
+		if got := tt.rules.clean(tt.name, "-"); got != tt.want {
+			t.Errorf("cleanName(%q) with %+v => %q, want %q", tt.name, tt.rules, got, tt.want)
+		}
+	}
+
+	if _, err := newNameRules("", ".", true, 0); err == nil {
+		t.Error("newNameRules() accepted an invalid replacement")
+	}
+	if _, err := newNameRules("", "-", true, 8); err == nil {
+		t.Error("newNameRules() accepted a maximum length too short for the hash")
+	}
+}
@@ -0,0 +1,246 @@
+package mesos
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/consul"
+	"github.com/CiscoCloud/mesos-consul/webhook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registrySchemes are the address prefixes of the --registry backends
+// besides consul
+var registrySchemes = []string{"etcd://", "eureka://", "serverset://", "k8s://", "dns://", "file://"}
+
+// Validate checks the options of c, and returns every problem found
+// rather than exiting on the first one. New refuses to start with any.
+func Validate(c *config.Config) []error {
+	errs := []error{}
+	add := func(option string, err error) {
+		errs = append(errs, fmt.Errorf("--%s: %s", option, err))
+	}
+
+	if c.Zk == "" {
+		add("zk", fmt.Errorf("Zookeeper address not provided"))
+	} else if !strings.HasPrefix(c.Zk, "zk://") {
+		add("zk", fmt.Errorf("'%s' is not a zk://host:port,.../path address", c.Zk))
+	}
+
+	seen := make(map[string]bool)
+	for _, uri := range c.Registries {
+		if seen[uri] {
+			add("registry", fmt.Errorf("'%s' specified more than once", uri))
+		}
+		seen[uri] = true
+
+		if uri != "consul" && !hasScheme(uri, registrySchemes) {
+			add("registry", fmt.Errorf("unknown registry '%s'", uri))
+		}
+	}
+
+	if c.IDTemplate != "" {
+		if _, _, err := parseIDTemplate(c.IDTemplate); err != nil {
+			add("id-template", err)
+		}
+	}
+
+	if c.LabelPrefix == "" {
+		add("label-prefix", fmt.Errorf("can not be empty"))
+	}
+
+	for _, v := range strings.Split(c.DiscoveryVisibility, ",") {
+		switch strings.ToUpper(strings.TrimSpace(v)) {
+		case "", "FRAMEWORK", "CLUSTER", "EXTERNAL":
+		default:
+			add("discovery-visibility", fmt.Errorf("invalid visibility '%s'", v))
+		}
+	}
+
+	policy := c.PortPolicy
+	if c.LabeledPortsOnly {
+		policy = PortPolicyLabel
+	}
+	if err := validPortPolicy(policy); err != nil {
+		add("task-port-policy", err)
+	}
+
+	for _, o := range []struct {
+		option  string
+		value   string
+		choices []string
+	}{
+		{"id-scheme", c.IDScheme, []string{IDSchemeV1, IDSchemeV2}},
+		{"port-limit-policy", c.PortLimitPolicy, []string{PortLimitFirst, PortLimitNamed}},
+		{"port-mode", c.PortMode, []string{PortModeIPOrder, PortModeHost, PortModeContainer, PortModeAuto}},
+		{"filter-precedence", c.FilterPrecedence, []string{PrecedenceBlacklist, PrecedenceWhitelist}},
+	} {
+		if !sliceContainsString(o.choices, o.value) {
+			add(o.option, fmt.Errorf("invalid value '%s', expected one of %s", o.value, strings.Join(o.choices, ", ")))
+		}
+	}
+
+	for _, o := range []struct {
+		option string
+		exprs  []string
+	}{
+		{"whitelist", c.WhiteList},
+		{"blacklist", c.BlackList},
+		{"agent-blacklist", c.AgentBlacklist},
+		{"job-result-framework", c.JobResultFramework},
+		{"data-framework", c.DataFramework},
+	} {
+		// Check each regex on its own, so the error points at the
+		// failing one rather than at their combination
+		for _, expr := range o.exprs {
+			if _, err := regexp.Compile(expr); err != nil {
+				add(o.option, err)
+			}
+		}
+	}
+	if len(c.DataFramework) > 0 {
+		if _, err := regexp.Compile(c.DriverPattern); err != nil {
+			add("driver-pattern", err)
+		}
+	}
+
+	if _, err := parseLabelSelectors(c.LabelBlacklist); err != nil {
+		add("label-blacklist", err)
+	}
+
+	for _, tt := range c.TaskTag {
+		if _, err := buildTaskTag([]string{tt}); err != nil {
+			add("task-tag", fmt.Errorf("'%s': %s", tt, err))
+		}
+	}
+
+	rules, err := newNameRules(c.NameStrip, c.NameReplacement, c.NameLowercase, c.NameMaxLength)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("service name rules: %s", err))
+	}
+
+	if c.ServiceNameTemplate != "" {
+		if _, err := parseNameTemplate(c.ServiceNameTemplate, rules, c.Separator); err != nil {
+			add("service-name-template", err)
+		}
+	}
+
+	if _, err := parseTagTemplates(c.TagTemplate, rules, c.Separator); err != nil {
+		add("tag-template", err)
+	}
+
+	for _, u := range c.Webhooks {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			add("webhook", fmt.Errorf("'%s' is not an http:// or https:// URL", u))
+		}
+	}
+	if _, err := webhook.ParseTemplate(c.WebhookTemplate); err != nil {
+		add("webhook-template", err)
+	}
+	if c.WebhookRetries < 0 {
+		add("webhook-retries", fmt.Errorf("can not be negative"))
+	}
+
+	if _, err := loadMetaSchema(c.MetaSchema); err != nil {
+		add("meta-schema", err)
+	}
+
+	if _, err := parseIPOrder(c.MesosIpOrder, c.PreferHostname); err != nil {
+		add("mesos-ip-order", err)
+	}
+
+	if c.Refresh <= 0 {
+		add("refresh", fmt.Errorf("must be positive"))
+	}
+	if c.RefreshJitter < 0 || c.RefreshJitter >= 100 {
+		add("refresh-jitter", fmt.Errorf("must be a percentage from 0 to 99"))
+	}
+	if c.RefreshSplay < 0 {
+		add("refresh-splay", fmt.Errorf("can not be negative"))
+	}
+	if c.HeartbeatsBeforeRemove < 1 {
+		add("heartbeats-before-remove", fmt.Errorf("must be at least 1"))
+	}
+	if c.Statsd != "" && c.StatsdInterval <= 0 {
+		add("statsd-interval", fmt.Errorf("must be positive"))
+	}
+	if c.DebugAddress != "" && c.DebugToken == "" {
+		add("debug-token", fmt.Errorf("required with --debug-address"))
+	}
+
+	if c.ReadyIntervals <= 0 {
+		add("ready-intervals", fmt.Errorf("must be positive"))
+	}
+
+	if usesConsul(c) {
+		errs = append(errs, consul.Validate()...)
+	}
+
+	return errs
+}
+
+// MustValidate exits, logging every problem Validate finds in c
+func MustValidate(c *config.Config) {
+	errs := Validate(c)
+	if len(errs) == 0 {
+		return
+	}
+
+	for _, err := range errs {
+		log.Error(err)
+	}
+	log.Fatal("Invalid configuration")
+}
+
+func hasScheme(uri string, schemes []string) bool {
+	for _, scheme := range schemes {
+		if strings.HasPrefix(uri, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckConnectivity checks that the Zookeeper ensemble is reachable and
+// knows a leading master, and that the Consul agent mesos-consul would
+// load its cache from answers, waiting at most timeout for each.
+func CheckConnectivity(c *config.Config, timeout time.Duration) []error {
+	errs := []error{}
+
+	reachable := 0
+	for _, member := range zkMembers(c.Zk) {
+		conn, err := net.DialTimeout("tcp", member, timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("--zk: Zookeeper member %s unreachable: %s", member, err))
+			continue
+		}
+		conn.Close()
+		reachable++
+	}
+	if reachable == 0 {
+		return append(errs, fmt.Errorf("--zk: no Zookeeper member reachable"))
+	}
+
+	m := new(Mesos)
+	if err := m.detect(c.Zk, timeout); err != nil {
+		return append(errs, fmt.Errorf("--zk: %s", err))
+	}
+	leader := m.getLeader()
+
+	if c.DryRun {
+		return errs
+	}
+
+	if usesConsul(c) {
+		if err := consul.Ping(leader.Ip); err != nil {
+			errs = append(errs, fmt.Errorf("--registry=consul: Consul agent of the leading master %s unreachable: %s", leader.Ip, err))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,35 @@
+package mesos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+)
+
+func TestValidate(t *testing.T) {
+	if errs := Validate(config.DefaultConfig()); len(errs) != 0 {
+		t.Errorf("Validate() of the defaults => %v, want none", errs)
+	}
+
+	c := config.DefaultConfig()
+	c.Registries = []string{"consul", "zookeeper://zk1:2181", "consul"}
+	c.WhiteList = []string{"^web", "^api("}
+	c.TaskTag = []string{"web:http", "nocolon"}
+	c.MesosIpOrder = "netinfo,nowhere"
+	c.PortMode = "bridge"
+	c.RefreshJitter = 100
+	c.Statsd = "127.0.0.1:8125"
+	c.StatsdInterval = 0
+	c.ReadyIntervals = 0
+
+	var got []string
+	for _, err := range Validate(c) {
+		got = append(got, strings.SplitN(err.Error(), ":", 2)[0])
+	}
+	want := []string{"--registry", "--registry", "--port-mode", "--whitelist", "--task-tag", "--mesos-ip-order",
+		"--refresh-jitter", "--statsd-interval", "--ready-intervals"}
+	if !sliceEq(got, want) {
+		t.Errorf("Validate() => errors of %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package mesos
+
+import (
+	"strconv"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// taskWeights returns the DNS SRV weights of the services of a task, from
+// its consul.weights.passing and consul.weights.warning labels, or nil
+// when neither is set. Either defaults to 1, the Consul default.
+func taskWeights(t *state.Task) *registry.Weights {
+	passing, okPassing := weightLabel(t, "weights.passing", 1)
+	warning, okWarning := weightLabel(t, "weights.warning", 0)
+	if !okPassing && !okWarning {
+		return nil
+	}
+
+	if !okWarning {
+		warning = 1
+	}
+	return &registry.Weights{Passing: passing, Warning: warning}
+}
+
+// weightLabel returns the value of a weight label, and whether it is set
+// to a valid weight of at least min
+func weightLabel(t *state.Task, name string, min int) (int, bool) {
+	l := t.PrefixedLabel(name)
+	if l == "" {
+		return 1, false
+	}
+
+	w, err := strconv.Atoi(l)
+	if err != nil || w < min {
+		log.WithField("task", t.ID).Warnf("Ignoring invalid %s label '%s'", t.PrefixedKey(name), l)
+		return 1, false
+	}
+	return w, true
+}
@@ -2,22 +2,74 @@ package mesos
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/mesos/mesos-go/detector"
-	_ "github.com/mesos/mesos-go/detector/zoo"
-	proto "github.com/mesos/mesos-go/mesosproto"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+
+	"github.com/mesos/mesos-go/api/v0/detector"
+	_ "github.com/mesos/mesos-go/api/v0/detector/zoo"
+	proto "github.com/mesos/mesos-go/api/v0/mesosproto"
+	"github.com/samuel/go-zookeeper/zk"
 	log "github.com/sirupsen/logrus"
 )
 
+// Timeout of the Zookeeper session watched for Ready
+const zkSessionTimeout = 10 * time.Second
+
+// zkSession keeps the state of the Zookeeper session for Ready
+type zkSession struct {
+	sync.Mutex
+	connected bool
+	since     time.Time
+}
+
+// changed records the state of the session at now
+func (s *zkSession) changed(state zk.State, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch state {
+	case zk.StateHasSession:
+		if !s.connected {
+			s.connected = true
+			s.since = now
+		}
+	case zk.StateDisconnected, zk.StateExpired, zk.StateAuthFailed:
+		if s.connected || s.since.IsZero() {
+			s.connected = false
+			s.since = now
+		}
+	}
+}
+
+// err returns why the session is not usable, or nil
+func (s *zkSession) err(now time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.connected {
+		return nil
+	}
+	if s.since.IsZero() {
+		return errors.New("not connected to Zookeeper")
+	}
+	return fmt.Errorf("Zookeeper session lost %v ago", now.Sub(s.since).Truncate(time.Second))
+}
+
 func (m *Mesos) OnMasterChanged(leader *proto.MasterInfo) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
 	m.started.Do(func() { close(m.startChan) })
 
+	if m.Leader != nil && leader != nil && m.Leader.GetId() != leader.GetId() {
+		metrics.MesosLeaderChanges.Inc()
+	}
 	m.Leader = leader
 }
 
@@ -29,14 +81,65 @@ func (m *Mesos) UpdatedMasters(masters []*proto.MasterInfo) {
 }
 
 func (m *Mesos) zkDetector(zkURI string) {
+	if err := m.detect(zkURI, 2*time.Minute); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := m.watchSession(zkURI); err != nil {
+		log.Fatal("Unable to connect to Zookeeper: ", err)
+	}
+}
+
+// watchSession keeps the state of a Zookeeper session to the servers of
+// zkURI, for Ready. The detector does not tell when it loses its own
+// session.
+func (m *Mesos) watchSession(zkURI string) error {
+	_, events, err := zk.Connect(zkServers(zkURI), zkSessionTimeout)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for ev := range events {
+			if ev.Type == zk.EventSession {
+				log.WithField("state", ev.State.String()).Debug("Zookeeper session")
+				m.zk.changed(ev.State, time.Now())
+			}
+		}
+	}()
+	return nil
+}
+
+// zkServers returns the servers of a zk://[user:pass@]host:port,.../path
+// address
+func zkServers(zkURI string) []string {
+	hosts := strings.TrimPrefix(zkURI, "zk://")
+	if i := strings.Index(hosts, "/"); i >= 0 {
+		hosts = hosts[:i]
+	}
+	if i := strings.LastIndex(hosts, "@"); i >= 0 {
+		hosts = hosts[i+1:]
+	}
+
+	servers := []string{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			servers = append(servers, h)
+		}
+	}
+	return servers
+}
+
+// detect watches the Mesos masters in Zookeeper and waits at most timeout
+// for the initial leader
+func (m *Mesos) detect(zkURI string, timeout time.Duration) error {
 	if zkURI == "" {
-		log.Fatal("Zookeeper address not provided")
+		return errors.New("Zookeeper address not provided")
 	}
 
 	log.WithField("zk", zkURI).Debug("Zookeeper address")
 	md, err := detector.New(zkURI)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
 	m.startChan = make(chan struct{})
@@ -45,8 +148,9 @@ func (m *Mesos) zkDetector(zkURI string) {
 	select {
 	case <-m.startChan:
 		log.Info("Done waiting for initial leader information from Zookeeper.")
-	case <-time.After(2 * time.Minute):
-		log.Fatal("Timed out waiting for initial ZK detection.")
+		return nil
+	case <-time.After(timeout):
+		return errors.New("Timed out waiting for initial ZK detection.")
 	}
 }
 
@@ -66,6 +170,7 @@ func (m *Mesos) getMasters() []*MesosHost {
 	ms := make([]*MesosHost, len(m.Masters))
 	for i, msp := range m.Masters {
 		mh := MasterInfoToMesosHost(msp)
+		mh.Version = msp.GetVersion()
 		if *m.Leader.Id == *msp.Id {
 			mh.IsLeader = true
 		}
@@ -0,0 +1,66 @@
+package mesos
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// zkDefaultPort is the client port of the ensemble members given
+// without one in the --zk address
+const zkDefaultPort = "2181"
+
+// zkMembers returns the host:port of the members of the ensemble of a
+// zk://host1:port1,host2:port2/path address
+func zkMembers(uri string) []string {
+	hosts := strings.TrimPrefix(uri, "zk://")
+	if i := strings.Index(hosts, "/"); i >= 0 {
+		hosts = hosts[:i]
+	}
+
+	members := []string{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(strings.Trim(h, "[]"), zkDefaultPort)
+		}
+		members = append(members, h)
+	}
+
+	return members
+}
+
+// zkRuok is the check script of an ensemble member, asking it whether it
+// is running in a non-error state with the ruok four letter word
+const zkRuok = "echo ruok | nc -w 2 %s %s | grep -q imok"
+
+// registerZookeeper registers the members of the ensemble as the
+// --zk-service service, with a ruok check of their client port
+func (m *Mesos) registerZookeeper() {
+	if m.ZkService == "" {
+		return
+	}
+
+	for _, member := range m.zkMembers {
+		host, port, _ := net.SplitHostPort(member)
+		ip := toIP(host)
+
+		m.registerHost(&registry.Service{
+			ID:      fmt.Sprintf("%s%s:%s:%s", m.servicePrefix(), m.ZkService, ip, port),
+			Name:    m.ZkService,
+			Port:    toPort(port),
+			Address: ip,
+			Agent:   ip,
+			Tags:    []string{},
+			Check: &registry.Check{
+				Script:   fmt.Sprintf(zkRuok, ip, port),
+				Interval: "10s",
+				Timeout:  "5s",
+			},
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RateWindow is the range over which dashboard panels compute the rate
+// of counters
+const RateWindow = "5m"
+
+// Grafana dashboard model, limited to the fields the generated dashboard
+// uses. See https://grafana.com/docs/grafana/latest/dashboards/build-dashboards/view-dashboard-json-model/
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          grafanaTime       `json:"time"`
+	Templating    grafanaTemplating `json:"templating"`
+	Panels        []grafanaPanel    `json:"panels"`
+}
+
+type grafanaTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+type grafanaPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Description string            `json:"description"`
+	Datasource  grafanaDatasource `json:"datasource"`
+	GridPos     grafanaGridPos    `json:"gridPos"`
+	Targets     []grafanaTarget   `json:"targets"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+// GrafanaDashboard returns a Grafana dashboard definition with one panel
+// per metric of the registry, querying a Prometheus datasource picked
+// from the dashboard's datasource variable. Counters are graphed as
+// their rate over RateWindow, gauges as their value, both summed by the
+// first label of the metric.
+func (r *Registry) GrafanaDashboard(title string) ([]byte, error) {
+	d := grafanaDashboard{
+		UID:           "mesos-consul",
+		Title:         title,
+		Tags:          []string{"mesos-consul"},
+		SchemaVersion: 36,
+		Refresh:       "1m",
+		Time:          grafanaTime{From: "now-6h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Datasource", Type: "datasource", Query: "prometheus"},
+		}},
+		Panels: []grafanaPanel{},
+	}
+
+	for i, f := range r.Gather() {
+		d.Panels = append(d.Panels, grafanaPanel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       panelTitle(f),
+			Description: f.Help,
+			Datasource:  grafanaDatasource{Type: "prometheus", UID: "${datasource}"},
+			GridPos:     grafanaGridPos{H: 8, W: 12, X: (i % 2) * 12, Y: (i / 2) * 8},
+			Targets:     []grafanaTarget{panelTarget(f)},
+		})
+	}
+
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// panelTitle turns a metric name into a panel title, dropping the common
+// prefix and the counter suffix
+func panelTitle(f Family) string {
+	name := strings.TrimPrefix(f.Name, "mesos_consul_")
+	name = strings.TrimSuffix(name, "_total")
+	name = strings.Replace(name, "_", " ", -1)
+	if name == "" {
+		return f.Name
+	}
+
+	title := strings.ToUpper(name[:1]) + name[1:]
+	if f.Type == TypeCounter {
+		title += " per second"
+	}
+	return title
+}
+
+// panelTarget returns the Prometheus query graphing a metric
+func panelTarget(f Family) grafanaTarget {
+	expr := f.Name
+	if f.Type == TypeCounter {
+		expr = fmt.Sprintf("rate(%s[%s])", f.Name, RateWindow)
+	}
+
+	if len(f.Labels) == 0 {
+		return grafanaTarget{Expr: fmt.Sprintf("sum(%s)", expr), RefID: "A"}
+	}
+
+	return grafanaTarget{
+		Expr:         fmt.Sprintf("sum by (%s) (%s)", f.Labels[0], expr),
+		LegendFormat: fmt.Sprintf("{{%s}}", f.Labels[0]),
+		RefID:        "A",
+	}
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGrafanaDashboard(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("mesos_consul_test_total", "Test counter.", "framework", "agent")
+	r.NewGauge("mesos_consul_test_pending", "Test gauge.")
+
+	body, err := r.GrafanaDashboard("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d grafanaDashboard
+	if err := json.Unmarshal(body, &d); err != nil {
+		t.Fatalf("dashboard is not valid JSON: %s", err)
+	}
+	if d.Title != "test" || len(d.Panels) != 2 {
+		t.Fatalf("dashboard => %+v", d)
+	}
+
+	tests := []struct {
+		title, expr string
+	}{
+		{"Test per second", "sum by (framework) (rate(mesos_consul_test_total[5m]))"},
+		{"Test pending", "sum(mesos_consul_test_pending)"},
+	}
+	for i, tt := range tests {
+		p := d.Panels[i]
+		if p.Title != tt.title || p.Targets[0].Expr != tt.expr {
+			t.Errorf("panel %d => %q %q, want %q %q", i, p.Title, p.Targets[0].Expr, tt.title, tt.expr)
+		}
+	}
+	if d.Panels[1].GridPos.X != 12 || d.Panels[1].GridPos.Y != 0 {
+		t.Errorf("panel 1 position => %+v", d.Panels[1].GridPos)
+	}
+}
@@ -0,0 +1,341 @@
+// Package metrics keeps the counters and gauges exported by mesos-consul.
+//
+// Every metric is declared once in this file so the set of exported names
+// and labels is stable and documented in one place.
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// OtherLabel replaces every label value of a sample once a metric
+// reaches its label set cap.
+const OtherLabel = "other"
+
+// Registry holds a set of metric families
+type Registry struct {
+	mu           sync.Mutex
+	families     []*family
+	maxLabelSets int
+}
+
+// NewRegistry returns an empty registry without a label set cap.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry holds every metric declared by this package
+var DefaultRegistry = NewRegistry()
+
+// SetMaxLabelSets caps the number of distinct label sets kept per metric.
+// Samples beyond the cap are aggregated under OtherLabel. 0 disables the cap.
+func (r *Registry) SetMaxLabelSets(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.maxLabelSets = n
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	values map[string]*sample
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func (r *Registry) newFamily(name, help, typ string, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.families {
+		if f.name == name {
+			panic(fmt.Sprintf("metrics: duplicate metric %q", name))
+		}
+	}
+
+	f := &family{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+	r.families = append(r.families, f)
+
+	return f
+}
+
+// update applies fn to the sample of the given label values
+func (r *Registry) update(f *family, labelValues []string, fn func(*sample)) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.values[key]
+	if !ok {
+		if r.maxLabelSets > 0 && len(f.values) >= r.maxLabelSets && len(f.labels) > 0 {
+			labelValues = make([]string, len(f.labels))
+			for i := range labelValues {
+				labelValues[i] = OtherLabel
+			}
+			key = strings.Join(labelValues, "\xff")
+			s, ok = f.values[key]
+		}
+		if !ok {
+			s = &sample{labels: append([]string{}, labelValues...)}
+			f.values[key] = s
+		}
+	}
+
+	fn(s)
+}
+
+// Counter is a metric which only goes up
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+// NewCounter declares a counter in the registry
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r, r.newFamily(name, help, TypeCounter, labels)}
+}
+
+// Inc adds 1 to the counter of the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter of the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.r.update(c.f, labelValues, func(s *sample) { s.value += v })
+}
+
+// Total returns the sum of the counter over every label value
+func (c *Counter) Total() float64 {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	total := 0.0
+	for _, s := range c.f.values {
+		total += s.value
+	}
+	return total
+}
+
+// Gauge is a metric which can go up and down
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+// NewGauge declares a gauge in the registry
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r, r.newFamily(name, help, TypeGauge, labels)}
+}
+
+// Set sets the gauge of the given label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.r.update(g.f, labelValues, func(s *sample) { s.value = v })
+}
+
+// Family is a point in time copy of a metric and its samples
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Labels  []string
+	Samples []Sample
+}
+
+// Sample is the value of a metric for one set of label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Gather returns a copy of every metric of the registry, in declaration
+// order, with samples sorted by label values.
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	families := make([]Family, 0, len(r.families))
+	for _, f := range r.families {
+		fam := Family{
+			Name:   f.name,
+			Help:   f.help,
+			Type:   f.typ,
+			Labels: append([]string{}, f.labels...),
+		}
+		for _, s := range f.values {
+			fam.Samples = append(fam.Samples, Sample{
+				LabelValues: append([]string{}, s.labels...),
+				Value:       s.value,
+			})
+		}
+		sort.Sort(byLabelValues(fam.Samples))
+		families = append(families, fam)
+	}
+
+	return families
+}
+
+type byLabelValues []Sample
+
+func (s byLabelValues) Len() int      { return len(s) }
+func (s byLabelValues) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLabelValues) Less(i, j int) bool {
+	return strings.Join(s[i].LabelValues, "\xff") < strings.Join(s[j].LabelValues, "\xff")
+}
+
+// HashLabel returns a short stable hash of a label value, keeping high
+// cardinality or sensitive values such as agent addresses out of metrics.
+func HashLabel(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// Exported metrics
+var (
+	// Registrations counts services registered, by framework and hashed agent
+	Registrations = DefaultRegistry.NewCounter(
+		"mesos_consul_registrations_total",
+		"Services registered.",
+		"framework", "agent")
+
+	// Deregistrations counts services deregistered, by framework and hashed agent
+	Deregistrations = DefaultRegistry.NewCounter(
+		"mesos_consul_deregistrations_total",
+		"Services deregistered.",
+		"framework", "agent")
+
+	// DeregistrationsPending is the number of services left to deregister
+	// in later cycles
+	DeregistrationsPending = DefaultRegistry.NewGauge(
+		"mesos_consul_deregistrations_pending",
+		"Services awaiting deregistration in later cycles.")
+
+	// ServicesBelowMinInstances is the number of services the last
+	// deregistrations left below --deregister-min-instances
+	ServicesBelowMinInstances = DefaultRegistry.NewGauge(
+		"mesos_consul_services_below_min_instances",
+		"Services left below the minimum instance count by deregistrations.")
+
+	// DeregistrationsBlocked counts deregistrations of the last instance
+	// of a service blocked while its task runs, by framework
+	DeregistrationsBlocked = DefaultRegistry.NewCounter(
+		"mesos_consul_deregistrations_blocked_total",
+		"Deregistrations of the last instance of a running task's service blocked.",
+		"framework")
+
+	// Leader is 1 while this instance holds the --consul-lock, 0 on
+	// standby
+	Leader = DefaultRegistry.NewGauge(
+		"mesos_consul_leader",
+		"Whether this instance is the active replica.")
+
+	// FallbackRegistrations counts services registered on a fallback
+	// Consul agent, by framework and hashed agent
+	FallbackRegistrations = DefaultRegistry.NewCounter(
+		"mesos_consul_fallback_registrations_total",
+		"Services registered on a fallback Consul agent.",
+		"framework", "agent")
+
+	// CriticalDeregistrations counts services deregistered for staying
+	// critical, by framework
+	CriticalDeregistrations = DefaultRegistry.NewCounter(
+		"mesos_consul_critical_deregistrations_total",
+		"Services deregistered for staying critical while their task runs.",
+		"framework")
+
+	// Transactions counts the catalog transactions executed
+	Transactions = DefaultRegistry.NewCounter(
+		"mesos_consul_transactions_total",
+		"Catalog transactions executed.")
+
+	// ReconcileRepairs counts the differences between the cache and
+	// Consul found by reconciliations, by kind (missing, changed or
+	// untracked)
+	ReconcileRepairs = DefaultRegistry.NewCounter(
+		"mesos_consul_reconcile_repairs_total",
+		"Differences between the cache and Consul repaired by reconciliations.",
+		"kind")
+
+	// RegistryErrors counts failed registry operations, by framework,
+	// hashed agent and operation (register or deregister)
+	RegistryErrors = DefaultRegistry.NewCounter(
+		"mesos_consul_registry_errors_total",
+		"Failed registry operations.",
+		"framework", "agent", "operation")
+
+	// Refreshes counts the refreshes run while leading, by result
+	// (success or failure)
+	Refreshes = DefaultRegistry.NewCounter(
+		"mesos_consul_refreshes_total",
+		"Refreshes run.",
+		"result")
+
+	// RefreshDuration is the duration of the last refresh, from loading
+	// the Mesos state to the last registry operation
+	RefreshDuration = DefaultRegistry.NewGauge(
+		"mesos_consul_refresh_duration_seconds",
+		"Duration of the last refresh.")
+
+	// MesosErrors counts the failed loads of the Mesos master state
+	MesosErrors = DefaultRegistry.NewCounter(
+		"mesos_consul_mesos_errors_total",
+		"Failed loads of the Mesos master state.")
+
+	// TasksSeen is the number of running tasks of the last Mesos state
+	TasksSeen = DefaultRegistry.NewGauge(
+		"mesos_consul_tasks_seen",
+		"Running tasks of the last Mesos state.")
+
+	// CycleServices is the number of services registered by the last
+	// refresh, Mesos hosts included
+	CycleServices = DefaultRegistry.NewGauge(
+		"mesos_consul_cycle_services",
+		"Services registered by the last refresh.")
+
+	// CacheServices is the number of services in the Consul registry
+	// cache after the last refresh
+	CacheServices = DefaultRegistry.NewGauge(
+		"mesos_consul_cache_services",
+		"Services in the registry cache.")
+
+	// MesosLeaderChanges counts the changes of the leading Mesos master
+	// seen in Zookeeper
+	MesosLeaderChanges = DefaultRegistry.NewCounter(
+		"mesos_consul_mesos_leader_changes_total",
+		"Changes of the leading Mesos master.")
+
+	// WebhookErrors counts the webhook notifications which were not
+	// delivered, by reason: failed after the retries, or dropped by a
+	// full queue
+	WebhookErrors = DefaultRegistry.NewCounter(
+		"mesos_consul_webhook_errors_total",
+		"Webhook notifications not delivered.",
+		"reason")
+)
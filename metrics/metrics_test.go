@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test counter.", "framework", "agent")
+
+	c.Inc("marathon", "a")
+	c.Inc("marathon", "a")
+	c.Add(3, "chronos", "b")
+
+	fams := r.Gather()
+	if len(fams) != 1 || fams[0].Name != "test_total" || fams[0].Type != TypeCounter {
+		t.Fatalf("Gather() => %+v", fams)
+	}
+	want := []Sample{
+		{[]string{"chronos", "b"}, 3},
+		{[]string{"marathon", "a"}, 2},
+	}
+	if len(fams[0].Samples) != len(want) {
+		t.Fatalf("samples => %+v, want %+v", fams[0].Samples, want)
+	}
+	for i, s := range fams[0].Samples {
+		if s.Value != want[i].Value || s.LabelValues[0] != want[i].LabelValues[0] || s.LabelValues[1] != want[i].LabelValues[1] {
+			t.Errorf("sample %d => %+v, want %+v", i, s, want[i])
+		}
+	}
+}
+
+func TestCounterTotal(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test counter.", "operation")
+
+	if total := c.Total(); total != 0 {
+		t.Errorf("Total() => %v, want 0", total)
+	}
+
+	c.Inc("register")
+	c.Add(2, "deregister")
+	if total := c.Total(); total != 3 {
+		t.Errorf("Total() => %v, want 3", total)
+	}
+}
+
+func TestMaxLabelSets(t *testing.T) {
+	r := NewRegistry()
+	r.SetMaxLabelSets(2)
+	g := r.NewGauge("test", "Test gauge.", "agent")
+
+	g.Set(1, "a")
+	g.Set(2, "b")
+	g.Set(3, "c")
+	g.Set(4, "d")
+	g.Set(5, "a")
+
+	got := map[string]float64{}
+	for _, s := range r.Gather()[0].Samples {
+		got[s.LabelValues[0]] = s.Value
+	}
+	if len(got) != 3 || got["a"] != 5 || got["b"] != 2 || got[OtherLabel] != 4 {
+		t.Errorf("samples => %v, want a=5 b=2 other=4", got)
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("dup_total", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("declaring a metric twice did not panic")
+		}
+	}()
+	r.NewGauge("dup_total", "")
+}
+
+func TestHashLabel(t *testing.T) {
+	if HashLabel("10.0.0.1") != HashLabel("10.0.0.1") {
+		t.Error("HashLabel is not stable")
+	}
+	if HashLabel("10.0.0.1") == HashLabel("10.0.0.2") {
+		t.Error("HashLabel collides on distinct agents")
+	}
+	if len(HashLabel("10.0.0.1")) != 8 {
+		t.Errorf("HashLabel(10.0.0.1) => %s, want 8 hex digits", HashLabel("10.0.0.1"))
+	}
+}
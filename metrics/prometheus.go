@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PrometheusContentType is the content type of the Prometheus text format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// WritePrometheus writes every metric of the registry in the Prometheus
+// text exposition format. Metrics without labels are written as 0 until
+// they are first set.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for _, f := range r.Gather() {
+		fmt.Fprintf(b, "# HELP %s %s\n", f.Name, helpEscaper.Replace(f.Help))
+		fmt.Fprintf(b, "# TYPE %s %s\n", f.Name, f.Type)
+
+		if len(f.Samples) == 0 && len(f.Labels) == 0 {
+			fmt.Fprintf(b, "%s 0\n", f.Name)
+		}
+		for _, s := range f.Samples {
+			b.WriteString(f.Name)
+			if len(f.Labels) > 0 {
+				pairs := make([]string, len(f.Labels))
+				for i, l := range f.Labels {
+					pairs[i] = fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(s.LabelValues[i]))
+				}
+				b.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			b.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+		}
+	}
+	return b.Flush()
+}
+
+// Handler serves the metrics of the registry to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", PrometheusContentType)
+		r.WritePrometheus(w)
+	})
+}
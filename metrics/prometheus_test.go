@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test counter.", "framework")
+	r.NewGauge("test_gauge", "Test gauge,\nunset.")
+
+	c.Inc(`mara"thon`)
+	c.Add(2.5, "chronos")
+
+	var b bytes.Buffer
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{framework="chronos"} 2.5
+test_total{framework="mara\"thon"} 1
+# HELP test_gauge Test gauge,\nunset.
+# TYPE test_gauge gauge
+test_gauge 0
+`
+	if b.String() != want {
+		t.Errorf("WritePrometheus() =>\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdPacketSize is the payload size kept under the MTU of most networks
+const statsdPacketSize = 1432
+
+var statsdEscaper = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+
+// Statsd pushes the metrics of a registry to a statsd server. Counters are
+// sent as the increment since the last push, gauges as their value, and
+// the gauges of durations, named *_seconds, as timings in milliseconds
+// when they changed. With DogStatsD, labels are sent as tags; otherwise
+// their values are appended to the metric name.
+type Statsd struct {
+	r         *Registry
+	prefix    string
+	tags      []string
+	dogstatsd bool
+
+	// Values of the samples at the last push
+	last map[string]float64
+}
+
+// NewStatsd returns a statsd pusher of the metrics of r, prefixing their
+// names by prefix and a dot. tags are added to every metric with DogStatsD.
+func NewStatsd(r *Registry, prefix string, tags []string, dogstatsd bool) *Statsd {
+	return &Statsd{
+		r:         r,
+		prefix:    prefix,
+		tags:      tags,
+		dogstatsd: dogstatsd,
+		last:      make(map[string]float64),
+	}
+}
+
+// Lines returns the statsd lines of the samples to push, and records
+// their values as pushed
+func (s *Statsd) Lines() []string {
+	lines := []string{}
+	for _, f := range s.r.Gather() {
+		for _, sample := range f.Samples {
+			key := f.Name + "\xff" + strings.Join(sample.LabelValues, "\xff")
+			last, seen := s.last[key]
+			s.last[key] = sample.Value
+
+			var value float64
+			var typ string
+			switch {
+			case f.Type == TypeCounter:
+				if seen && sample.Value == last {
+					continue
+				}
+				value, typ = sample.Value-last, "c"
+			case strings.HasSuffix(f.Name, "_seconds"):
+				if seen && sample.Value == last {
+					continue
+				}
+				value, typ = sample.Value*1000, "ms"
+			default:
+				value, typ = sample.Value, "g"
+			}
+
+			lines = append(lines, s.line(f, sample, value, typ))
+		}
+	}
+	return lines
+}
+
+func (s *Statsd) line(f Family, sample Sample, value float64, typ string) string {
+	name := f.Name
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+
+	tags := append([]string{}, s.tags...)
+	for i, l := range f.Labels {
+		v := statsdEscaper.Replace(sample.LabelValues[i])
+		if s.dogstatsd {
+			tags = append(tags, l+":"+v)
+		} else {
+			name += "." + v
+		}
+	}
+
+	line := fmt.Sprintf("%s:%s|%s", name, strconv.FormatFloat(value, 'f', -1, 64), typ)
+	if s.dogstatsd && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// Run pushes the metrics to the statsd server at addr over UDP every
+// interval. It only returns when addr can't be resolved or interval is
+// not positive.
+func (s *Statsd) Run(addr string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid statsd interval %v", interval)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for range time.Tick(interval) {
+		for _, p := range statsdPackets(s.Lines()) {
+			// Errors, such as no server listening, are not worth
+			// reporting on every push
+			conn.Write([]byte(p))
+		}
+	}
+	return nil
+}
+
+// statsdPackets joins lines into packets of at most statsdPacketSize
+// bytes, longer lines being sent alone
+func statsdPackets(lines []string) []string {
+	packets := []string{}
+	packet := ""
+	for _, l := range lines {
+		if packet != "" && len(packet)+1+len(l) > statsdPacketSize {
+			packets = append(packets, packet)
+			packet = ""
+		}
+		if packet != "" {
+			packet += "\n"
+		}
+		packet += l
+	}
+	if packet != "" {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdLines(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test counter.", "framework")
+	g := r.NewGauge("test_services", "Test gauge.")
+	d := r.NewGauge("test_duration_seconds", "Test duration.")
+
+	c.Add(3, "marathon")
+	g.Set(12)
+	d.Set(0.25)
+
+	for _, tt := range []struct {
+		dogstatsd bool
+		want      []string
+	}{
+		{false, []string{
+			"mc.test_total.marathon:3|c",
+			"mc.test_services:12|g",
+			"mc.test_duration_seconds:250|ms",
+		}},
+		{true, []string{
+			"mc.test_total:3|c|#env:prod,framework:marathon",
+			"mc.test_services:12|g|#env:prod",
+			"mc.test_duration_seconds:250|ms|#env:prod",
+		}},
+	} {
+		s := NewStatsd(r, "mc", []string{"env:prod"}, tt.dogstatsd)
+		if lines := s.Lines(); !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("dogstatsd %v: Lines() => %v, want %v", tt.dogstatsd, lines, tt.want)
+		}
+	}
+
+	s := NewStatsd(r, "", nil, false)
+	s.Lines()
+	c.Inc("marathon")
+	want := []string{"test_total.marathon:1|c", "test_services:12|g"}
+	if lines := s.Lines(); !reflect.DeepEqual(lines, want) {
+		t.Errorf("second Lines() => %v, want %v", lines, want)
+	}
+}
+
+func TestStatsdPackets(t *testing.T) {
+	short := "test_services:12|g"
+	long := strings.Repeat("x", statsdPacketSize)
+
+	packets := statsdPackets([]string{short, short, long, short})
+	want := []string{short + "\n" + short, long, short}
+	if !reflect.DeepEqual(packets, want) {
+		t.Errorf("statsdPackets() => %d packets, want %d", len(packets), len(want))
+	}
+}
+
+func TestStatsdRunInterval(t *testing.T) {
+	s := NewStatsd(NewRegistry(), "", nil, false)
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := s.Run("127.0.0.1:8125", interval); err == nil {
+			t.Errorf("Run() every %v => nil, want an error", interval)
+		}
+	}
+}
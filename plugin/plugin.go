@@ -0,0 +1,186 @@
+// Package plugin exposes registry.Registry over hashicorp/go-plugin, so
+// that registries can ship as separate binaries, loaded with
+// --registry-plugin.
+//
+// A plugin implements registry.Registry and serves it from its main:
+//
+//	func main() {
+//		plugin.Serve(&MyRegistry{})
+//	}
+//
+// The optional registry interfaces, such as registry.Elector, are not
+// available to plugins.
+package plugin
+
+import (
+	"fmt"
+	"net/rpc"
+	"os/exec"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	goplugin "github.com/hashicorp/go-plugin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handshake is the handshake of mesos-consul and its registry plugins.
+// ProtocolVersion changes along with the registry.Registry interface.
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "MESOS_CONSUL_PLUGIN",
+	MagicCookieValue: "registry",
+}
+
+// Name of the registry in the plugin set
+const registryName = "registry"
+
+// RegistryPlugin is the go-plugin plugin of a registry. Impl is set on
+// the plugin side only.
+type RegistryPlugin struct {
+	Impl registry.Registry
+}
+
+func (p *RegistryPlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &RPCServer{Impl: p.Impl}, nil
+}
+
+func (p *RegistryPlugin) Client(b *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &RPCClient{client: c}, nil
+}
+
+// Serve serves the registry of a plugin, until mesos-consul stops it
+func Serve(impl registry.Registry) {
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins: map[string]goplugin.Plugin{
+			registryName: &RegistryPlugin{Impl: impl},
+		},
+	})
+}
+
+// Plugin is the registry of a plugin binary. A plugin which exited is
+// started again on the next call, and loads its cache again on the next
+// refresh, its new cache being empty.
+type Plugin struct {
+	path   string
+	client *goplugin.Client
+	impl   registry.Registry
+
+	// Whether the cache of the plugin, created when it was started
+	// again, is to be loaded
+	load bool
+}
+
+// New starts the plugin binary at path, and returns its registry
+func New(path string) registry.Registry {
+	p := &Plugin{path: path}
+	if err := p.start(); err != nil {
+		log.Fatalf("Unable to start registry plugin %s: %s", path, err)
+	}
+	return p
+}
+
+// Cleanup stops the plugins, which would otherwise outlive mesos-consul
+func Cleanup() {
+	goplugin.CleanupClients()
+}
+
+func (p *Plugin) start() error {
+	client := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig: Handshake,
+		Plugins: map[string]goplugin.Plugin{
+			registryName: &RegistryPlugin{},
+		},
+		Cmd:     exec.Command(p.path),
+		Managed: true,
+	})
+
+	rpcClient, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return err
+	}
+
+	raw, err := rpcClient.Dispense(registryName)
+	if err != nil {
+		client.Kill()
+		return err
+	}
+
+	p.client = client
+	p.impl = raw.(registry.Registry)
+	return nil
+}
+
+// registry returns the registry of the plugin, starting the plugin again
+// when it exited, or nil when it can not be started
+func (p *Plugin) registry() registry.Registry {
+	if !p.client.Exited() {
+		return p.impl
+	}
+
+	log.Warnf("Registry plugin %s exited, starting it again", p.path)
+	p.client.Kill()
+	if err := p.start(); err != nil {
+		log.Warnf("Unable to start registry plugin %s: %s", p.path, err)
+		return nil
+	}
+
+	// The plugin may be called before the next refresh creates its
+	// cache
+	p.load = p.impl.CacheCreate()
+	return p.impl
+}
+
+// CacheCreate creates the cache of the plugin, and tells whether it
+// needs to be loaded, as after the plugin was started again. The cache
+// of a plugin which can not be started is created once it starts.
+func (p *Plugin) CacheCreate() bool {
+	r := p.registry()
+	if r == nil {
+		return false
+	}
+
+	load := r.CacheCreate() || p.load
+	p.load = false
+	return load
+}
+
+func (p *Plugin) CacheLoad(host string) error {
+	r := p.registry()
+	if r == nil {
+		return fmt.Errorf("registry plugin %s is not running", p.path)
+	}
+	return r.CacheLoad(host)
+}
+
+func (p *Plugin) CacheLookup(id string) *registry.Service {
+	if r := p.registry(); r != nil {
+		return r.CacheLookup(id)
+	}
+	return nil
+}
+
+func (p *Plugin) CacheDelete(id string) {
+	if r := p.registry(); r != nil {
+		r.CacheDelete(id)
+	}
+}
+
+func (p *Plugin) CacheMark(id string) {
+	if r := p.registry(); r != nil {
+		r.CacheMark(id)
+	}
+}
+
+func (p *Plugin) Register(s *registry.Service) {
+	if r := p.registry(); r != nil {
+		r.Register(s)
+	}
+}
+
+func (p *Plugin) Deregister() {
+	if r := p.registry(); r != nil {
+		r.Deregister()
+	}
+}
@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// Environment variable making the test binary serve the memory registry
+// as a plugin
+const servePluginEnv = "MESOS_CONSUL_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(servePluginEnv) != "" {
+		Serve(&memory{services: make(map[string]*registry.Service)})
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestPluginRestart(t *testing.T) {
+	os.Setenv(servePluginEnv, "1")
+	defer os.Unsetenv(servePluginEnv)
+
+	p := New(os.Args[0]).(*Plugin)
+	defer p.client.Kill()
+
+	if !p.CacheCreate() {
+		t.Error("CacheCreate() => false for the cache of a new plugin, want true")
+	}
+	p.Register(&registry.Service{ID: "mesos-consul:web", Name: "web"})
+	if p.CacheLookup("mesos-consul:web") == nil {
+		t.Fatal("CacheLookup() => nil after registration")
+	}
+
+	p.client.Kill()
+
+	// The plugin is started again, with an empty cache to be loaded
+	p.Register(&registry.Service{ID: "mesos-consul:api", Name: "api"})
+	if p.client.Exited() {
+		t.Fatal("the plugin was not started again")
+	}
+	if p.CacheLookup("mesos-consul:api") == nil {
+		t.Error("CacheLookup() => nil after registration in the restarted plugin")
+	}
+	if !p.CacheCreate() {
+		t.Error("CacheCreate() => false after a restart, want the cache loaded")
+	}
+	if p.CacheCreate() {
+		t.Error("CacheCreate() => true again, want the cache loaded once")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	os.Setenv(servePluginEnv, "1")
+	defer os.Unsetenv(servePluginEnv)
+
+	p := New(os.Args[0]).(*Plugin)
+	Cleanup()
+
+	if !p.client.Exited() {
+		t.Error("the plugin is still running after Cleanup()")
+	}
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"net/rpc"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Empty is the argument or reply of the calls without one
+type Empty struct{}
+
+// LookupReply is the reply of CacheLookup, whose service is nil when
+// not cached
+type LookupReply struct {
+	Service *registry.Service
+}
+
+// RPCClient is the registry.Registry of a plugin, calling it over RPC.
+// The Registry interface does not report errors, so failed calls are
+// logged.
+type RPCClient struct {
+	client *rpc.Client
+}
+
+func (c *RPCClient) call(method string, args interface{}, reply interface{}) error {
+	err := c.client.Call("Plugin."+method, args, reply)
+	if err != nil {
+		log.Warnf("Registry plugin call %s failed: %s", method, err)
+	}
+	return err
+}
+
+func (c *RPCClient) CacheCreate() bool {
+	var load bool
+	c.call("CacheCreate", Empty{}, &load)
+	return load
+}
+
+func (c *RPCClient) CacheDelete(id string) {
+	c.call("CacheDelete", id, &Empty{})
+}
+
+func (c *RPCClient) CacheLoad(host string) error {
+	var empty Empty
+	return c.client.Call("Plugin.CacheLoad", host, &empty)
+}
+
+func (c *RPCClient) CacheLookup(id string) *registry.Service {
+	var reply LookupReply
+	if err := c.call("CacheLookup", id, &reply); err != nil {
+		return nil
+	}
+	return reply.Service
+}
+
+func (c *RPCClient) CacheMark(id string) {
+	c.call("CacheMark", id, &Empty{})
+}
+
+func (c *RPCClient) Register(s *registry.Service) {
+	c.call("Register", s, &Empty{})
+}
+
+func (c *RPCClient) Deregister() {
+	c.call("Deregister", Empty{}, &Empty{})
+}
+
+// RPCServer serves the registry of a plugin over RPC
+type RPCServer struct {
+	Impl registry.Registry
+}
+
+func (s *RPCServer) CacheCreate(args Empty, load *bool) error {
+	*load = s.Impl.CacheCreate()
+	return nil
+}
+
+func (s *RPCServer) CacheDelete(id string, reply *Empty) error {
+	s.Impl.CacheDelete(id)
+	return nil
+}
+
+func (s *RPCServer) CacheLoad(host string, reply *Empty) error {
+	return s.Impl.CacheLoad(host)
+}
+
+func (s *RPCServer) CacheLookup(id string, reply *LookupReply) error {
+	reply.Service = s.Impl.CacheLookup(id)
+	return nil
+}
+
+func (s *RPCServer) CacheMark(id string, reply *Empty) error {
+	s.Impl.CacheMark(id)
+	return nil
+}
+
+func (s *RPCServer) Register(service *registry.Service, reply *Empty) error {
+	s.Impl.Register(service)
+	return nil
+}
+
+func (s *RPCServer) Deregister(args Empty, reply *Empty) error {
+	s.Impl.Deregister()
+	return nil
+}
@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// memory is an in-memory registry
+type memory struct {
+	services map[string]*registry.Service
+	created  bool
+}
+
+func (m *memory) CacheCreate() bool {
+	load := !m.created
+	m.created = true
+	return load
+}
+
+func (m *memory) CacheDelete(id string)       { delete(m.services, id) }
+func (m *memory) CacheLoad(host string) error { return nil }
+func (m *memory) CacheMark(id string)         {}
+func (m *memory) Deregister()                 {}
+
+func (m *memory) CacheLookup(id string) *registry.Service {
+	return m.services[id]
+}
+
+func (m *memory) Register(s *registry.Service) {
+	m.services[s.ID] = s
+}
+
+func TestRPC(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &RPCServer{Impl: &memory{services: make(map[string]*registry.Service)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pluginConn, hostConn := net.Pipe()
+	go server.ServeConn(pluginConn)
+	c := &RPCClient{client: rpc.NewClient(hostConn)}
+	defer c.client.Close()
+
+	if !c.CacheCreate() {
+		t.Error("CacheCreate() => false, want true")
+	}
+
+	if s := c.CacheLookup("mesos-consul:web"); s != nil {
+		t.Errorf("CacheLookup() => %v before registration, want nil", s)
+	}
+
+	c.Register(&registry.Service{
+		ID:    "mesos-consul:web",
+		Name:  "web",
+		Port:  31000,
+		Tags:  []string{"http"},
+		Check: &registry.Check{HTTP: "http://10.0.0.1:31000/health"},
+	})
+
+	s := c.CacheLookup("mesos-consul:web")
+	if s == nil || s.Name != "web" || s.Port != 31000 || len(s.Tags) != 1 || s.Check.HTTP == "" {
+		t.Errorf("CacheLookup() => %+v, want the registered service", s)
+	}
+
+	c.CacheDelete("mesos-consul:web")
+	if s := c.CacheLookup("mesos-consul:web"); s != nil {
+		t.Errorf("CacheLookup() => %v after CacheDelete(), want nil", s)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/consul"
+	"github.com/CiscoCloud/mesos-consul/mesos"
+
+	flag "github.com/ogier/pflag"
+	log "github.com/sirupsen/logrus"
+)
+
+// purge runs the purge subcommand, deregistering the services left in the
+// Consul catalog by mesos-consul which no running task corresponds to, and
+// returns the exit status
+func purge(args []string) int {
+	var prefix string
+	var timeout time.Duration
+
+	c, err := parseFlags(args, func(flags *flag.FlagSet) {
+		flags.StringVar(&prefix, "prefix", "", "")
+		flags.DurationVar(&timeout, "timeout", 10*time.Second, "")
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	cluster, err := mesos.Connect(c, timeout)
+	if err != nil {
+		log.Errorf("Unable to find the leading Mesos master, nothing purged: %s", err)
+		return 1
+	}
+
+	// The catalog is listed before the Mesos state is loaded, so that the
+	// services of the tasks started meanwhile are in the state
+	registrations, err := consul.Registrations(cluster.Leader(), prefix)
+	if err != nil {
+		log.Errorf("Unable to list the Consul catalog: %s", err)
+		return 1
+	}
+
+	running, err := cluster.Running()
+	if err != nil {
+		log.Errorf("Unable to load the Mesos state, nothing purged: %s", err)
+		return 1
+	}
+	orphans := consul.Orphans(registrations, running.Has)
+
+	for _, o := range orphans {
+		fmt.Printf("%s\t%s\t%s\n", o.ID, o.Name, o.Node)
+	}
+	if c.DryRun {
+		fmt.Printf("%d orphaned service(s), none deregistered\n", len(orphans))
+		return 0
+	}
+
+	stillRunning := func(id string, taskID string) (bool, error) {
+		r, err := cluster.Running()
+		if err != nil {
+			return false, err
+		}
+		return r.Has(id, taskID), nil
+	}
+	deregistered, failed := consul.Purge(orphans, stillRunning)
+	if failed > 0 {
+		fmt.Printf("%d orphaned service(s), %d deregistered, %d could not be deregistered\n", len(orphans), deregistered, failed)
+		return 1
+	}
+	fmt.Printf("%d orphaned service(s), %d deregistered\n", len(orphans), deregistered)
+	return 0
+}
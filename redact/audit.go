@@ -0,0 +1,15 @@
+package redact
+
+import (
+	"github.com/CiscoCloud/mesos-consul/audit"
+)
+
+// Record returns r with every secret masked, for the audit log and the
+// webhook notifications.
+func (r *Redactor) Record(rec audit.Record) audit.Record {
+	rec.ServiceID = r.String(rec.ServiceID)
+	rec.Service = r.String(rec.Service)
+	rec.TaskID = r.String(rec.TaskID)
+	rec.Agent = r.String(rec.Agent)
+	return rec
+}
@@ -0,0 +1,21 @@
+package redact
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Formatter masks secrets in the log lines formatted by another formatter
+type Formatter struct {
+	Formatter log.Formatter
+	Redactor  *Redactor
+}
+
+// Format formats the entry and masks its secrets
+func (f *Formatter) Format(e *log.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Redactor.Bytes(b), nil
+}
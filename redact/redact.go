@@ -0,0 +1,135 @@
+// Package redact masks secrets in the output of mesos-consul, such as
+// log lines, so debug output can be shared safely.
+//
+// Secrets are found by pattern, like the value of a token= parameter,
+// and by value, like the Consul ACL token or the values of sensitive
+// task labels.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every redacted value
+const Mask = "[REDACTED]"
+
+// DefaultPatterns mask the values of token, password and secret
+// parameters, and the password of URLs.
+var DefaultPatterns = []string{
+	`(?i)(?:token|passw(?:or)?d|secret)["']?\s*[=:]\s*["']?([^\s"'&,;]+)`,
+	`://[^/\s:@]+:([^/\s@]+)@`,
+}
+
+// Redactor masks the matches of a set of patterns and a set of values
+type Redactor struct {
+	mu       sync.RWMutex
+	patterns []*regexp.Regexp
+	sources  map[string][]string
+	values   []string
+}
+
+// New returns a redactor masking the matches of the given patterns.
+func New(patterns ...string) (*Redactor, error) {
+	r := &Redactor{sources: make(map[string][]string)}
+	for _, p := range patterns {
+		if err := r.AddPattern(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Default is the redactor of the mesos-consul output
+var Default, _ = New(DefaultPatterns...)
+
+// AddPattern adds a regular expression to the redactor. When it has a
+// capture group, only the first group is masked, otherwise the whole match.
+func (r *Redactor) AddPattern(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid redaction pattern '%s': %s", expr, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.patterns = append(r.patterns, re)
+	return nil
+}
+
+// SetValues replaces the values masked on behalf of source. Empty values
+// are ignored.
+func (r *Redactor) SetValues(source string, values []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sources[source] = values
+
+	r.values = nil
+	for _, vs := range r.sources {
+		for _, v := range vs {
+			if v != "" {
+				r.values = append(r.values, v)
+			}
+		}
+	}
+	// Mask longer values first, in case one contains another
+	sort.Sort(byLength(r.values))
+}
+
+// String returns s with every secret masked
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, v := range r.values {
+		s = strings.Replace(s, v, Mask, -1)
+	}
+	for _, re := range r.patterns {
+		s = redactPattern(re, s)
+	}
+
+	return s
+}
+
+// Bytes returns b with every secret masked
+func (r *Redactor) Bytes(b []byte) []byte {
+	return []byte(r.String(string(b)))
+}
+
+// redactPattern masks the matches of re in s, or their first capture
+// group when re has one.
+func redactPattern(re *regexp.Regexp, s string) string {
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+
+	var out []byte
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		out = append(out, s[last:start]...)
+		out = append(out, Mask...)
+		last = end
+	}
+	if out == nil {
+		return s
+	}
+
+	return string(append(out, s[last:]...))
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
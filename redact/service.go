@@ -0,0 +1,50 @@
+package redact
+
+import (
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+// Pair returns value with every secret masked, value being that of key,
+// so that the value of a token key is masked as in token=value
+func (r *Redactor) Pair(key string, value string) string {
+	masked := r.String(key + "=" + value)
+	if strings.HasPrefix(masked, key+"=") {
+		return masked[len(key)+1:]
+	}
+	return r.String(value)
+}
+
+// Service returns a copy of s with every secret masked in its tags, meta
+// and check, and without its ACL token, for the output of the services
+// registered. s is not changed.
+func (r *Redactor) Service(s *registry.Service) *registry.Service {
+	c := *s
+	c.Token = ""
+
+	if s.Tags != nil {
+		c.Tags = make([]string, len(s.Tags))
+		for i, t := range s.Tags {
+			c.Tags[i] = r.String(t)
+		}
+	}
+
+	if s.Meta != nil {
+		c.Meta = make(map[string]string, len(s.Meta))
+		for k, v := range s.Meta {
+			c.Meta[k] = r.Pair(k, v)
+		}
+	}
+
+	if s.Check != nil {
+		chk := *s.Check
+		chk.Script = r.String(chk.Script)
+		chk.HTTP = r.String(chk.HTTP)
+		chk.TCP = r.String(chk.TCP)
+		chk.GRPC = r.String(chk.GRPC)
+		c.Check = &chk
+	}
+
+	return &c
+}
@@ -0,0 +1,70 @@
+package redact
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+	"github.com/CiscoCloud/mesos-consul/registry"
+)
+
+func TestPair(t *testing.T) {
+	r, _ := New(DefaultPatterns...)
+	r.SetValues("labels", []string{"db-pass"})
+
+	for _, tt := range []struct {
+		key, value, want string
+	}{
+		{"api-token", "abc123", Mask},
+		{"DB_PASSWORD", "hunter2", Mask},
+		{"version", "1.2", "1.2"},
+		{"dsn", "postgres://app:db-pass@db:5432", "postgres://app:" + Mask + "@db:5432"},
+		{"url", "http://10.0.0.1/health?token=abc", "http://10.0.0.1/health?token=" + Mask},
+	} {
+		if got := r.Pair(tt.key, tt.value); got != tt.want {
+			t.Errorf("Pair(%q, %q) => %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	r, _ := New(DefaultPatterns...)
+	r.SetValues("labels", []string{"s3cr3t"})
+
+	s := &registry.Service{
+		ID:    "mesos-consul:web",
+		Name:  "web",
+		Token: "acl-token",
+		Tags:  []string{"http", "key=s3cr3t"},
+		Meta:  map[string]string{"secret": "plain", "framework": "marathon"},
+		Check: &registry.Check{HTTP: "http://10.0.0.1/health?token=abc", Interval: "10s"},
+	}
+	c := r.Service(s)
+
+	if c.Token != "" {
+		t.Error("kept the ACL token")
+	}
+	if c.Tags[0] != "http" || c.Tags[1] != "key="+Mask {
+		t.Errorf("tags => %v", c.Tags)
+	}
+	if c.Meta["secret"] != Mask || c.Meta["framework"] != "marathon" {
+		t.Errorf("meta => %v", c.Meta)
+	}
+	if c.Check.HTTP != "http://10.0.0.1/health?token="+Mask || c.Check.Interval != "10s" {
+		t.Errorf("check => %+v", c.Check)
+	}
+
+	if s.Token != "acl-token" || s.Tags[1] != "key=s3cr3t" || s.Meta["secret"] != "plain" || s.Check.HTTP != "http://10.0.0.1/health?token=abc" {
+		t.Errorf("changed the service: %+v", s)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	r, _ := New(DefaultPatterns...)
+	r.SetValues("labels", []string{"s3cr3t"})
+
+	rec := r.Record(audit.Record{Op: "register", ServiceID: "mesos-consul:s3cr3t", Service: "web", TaskID: "web.s3cr3t", Agent: "10.0.0.1"})
+	want := audit.Record{Op: "register", ServiceID: "mesos-consul:" + Mask, Service: "web", TaskID: "web." + Mask, Agent: "10.0.0.1"}
+	if rec != want {
+		t.Errorf("Record() => %+v, want %+v", rec, want)
+	}
+}
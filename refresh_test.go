@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/mesos"
+)
+
+func TestRunAdaptiveReload(t *testing.T) {
+	c := config.DefaultConfig()
+	c.Refresh = 20 * time.Millisecond
+	c.RefreshMin = 10 * time.Millisecond
+	c.RefreshMax = time.Second
+	c.RefreshJitter = 0
+
+	hup := make(chan os.Signal)
+	stop := make(chan os.Signal)
+	done := make(chan *adaptiveSchedule)
+
+	refreshes := 0
+	reloads := 0
+	go func() {
+		done <- runAdaptive(c, func() int { refreshes++; return 0 }, func() bool { reloads++; return false }, hup, stop)
+	}()
+
+	// SIGHUPs much more frequent than the refreshes
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		hup <- syscall.SIGHUP
+		time.Sleep(2 * time.Millisecond)
+	}
+	stop <- syscall.SIGTERM
+	s := <-done
+
+	if refreshes < 3 {
+		t.Errorf("%d refreshes in 300ms under a stream of SIGHUPs, want at least 3", refreshes)
+	}
+	if reloads == 0 {
+		t.Error("no reload")
+	}
+
+	// Only the refreshes fed the churn to the adaptive refresh
+	want := mesos.NewAdaptiveRefresh(c.Refresh, c.RefreshMin, c.RefreshMax, c.RefreshChurn)
+	for i := 0; i < refreshes; i++ {
+		want.Next(0)
+	}
+	if got := s.a.Interval(); got != want.Interval() {
+		t.Errorf("interval %v after %d refreshes and %d reloads, want %v", got, refreshes, reloads, want.Interval())
+	}
+}
@@ -0,0 +1,45 @@
+package registry
+
+import "sync"
+
+// ReasonCritical is the reason of the deregistration of a service whose
+// check stayed critical, which the registry decides on its own
+const ReasonCritical = "critical"
+
+// Operation is a registry operation which succeeded
+type Operation struct {
+	// Operation, register or deregister
+	Op      string
+	Service *Service
+
+	// Why the registry made the operation on its own, empty for those
+	// of the refreshes
+	Reason string
+}
+
+var (
+	appliedLock sync.Mutex
+	applied     func(*Operation)
+)
+
+// NotifyApplied makes the registries call f with each operation which
+// succeeds, nil to stop
+func NotifyApplied(f func(*Operation)) {
+	appliedLock.Lock()
+	defer appliedLock.Unlock()
+
+	applied = f
+}
+
+// Applied reports that the operation op on s succeeded. Registries call
+// it where they count the operation in metrics.Registrations or
+// metrics.Deregistrations.
+func Applied(op string, s *Service, reason string) {
+	appliedLock.Lock()
+	f := applied
+	appliedLock.Unlock()
+
+	if f != nil {
+		f(&Operation{Op: op, Service: s, Reason: reason})
+	}
+}
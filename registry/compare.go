@@ -0,0 +1,97 @@
+package registry
+
+import "sort"
+
+// SameService returns whether a and b register the same service: same
+// name, address, port, tags, meta, check, namespace, tagged addresses,
+// weights and sidecar. Tags are left out when b lets external tools
+// override them. The agent and token a service is registered through are
+// not part of the registration.
+func SameService(a, b *Service) bool {
+	return a.Name == b.Name &&
+		a.Port == b.Port &&
+		a.Address == b.Address &&
+		a.Namespace == b.Namespace &&
+		a.EnableTagOverride == b.EnableTagOverride &&
+		(b.EnableTagOverride || sameTags(a.Tags, b.Tags)) &&
+		sameMeta(a.Meta, b.Meta) &&
+		sameCheck(a.Check, b.Check) &&
+		sameTaggedAddresses(a.TaggedAddresses, b.TaggedAddresses) &&
+		sameWeights(a.Weights, b.Weights) &&
+		sameConnect(a.Connect, b.Connect)
+}
+
+// sameTags compares tags regardless of their order
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	at := append([]string{}, a...)
+	bt := append([]string{}, b...)
+	sort.Strings(at)
+	sort.Strings(bt)
+	for i := range at {
+		if at[i] != bt[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sameCheck compares two checks, a missing check being the same as one
+// which doesn't probe the service
+func sameCheck(a, b *Check) bool {
+	aDefined := a != nil && a.Defined()
+	bDefined := b != nil && b.Defined()
+	if !aDefined || !bDefined {
+		return aDefined == bDefined
+	}
+	return *a == *b
+}
+
+func sameTaggedAddresses(a, b map[string]TaggedAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sameWeights(a, b *Weights) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameConnect(a, b *Connect) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.SidecarPort != b.SidecarPort || len(a.Upstreams) != len(b.Upstreams) {
+		return false
+	}
+	for i := range a.Upstreams {
+		if a.Upstreams[i] != b.Upstreams[i] {
+			return false
+		}
+	}
+	return true
+}
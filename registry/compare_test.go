@@ -0,0 +1,56 @@
+package registry
+
+import "testing"
+
+func TestSameService(t *testing.T) {
+	base := func() *Service {
+		return &Service{
+			ID:      "mesos-consul:web",
+			Name:    "web",
+			Port:    31000,
+			Address: "10.0.0.1",
+			Tags:    []string{"a", "b"},
+			Meta:    map[string]string{"framework": "marathon"},
+			Check:   &Check{HTTP: "http://10.0.0.1:31000/health", Interval: "10s"},
+			Agent:   "10.0.0.1",
+		}
+	}
+
+	for i, tt := range []struct {
+		change func(s *Service)
+		same   bool
+	}{
+		{func(s *Service) {}, true},
+		{func(s *Service) { s.Tags = []string{"b", "a"} }, true},
+		{func(s *Service) { s.Agent = "10.0.0.2"; s.Token = "secret" }, true},
+		{func(s *Service) { s.Tags = []string{"a"} }, false},
+		{func(s *Service) { s.Tags = []string{"c"}; s.EnableTagOverride = true }, false},
+		{func(s *Service) { s.Meta["framework"] = "chronos" }, false},
+		{func(s *Service) { s.Meta = nil }, false},
+		{func(s *Service) { s.Check.Interval = "5s" }, false},
+		{func(s *Service) { s.Check = nil }, false},
+		{func(s *Service) { s.Weights = &Weights{Passing: 10, Warning: 1} }, false},
+		{func(s *Service) { s.TaggedAddresses = map[string]TaggedAddress{"wan": {"1.2.3.4", 80}} }, false},
+		{func(s *Service) { s.Connect = &Connect{Upstreams: []Upstream{{"db", 5432}}} }, false},
+		{func(s *Service) { s.Namespace = "team" }, false},
+	} {
+		b := base()
+		tt.change(b)
+		if got := SameService(base(), b); got != tt.same {
+			t.Errorf("test #%d: SameService() => %v, want %v", i, got, tt.same)
+		}
+	}
+
+	a, b := base(), base()
+	a.Check, b.Check = nil, DefaultCheck()
+	if !SameService(a, b) {
+		t.Error("SameService() => false for a missing and an empty check")
+	}
+
+	a, b = base(), base()
+	a.Tags, b.Tags = []string{"old"}, []string{"new"}
+	b.EnableTagOverride, a.EnableTagOverride = true, true
+	if !SameService(a, b) {
+		t.Error("SameService() => false for overridable tags")
+	}
+}
@@ -0,0 +1,45 @@
+package registry
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OperationError is a registry operation which failed
+type OperationError struct {
+	// Operation, register or deregister
+	Op  string
+	ID  string
+	Err error
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("Unable to %s %s: %s", e.Op, e.ID, e.Err)
+}
+
+var (
+	failuresLock sync.Mutex
+	failures     func(*OperationError)
+)
+
+// NotifyFailures makes the registries call f with each operation which
+// fails, nil to stop
+func NotifyFailures(f func(*OperationError)) {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+
+	failures = f
+}
+
+// Failed reports the failure of the operation op on the service id.
+// Registries call it where they count the failure in
+// metrics.RegistryErrors.
+func Failed(op string, id string, err error) {
+	failuresLock.Lock()
+	f := failures
+	failuresLock.Unlock()
+
+	if f != nil {
+		f(&OperationError{Op: op, ID: id, Err: err})
+	}
+}
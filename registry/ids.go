@@ -0,0 +1,49 @@
+package registry
+
+import "strings"
+
+// DefaultIDPrefix starts the IDs of the ID schemes
+const DefaultIDPrefix = "mesos-consul:"
+
+// Meta marking the services registered by mesos-consul whose ID does not
+// start with DefaultIDPrefix, such as the IDs of an --id-template
+const (
+	OwnerMetaKey   = "registered-by"
+	OwnerMetaValue = "mesos-consul"
+)
+
+// TaskIDMetaKey is the meta key of the ID of the task of a service
+const TaskIDMetaKey = "task-id"
+
+// Owned returns whether the service of the given ID and meta was
+// registered by mesos-consul: its ID starts with DefaultIDPrefix, or its
+// meta marks it. Services of other tools sharing the prefix of an
+// --id-template are not taken for ours.
+func Owned(id string, meta map[string]string) bool {
+	return strings.HasPrefix(id, DefaultIDPrefix) || meta[OwnerMetaKey] == OwnerMetaValue
+}
+
+// MarkOwned adds the owner meta to a service whose ID does not start with
+// DefaultIDPrefix, so that registries recognize it as registered by
+// mesos-consul. The meta of the service is copied, not changed.
+func MarkOwned(s *Service) {
+	if strings.HasPrefix(s.ID, DefaultIDPrefix) {
+		return
+	}
+
+	meta := make(map[string]string, len(s.Meta)+1)
+	for k, v := range s.Meta {
+		meta[k] = v
+	}
+	meta[OwnerMetaKey] = OwnerMetaValue
+	s.Meta = meta
+}
+
+// FrameworkLabel returns the framework metrics label of a service of the
+// given meta. Mesos hosts belong to no framework.
+func FrameworkLabel(meta map[string]string) string {
+	if fw := meta["framework"]; fw != "" {
+		return fw
+	}
+	return "none"
+}
@@ -0,0 +1,38 @@
+package registry
+
+import "testing"
+
+func TestOwned(t *testing.T) {
+	for i, tt := range []struct {
+		id   string
+		meta map[string]string
+		want bool
+	}{
+		{"mesos-consul:10.0.0.1:web:31000", nil, true},
+		{"svc:mesos:10.0.0.1:web.1:31000", nil, false},
+		{"svc:mesos:10.0.0.1:web.1:31000", map[string]string{OwnerMetaKey: OwnerMetaValue}, true},
+		{"svc:mesos:10.0.0.1:web.1:31000", map[string]string{OwnerMetaKey: "registrator"}, false},
+	} {
+		if got := Owned(tt.id, tt.meta); got != tt.want {
+			t.Errorf("test #%d: Owned(%s, %v) => %v, want %v", i, tt.id, tt.meta, got, tt.want)
+		}
+	}
+}
+
+func TestMarkOwned(t *testing.T) {
+	meta := map[string]string{"framework": "marathon"}
+	s := &Service{ID: "svc:mesos:10.0.0.1:web.1:31000", Meta: meta}
+	MarkOwned(s)
+	if !Owned(s.ID, s.Meta) || s.Meta["framework"] != "marathon" {
+		t.Errorf("MarkOwned() => %v", s.Meta)
+	}
+	if _, ok := meta[OwnerMetaKey]; ok {
+		t.Error("MarkOwned() changed the meta of the task")
+	}
+
+	s = &Service{ID: "mesos-consul:10.0.0.1:web:31000"}
+	MarkOwned(s)
+	if s.Meta != nil {
+		t.Errorf("MarkOwned() => %v for a mesos-consul: ID", s.Meta)
+	}
+}
@@ -0,0 +1,253 @@
+package registry
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// multi registers services in several registries, each with its own
+// cache, error handling and deregistration sweep. The first registry is
+// the primary one, answering the lookups of the optional interfaces
+// meant for a single registry.
+type multi struct {
+	registries []Registry
+	names      []string
+
+	// Registries whose cache is to be loaded, again after a failure
+	load []bool
+}
+
+// NewMulti returns a registry registering in all the given registries,
+// named by names in logs, or the registry itself when there is one.
+func NewMulti(names []string, registries []Registry) Registry {
+	if len(registries) == 1 {
+		return registries[0]
+	}
+
+	return &multi{
+		registries: registries,
+		names:      names,
+		load:       make([]bool, len(registries)),
+	}
+}
+
+func (m *multi) CacheCreate() bool {
+	load := false
+	for i, r := range m.registries {
+		if r.CacheCreate() {
+			m.load[i] = true
+		}
+		load = load || m.load[i]
+	}
+	return load
+}
+
+// CacheLoad loads the caches to be loaded. A registry failing to load
+// its cache does not keep the others from loading theirs, and loads it
+// again on the next refresh.
+func (m *multi) CacheLoad(host string) error {
+	var err error
+	for i, r := range m.registries {
+		if !m.load[i] {
+			continue
+		}
+
+		if e := r.CacheLoad(host); e != nil {
+			log.Warnf("Unable to load the cache of registry %s: %s", m.names[i], e)
+			if err == nil {
+				err = fmt.Errorf("registry %s: %s", m.names[i], e)
+			}
+			continue
+		}
+		m.load[i] = false
+	}
+	return err
+}
+
+// CacheLookup returns the service cached by the primary registry, as
+// long as every registry has it cached. Otherwise the service is
+// registered again, in the registries missing it.
+func (m *multi) CacheLookup(id string) *Service {
+	for _, r := range m.registries[1:] {
+		if r.CacheLookup(id) == nil {
+			return nil
+		}
+	}
+	return m.registries[0].CacheLookup(id)
+}
+
+// Cached returns the services cached by any registry, as cached by the
+// first one listing its cache
+func (m *multi) Cached() []*Service {
+	seen := make(map[string]bool)
+	services := []*Service{}
+	for _, r := range m.registries {
+		l, ok := r.(CacheLister)
+		if !ok {
+			continue
+		}
+		for _, s := range l.Cached() {
+			if !seen[s.ID] {
+				seen[s.ID] = true
+				services = append(services, s)
+			}
+		}
+	}
+	return services
+}
+
+func (m *multi) CacheDelete(id string) {
+	for _, r := range m.registries {
+		r.CacheDelete(id)
+	}
+}
+
+func (m *multi) CacheMark(id string) {
+	for _, r := range m.registries {
+		r.CacheMark(id)
+	}
+}
+
+func (m *multi) Register(s *Service) {
+	for _, r := range m.registries {
+		r.Register(s)
+	}
+}
+
+func (m *multi) Deregister() {
+	for _, r := range m.registries {
+		r.Deregister()
+	}
+}
+
+func (m *multi) SetRunningServices(names []string) {
+	for _, r := range m.registries {
+		if t, ok := r.(TaskTracker); ok {
+			t.SetRunningServices(names)
+		}
+	}
+}
+
+func (m *multi) MirrorTasks(host string, tasks []*Task) {
+	for _, r := range m.registries {
+		if t, ok := r.(TaskMirror); ok {
+			t.MirrorTasks(host, tasks)
+		}
+	}
+}
+
+func (m *multi) SyncNodes(host string, nodes []*Node) {
+	for _, r := range m.registries {
+		if n, ok := r.(NodeRegistrar); ok {
+			n.SyncNodes(host, nodes)
+		}
+	}
+}
+
+// RegistersNodes reports whether any registry registers nodes
+func (m *multi) RegistersNodes() bool {
+	for _, r := range m.registries {
+		if n, ok := r.(NodeRegistrar); ok && n.RegistersNodes() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multi) PruneNode(host string, address string) error {
+	var err error
+	for i, r := range m.registries {
+		if p, ok := r.(NodePruner); ok {
+			if e := p.PruneNode(host, address); e != nil && err == nil {
+				err = fmt.Errorf("registry %s: %s", m.names[i], e)
+			}
+		}
+	}
+	return err
+}
+
+func (m *multi) EnableMaintenance(s *Service, reason string) error {
+	var err error
+	for i, r := range m.registries {
+		if mt, ok := r.(Maintainer); ok {
+			if e := mt.EnableMaintenance(s, reason); e != nil && err == nil {
+				err = fmt.Errorf("registry %s: %s", m.names[i], e)
+			}
+		}
+	}
+	return err
+}
+
+func (m *multi) DisableMaintenance(s *Service) error {
+	var err error
+	for i, r := range m.registries {
+		if mt, ok := r.(Maintainer); ok {
+			if e := mt.DisableMaintenance(s); e != nil && err == nil {
+				err = fmt.Errorf("registry %s: %s", m.names[i], e)
+			}
+		}
+	}
+	return err
+}
+
+// Maintained returns the services in maintenance mode in any registry
+func (m *multi) Maintained() ([]*Service, error) {
+	var err error
+	seen := make(map[string]bool)
+	services := []*Service{}
+	for i, r := range m.registries {
+		mt, ok := r.(Maintainer)
+		if !ok {
+			continue
+		}
+		found, e := mt.Maintained()
+		if e != nil && err == nil {
+			err = fmt.Errorf("registry %s: %s", m.names[i], e)
+		}
+		for _, s := range found {
+			if !seen[s.ID] {
+				seen[s.ID] = true
+				services = append(services, s)
+			}
+		}
+	}
+	return services, err
+}
+
+// Leading reports whether the first electing registry leads, or true
+// when none elects
+func (m *multi) Leading(host string) bool {
+	for _, r := range m.registries {
+		if e, ok := r.(Elector); ok {
+			return e.Leading(host)
+		}
+	}
+	return true
+}
+
+// KVGet reads the key from the first registry with a key/value store, or
+// reports it missing when none has one
+func (m *multi) KVGet(host string, key string) (string, bool, error) {
+	for _, r := range m.registries {
+		if kv, ok := r.(KVReader); ok {
+			return kv.KVGet(host, key)
+		}
+	}
+	return "", false, nil
+}
+
+// KVWatched watches the prefix in the first registry with a key/value
+// store. It fails when that store can't be watched
+func (m *multi) KVWatched(host string, prefix string) (map[string]string, error) {
+	for _, r := range m.registries {
+		if _, ok := r.(KVReader); !ok {
+			continue
+		}
+		if w, ok := r.(KVWatcher); ok {
+			return w.KVWatched(host, prefix)
+		}
+		return nil, fmt.Errorf("the key/value store can't be watched")
+	}
+	return nil, fmt.Errorf("no registry with a key/value store")
+}
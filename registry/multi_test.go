@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+)
+
+// fake is an in-memory registry whose cache load fails while loadErr
+// is set
+type fake struct {
+	services   map[string]*Service
+	registered []string
+	loadErr    error
+}
+
+func newFake() *fake {
+	return &fake{services: make(map[string]*Service)}
+}
+
+func (f *fake) CacheCreate() bool           { return false }
+func (f *fake) CacheLoad(host string) error { return f.loadErr }
+func (f *fake) CacheDelete(id string)       { delete(f.services, id) }
+func (f *fake) CacheMark(id string)         {}
+func (f *fake) Deregister()                 {}
+
+func (f *fake) CacheLookup(id string) *Service {
+	return f.services[id]
+}
+
+func (f *fake) Cached() []*Service {
+	services := []*Service{}
+	for _, s := range f.services {
+		services = append(services, s)
+	}
+	return services
+}
+
+func (f *fake) Register(s *Service) {
+	if _, ok := f.services[s.ID]; ok {
+		return
+	}
+	f.services[s.ID] = s
+	f.registered = append(f.registered, s.ID)
+}
+
+func TestMultiCacheLookup(t *testing.T) {
+	primary, secondary := newFake(), newFake()
+	m := NewMulti([]string{"primary", "secondary"}, []Registry{primary, secondary})
+
+	s := &Service{ID: "mesos-consul:web"}
+	primary.Register(s)
+
+	if got := m.CacheLookup(s.ID); got != nil {
+		t.Fatalf("CacheLookup() => %v while the secondary registry misses it", got)
+	}
+
+	m.Register(s)
+	if len(primary.registered) != 1 || len(secondary.registered) != 1 {
+		t.Errorf("Register() => %v and %v, want a registration in each", primary.registered, secondary.registered)
+	}
+	if got := m.CacheLookup(s.ID); got != s {
+		t.Errorf("CacheLookup() => %v, want %v", got, s)
+	}
+}
+
+func TestMultiCacheLoad(t *testing.T) {
+	primary, secondary := newFake(), newFake()
+	secondary.loadErr = errors.New("unreachable")
+	m := NewMulti([]string{"primary", "secondary"}, []Registry{primary, secondary}).(*multi)
+	m.load = []bool{true, true}
+
+	if err := m.CacheLoad(""); err == nil {
+		t.Error("CacheLoad() did not report the failure of the secondary registry")
+	}
+	if m.load[0] || !m.load[1] {
+		t.Errorf("load => %v, want [false true]", m.load)
+	}
+
+	if !m.CacheCreate() {
+		t.Error("CacheCreate() => false, want the secondary cache loaded again")
+	}
+
+	secondary.loadErr = nil
+	if err := m.CacheLoad(""); err != nil {
+		t.Errorf("CacheLoad() => %s", err)
+	}
+	if m.CacheCreate() {
+		t.Error("CacheCreate() => true once every cache is loaded")
+	}
+}
+
+func TestMultiCached(t *testing.T) {
+	primary, secondary := newFake(), newFake()
+	m := NewMulti([]string{"primary", "secondary"}, []Registry{primary, secondary}).(CacheLister)
+
+	primary.Register(&Service{ID: "mesos-consul:web", Name: "web"})
+	secondary.Register(&Service{ID: "mesos-consul:web", Name: "other"})
+	secondary.Register(&Service{ID: "mesos-consul:api", Name: "api"})
+
+	got := make(map[string]string)
+	for _, s := range m.Cached() {
+		if _, ok := got[s.ID]; ok {
+			t.Errorf("Cached() lists %s twice", s.ID)
+		}
+		got[s.ID] = s.Name
+	}
+	if len(got) != 2 || got["mesos-consul:web"] != "web" || got["mesos-consul:api"] != "api" {
+		t.Errorf("Cached() => %v, want web from the primary registry and api", got)
+	}
+}
@@ -4,7 +4,22 @@ type Check struct {
 	Script   string
 	TTL      string
 	HTTP     string
+	TCP      string
 	Interval string
+	Timeout  string
+
+	// Time after which Consul deregisters a service whose check is critical
+	DeregisterCriticalServiceAfter string
+
+	// gRPC check address, as host:port[/service]
+	GRPC          string
+	GRPCUseTLS    bool
+	TLSSkipVerify bool
+}
+
+// Defined returns whether the check probes the service in some way
+func (c *Check) Defined() bool {
+	return c.Script != "" || c.TTL != "" || c.HTTP != "" || c.TCP != "" || c.GRPC != ""
 }
 
 type Service struct {
@@ -13,8 +28,54 @@ type Service struct {
 	Port    int
 	Address string
 	Tags    []string
+	Meta    map[string]string
 	Check   *Check
 	Agent   string
+
+	// Consul Enterprise namespace, empty for the default one
+	Namespace string
+
+	// ACL token, or vault:<path> to one, the service is registered with.
+	// Empty for the registry token
+	Token string
+
+	// Let external tools change the tags of the service in Consul
+	EnableTagOverride bool
+
+	// Addresses of the service on other networks, such as "lan" and "wan"
+	TaggedAddresses map[string]TaggedAddress
+
+	// DNS SRV weights of the service when passing and warning, or nil
+	// for the registry default
+	Weights *Weights
+
+	// Connect sidecar proxy registered along the service, or nil
+	Connect *Connect
+}
+
+// Connect is the service mesh sidecar proxy of a service
+type Connect struct {
+	// Port of the sidecar proxy, 0 to let the registry pick one
+	SidecarPort int
+	Upstreams   []Upstream
+}
+
+// Upstream is a service the sidecar proxy exposes on a local port
+type Upstream struct {
+	Name          string
+	LocalBindPort int
+}
+
+// Weights are the DNS SRV weights of a service by health status
+type Weights struct {
+	Passing int
+	Warning int
+}
+
+// TaggedAddress is an address and port of a service on a given network
+type TaggedAddress struct {
+	Address string
+	Port    int
 }
 
 type Registry interface {
@@ -28,11 +89,99 @@ type Registry interface {
 	Deregister()
 }
 
+// CacheLister is implemented by registries which can list their cache.
+// Cached returns the services of the cache, those loaded from the
+// registry included.
+type CacheLister interface {
+	Cached() []*Service
+}
+
+// NodePruner is implemented by registries which can remove the node
+// entry of a decommissioned agent. The node at address is pruned through
+// the registry agent at host.
+type NodePruner interface {
+	PruneNode(host string, address string) error
+}
+
+// Maintainer is implemented by registries which can put a service in
+// maintenance mode. Maintained returns the services in maintenance mode,
+// including those put in it by an earlier mesos-consul process.
+type Maintainer interface {
+	EnableMaintenance(s *Service, reason string) error
+	DisableMaintenance(s *Service) error
+	Maintained() ([]*Service, error)
+}
+
+// TaskTracker is implemented by registries which are told the names of
+// the services the tasks running in Mesos may register during a refresh,
+// before Deregister.
+type TaskTracker interface {
+	SetRunningServices(names []string)
+}
+
+// TaskMirror is implemented by registries which keep a copy of the
+// metadata of the Mesos tasks. MirrorTasks is passed the tasks of a
+// refresh, and mirrors them through the registry agent at host.
+type TaskMirror interface {
+	MirrorTasks(host string, tasks []*Task)
+}
+
+// Elector is implemented by registries which elect a single active
+// mesos-consul instance among replicas. Leading reports whether this
+// instance is the active one, campaigning through the registry agent at
+// host.
+type Elector interface {
+	Leading(host string) bool
+}
+
+// NodeRegistrar is implemented by registries which can register the
+// Mesos agents as nodes. SyncNodes is passed the agents of a refresh, and
+// registers them through the registry agent at host. RegistersNodes
+// reports whether the registry is configured to register nodes.
+type NodeRegistrar interface {
+	SyncNodes(host string, nodes []*Node)
+	RegistersNodes() bool
+}
+
+// Node is a Mesos agent registered as a node
+type Node struct {
+	Address string
+	Meta    map[string]string
+}
+
+// KVReader is implemented by registries with a key/value store. KVGet
+// returns the value of key through the registry agent at host, and
+// whether the key exists.
+type KVReader interface {
+	KVGet(host string, key string) (string, bool, error)
+}
+
+// KVWatcher is implemented by registries whose key/value store can be
+// watched. KVWatched returns the keys under prefix, watched in the
+// background through the registry agent at host from the first call,
+// and the error of the last failed watch.
+type KVWatcher interface {
+	KVWatched(host string, prefix string) (map[string]string, error)
+}
+
+// Task is the metadata of a Mesos task
+type Task struct {
+	ID        string
+	Name      string
+	Framework string
+	SlaveID   string
+	AgentIP   string
+	State     string
+	Ports     []string
+	Labels    map[string]string
+}
+
 func DefaultCheck() *Check {
 	return &Check{
 		TTL:      "",
 		Script:   "",
 		HTTP:     "",
+		TCP:      "",
 		Interval: "",
 	}
 }
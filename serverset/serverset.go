@@ -0,0 +1,289 @@
+package serverset
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	"github.com/samuel/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeout of the ZooKeeper session holding the members
+const sessionTimeout = 10 * time.Second
+
+// conn is the part of the ZooKeeper connection used by the registry
+type conn interface {
+	SessionID() int64
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+}
+
+// Serverset registers services as Twitter serversets: each instance of
+// a service is an ephemeral sequential member_ znode under
+// <root>/<service name>, holding its endpoint. The members live as long
+// as the ZooKeeper session of mesos-consul.
+type Serverset struct {
+	conn  conn
+	root  string
+	cache map[string]*cacheEntry
+
+	// Service znodes known to exist
+	dirs map[string]bool
+
+	// Refreshes a service may be missing from before it is deregistered
+	heartbeats int
+}
+
+type cacheEntry struct {
+	service         *registry.Service
+	member          string
+	session         int64
+	shard           int
+	validityCounter int
+}
+
+// member is the content of a member znode, as read by Finagle and
+// Aurora clients
+type member struct {
+	ServiceEndpoint     endpoint            `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]endpoint `json:"additionalEndpoints"`
+	Status              string              `json:"status"`
+	Shard               int                 `json:"shard"`
+}
+
+type endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// New returns the serverset registry of a serverset://host:port,.../root
+// address, whose services are deregistered once missing from heartbeats
+// refreshes.
+func New(uri string, heartbeats int) registry.Registry {
+	servers, root := parseURI(uri)
+
+	conn, _, err := zk.Connect(servers, sessionTimeout)
+	if err != nil {
+		log.Fatal("Unable to connect to ZooKeeper: ", err)
+	}
+
+	return &Serverset{
+		conn: conn,
+		root: root,
+		dirs: make(map[string]bool),
+
+		heartbeats: heartbeats,
+	}
+}
+
+// parseURI returns the servers and root path of a
+// serverset://host:port,host:port/root address
+func parseURI(uri string) ([]string, string) {
+	hosts := strings.TrimPrefix(uri, "serverset://")
+	root := "/"
+	if i := strings.Index(hosts, "/"); i >= 0 {
+		root = path.Clean(hosts[i:])
+		hosts = hosts[:i]
+	}
+
+	servers := []string{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			servers = append(servers, h)
+		}
+	}
+
+	return servers, root
+}
+
+// CacheCreate creates the cache, and tells whether it needs to be
+// loaded
+func (s *Serverset) CacheCreate() bool {
+	if s.cache == nil {
+		s.cache = make(map[string]*cacheEntry)
+		return true
+	}
+
+	return false
+}
+
+// CacheLoad loads nothing: the members registered by a previous run
+// expire along with its session.
+func (s *Serverset) CacheLoad(host string) error {
+	return nil
+}
+
+// CacheLookup returns the cached service of the given ID, or nil
+func (s *Serverset) CacheLookup(id string) *registry.Service {
+	if c, ok := s.cache[id]; ok {
+		return c.service
+	}
+	return nil
+}
+
+// Cached returns the services of the cache
+func (s *Serverset) Cached() []*registry.Service {
+	services := make([]*registry.Service, 0, len(s.cache))
+	for id := range s.cache {
+		services = append(services, s.CacheLookup(id))
+	}
+	return services
+}
+
+// CacheDelete removes a service from the cache. Since a service is only
+// removed from the cache to be registered again, its member is deleted
+// as well.
+func (s *Serverset) CacheDelete(id string) {
+	c, ok := s.cache[id]
+	if !ok {
+		return
+	}
+
+	if err := s.delete(c); err != nil {
+		log.Warnf("Unable to delete the member of %s: %s", id, err)
+	}
+	delete(s.cache, id)
+}
+
+// CacheMark marks a service as seen during the refresh
+func (s *Serverset) CacheMark(id string) {
+	if c, ok := s.cache[id]; ok {
+		c.validityCounter = 0
+	}
+}
+
+// Register creates the member of a service, unless it is cached. The
+// members created in a session which expired, and which ZooKeeper
+// deleted along with it, are created again with the same shard.
+func (s *Serverset) Register(service *registry.Service) {
+	shard := -1
+	if c, ok := s.cache[service.ID]; ok {
+		if c.session == s.conn.SessionID() {
+			log.Debugf("Service found. Not registering: %s", service.ID)
+			s.CacheMark(service.ID)
+			return
+		}
+		shard = c.shard
+	}
+	if shard < 0 {
+		shard = s.freeShard(service.Name)
+	}
+
+	log.Info("Registering ", service.ID)
+
+	c, err := s.create(service, shard)
+	if err != nil {
+		log.Warnf("Unable to register %s: %s", service.ID, err)
+		metrics.RegistryErrors.Inc(registry.FrameworkLabel(service.Meta), metrics.HashLabel(service.Agent), "register")
+		registry.Failed("register", service.ID, err)
+		return
+	}
+	metrics.Registrations.Inc(registry.FrameworkLabel(service.Meta), metrics.HashLabel(service.Agent))
+	registry.Applied("register", service, "")
+
+	s.cache[service.ID] = c
+}
+
+// Deregister deletes the members of the services not seen during the
+// refresh.
+func (s *Serverset) Deregister() {
+	for id, c := range s.cache {
+		if c.validityCounter < s.heartbeats {
+			c.validityCounter++
+			continue
+		}
+
+		log.Infof("Deregistering %s", id)
+		if err := s.delete(c); err != nil {
+			log.Info("Deregistration error ", err)
+			metrics.RegistryErrors.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent), "deregister")
+			registry.Failed("deregister", id, err)
+			continue
+		}
+		metrics.Deregistrations.Inc(registry.FrameworkLabel(c.service.Meta), metrics.HashLabel(c.service.Agent))
+		registry.Applied("deregister", c.service, "")
+		delete(s.cache, id)
+	}
+}
+
+// freeShard returns the lowest shard no cached instance of the service
+// of the given name holds, so that the instances of a service are
+// numbered from 0 as Aurora numbers its instances
+func (s *Serverset) freeShard(name string) int {
+	used := make(map[int]bool)
+	for _, c := range s.cache {
+		if c.service.Name == name {
+			used[c.shard] = true
+		}
+	}
+
+	shard := 0
+	for used[shard] {
+		shard++
+	}
+	return shard
+}
+
+func (s *Serverset) create(service *registry.Service, shard int) (*cacheEntry, error) {
+	dir := path.Join(s.root, service.Name)
+	if err := s.mkdirs(dir); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(member{
+		ServiceEndpoint:     endpoint{Host: service.Address, Port: service.Port},
+		AdditionalEndpoints: map[string]endpoint{},
+		Status:              "ALIVE",
+		Shard:               shard,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session := s.conn.SessionID()
+	p, err := s.conn.Create(dir+"/member_", b, zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheEntry{service: service, member: p, session: session, shard: shard}, nil
+}
+
+// delete deletes the member of a service. Members of an expired session
+// are already gone.
+func (s *Serverset) delete(c *cacheEntry) error {
+	if c.session != s.conn.SessionID() {
+		return nil
+	}
+
+	err := s.conn.Delete(c.member, -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+// mkdirs creates the persistent znodes of a path
+func (s *Serverset) mkdirs(dir string) error {
+	if s.dirs[dir] {
+		return nil
+	}
+
+	p := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		p += "/" + part
+
+		_, err := s.conn.Create(p, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+
+	s.dirs[dir] = true
+	return nil
+}
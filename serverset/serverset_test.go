@@ -0,0 +1,151 @@
+package serverset
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// testConn is a ZooKeeper connection keeping the znodes created
+type testConn struct {
+	session int64
+	seq     int
+	nodes   map[string][]byte
+}
+
+func newTestServerset(heartbeats int) (*Serverset, *testConn) {
+	c := &testConn{session: 1, nodes: make(map[string][]byte)}
+	s := &Serverset{conn: c, root: "/aurora", dirs: make(map[string]bool), heartbeats: heartbeats}
+	s.CacheCreate()
+	return s, c
+}
+
+func (c *testConn) SessionID() int64 {
+	return c.session
+}
+
+func (c *testConn) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	if flags&zk.FlagSequence != 0 {
+		path = fmt.Sprintf("%s%010d", path, c.seq)
+		c.seq++
+	}
+	if _, ok := c.nodes[path]; ok {
+		return "", zk.ErrNodeExists
+	}
+	c.nodes[path] = data
+	return path, nil
+}
+
+func (c *testConn) Delete(path string, version int32) error {
+	if _, ok := c.nodes[path]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(c.nodes, path)
+	return nil
+}
+
+// expire drops the ephemeral members along with the session
+func (c *testConn) expire() {
+	for p := range c.nodes {
+		if strings.Contains(p, "/member_") {
+			delete(c.nodes, p)
+		}
+	}
+	c.session++
+}
+
+// shards returns the shards of the members of a service
+func (c *testConn) shards(t *testing.T, dir string) map[int]bool {
+	shards := make(map[int]bool)
+	for p, data := range c.nodes {
+		if !strings.HasPrefix(p, dir+"/member_") {
+			continue
+		}
+		m := member{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("member %s: %s", p, err)
+		}
+		shards[m.Shard] = true
+	}
+	return shards
+}
+
+func TestRegisterShards(t *testing.T) {
+	s, c := newTestServerset(1)
+	for i := 0; i < 3; i++ {
+		s.Register(&registry.Service{ID: fmt.Sprintf("mesos-consul:web:%d", i), Name: "web", Address: "10.0.0.1", Port: 31000 + i})
+	}
+	s.Register(&registry.Service{ID: "mesos-consul:api:0", Name: "api", Address: "10.0.0.1", Port: 32000})
+
+	if got, want := c.shards(t, "/aurora/web"), map[int]bool{0: true, 1: true, 2: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shards of web %v, want %v", got, want)
+	}
+	if got, want := c.shards(t, "/aurora/api"), map[int]bool{0: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shards of api %v, want %v", got, want)
+	}
+
+	// The shard of a deregistered instance goes to the next one
+	s.CacheDelete("mesos-consul:web:1")
+	s.Register(&registry.Service{ID: "mesos-consul:web:3", Name: "web", Address: "10.0.0.1", Port: 31003})
+	if shard := s.cache["mesos-consul:web:3"].shard; shard != 1 {
+		t.Errorf("new instance got shard %d, want the free shard 1", shard)
+	}
+}
+
+func TestRegisterExpiredSession(t *testing.T) {
+	s, c := newTestServerset(1)
+	s.Register(&registry.Service{ID: "mesos-consul:web:0", Name: "web", Address: "10.0.0.1", Port: 31000})
+	s.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 31001})
+
+	c.expire()
+	s.Register(&registry.Service{ID: "mesos-consul:web:1", Name: "web", Address: "10.0.0.1", Port: 31001})
+
+	if got, want := c.shards(t, "/aurora/web"), map[int]bool{1: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shards after the session expired %v, want the shard kept %v", got, want)
+	}
+	if e := s.cache["mesos-consul:web:1"]; e.session != c.session {
+		t.Errorf("member recorded in session %d, want %d", e.session, c.session)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	s, c := newTestServerset(2)
+	s.Register(&registry.Service{ID: "mesos-consul:web:0", Name: "web", Address: "10.0.0.1", Port: 31000})
+
+	for i := 0; i < 2; i++ {
+		s.Deregister()
+		if len(c.shards(t, "/aurora/web")) != 1 {
+			t.Fatalf("member deleted after %d refreshes without the service, want 3", i+1)
+		}
+	}
+
+	s.Deregister()
+	if len(c.shards(t, "/aurora/web")) != 0 {
+		t.Error("member kept after 3 refreshes without the service")
+	}
+	if len(s.cache) != 0 {
+		t.Errorf("%d services left cached, want none", len(s.cache))
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	for _, tt := range []struct {
+		uri     string
+		servers []string
+		root    string
+	}{
+		{"serverset://zk1:2181", []string{"zk1:2181"}, "/"},
+		{"serverset://zk1:2181,zk2:2181/aurora/", []string{"zk1:2181", "zk2:2181"}, "/aurora"},
+	} {
+		servers, root := parseURI(tt.uri)
+		if !reflect.DeepEqual(servers, tt.servers) || root != tt.root {
+			t.Errorf("parseURI(%s) => %v, %s, want %v, %s", tt.uri, servers, root, tt.servers, tt.root)
+		}
+	}
+}
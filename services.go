@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/mesos"
+	"github.com/CiscoCloud/mesos-consul/redact"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServicesHandler serves the services registered during the last refresh
+// and those of the registry cache as JSON
+func ServicesHandler(leader *mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(redactOwned(leader.Owned()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// redactOwned masks the secrets in the fields of the owned services
+func redactOwned(owned []mesos.OwnedService) []mesos.OwnedService {
+	for i, o := range owned {
+		for _, f := range []*string{&o.ID, &o.Name, &o.Task, &o.Framework, &o.Agent, &o.Address} {
+			*f = redact.Default.String(*f)
+		}
+		owned[i] = o
+	}
+	return owned
+}
+
+// services runs the services subcommand, printing the services a running
+// instance registered from its /services endpoint, and returns the exit
+// status
+func services(args []string) int {
+	c, err := parseFlags(args)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	url := fmt.Sprintf("http://%s:%s/services", c.HealthcheckIp, c.HealthcheckPort)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Errorf("Unable to reach mesos-consul, is it running with --healthcheck? %s", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("%s: %s", url, resp.Status)
+		return 1
+	}
+
+	var owned []mesos.OwnedService
+	if err := json.NewDecoder(resp.Body).Decode(&owned); err != nil {
+		log.Errorf("%s: %s", url, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTASK\tAGENT\tADDRESS\tSTATE\tREGISTERED\tLAST SEEN")
+	for _, o := range owned {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s:%d\t%s\t%s\t%s\n", o.ID, o.Name, o.Task, o.Agent, o.Address, o.Port, o.State,
+			timeString(o.Registered), timeString(o.LastSeen))
+	}
+	w.Flush()
+
+	return 0
+}
+
+// timeString returns t as RFC 3339, or - when it is zero
+func timeString(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/CiscoCloud/mesos-consul/mesos"
+	"github.com/CiscoCloud/mesos-consul/redact"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	flag "github.com/ogier/pflag"
+	log "github.com/sirupsen/logrus"
+)
+
+// simulate runs the simulate subcommand and returns the exit status
+func simulate(args []string) int {
+	var before, after string
+
+	c, err := parseFlags(args, func(flags *flag.FlagSet) {
+		flags.StringVar(&before, "before", "", "")
+		flags.StringVar(&after, "after", "", "")
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if before == "" || after == "" {
+		log.Error("simulate requires --before and --after")
+		return 1
+	}
+
+	b, err := loadSnapshot(before)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	a, err := loadSnapshot(after)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	for _, action := range mesos.Simulate(c, b, a) {
+		fmt.Println(redact.Default.String(action.String()))
+	}
+
+	return 0
+}
+
+// loadSnapshot reads a Mesos state.json snapshot
+func loadSnapshot(path string) (state.State, error) {
+	var sj state.State
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return sj, err
+	}
+
+	if err := json.Unmarshal(body, &sj); err != nil {
+		return sj, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return sj, nil
+}
@@ -0,0 +1,110 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// IPResolver resolves the candidate IP addresses of a Task from a single
+// source, such as its NetworkInfo or the agent it runs on.
+type IPResolver interface {
+	Resolve(t *Task) []string
+}
+
+// IPResolverFunc adapts an ordinary function to the IPResolver interface.
+type IPResolverFunc func(t *Task) []string
+
+// Resolve calls f(t).
+func (f IPResolverFunc) Resolve(t *Task) []string { return f(t) }
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]IPResolver{}
+)
+
+// RegisterIPResolver makes an IP resolver available under the given name
+// for use in the IP search order. It panics if the name is already taken.
+func RegisterIPResolver(name string, r IPResolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+
+	if r == nil {
+		panic("state: RegisterIPResolver resolver is nil")
+	}
+	if _, dup := resolvers[name]; dup {
+		panic(fmt.Sprintf("state: RegisterIPResolver called twice for resolver %q", name))
+	}
+	resolvers[name] = r
+}
+
+// IsValidSource reports whether src is the name of a registered IP resolver.
+func IsValidSource(src string) bool {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+
+	_, ok := resolvers[src]
+	return ok
+}
+
+// ipResolver returns the IP resolver registered under name.
+func ipResolver(name string) (IPResolver, bool) {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+
+	r, ok := resolvers[name]
+	return r, ok
+}
+
+// IPResolvers returns the names of all registered IP resolvers.
+func IPResolvers() []string {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+
+	names := make([]string, 0, len(resolvers))
+	for name := range resolvers {
+		names = append(names, name)
+	}
+	return names
+}
+
+func init() {
+	RegisterIPResolver("host", IPResolverFunc(hostIPs))
+	RegisterIPResolver(HostnameSource, IPResolverFunc(hostnames))
+	RegisterIPResolver("mesos", IPResolverFunc(mesosIPs))
+	RegisterIPResolver("docker", IPResolverFunc(dockerIPs))
+	RegisterIPResolver("netinfo", IPResolverFunc(networkInfoIPs))
+	RegisterIPResolver("netinfo4", IPResolverFunc(networkInfoFamilyIPs(FamilyIPv4)))
+	RegisterIPResolver("netinfo6", IPResolverFunc(networkInfoFamilyIPs(FamilyIPv6)))
+	RegisterIPResolver("label", IPResolverFunc(labelIPs))
+	RegisterIPResolver("cloud", IPResolverFunc(cloudIPs))
+}
+
+// AddressLabel is the name, under LabelPrefix, of the task label which
+// holds an explicit task address.
+const AddressLabel = "address"
+
+// labelIPs returns the IP address set in the task's consul.address label.
+func labelIPs(t *Task) []string {
+	if a := strings.TrimSpace(t.PrefixedLabel(AddressLabel)); a != "" {
+		return []string{a}
+	}
+	return nil
+}
+
+// CloudIPAttributes are the agent attributes, in order of preference, that
+// the cloud resolver reads the instance address from. Cloud provisioning
+// tooling commonly publishes them on each agent.
+var CloudIPAttributes = []string{"private_ip", "public_ip"}
+
+// cloudIPs returns the instance addresses published as attributes of the
+// agent a Task runs on.
+func cloudIPs(t *Task) []string {
+	ips := []string{}
+	for _, attr := range CloudIPAttributes {
+		if v, ok := t.SlaveAttributes[attr]; ok && v != "" {
+			ips = append(ips, v)
+		}
+	}
+	return ips
+}
@@ -2,11 +2,12 @@ package state
 
 import (
 	"bytes"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
 
-	"github.com/mesos/mesos-go/upid"
+	"github.com/mesos/mesos-go/api/v0/upid"
 )
 
 // Resources holds resources as defined in the /state.json Mesos HTTP endpoint.
@@ -62,6 +63,7 @@ type ContainerStatus struct {
 // NetworkInfo holds the network configuration for a single interface
 // as defined in the /state.json Mesos HTTP endpoint.
 type NetworkInfo struct {
+	Name        string      `json:"name,omitempty"`
 	IPAddresses []IPAddress `json:"ip_addresses,omitempty"`
 	// back-compat with 0.25 IPAddress format
 	IPAddress string `json:"ip_address,omitempty"`
@@ -71,6 +73,7 @@ type NetworkInfo struct {
 // as defined in the /state.json Mesos HTTP endpoint.
 type IPAddress struct {
 	IPAddress string `json:"ip_address,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
 }
 
 // Task holds a task as defined in the /state.json Mesos HTTP endpoint.
@@ -84,8 +87,92 @@ type Task struct {
 	Labels        []Label  `json:"labels"`
 	Resources     `json:"resources"`
 	DiscoveryInfo DiscoveryInfo `json:"discovery"`
+	Container     Container     `json:"container"`
+	Command       *CommandInfo  `json:"command,omitempty"`
+	HealthCheck   *HealthCheck  `json:"health_check,omitempty"`
+
+	SlaveIP         string            `json:"-"`
+	SlaveHostname   string            `json:"-"`
+	SlaveAttributes map[string]string `json:"-"`
+	FrameworkName   string            `json:"-"`
+
+	// Prefix of the task labels recognized by mesos-consul,
+	// DefaultLabelPrefix when empty
+	LabelPrefix string `json:"-"`
+}
+
+// IsDockerBridge returns whether the task is a Docker container using
+// bridge networking.
+func (t *Task) IsDockerBridge() bool {
+	return t.Container.Docker != nil && strings.ToUpper(t.Container.Docker.Network) == "BRIDGE"
+}
+
+// ContainerPort returns the container port a host port is mapped to, or 0
+// when the port is not mapped.
+func (t *Task) ContainerPort(hostPort int) int {
+	if t.Container.Docker == nil {
+		return 0
+	}
+	for _, pm := range t.Container.Docker.PortMappings {
+		if pm.HostPort == hostPort {
+			return pm.ContainerPort
+		}
+	}
+	return 0
+}
+
+// HostPort returns the host port a container port is mapped to, or 0
+// when the port is not mapped.
+func (t *Task) HostPort(containerPort int) int {
+	if t.Container.Docker == nil {
+		return 0
+	}
+	for _, pm := range t.Container.Docker.PortMappings {
+		if pm.ContainerPort == containerPort {
+			return pm.HostPort
+		}
+	}
+	return 0
+}
 
-	SlaveIP string `json:"-"`
+// PortProtocol returns the protocol of the Docker port mapping of a host
+// port, or "" when the port is not mapped.
+func (t *Task) PortProtocol(hostPort int) string {
+	if t.Container.Docker == nil {
+		return ""
+	}
+	for _, pm := range t.Container.Docker.PortMappings {
+		if pm.HostPort == hostPort {
+			return pm.Protocol
+		}
+	}
+	return ""
+}
+
+// Env returns the value of a variable of the task's command environment,
+// or "" when the task has no such variable.
+func (t *Task) Env(name string) string {
+	if t.Command == nil {
+		return ""
+	}
+	for _, v := range t.Command.Environment.Variables {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// LastStatus returns the most recent status of the task, or nil if the
+// task has no status.
+func (t *Task) LastStatus() *Status {
+	var last *Status
+	for i := range t.Statuses {
+		if last == nil || t.Statuses[i].Timestamp > last.Timestamp {
+			last = &t.Statuses[i]
+		}
+	}
+	return last
 }
 
 // HasDiscoveryInfo return whether the DiscoveryInfo was provided in the state.json
@@ -101,6 +188,36 @@ func (t *Task) IP(srcs ...string) string {
 	return ""
 }
 
+// IPByFamily returns the first Task IP of the given address family found in
+// the given sources. An empty family matches any address.
+func (t *Task) IPByFamily(family string, srcs ...string) string {
+	ip, _ := t.ResolveIP(family, srcs...)
+	return ip
+}
+
+// ResolveIP returns the first Task IP of the given address family found in
+// the given sources, along with the name of the source it came from. The
+// hostname source yields the agent hostname, unless a family is given.
+func (t *Task) ResolveIP(family string, srcs ...string) (string, string) {
+	if t == nil {
+		return "", ""
+	}
+	for i := range srcs {
+		if srcs[i] == HostnameSource {
+			if family == "" && t.SlaveHostname != "" {
+				return t.SlaveHostname, HostnameSource
+			}
+			continue
+		}
+		for _, ip := range t.IPs(srcs[i]) {
+			if MatchesFamily(ip, family) {
+				return ip.String(), srcs[i]
+			}
+		}
+	}
+	return "", ""
+}
+
 // IPs returns a slice of IPs sourced from the given sources with ascending
 // priority.
 func (t *Task) IPs(srcs ...string) (ips []net.IP) {
@@ -108,9 +225,9 @@ func (t *Task) IPs(srcs ...string) (ips []net.IP) {
 		return nil
 	}
 	for i := range srcs {
-		if src, ok := sources[srcs[i]]; ok {
-			for _, srcIP := range src(t) {
-				if ip := net.ParseIP(srcIP); len(ip) > 0 {
+		if r, ok := ipResolver(srcs[i]); ok {
+			for _, srcIP := range r.Resolve(t) {
+				if ip := ParseIP(srcIP); len(ip) > 0 {
 					ips = append(ips, ip)
 				}
 			}
@@ -119,6 +236,32 @@ func (t *Task) IPs(srcs ...string) (ips []net.IP) {
 	return ips
 }
 
+// Address families accepted by IPByFamily.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// ParseIP parses an IPv4 or IPv6 address, stripping the square brackets
+// IPv6 literals are often wrapped in.
+func ParseIP(s string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "["), "]"))
+}
+
+// MatchesFamily reports whether ip belongs to the given address family.
+// An empty family matches any address.
+func MatchesFamily(ip net.IP, family string) bool {
+	switch strings.ToLower(family) {
+	case "":
+		return true
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	}
+	return false
+}
+
 // Label returns the label.Value of the key matching the passed in string
 func (t *Task) Label(name string) string {
 	for _, l := range t.Labels {
@@ -130,18 +273,37 @@ func (t *Task) Label(name string) string {
 	return ""
 }
 
-// sources maps the string representation of IP sources to their functions.
-var sources = map[string]func(*Task) []string{
-	"host":    hostIPs,
-	"mesos":   mesosIPs,
-	"docker":  dockerIPs,
-	"netinfo": networkInfoIPs,
+// DefaultLabelPrefix is the prefix of the task labels recognized by
+// mesos-consul, such as consul.address, of the tasks without LabelPrefix.
+const DefaultLabelPrefix = "consul."
+
+// PrefixedKey returns the key of the task label name under the label prefix
+// of the task.
+func (t *Task) PrefixedKey(name string) string {
+	if t.LabelPrefix == "" {
+		return DefaultLabelPrefix + name
+	}
+	return t.LabelPrefix + name
+}
+
+// PrefixedLabel returns the value of the task label name under the label
+// prefix of the task.
+func (t *Task) PrefixedLabel(name string) string {
+	return t.Label(t.PrefixedKey(name))
 }
 
 // hostIPs is an IPSource which returns the IP addresses of the slave a Task
 // runs on.
 func hostIPs(t *Task) []string { return []string{t.SlaveIP} }
 
+// HostnameSource is the name of the source registering the hostname of the
+// slave a Task runs on instead of an IP address.
+const HostnameSource = "hostname"
+
+// hostnames returns the hostname of the slave a Task runs on. Being no IP
+// address, it is only used by ResolveIP.
+func hostnames(t *Task) []string { return []string{t.SlaveHostname} }
+
 // networkInfoIPs returns IP addresses from a given Task's
 // []Status.ContainerStatus.[]NetworkInfos.IPAddress
 func networkInfoIPs(t *Task) []string {
@@ -164,6 +326,61 @@ func networkInfoIPs(t *Task) []string {
 	})
 }
 
+// NetworkIPs returns the addresses the task has on the named network,
+// as reported in the NetworkInfo of its latest running status.
+func (t *Task) NetworkIPs(name string) []string {
+	return statusIPs(t.Statuses, func(s *Status) []string {
+		ips := []string{}
+		for _, netinfo := range s.ContainerStatus.NetworkInfos {
+			if netinfo.Name != name {
+				continue
+			}
+			for _, ipAddress := range netinfo.IPAddresses {
+				ips = append(ips, ipAddress.IPAddress)
+			}
+			if len(netinfo.IPAddresses) == 0 && netinfo.IPAddress != "" {
+				ips = append(ips, netinfo.IPAddress)
+			}
+		}
+		return ips
+	})
+}
+
+// networkInfoFamilyIPs returns an IPSource which only yields the NetworkInfo
+// addresses of the given family. The address protocol reported by Mesos is
+// used when present, otherwise the family is derived from the address itself.
+func networkInfoFamilyIPs(family string) func(*Task) []string {
+	return func(t *Task) []string {
+		return statusIPs(t.Statuses, func(s *Status) []string {
+			ips := []string{}
+			for _, netinfo := range s.ContainerStatus.NetworkInfos {
+				for _, ipAddress := range netinfo.IPAddresses {
+					switch strings.ToUpper(ipAddress.Protocol) {
+					case "IPV4":
+						if family == FamilyIPv4 {
+							ips = append(ips, ipAddress.IPAddress)
+						}
+					case "IPV6":
+						if family == FamilyIPv6 {
+							ips = append(ips, ipAddress.IPAddress)
+						}
+					default:
+						if ip := ParseIP(ipAddress.IPAddress); ip != nil && MatchesFamily(ip, family) {
+							ips = append(ips, ipAddress.IPAddress)
+						}
+					}
+				}
+				if len(netinfo.IPAddresses) == 0 && netinfo.IPAddress != "" {
+					if ip := ParseIP(netinfo.IPAddress); ip != nil && MatchesFamily(ip, family) {
+						ips = append(ips, netinfo.IPAddress)
+					}
+				}
+			}
+			return ips
+		})
+	}
+}
+
 const (
 	// DockerIPLabel is the key of the Label which holds the Docker containerizer IP value.
 	DockerIPLabel = "Docker.NetworkSettings.IPAddress"
@@ -218,10 +435,11 @@ func labels(key string) func(*Status) []string {
 
 // Framework holds a framework as defined in the /state.json Mesos HTTP endpoint.
 type Framework struct {
-	Tasks    []Task `json:"tasks"`
-	PID      PID    `json:"pid"`
-	Name     string `json:"name"`
-	Hostname string `json:"hostname"`
+	Tasks          []Task `json:"tasks"`
+	CompletedTasks []Task `json:"completed_tasks"`
+	PID            PID    `json:"pid"`
+	Name           string `json:"name"`
+	Hostname       string `json:"hostname"`
 }
 
 // HostPort returns the hostname and port where a framework's scheduler is
@@ -235,9 +453,32 @@ func (f Framework) HostPort() (string, string) {
 
 // Slave holds a slave as defined in the /state.json Mesos HTTP endpoint.
 type Slave struct {
-	ID       string `json:"id"`
-	Hostname string `json:"hostname"`
-	PID      PID    `json:"pid"`
+	ID         string                 `json:"id"`
+	Hostname   string                 `json:"hostname"`
+	Version    string                 `json:"version,omitempty"`
+	PID        PID                    `json:"pid"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	DrainInfo  *DrainInfo             `json:"drain_info,omitempty"`
+}
+
+// DrainInfo holds the draining state of a slave, reported by Mesos 1.9+.
+type DrainInfo struct {
+	State string `json:"state"`
+}
+
+// Draining returns whether the slave is being drained or has been drained.
+func (s Slave) Draining() bool {
+	return s.DrainInfo != nil && (s.DrainInfo.State == "DRAINING" || s.DrainInfo.State == "DRAINED")
+}
+
+// AttributeMap returns the slave attributes with their values formatted
+// as strings. Scalar attributes are reported as numbers by Mesos.
+func (s Slave) AttributeMap() map[string]string {
+	attrs := make(map[string]string, len(s.Attributes))
+	for k, v := range s.Attributes {
+		attrs[k] = fmt.Sprint(v)
+	}
+	return attrs
 }
 
 // PID holds a Mesos PID and implements the json.Unmarshaler interface.
@@ -256,6 +497,15 @@ type State struct {
 	Leader     string      `json:"leader"`
 }
 
+// SetLabelPrefix sets the label prefix of all the tasks of the state.
+func (s *State) SetLabelPrefix(prefix string) {
+	for i := range s.Frameworks {
+		for j := range s.Frameworks[i].Tasks {
+			s.Frameworks[i].Tasks[j].LabelPrefix = prefix
+		}
+	}
+}
+
 // DiscoveryInfo holds the discovery meta data for a task defined in the /state.json Mesos HTTP endpoint.
 type DiscoveryInfo struct {
 	Visibilty   string `json:"visibility"`
@@ -273,7 +523,78 @@ type DiscoveryInfo struct {
 
 // DiscoveryPort holds a port for a task defined in the /state.json Mesos HTTP endpoint.
 type DiscoveryPort struct {
-	Protocol string `json:"protocol"`
-	Number   int    `json:"number"`
-	Name     string `json:"name"`
+	Protocol   string `json:"protocol"`
+	Number     int    `json:"number"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility,omitempty"`
+}
+
+// Container holds the container configuration of a task as defined in the
+// /state.json Mesos HTTP endpoint.
+type Container struct {
+	Type   string      `json:"type"`
+	Docker *DockerInfo `json:"docker,omitempty"`
+}
+
+// CommandInfo holds the command of a task as defined in the /state.json
+// Mesos HTTP endpoint. It is only reported for some executors.
+type CommandInfo struct {
+	Value       string `json:"value,omitempty"`
+	Environment struct {
+		Variables []Variable `json:"variables"`
+	} `json:"environment"`
+}
+
+// Variable holds an environment variable of a task command.
+type Variable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// DockerInfo holds the Docker configuration of a container as defined in
+// the /state.json Mesos HTTP endpoint.
+type DockerInfo struct {
+	Image        string        `json:"image"`
+	Network      string        `json:"network"`
+	PortMappings []PortMapping `json:"port_mappings,omitempty"`
+}
+
+// PortMapping holds a Docker host to container port mapping as defined in
+// the /state.json Mesos HTTP endpoint.
+type PortMapping struct {
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// HealthCheck holds the health check of a task as defined in the
+// /state.json Mesos HTTP endpoint.
+type HealthCheck struct {
+	Type            string           `json:"type,omitempty"`
+	HTTP            *HTTPHealthCheck `json:"http,omitempty"`
+	IntervalSeconds float64          `json:"interval_seconds,omitempty"`
+	TimeoutSeconds  float64          `json:"timeout_seconds,omitempty"`
+}
+
+// HTTPHealthCheck holds the HTTP part of a task health check as defined
+// in the /state.json Mesos HTTP endpoint. Port is in the network
+// namespace of the task.
+type HTTPHealthCheck struct {
+	Scheme string `json:"scheme,omitempty"`
+	Port   int    `json:"port"`
+	Path   string `json:"path,omitempty"`
+}
+
+// HTTPHealthCheck returns the HTTP health check of the task, or nil when
+// the task has no health check or a health check of another type.
+func (t *Task) HTTPHealthCheck() *HTTPHealthCheck {
+	hc := t.HealthCheck
+	if hc == nil || hc.HTTP == nil || hc.HTTP.Port == 0 {
+		return nil
+	}
+	// Mesos before 1.0 reports no type
+	if hc.Type != "" && strings.ToUpper(hc.Type) != "HTTP" {
+		return nil
+	}
+	return hc.HTTP
 }
@@ -2,11 +2,12 @@ package state_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"reflect"
 	"testing"
 
-	"github.com/mesos/mesos-go/upid"
+	"github.com/mesos/mesos-go/api/v0/upid"
 	. "github.com/CiscoCloud/mesos-consul/state"
 )
 
@@ -103,6 +104,21 @@ func TestTask_IPs(t *testing.T) {
 			srcs: []string{"docker"},
 			want: ips("1.2.3.4", "2.3.4.5"),
 		},
+		{ // IPv6 addresses with and without brackets
+			Task: task(statuses(status(state("TASK_RUNNING"), netinfo("[2001:db8::1]", "2001:db8::2")))),
+			srcs: []string{"netinfo"},
+			want: ips("2001:db8::1", "2001:db8::2"),
+		},
+		{ // family specific netinfo sources
+			Task: task(statuses(status(state("TASK_RUNNING"), netinfo("1.2.3.4", "2001:db8::1")))),
+			srcs: []string{"netinfo6", "netinfo4"},
+			want: ips("2001:db8::1", "1.2.3.4"),
+		},
+		{ // netinfo protocol field takes precedence
+			Task: task(statuses(status(state("TASK_RUNNING"), netinfoProto("IPv6", "2001:db8::1"), netinfoProto("IPv4", "1.2.3.4")))),
+			srcs: []string{"netinfo4"},
+			want: ips("1.2.3.4"),
+		},
 	} {
 		if got := tt.IPs(tt.srcs...); !reflect.DeepEqual(got, tt.want) {
 			t.Logf("%+v", tt.Task)
@@ -111,6 +127,89 @@ func TestTask_IPs(t *testing.T) {
 	}
 }
 
+func TestTask_IPByFamily(t *testing.T) {
+	tk := task(
+		slaveIP("10.0.0.1"),
+		statuses(status(state("TASK_RUNNING"), netinfo("2001:db8::1", "1.2.3.4"))),
+	)
+	for i, tt := range []struct {
+		family string
+		srcs   []string
+		want   string
+	}{
+		{"", []string{"netinfo", "host"}, "2001:db8::1"},
+		{"ipv4", []string{"netinfo", "host"}, "1.2.3.4"},
+		{"IPv6", []string{"host", "netinfo"}, "2001:db8::1"},
+		{"ipv6", []string{"host"}, ""},
+		{"bogus", []string{"netinfo"}, ""},
+	} {
+		if got := tk.IPByFamily(tt.family, tt.srcs...); got != tt.want {
+			t.Errorf("test #%d: got %q, want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestTask_ResolveIP(t *testing.T) {
+	tk := task(
+		slaveIP("10.0.0.1"),
+		statuses(status(state("TASK_RUNNING"), labels(DockerIPLabel, "172.17.0.2"))),
+	)
+	tk.Labels = []Label{{Key: DefaultLabelPrefix + AddressLabel, Value: "10.1.2.3"}}
+	tk.SlaveAttributes = map[string]string{"public_ip": "52.1.2.3", "rack": "a"}
+	tk.SlaveHostname = "agent1.example.com"
+
+	for i, tt := range []struct {
+		srcs     []string
+		ip       string
+		resolver string
+	}{
+		{[]string{"netinfo", "docker", "host"}, "172.17.0.2", "docker"},
+		{[]string{"netinfo", "host"}, "10.0.0.1", "host"},
+		{[]string{"cloud", "host"}, "52.1.2.3", "cloud"},
+		{[]string{"label", "cloud"}, "10.1.2.3", "label"},
+		{[]string{"hostname", "host"}, "agent1.example.com", "hostname"},
+		{[]string{"netinfo"}, "", ""},
+	} {
+		ip, resolver := tk.ResolveIP("", tt.srcs...)
+		if ip != tt.ip || resolver != tt.resolver {
+			t.Errorf("test #%d: got (%q, %q), want (%q, %q)", i, ip, resolver, tt.ip, tt.resolver)
+		}
+	}
+}
+
+func TestRegisterIPResolver(t *testing.T) {
+	RegisterIPResolver("test-static", IPResolverFunc(func(*Task) []string {
+		return []string{"192.0.2.1"}
+	}))
+	if !IsValidSource("test-static") {
+		t.Fatal("registered resolver is not a valid source")
+	}
+	if got := task().IP("test-static"); got != "192.0.2.1" {
+		t.Errorf("got %q, want %q", got, "192.0.2.1")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate resolver did not panic")
+		}
+	}()
+	RegisterIPResolver("host", IPResolverFunc(func(*Task) []string { return nil }))
+}
+
+func TestRegisterIPResolverConcurrent(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			RegisterIPResolver(fmt.Sprintf("test-concurrent-%d", i), IPResolverFunc(func(*Task) []string { return nil }))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		task(slaveIP("1.2.3.4")).IPs("host", "test-concurrent-0")
+	}
+	<-done
+}
+
 // test helpers
 
 type (
@@ -176,6 +275,41 @@ func netinfo(ips ...string) statusOpt {
 	}
 }
 
+func netinfoProto(protocol, ip string) statusOpt {
+	return func(s *Status) {
+		s.ContainerStatus.NetworkInfos = append(s.ContainerStatus.NetworkInfos, NetworkInfo{
+			IPAddresses: []IPAddress{{IPAddress: ip, Protocol: protocol}},
+		})
+	}
+}
+
 func timestamp(t float64) statusOpt {
 	return func(s *Status) { s.Timestamp = t }
 }
+
+func TestPrefixedLabel(t *testing.T) {
+	tk := &Task{Labels: []Label{
+		{Key: "consul.address", Value: "10.1.2.3"},
+		{Key: "discovery.address", Value: "10.4.5.6"},
+	}}
+
+	if got := tk.PrefixedLabel(AddressLabel); got != "10.1.2.3" {
+		t.Errorf("PrefixedLabel(%s) => %s, want 10.1.2.3", AddressLabel, got)
+	}
+
+	sj := State{Frameworks: []Framework{{Tasks: []Task{*tk}}}}
+	sj.SetLabelPrefix("discovery.")
+	tk = &sj.Frameworks[0].Tasks[0]
+	if got := tk.PrefixedLabel(AddressLabel); got != "10.4.5.6" {
+		t.Errorf("PrefixedLabel(%s) with prefix discovery. => %s, want 10.4.5.6", AddressLabel, got)
+	}
+}
+
+func TestTask_ResolveIPHostnameFamily(t *testing.T) {
+	tk := task(slaveIP("10.0.0.1"))
+	tk.SlaveHostname = "agent1.example.com"
+
+	if ip, resolver := tk.ResolveIP(FamilyIPv4, HostnameSource, "host"); ip != "10.0.0.1" || resolver != "host" {
+		t.Errorf("got (%q, %q), want (10.0.0.1, host)", ip, resolver)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/mesos"
+	"github.com/CiscoCloud/mesos-consul/redact"
+
+	flag "github.com/ogier/pflag"
+)
+
+// validate runs the validate subcommand and returns the exit status
+func validate(args []string) int {
+	var offline bool
+	var timeout time.Duration
+
+	c, err := parseFlags(args, func(flags *flag.FlagSet) {
+		flags.BoolVar(&offline, "offline", false, "")
+		flags.DurationVar(&timeout, "timeout", 10*time.Second, "")
+	})
+	if err != nil {
+		fmt.Println(redact.Default.String(err.Error()))
+		return 1
+	}
+
+	errs := mesos.Validate(c)
+	if !offline {
+		errs = append(errs, mesos.CheckConnectivity(c, timeout)...)
+	}
+
+	for _, err := range errs {
+		fmt.Println(redact.Default.String(err.Error()))
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(errs))
+		return 1
+	}
+
+	fmt.Println("Configuration OK")
+	return 0
+}
@@ -0,0 +1,237 @@
+// Package webhook posts the services registered and deregistered by
+// mesos-consul to HTTP endpoints, one batch of records per refresh.
+// Batches are queued and sent in the background by a worker per endpoint,
+// retried with an exponential backoff, so a slow endpoint doesn't delay
+// the refreshes nor the other endpoints.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+	"github.com/CiscoCloud/mesos-consul/metrics"
+	"github.com/CiscoCloud/mesos-consul/redact"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// queueSize is the number of batches waiting to be sent to an endpoint,
+// beyond which new ones are dropped
+const queueSize = 100
+
+// maxRetryAfter bounds the wait asked by the Retry-After header of a 429
+// response
+const maxRetryAfter = 5 * time.Minute
+
+// retryDelay is the delay before the first retry, doubled on each one
+var retryDelay = time.Second
+
+// Notifier posts audit records to webhooks
+type Notifier struct {
+	tmpl    *template.Template
+	retries int
+	client  *http.Client
+	workers []*worker
+
+	// Records of the current refresh
+	mu    sync.Mutex
+	batch []audit.Record
+
+	// Done once the queues are drained after Close
+	wg sync.WaitGroup
+}
+
+// worker sends the batches queued for an endpoint
+type worker struct {
+	url   string
+	queue chan []audit.Record
+}
+
+// ParseTemplate parses a webhook body template, rendered with the list
+// of the records of a refresh, and checks it renders a record. Records
+// are rendered as a JSON list without a template.
+func ParseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.Execute(ioutil.Discard, []audit.Record{{Op: audit.OpRegister}}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// New returns a notifier posting to urls the bodies rendered by the tmpl
+// template, retrying each post up to retries times, and starts sending.
+func New(urls []string, tmpl string, retries int, timeout time.Duration) (*Notifier, error) {
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("'%s' is not an http:// or https:// URL", u)
+		}
+	}
+	t, err := ParseTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	redact.Default.SetValues("webhook", urls)
+
+	n := &Notifier{
+		tmpl:    t,
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+	}
+	for _, u := range urls {
+		w := &worker{url: u, queue: make(chan []audit.Record, queueSize)}
+		n.workers = append(n.workers, w)
+		n.wg.Add(1)
+		go n.run(w)
+	}
+	return n, nil
+}
+
+// Notify adds r to the batch of the current refresh
+func (n *Notifier) Notify(r audit.Record) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.batch = append(n.batch, r)
+}
+
+// Flush queues the batch of the current refresh for each webhook, or
+// drops it for those whose queue is full
+func (n *Notifier) Flush() {
+	n.mu.Lock()
+	batch := n.batch
+	n.batch = nil
+	n.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	for _, w := range n.workers {
+		select {
+		case w.queue <- batch:
+		default:
+			metrics.WebhookErrors.Inc("dropped")
+			log.WithField("records", len(batch)).Warn("Webhook queue full, dropping the notification")
+		}
+	}
+}
+
+// Close flushes the current batch and waits for the queued ones to be
+// sent. No record may be notified after Close.
+func (n *Notifier) Close() {
+	n.Flush()
+	for _, w := range n.workers {
+		close(w.queue)
+	}
+	n.wg.Wait()
+}
+
+func (n *Notifier) run(w *worker) {
+	defer n.wg.Done()
+
+	for batch := range w.queue {
+		body, err := n.render(batch)
+		if err != nil {
+			metrics.WebhookErrors.Inc("failed")
+			log.Warn("Unable to render the webhook body: ", err)
+			continue
+		}
+
+		if err := n.post(w.url, body); err != nil {
+			metrics.WebhookErrors.Inc("failed")
+			log.WithField("records", len(batch)).Warn("Webhook notification failed: ", err)
+		}
+	}
+}
+
+// render returns the body of the notification of batch
+func (n *Notifier) render(batch []audit.Record) ([]byte, error) {
+	if n.tmpl == nil {
+		return json.Marshal(batch)
+	}
+
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, batch); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// post posts body to url, retrying on errors, 5xx statuses, and 429
+// statuses after their Retry-After
+func (n *Notifier) post(url string, body []byte) error {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := n.postOnce(url, body)
+		if !retry || attempt >= n.retries {
+			return err
+		}
+		if wait == 0 {
+			wait = delay
+			delay *= 2
+		}
+
+		log.WithField("attempt", attempt+1).Debugf("Webhook notification failed, retrying in %v: %s", wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// postOnce posts body to url, and returns whether a failed post is worth
+// retrying, and how long to wait before when the endpoint tells
+func (n *Notifier) postOnce(url string, body []byte) (bool, time.Duration, error) {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, 0, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true, retryAfter(resp.Header.Get("Retry-After"), time.Now()), fmt.Errorf("%s: %s", url, resp.Status)
+	case resp.StatusCode >= 500:
+		return true, 0, fmt.Errorf("%s: %s", url, resp.Status)
+	case resp.StatusCode >= 300:
+		return false, 0, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return false, 0, nil
+}
+
+// retryAfter returns the wait of a Retry-After header at now, in seconds
+// or as an HTTP date, at most maxRetryAfter. It is 0 when the header is
+// missing or invalid.
+func retryAfter(header string, now time.Time) time.Duration {
+	var wait time.Duration
+	if secs, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		wait = t.Sub(now)
+	}
+
+	switch {
+	case wait < 0:
+		return 0
+	case wait > maxRetryAfter:
+		return maxRetryAfter
+	}
+	return wait
+}
@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+)
+
+func TestNotify(t *testing.T) {
+	retryDelay = time.Millisecond
+
+	attempts := 0
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer ts.Close()
+
+	tmpl := `{"text": {{json (printf "%d changes" (len .))}}, "attachments": [
+		{{- range $i, $r := .}}{{if $i}},{{end}}{"text": {{json (printf "%s %s (%s)" $r.Op $r.ServiceID $r.Reason)}}}{{end}}]}`
+	n, err := New([]string{ts.URL}, tmpl, 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(audit.Record{Op: audit.OpDeregister, ServiceID: `mesos-consul:10.0.0.1:web:31000`, Reason: "task-gone"})
+	n.Notify(audit.Record{Op: audit.OpRegister, ServiceID: `mesos-consul:10.0.0.2:web:31000`, Reason: "new-task"})
+	n.Flush()
+
+	select {
+	case body := <-bodies:
+		want := `{"text": "2 changes", "attachments": [{"text": "deregister mesos-consul:10.0.0.1:web:31000 (task-gone)"},{"text": "register mesos-consul:10.0.0.2:web:31000 (new-task)"}]}`
+		if body != want {
+			t.Errorf("body => %s, want %s", body, want)
+		}
+		if !json.Valid([]byte(body)) {
+			t.Errorf("body %s is not JSON", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+	if attempts != 3 {
+		t.Errorf("%d attempts, want 3", attempts)
+	}
+
+	// Nothing is posted for a refresh without changes
+	n.Flush()
+	n.Close()
+	if attempts != 3 {
+		t.Errorf("%d attempts after an empty batch, want 3", attempts)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 15, 10, 41, 1, 0, time.UTC)
+	for header, want := range map[string]time.Duration{
+		"":                              0,
+		"soon":                          0,
+		"30":                            30 * time.Second,
+		"3600":                          maxRetryAfter,
+		"Thu, 15 Oct 2026 10:41:21 GMT": 20 * time.Second,
+		"Thu, 15 Oct 2026 10:40:21 GMT": 0,
+	} {
+		if got := retryAfter(header, now); got != want {
+			t.Errorf("retryAfter(%q) => %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestSlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	received := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	n, err := New([]string{slow.URL, fast.URL}, "", 0, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(audit.Record{Op: audit.OpRegister, ServiceID: "mesos-consul:10.0.0.1:web:31000"})
+	n.Flush()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Error("a slow endpoint delayed the notification of the other one")
+	}
+	close(release)
+	n.Close()
+}
+
+func TestNew(t *testing.T) {
+	for _, tt := range []struct {
+		urls []string
+		tmpl string
+	}{
+		{[]string{"hooks.slack.com/services/T0"}, ""},
+		{[]string{"https://hooks.slack.com/services/T0"}, "{{.Op"},
+		// Rendered with a list of records, not a record
+		{[]string{"https://hooks.slack.com/services/T0"}, "{{.Op}}"},
+	} {
+		if _, err := New(tt.urls, tt.tmpl, 0, time.Second); err == nil {
+			t.Errorf("New(%v, %q) => no error", tt.urls, tt.tmpl)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	var received int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var records []audit.Record
+		json.NewDecoder(r.Body).Decode(&records)
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&received, int32(len(records)))
+	}))
+	defer ts.Close()
+
+	n, err := New([]string{ts.URL}, "", 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		n.Notify(audit.Record{Op: audit.OpRegister, ServiceID: "mesos-consul:10.0.0.1:web:31000"})
+	}
+	n.Close()
+
+	if received := atomic.LoadInt32(&received); received != 3 {
+		t.Errorf("%d records sent before Close() returned, want 3", received)
+	}
+}